@@ -10,6 +10,7 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -36,17 +37,30 @@ func (f *seqStringFlag) Set(value string) error {
 
 var logs seqStringFlag
 
+var namespacedProgs seqStringFlag
+
+var logStartOffsets seqStringFlag
+
+var rollups seqStringFlag
+
+var backendInstanceLabels seqStringFlag
+
 var (
 	port               = flag.String("port", "3903", "HTTP port to listen on.")
 	address            = flag.String("address", "", "Host or IP address on which to bind HTTP listener")
-	unixSocket         = flag.String("unix_socket", "", "UNIX Socket to listen on")
+	unixSocket         = flag.String("unix_socket", "", "UNIX Socket to listen on, instead of the TCP port unless --address or --port are also given.  The socket is removed on shutdown.")
 	progs              = flag.String("progs", "", "Name of the directory containing mtail programs")
 	ignoreRegexPattern = flag.String("ignore_filename_regex_pattern", "", "")
+	logEncoding        = flag.String("log_encoding", "utf-8", "Character encoding of logs that don't start with a byte order mark: one of utf-8, utf-16le, utf-16be, or latin1.")
+	recordDelimiter    = flag.String("record_delimiter", "", "Character separating the records in the logs, instead of newline: a single ASCII character, or a Go escape sequence such as \\x00 for NUL-delimited records.")
+	excludeLines       = flag.String("exclude_lines_regex_pattern", "", "Regular expression matching lines to drop from all logs before they reach the programs, such as health check requests.  Dropped lines are counted in lines_filtered_total.")
+	linesFullPolicy    = flag.String("lines_full_policy", "block", "What to do with a line read from a log while the programs are still busy with earlier lines: block to stop reading until they catch up, or drop-newest or drop-oldest to discard a line and keep reading.")
 
 	version = flag.Bool("version", false, "Print mtail version information.")
 
 	// Compiler behaviour flags
 	oneShot      = flag.Bool("one_shot", false, "Compile the programs, then read the contents of the provided logs from start until EOF, print the values of the metrics store and exit. This is a debugging flag only, not for production use.")
+	replay       = flag.Bool("replay", false, "Read the contents of the provided logs from start until EOF, push the metrics once to the configured collectors with the times parsed from the logs, and exit.  Use this to backfill metrics from old logs.")
 	compileOnly  = flag.Bool("compile_only", false, "Compile programs only, do not load the virtual machine.")
 	dumpAst      = flag.Bool("dump_ast", false, "Dump AST of programs after parse (to INFO log).")
 	dumpAstTypes = flag.Bool("dump_ast_types", false, "Dump AST of programs with type annotation after typecheck (to INFO log).")
@@ -57,12 +71,31 @@ var (
 	overrideTimezone     = flag.String("override_timezone", "", "If set, use the provided timezone in timestamp conversion, instead of UTC.")
 	emitProgLabel        = flag.Bool("emit_prog_label", true, "Emit the 'prog' label in variable exports.")
 	emitMetricTimestamp  = flag.Bool("emit_metric_timestamp", false, "Emit the recorded timestamp of a metric.  If disabled (the default) no explicit timestamp is sent to a collector.")
+	emitInstanceLabel    = flag.Bool("emit_instance_label", false, "Add an 'instance' label to all exported metrics, identifying this mtail.")
+	instanceLabel        = flag.String("instance_label", "", "Value of the 'instance' label added by --emit_instance_label.  Defaults to the hostname.")
+	emitObservationCount = flag.Bool("emit_observation_count", false, "Emit the number of observations of each gauge as a companion <metric>_count metric.")
+	emitLastSeen         = flag.Bool("emit_last_seen", false, "Emit the time each label set of a metric was last updated, in seconds since the epoch, as a companion <metric>_last_seen_seconds metric.")
+	emitLabelSetCount    = flag.Bool("emit_labelset_count", false, "Emit the number of label sets of each metric as a metric_labelset_count gauge.")
+	relabelConfig        = flag.String("relabel_config", "", "If set, path of a JSON file holding a list of relabel rules to apply in order to each label set exported, to drop, keep, or rewrite them.  See docs/Deploying.md.")
+	counterTotalSuffix   = flag.Bool("prometheus_counter_total_suffix", false, "Append _total to the Prometheus names of counters that don't already end with it.")
+	openMetrics          = flag.Bool("prometheus_openmetrics", false, "Serve /metrics in the OpenMetrics format, with exemplars, to scrapers that accept it.  Implies --prometheus_counter_total_suffix.")
+	vmLineQueueSize      = flag.Int("vm_line_queue_size", 0, "If positive, queue up to this many lines for each program, and drop lines for a program once its queue is full instead of waiting for it.  Dropped lines are counted in vm_lines_dropped_total.")
+	vmWorkers            = flag.Int("vm_workers", 1, "Number of virtual machines run for each program, processing its lines concurrently.  With more than one, lines are not processed in order, and programs using builtins that keep state between lines, like changed() or top_k(), fail to load.")
+	deadLetterFile       = flag.String("dead_letter_file", "", "If set, append the lines that matched no pattern in any program to this file, and count them in lines_unmatched_total.")
+	deadLetterSample     = flag.Int("dead_letter_sample", 0, "If positive, keep this many of the last lines that matched no pattern in any program in the lines_unmatched_sample expvar, and count them in lines_unmatched_total.")
+	gceMetadata          = flag.Bool("gce_metadata", false, "Fetch the zone, machine type, and instance name and id from the Google Compute Engine metadata server at startup, for programs to read with getmeta().")
 
 	// Ops flags
 	pollInterval                = flag.Duration("poll_interval", 250*time.Millisecond, "Set the interval to poll all log files for data; must be positive, or zero to disable polling.  With polling mode, only the files found at mtail startup will be polled.")
+	pollJitter                  = flag.Float64("poll_jitter", 0, "If positive, randomly lengthen or shorten each --poll_interval by up to this fraction of it, to spread the disk load of many mtails started together.  Must be less than 1.")
 	expiredMetricGcTickInterval = flag.Duration("expired_metrics_gc_interval", time.Hour, "interval between expired metric garbage collection runs")
 	staleLogGcTickInterval      = flag.Duration("stale_log_gc_interval", time.Hour, "interval between stale log garbage collection runs")
+	checkpointPath              = flag.String("checkpoint_path", "", "If set, periodically write the values of all metrics to this file, and restore them from it on startup so that counters continue across restarts.")
+	checkpointInterval          = flag.Duration("checkpoint_interval", time.Minute, "interval between metric checkpoints written to --checkpoint_path")
+	checkpointTTL               = flag.Duration("checkpoint_ttl", 24*time.Hour, "If positive, don't restore label sets from the checkpoint that were last updated longer ago than this.")
 	metricPushInterval          = flag.Duration("metric_push_interval", time.Minute, "interval between metric pushes to passive collectors")
+	enableAdminEndpoints        = flag.Bool("enable_admin_endpoints", false, "Serve the HTTP endpoints that change mtail's state: /tailz/add, /tailz/remove, /progz/enable, and /progz/disable.  Only enable this if untrusted clients can't reach the HTTP server.")
+	tailzPathPrefix             = flag.String("tailz_path_prefix", "", "Directory that logs may be added under with a POST to /tailz/add, as well as those matching --logs.  Only used with --enable_admin_endpoints.")
 
 	// Debugging flags
 	blockProfileRate     = flag.Int("block_profile_rate", 0, "Nanoseconds of block time before goroutine blocking events reported. 0 turns off.  See https://golang.org/pkg/runtime/#SetBlockProfileRate")
@@ -79,6 +112,10 @@ var (
 
 func init() {
 	flag.Var(&logs, "logs", "List of log files to monitor, separated by commas.  This flag may be specified multiple times.")
+	flag.Var(&logStartOffsets, "log_start_offsets", "List of pathname=offset pairs, separated by commas, of logs to start reading from a byte offset instead of from their end, e.g. to resume a backfill.  An offset past the end of the log starts at its end.  This flag may be specified multiple times.")
+	flag.Var(&rollups, "prometheus_rollups", "List of metric=key:key... rules, separated by commas, of counters and gauges to also export to Prometheus summed across the label keys given, as a metric named <metric>_without_<key>_..., e.g. requests=instance to sum requests across instances.  This flag may be specified multiple times.")
+	flag.Var(&backendInstanceLabels, "backend_instance_labels", "List of backend=value pairs, separated by commas, of the 'instance' label to add to the metrics exported to one backend instead of --instance_label, even without --emit_instance_label.  An empty value omits the label from that backend, e.g. graphite= to leave it out of graphite pushes.  The backends are prometheus, json, varz, collectd, graphite, statsd, mqtt, and cloudwatch.  This flag may be specified multiple times.")
+	flag.Var(&namespacedProgs, "namespaced_progs", "List of namespace=directory pairs, separated by commas, of more directories containing mtail programs.  The names of the metrics declared by programs in each directory are prefixed with its namespace and an underscore.  This flag may be specified multiple times.")
 }
 
 var (
@@ -91,6 +128,16 @@ var (
 	Revision string = "invalid:-use-make-to-build"
 )
 
+// tcpFlagsSet returns true if the TCP listen address or port were given on the command line.
+func tcpFlagsSet() (set bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "address" || f.Name == "port" {
+			set = true
+		}
+	})
+	return
+}
+
 func main() {
 	buildInfo := mtail.BuildInfo{
 		Branch:   Branch,
@@ -130,9 +177,12 @@ func main() {
 		glog.Exitf("mtail requires programs that in instruct it how to extract metrics from logs; please use the flag -progs to specify the directory containing the programs.")
 	}
 	if !(*dumpBytecode || *dumpAst || *dumpAstTypes || *compileOnly) {
-		if len(logs) == 0 {
+		if len(logs) == 0 && (*oneShot || *replay || !*enableAdminEndpoints || *tailzPathPrefix == "") {
 			glog.Exitf("mtail requires the names of logs to follow in order to extract logs from them; please use the flag -logs one or more times to specify glob patterns describing these logs.")
 		}
+		if len(logs) == 0 {
+			glog.Infof("No logs given with -logs; waiting for paths under %s to be added with a POST to /tailz/add.", *tailzPathPrefix)
+		}
 	}
 
 	if *traceSamplePeriod > 0 {
@@ -143,6 +193,10 @@ func main() {
 		*pollInterval = time.Millisecond * 250
 	}
 
+	if *pollJitter < 0 || *pollJitter >= 1 {
+		glog.Exitf("poll_jitter must be at least 0 and less than 1, not %g", *pollJitter)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -158,6 +212,10 @@ func main() {
 		mtail.ProgramPath(*progs),
 		mtail.LogPathPatterns(logs...),
 		mtail.IgnoreRegexPattern(*ignoreRegexPattern),
+		mtail.LogEncoding(*logEncoding),
+		mtail.RecordDelimiter(*recordDelimiter),
+		mtail.ExcludeLinesPattern(*excludeLines),
+		mtail.LinesFullPolicy(*linesFullPolicy),
 		mtail.SetBuildInfo(buildInfo),
 		mtail.OverrideLocation(loc),
 		mtail.MetricPushInterval(*metricPushInterval),
@@ -167,17 +225,29 @@ func main() {
 		opts = append(opts, mtail.StaleLogGcWaker(staleLogGcWaker))
 	}
 	if *pollInterval > 0 {
-		logPatternPollWaker := waker.NewTimed(ctx, *pollInterval)
+		var logPatternPollWaker waker.Waker
+		if *pollJitter > 0 {
+			logPatternPollWaker = waker.NewJitteredTimed(ctx, *pollInterval, *pollJitter)
+		} else {
+			logPatternPollWaker = waker.NewTimed(ctx, *pollInterval)
+		}
 		opts = append(opts, mtail.LogPatternPollWaker(logPatternPollWaker), mtail.LogstreamPollWaker(logPatternPollWaker))
 	}
-	if *unixSocket == "" {
+	if *unixSocket == "" || tcpFlagsSet() {
 		opts = append(opts, mtail.BindAddress(*address, *port))
-	} else {
+	}
+	if *unixSocket != "" {
 		opts = append(opts, mtail.BindUnixSocket(*unixSocket))
 	}
+	if *enableAdminEndpoints {
+		opts = append(opts, mtail.EnableAdminEndpoints, mtail.TailzPathPrefix(*tailzPathPrefix))
+	}
 	if *oneShot {
 		opts = append(opts, mtail.OneShot)
 	}
+	if *replay {
+		opts = append(opts, mtail.Replay)
+	}
 	if *compileOnly {
 		opts = append(opts, mtail.CompileOnly)
 	}
@@ -199,6 +269,77 @@ func main() {
 	if *emitMetricTimestamp {
 		opts = append(opts, mtail.EmitMetricTimestamp)
 	}
+	if *emitInstanceLabel {
+		opts = append(opts, mtail.InstanceLabel(*instanceLabel))
+	}
+	if *emitObservationCount {
+		opts = append(opts, mtail.EmitObservationCount)
+	}
+	if *emitLastSeen {
+		opts = append(opts, mtail.EmitLastSeen)
+	}
+	if *emitLabelSetCount {
+		opts = append(opts, mtail.EmitLabelSetCount)
+	}
+	if *counterTotalSuffix {
+		opts = append(opts, mtail.CounterTotalSuffix)
+	}
+	if *openMetrics {
+		opts = append(opts, mtail.EnableOpenMetrics)
+	}
+	if *vmLineQueueSize > 0 {
+		opts = append(opts, mtail.DropLinesWhenFull(*vmLineQueueSize))
+	}
+	if *vmWorkers > 1 {
+		opts = append(opts, mtail.VMWorkers(*vmWorkers))
+	}
+	if *deadLetterFile != "" {
+		opts = append(opts, mtail.DeadLetterFile(*deadLetterFile))
+	}
+	if *deadLetterSample > 0 {
+		opts = append(opts, mtail.DeadLetterSample(*deadLetterSample))
+	}
+	if *gceMetadata {
+		opts = append(opts, mtail.HostMetadata(mtail.GCEMetadata()))
+	}
+	if *checkpointPath != "" {
+		opts = append(opts, mtail.Checkpoint(*checkpointPath, *checkpointInterval, *checkpointTTL))
+	}
+	for _, p := range namespacedProgs {
+		parts := strings.SplitN(p, "=", 2)
+		if len(parts) != 2 {
+			glog.Exitf("Couldn't parse namespaced program path %q, expecting namespace=directory", p)
+		}
+		opts = append(opts, mtail.NamespacedProgramPath(parts[1], parts[0]))
+	}
+	for _, o := range logStartOffsets {
+		i := strings.LastIndex(o, "=")
+		if i < 0 {
+			glog.Exitf("Couldn't parse log start offset %q, expecting pathname=offset", o)
+		}
+		offset, err := strconv.ParseInt(o[i+1:], 10, 64)
+		if err != nil {
+			glog.Exitf("Couldn't parse log start offset %q: %s", o, err)
+		}
+		opts = append(opts, mtail.LogStartOffset(o[:i], offset))
+	}
+	if *relabelConfig != "" {
+		opts = append(opts, mtail.RelabelConfig(*relabelConfig))
+	}
+	for _, b := range backendInstanceLabels {
+		parts := strings.SplitN(b, "=", 2)
+		if len(parts) != 2 {
+			glog.Exitf("Couldn't parse backend instance label %q, expecting backend=value", b)
+		}
+		opts = append(opts, mtail.BackendInstanceLabel(parts[0], parts[1]))
+	}
+	for _, r := range rollups {
+		parts := strings.SplitN(r, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			glog.Exitf("Couldn't parse rollup %q, expecting metric=key:key...", r)
+		}
+		opts = append(opts, mtail.Rollup(parts[0], strings.Split(parts[1], ":")...))
+	}
 	if *jaegerEndpoint != "" {
 		opts = append(opts, mtail.JaegerReporter(*jaegerEndpoint))
 	}
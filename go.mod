@@ -6,9 +6,11 @@ require (
 	contrib.go.opencensus.io/exporter/jaeger v0.2.1
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
 	github.com/golang/groupcache v0.0.0-20200121045136-8c9f03a8e57e
+	github.com/golang/protobuf v1.4.3
 	github.com/google/go-cmp v0.5.4
 	github.com/pkg/errors v0.9.1
 	github.com/prometheus/client_golang v1.9.0
+	github.com/prometheus/client_model v0.2.0
 	github.com/prometheus/common v0.15.0
 	go.opencensus.io v0.22.5
 	golang.org/x/net v0.0.0-20200822124328-c89045814202 // indirect
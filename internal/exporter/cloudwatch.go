@@ -0,0 +1,343 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/internal/metrics"
+	"github.com/pkg/errors"
+)
+
+var (
+	cloudWatchNamespace = flag.String("cloudwatch_namespace", "",
+		"AWS CloudWatch namespace to put metrics in.  Metrics are only pushed to CloudWatch if this is set.")
+	cloudWatchRegion = flag.String("cloudwatch_region", "",
+		"AWS region of CloudWatch to push metrics to.  Defaults to the region in the AWS_REGION or AWS_DEFAULT_REGION environment variable.")
+	cloudWatchEndpoint = flag.String("cloudwatch_endpoint", "",
+		"URL of the CloudWatch API to push metrics to, if not that of the region.")
+	cloudWatchPushInterval = flag.Duration("cloudwatch_push_interval", 0,
+		"Interval between metric pushes to CloudWatch, if not that of the other push collectors.")
+	cloudWatchMetricsAllow = flag.String("cloudwatch_metrics_allow", "",
+		"Comma separated glob patterns of the names of the metrics to push to CloudWatch, or all metrics if empty.")
+	cloudWatchMetricsDeny = flag.String("cloudwatch_metrics_deny", "",
+		"Comma separated glob patterns of the names of the metrics not to push to CloudWatch.")
+
+	cloudWatchExportTotal   = expvar.NewInt("cloudwatch_export_total")
+	cloudWatchExportSuccess = expvar.NewInt("cloudwatch_export_success")
+)
+
+const (
+	// cloudWatchMaxData is the most metric data put in one PutMetricData call.
+	cloudWatchMaxData = 20
+	// cloudWatchMaxDimensions is the most dimensions CloudWatch accepts on a
+	// metric.
+	cloudWatchMaxDimensions = 30
+	// cloudWatchMaxAge is the age of the oldest timestamp CloudWatch accepts.
+	cloudWatchMaxAge = 14 * 24 * time.Hour
+)
+
+// cloudWatchNow returns the current time.  It is a variable so that tests can
+// fix the time.
+var cloudWatchNow = time.Now
+
+// cloudWatchDimension is a name and value that a CloudWatch metric is
+// dimensioned by.
+type cloudWatchDimension struct {
+	Name, Value string
+}
+
+// cloudWatchDatum is one value of a CloudWatch metric.
+type cloudWatchDatum struct {
+	MetricName string
+	Dimensions []cloudWatchDimension // Sorted by name.
+	Value      float64
+	Unit       string
+	Timestamp  time.Time
+}
+
+// cloudWatchClient puts metric data in CloudWatch.
+type cloudWatchClient interface {
+	PutMetricData(namespace string, data []cloudWatchDatum) error
+}
+
+// newCloudWatchClient returns a client of the CloudWatch API in region, at
+// endpoint if it is not empty.  It is a variable so that tests can fake
+// CloudWatch.
+var newCloudWatchClient = func(region, endpoint string) (cloudWatchClient, error) {
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		return nil, errors.New("no AWS region for CloudWatch, set --cloudwatch_region")
+	}
+	if endpoint == "" {
+		endpoint = "https://monitoring." + region + ".amazonaws.com/"
+	}
+	c := &cloudWatchHTTPClient{
+		endpoint:     endpoint,
+		region:       region,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{Timeout: *writeDeadline},
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, errors.New("no AWS credentials for CloudWatch, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return c, nil
+}
+
+// cloudWatchTarget describes where metrics are put in CloudWatch.
+type cloudWatchTarget struct {
+	namespace string
+	client    cloudWatchClient
+
+	mu   sync.Mutex         // protects last, as pushes may overlap
+	last map[string]float64 // Value of each counter series when it was last put, by series.
+}
+
+// delta returns the increase of the counter series named by key to value since
+// it was last put, or value if it has not been put before or was since reset.
+func (c *cloudWatchTarget) delta(key string, value float64) float64 {
+	if last, ok := c.last[key]; ok && value >= last {
+		return value - last
+	}
+	return value
+}
+
+// cloudWatchUnit returns the CloudWatch unit of the values of metrics of kind.
+func cloudWatchUnit(kind metrics.Kind) string {
+	if kind == metrics.Counter {
+		return "Count"
+	}
+	return "None"
+}
+
+// putCloudWatch puts each label set of the counters, gauges, and timers in the
+// store in CloudWatch, as a metric dimensioned by its labels, batching them
+// into as few calls as CloudWatch allows.  CloudWatch sums the values put in
+// each period, so counters are put as their increase since the last put.
+// Timestamps too old for CloudWatch, like the zero time of a datum never set,
+// are replaced by the current time, as CloudWatch rejects the whole call.
+func (e *Exporter) putCloudWatch(target pushOptions) error {
+	cw := target.cloudWatch
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.last == nil {
+		cw.last = make(map[string]float64)
+	}
+	now := cloudWatchNow().UTC()
+	// The counter values in the batch, by series, to remember once put.
+	var batch []cloudWatchDatum
+	counters := make(map[string]float64)
+	seen := make(map[string]struct{})
+	var putErr error
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := cw.client.PutMetricData(cw.namespace, batch); err != nil {
+			putErr = err
+		} else {
+			target.success.Add(int64(len(batch)))
+			for k, v := range counters {
+				cw.last[k] = v
+			}
+		}
+		batch = nil
+		counters = make(map[string]float64)
+	}
+	err := e.store.Range(func(m *metrics.Metric) error {
+		m.RLock()
+		defer m.RUnlock()
+		if m.Kind == metrics.Text || m.Kind == metrics.Histogram || !target.filter.Allows(m.Name) {
+			return nil
+		}
+		lc := make(chan *metrics.LabelSet)
+		go m.EmitLabelSets(lc)
+		for l := range lc {
+			if l = e.relabel(m, e.withInstanceLabel(target.name, l)); l == nil {
+				continue
+			}
+			target.total.Add(1)
+			d := cloudWatchDatum{
+				MetricName: m.Name,
+				Value:      promValueForDatum(l.Datum),
+				Unit:       cloudWatchUnit(m.Kind),
+				Timestamp:  l.Datum.TimeUTC(),
+			}
+			if now.Sub(d.Timestamp) > cloudWatchMaxAge {
+				d.Timestamp = now
+			}
+			for k, v := range l.Labels {
+				// CloudWatch doesn't accept empty dimension values.
+				if v != "" {
+					d.Dimensions = append(d.Dimensions, cloudWatchDimension{k, v})
+				}
+			}
+			if !e.omitProgLabel {
+				d.Dimensions = append(d.Dimensions, cloudWatchDimension{"prog", m.Program})
+			}
+			if len(d.Dimensions) > cloudWatchMaxDimensions {
+				glog.Infof("Not putting %s in CloudWatch, it has %d dimensions and at most %d are allowed.", m.Name, len(d.Dimensions), cloudWatchMaxDimensions)
+				continue
+			}
+			sort.Slice(d.Dimensions, func(i, j int) bool { return d.Dimensions[i].Name < d.Dimensions[j].Name })
+			if m.Kind == metrics.Counter {
+				key := cloudWatchSeries(d)
+				seen[key] = struct{}{}
+				counters[key] = d.Value
+				d.Value = cw.delta(key, d.Value)
+			}
+			batch = append(batch, d)
+			if len(batch) == cloudWatchMaxData {
+				flush()
+			}
+		}
+		return nil
+	})
+	flush()
+	// Forget the counters no longer exported.
+	for k := range cw.last {
+		if _, ok := seen[k]; !ok {
+			delete(cw.last, k)
+		}
+	}
+	if err == nil {
+		err = putErr
+	}
+	if err != nil {
+		return errors.Errorf("cloudwatch put error: %s", err)
+	}
+	return nil
+}
+
+// cloudWatchSeries returns a key naming the series of d, by its metric name and
+// sorted dimensions.
+func cloudWatchSeries(d cloudWatchDatum) string {
+	var b strings.Builder
+	b.WriteString(d.MetricName)
+	for _, dim := range d.Dimensions {
+		b.WriteByte(0)
+		b.WriteString(dim.Name)
+		b.WriteByte(0)
+		b.WriteString(dim.Value)
+	}
+	return b.String()
+}
+
+// cloudWatchHTTPClient puts metric data with the CloudWatch query API, signing
+// requests with AWS Signature Version 4.
+type cloudWatchHTTPClient struct {
+	endpoint, region                   string
+	accessKey, secretKey, sessionToken string
+	client                             *http.Client
+}
+
+// PutMetricData makes a PutMetricData call with data.
+func (c *cloudWatchHTTPClient) PutMetricData(namespace string, data []cloudWatchDatum) error {
+	form := url.Values{}
+	form.Set("Action", "PutMetricData")
+	form.Set("Version", "2010-08-01")
+	form.Set("Namespace", namespace)
+	for i, d := range data {
+		p := fmt.Sprintf("MetricData.member.%d.", i+1)
+		form.Set(p+"MetricName", d.MetricName)
+		form.Set(p+"Value", fmt.Sprint(d.Value))
+		form.Set(p+"Unit", d.Unit)
+		form.Set(p+"Timestamp", d.Timestamp.UTC().Format(time.RFC3339))
+		for j, dim := range d.Dimensions {
+			q := fmt.Sprintf("%sDimensions.member.%d.", p, j+1)
+			form.Set(q+"Name", dim.Name)
+			form.Set(q+"Value", dim.Value)
+		}
+	}
+	body := form.Encode()
+	req, err := http.NewRequest("POST", c.endpoint, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signV4(req, []byte(body), c.region, "monitoring", c.accessKey, c.secretKey, c.sessionToken, time.Now())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("PutMetricData returned %s: %s", resp.Status, b)
+	}
+	return nil
+}
+
+// signV4 signs req, with the payload body, for service in region with AWS
+// Signature Version 4, adding the X-Amz-Date, X-Amz-Security-Token if
+// sessionToken is not empty, and Authorization headers.
+func signV4(req *http.Request, body []byte, region, service, accessKey, secretKey, sessionToken string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	// url.Values.Encode sorts by key, but escapes a space as + rather than %20.
+	query := strings.Replace(req.URL.Query().Encode(), "+", "%20", -1)
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, query, canonicalHeaders.String(), signedHeaders, hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := []byte("AWS4" + secretKey)
+	for _, s := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
@@ -0,0 +1,310 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+)
+
+// fakeCloudWatchClient records the metric data put in each call.
+type fakeCloudWatchClient struct {
+	namespace string
+	calls     [][]cloudWatchDatum
+}
+
+func (c *fakeCloudWatchClient) PutMetricData(namespace string, data []cloudWatchDatum) error {
+	c.namespace = namespace
+	c.calls = append(c.calls, data)
+	return nil
+}
+
+func TestPutCloudWatch(t *testing.T) {
+	client := &fakeCloudWatchClient{}
+	origClient := newCloudWatchClient
+	defer func() { newCloudWatchClient = origClient }()
+	newCloudWatchClient = func(region, endpoint string) (cloudWatchClient, error) {
+		return client, nil
+	}
+	*cloudWatchNamespace = "mtail"
+	defer func() { *cloudWatchNamespace = "" }()
+
+	ts := time.Unix(1343124840, 0)
+	origNow := cloudWatchNow
+	defer func() { cloudWatchNow = origNow }()
+	cloudWatchNow = func() time.Time { return ts.Add(time.Minute) }
+	store := metrics.NewStore()
+	c := metrics.NewMetric("requests", "prog", metrics.Counter, metrics.Int, "code")
+	testutil.FatalIfErr(t, store.Add(c))
+	for i := 0; i < 25; i++ {
+		d, err := c.GetDatum(fmt.Sprintf("%d", 200+i))
+		testutil.FatalIfErr(t, err)
+		datum.SetInt(d, int64(i), ts)
+	}
+	g := metrics.NewMetric("temperature", "prog", metrics.Gauge, metrics.Float, "room")
+	testutil.FatalIfErr(t, store.Add(g))
+	d, err := g.GetDatum("")
+	testutil.FatalIfErr(t, err)
+	datum.SetFloat(d, 21.5, ts)
+	keys := make([]string, cloudWatchMaxDimensions)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("k%d", i)
+	}
+	wide := metrics.NewMetric("wide", "prog", metrics.Gauge, metrics.Int, keys...)
+	testutil.FatalIfErr(t, store.Add(wide))
+	d, err = wide.GetDatum(keys...)
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 1, ts)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	e, err := New(ctx, &wg, store, Hostname("gunstar"))
+	testutil.FatalIfErr(t, err)
+	e.PushMetrics()
+	cancel()
+	wg.Wait()
+
+	testutil.ExpectNoDiff(t, "mtail", client.namespace)
+	// The wide gauge has one dimension too many with the prog.
+	var sizes []int
+	put := map[string]cloudWatchDatum{}
+	for _, call := range client.calls {
+		sizes = append(sizes, len(call))
+		for _, d := range call {
+			var dims []string
+			for _, dim := range d.Dimensions {
+				dims = append(dims, dim.Name+"="+dim.Value)
+			}
+			put[d.MetricName+"{"+strings.Join(dims, ",")+"}"] = d
+		}
+	}
+	testutil.ExpectNoDiff(t, []int{cloudWatchMaxData, 6}, sizes)
+	testutil.ExpectNoDiff(t, 26, len(put))
+
+	expected := map[string]cloudWatchDatum{
+		"requests{code=203,prog=prog}": {
+			MetricName: "requests",
+			Dimensions: []cloudWatchDimension{{"code", "203"}, {"prog", "prog"}},
+			Value:      3,
+			Unit:       "Count",
+			Timestamp:  ts.UTC(),
+		},
+		// The empty label value is left out.
+		"temperature{prog=prog}": {
+			MetricName: "temperature",
+			Dimensions: []cloudWatchDimension{{"prog", "prog"}},
+			Value:      21.5,
+			Unit:       "None",
+			Timestamp:  ts.UTC(),
+		},
+	}
+	for k, want := range expected {
+		testutil.ExpectNoDiff(t, want, put[k])
+	}
+}
+
+func TestPutCloudWatchCounterDeltas(t *testing.T) {
+	client := &fakeCloudWatchClient{}
+	origClient := newCloudWatchClient
+	defer func() { newCloudWatchClient = origClient }()
+	newCloudWatchClient = func(region, endpoint string) (cloudWatchClient, error) {
+		return client, nil
+	}
+	*cloudWatchNamespace = "mtail"
+	defer func() { *cloudWatchNamespace = "" }()
+	now := time.Unix(1343124840, 0)
+	origNow := cloudWatchNow
+	defer func() { cloudWatchNow = origNow }()
+	cloudWatchNow = func() time.Time { return now }
+
+	store := metrics.NewStore()
+	c := metrics.NewMetric("requests", "prog", metrics.Counter, metrics.Int)
+	testutil.FatalIfErr(t, store.Add(c))
+	d, err := c.GetDatum()
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 5, now)
+	g := metrics.NewMetric("temperature", "prog", metrics.Gauge, metrics.Float)
+	testutil.FatalIfErr(t, store.Add(g))
+	gd, err := g.GetDatum()
+	testutil.FatalIfErr(t, err)
+	datum.SetFloat(gd, 21.5, now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	e, err := New(ctx, &wg, store, Hostname("gunstar"))
+	testutil.FatalIfErr(t, err)
+	values := func() map[string]float64 {
+		v := map[string]float64{}
+		for _, d := range client.calls[len(client.calls)-1] {
+			v[d.MetricName] = d.Value
+		}
+		return v
+	}
+	e.PushMetrics()
+	testutil.ExpectNoDiff(t, map[string]float64{"requests": 5, "temperature": 21.5}, values())
+	// Counters are put as their increase since the last put, gauges as they are.
+	datum.IncIntBy(d, 3, now)
+	e.PushMetrics()
+	testutil.ExpectNoDiff(t, map[string]float64{"requests": 3, "temperature": 21.5}, values())
+	e.PushMetrics()
+	testutil.ExpectNoDiff(t, map[string]float64{"requests": 0, "temperature": 21.5}, values())
+	// A counter that went down was reset, so all of it is new.
+	datum.SetInt(d, 2, now)
+	e.PushMetrics()
+	testutil.ExpectNoDiff(t, map[string]float64{"requests": 2, "temperature": 21.5}, values())
+	cancel()
+	wg.Wait()
+}
+
+func TestPutCloudWatchBackendInstanceLabelOmitted(t *testing.T) {
+	client := &fakeCloudWatchClient{}
+	origClient := newCloudWatchClient
+	defer func() { newCloudWatchClient = origClient }()
+	newCloudWatchClient = func(region, endpoint string) (cloudWatchClient, error) {
+		return client, nil
+	}
+	*cloudWatchNamespace = "mtail"
+	defer func() { *cloudWatchNamespace = "" }()
+	now := time.Unix(1343124840, 0)
+	origNow := cloudWatchNow
+	defer func() { cloudWatchNow = origNow }()
+	cloudWatchNow = func() time.Time { return now }
+
+	store := metrics.NewStore()
+	g := metrics.NewMetric("temperature", "prog", metrics.Gauge, metrics.Float)
+	testutil.FatalIfErr(t, store.Add(g))
+	d, err := g.GetDatum()
+	testutil.FatalIfErr(t, err)
+	datum.SetFloat(d, 21.5, now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	e, err := New(ctx, &wg, store, Hostname("gunstar"), InstanceLabel("mtail-1"), BackendInstanceLabel("cloudwatch", ""))
+	testutil.FatalIfErr(t, err)
+	e.PushMetrics()
+	cancel()
+	wg.Wait()
+
+	// The instance label is left out of the dimensions.
+	expected := [][]cloudWatchDatum{{{
+		MetricName: "temperature",
+		Dimensions: []cloudWatchDimension{{"prog", "prog"}},
+		Value:      21.5,
+		Unit:       "None",
+		Timestamp:  now.UTC(),
+	}}}
+	testutil.ExpectNoDiff(t, expected, client.calls)
+}
+
+func TestPutCloudWatchTimestamps(t *testing.T) {
+	client := &fakeCloudWatchClient{}
+	origClient := newCloudWatchClient
+	defer func() { newCloudWatchClient = origClient }()
+	newCloudWatchClient = func(region, endpoint string) (cloudWatchClient, error) {
+		return client, nil
+	}
+	*cloudWatchNamespace = "mtail"
+	defer func() { *cloudWatchNamespace = "" }()
+	now := time.Unix(1343124840, 0).UTC()
+	origNow := cloudWatchNow
+	defer func() { cloudWatchNow = origNow }()
+	cloudWatchNow = func() time.Time { return now }
+
+	store := metrics.NewStore()
+	g := metrics.NewMetric("temperature", "prog", metrics.Gauge, metrics.Int, "room")
+	testutil.FatalIfErr(t, store.Add(g))
+	for room, ts := range map[string]time.Time{
+		"recent": now.Add(-time.Hour),
+		"stale":  now.Add(-15 * 24 * time.Hour),
+	} {
+		d, err := g.GetDatum(room)
+		testutil.FatalIfErr(t, err)
+		datum.SetInt(d, 1, ts)
+	}
+	// A datum never set has the zero time of the epoch.
+	g.LabelValues = append(g.LabelValues, &metrics.LabelValue{Labels: []string{"unset"}, Value: &datum.Int{}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	e, err := New(ctx, &wg, store, Hostname("gunstar"))
+	testutil.FatalIfErr(t, err)
+	e.PushMetrics()
+	cancel()
+	wg.Wait()
+
+	got := map[string]time.Time{}
+	for _, call := range client.calls {
+		for _, d := range call {
+			got[d.Dimensions[len(d.Dimensions)-1].Value] = d.Timestamp
+		}
+	}
+	testutil.ExpectNoDiff(t, map[string]time.Time{
+		"recent": now.Add(-time.Hour),
+		"stale":  now,
+		"unset":  now,
+	}, got)
+}
+
+func TestSignV4(t *testing.T) {
+	// The example request from the AWS Signature Version 4 documentation.
+	req, err := http.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	testutil.FatalIfErr(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signV4(req, nil, "us-east-1", "iam", "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	testutil.ExpectNoDiff(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+	testutil.ExpectNoDiff(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7", req.Header.Get("Authorization"))
+}
+
+func TestCloudWatchPutMetricData(t *testing.T) {
+	var form map[string][]string
+	var auth, token string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		testutil.FatalIfErr(t, r.ParseForm())
+		form = r.PostForm
+		auth = r.Header.Get("Authorization")
+		token = r.Header.Get("X-Amz-Security-Token")
+	}))
+	defer srv.Close()
+
+	c := &cloudWatchHTTPClient{endpoint: srv.URL, region: "us-west-2", accessKey: "AKID", secretKey: "secret", sessionToken: "token", client: srv.Client()}
+	testutil.FatalIfErr(t, c.PutMetricData("mtail", []cloudWatchDatum{
+		{
+			MetricName: "requests",
+			Dimensions: []cloudWatchDimension{{"code", "200"}, {"prog", "prog"}},
+			Value:      37,
+			Unit:       "Count",
+			Timestamp:  time.Unix(1343124840, 0),
+		},
+	}))
+
+	expected := map[string][]string{
+		"Action":                         {"PutMetricData"},
+		"Version":                        {"2010-08-01"},
+		"Namespace":                      {"mtail"},
+		"MetricData.member.1.MetricName": {"requests"},
+		"MetricData.member.1.Value":      {"37"},
+		"MetricData.member.1.Unit":       {"Count"},
+		"MetricData.member.1.Timestamp":  {"2012-07-24T10:14:00Z"},
+		"MetricData.member.1.Dimensions.member.1.Name":  {"code"},
+		"MetricData.member.1.Dimensions.member.1.Value": {"200"},
+		"MetricData.member.1.Dimensions.member.2.Name":  {"prog"},
+		"MetricData.member.1.Dimensions.member.2.Value": {"prog"},
+	}
+	testutil.ExpectNoDiff(t, expected, form)
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/us-west-2/monitoring/aws4_request, SignedHeaders=content-type;host;x-amz-date;x-amz-security-token, Signature=") {
+		t.Errorf("unexpected Authorization header %q", auth)
+	}
+	testutil.ExpectNoDiff(t, "token", token)
+}
@@ -23,6 +23,12 @@ var (
 		"Path to collectd unixsock to write metrics to.")
 	collectdPrefix = flag.String("collectd_prefix", "",
 		"Prefix to use for collectd metrics.")
+	collectdPushInterval = flag.Duration("collectd_push_interval", 0,
+		"Interval between metric pushes to collectd, if not that of the other push collectors.")
+	collectdMetricsAllow = flag.String("collectd_metrics_allow", "",
+		"Comma separated glob patterns of the names of the metrics to push to collectd, or all metrics if empty.")
+	collectdMetricsDeny = flag.String("collectd_metrics_deny", "",
+		"Comma separated glob patterns of the names of the metrics not to push to collectd.")
 
 	collectdExportTotal   = expvar.NewInt("collectd_export_total")
 	collectdExportSuccess = expvar.NewInt("collectd_export_success")
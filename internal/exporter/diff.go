@@ -0,0 +1,158 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/internal/metrics"
+)
+
+// maxSnapshots is the number of snapshots kept for diffs, after which the
+// oldest is forgotten.
+const maxSnapshots = 16
+
+// DiffEntry is a label set of a metric that was added, removed, or changed
+// between two snapshots of the metrics.
+type DiffEntry struct {
+	Name    string            `json:"name"`
+	Program string            `json:"program"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Old     string            `json:"old,omitempty"`
+	New     string            `json:"new,omitempty"`
+}
+
+// Diff is the change in the metrics since a snapshot.  Token names a new
+// snapshot, taken when the diff was made, to diff against next time.
+type Diff struct {
+	Token   string      `json:"token"`
+	Added   []DiffEntry `json:"added"`
+	Removed []DiffEntry `json:"removed"`
+	Changed []DiffEntry `json:"changed"`
+}
+
+// snapshot is the value of each label set of each metric, keyed by the
+// program, metric, and labels.
+type snapshot map[string]DiffEntry
+
+// takeSnapshot records the current value of each label set in the store.
+func (e *Exporter) takeSnapshot() snapshot {
+	e.updateRatios()
+	s := make(snapshot)
+	e.store.Range(func(m *metrics.Metric) error {
+		m.RLock()
+		defer m.RUnlock()
+		lsc := make(chan *metrics.LabelSet)
+		go m.EmitLabelSets(lsc)
+		for ls := range lsc {
+			s[snapshotKey(m, ls.Labels)] = DiffEntry{
+				Name:    m.Name,
+				Program: m.Program,
+				Labels:  ls.Labels,
+				New:     ls.Datum.ValueString(),
+			}
+		}
+		return nil
+	})
+	return s
+}
+
+func snapshotKey(m *metrics.Metric, labels map[string]string) string {
+	parts := make([]string, 0, len(labels))
+	for k, v := range labels {
+		parts = append(parts, k+"="+v)
+	}
+	sort.Strings(parts)
+	return m.Program + "\x00" + m.Name + "\x00" + strings.Join(parts, "\x00")
+}
+
+// diffSnapshots returns the label sets added, removed, and changed from old to
+// cur, in key order.
+func diffSnapshots(old, cur snapshot) Diff {
+	d := Diff{Added: []DiffEntry{}, Removed: []DiffEntry{}, Changed: []DiffEntry{}}
+	keys := make([]string, 0, len(old)+len(cur))
+	for k := range old {
+		keys = append(keys, k)
+	}
+	for k := range cur {
+		if _, ok := old[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		o, inOld := old[k]
+		c, inCur := cur[k]
+		switch {
+		case !inOld:
+			d.Added = append(d.Added, c)
+		case !inCur:
+			o.Old, o.New = o.New, ""
+			d.Removed = append(d.Removed, o)
+		case o.New != c.New:
+			c.Old = o.New
+			d.Changed = append(d.Changed, c)
+		}
+	}
+	return d
+}
+
+// saveSnapshot keeps s for later diffs, and returns the token naming it.
+func (e *Exporter) saveSnapshot(s snapshot) string {
+	e.snapshotsMu.Lock()
+	defer e.snapshotsMu.Unlock()
+	e.lastSnapshot++
+	token := strconv.FormatUint(e.lastSnapshot, 10)
+	e.snapshots.Add(token, s)
+	return token
+}
+
+// loadSnapshot returns the snapshot named by token, if it is still kept.
+func (e *Exporter) loadSnapshot(token string) (snapshot, bool) {
+	e.snapshotsMu.Lock()
+	defer e.snapshotsMu.Unlock()
+	s, ok := e.snapshots.Get(token)
+	if !ok {
+		return nil, false
+	}
+	return s.(snapshot), true
+}
+
+// HandleDiff exports as JSON the change in the metrics since the snapshot
+// named by the `since' parameter, and a token naming a new snapshot.  Without
+// `since', only the token is exported.
+func (e *Exporter) HandleDiff(w http.ResponseWriter, r *http.Request) {
+	var old snapshot
+	if since := r.FormValue("since"); since != "" {
+		var ok bool
+		old, ok = e.loadSnapshot(since)
+		if !ok {
+			http.Error(w, "unknown or expired snapshot token "+since, http.StatusNotFound)
+			return
+		}
+	}
+	cur := e.takeSnapshot()
+	d := Diff{}
+	if old != nil {
+		d = diffSnapshots(old, cur)
+	}
+	d.Token = e.saveSnapshot(cur)
+	b, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		exportJSONErrors.Add(1)
+		glog.Info("error marshalling metrics diff into json:", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	if _, err := w.Write(b); err != nil {
+		glog.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestHandleDiff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	ms := metrics.NewStore()
+	m := &metrics.Metric{
+		Name:    "foo",
+		Program: "test",
+		Kind:    metrics.Counter,
+		Keys:    []string{"a"},
+		LabelValues: []*metrics.LabelValue{
+			{Labels: []string{"1"}, Value: datum.MakeInt(1, time.Unix(0, 0))},
+			{Labels: []string{"2"}, Value: datum.MakeInt(2, time.Unix(0, 0))},
+		},
+	}
+	testutil.FatalIfErr(t, ms.Add(m))
+	e, err := New(ctx, &wg, ms, Hostname("gunstar"))
+	testutil.FatalIfErr(t, err)
+	diff := func(url string) Diff {
+		t.Helper()
+		response := httptest.NewRecorder()
+		e.HandleDiff(response, httptest.NewRequest("GET", url, nil))
+		if response.Code != http.StatusOK {
+			t.Fatalf("response code not 200: %d", response.Code)
+		}
+		var d Diff
+		testutil.FatalIfErr(t, json.NewDecoder(response.Body).Decode(&d))
+		return d
+	}
+
+	token := diff("/json/diff").Token
+
+	d, err := m.GetDatum("1")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 5, time.Unix(1, 0))
+
+	got := diff("/json/diff?since=" + token)
+	expected := Diff{
+		Token:   got.Token,
+		Added:   []DiffEntry{},
+		Removed: []DiffEntry{},
+		Changed: []DiffEntry{
+			{Name: "foo", Program: "test", Labels: map[string]string{"a": "1"}, Old: "1", New: "5"},
+		},
+	}
+	testutil.ExpectNoDiff(t, expected, got)
+	if got.Token == token {
+		t.Errorf("diff token %q is unchanged", got.Token)
+	}
+
+	response := httptest.NewRecorder()
+	e.HandleDiff(response, httptest.NewRequest("GET", "/json/diff?since=unknown", nil))
+	if response.Code != http.StatusNotFound {
+		t.Errorf("response code for unknown token not 404: %d", response.Code)
+	}
+	cancel()
+	wg.Wait()
+}
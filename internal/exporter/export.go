@@ -6,6 +6,8 @@
 package exporter
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"expvar"
 	"flag"
@@ -18,7 +20,9 @@ import (
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/golang/groupcache/lru"
 	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/waker"
 	"github.com/pkg/errors"
 )
 
@@ -27,17 +31,60 @@ var (
 	writeDeadline = flag.Duration("metric_push_write_deadline", 10*time.Second, "Time to wait for a push to succeed before exiting with an error.")
 )
 
+var (
+	// pushDuration records how long the last push to each backend took, in
+	// seconds, and pushSuccess whether it succeeded, as 1, or failed, as 0.
+	pushDuration = expvar.NewMap("exporter_push_duration_seconds")
+	pushSuccess  = expvar.NewMap("exporter_push_success")
+)
+
+// dialPushTarget connects to a push target.  It is a variable so that tests
+// can fake the backend.
+var dialPushTarget = net.DialTimeout
+
+// instanceLabelName is the label added to exported metrics by the InstanceLabel option.
+const instanceLabelName = "instance"
+
+// instanceLabelBackends are the backends that BackendInstanceLabel can be
+// given.
+var instanceLabelBackends = map[string]bool{
+	"prometheus": true,
+	"json":       true,
+	"varz":       true,
+	"collectd":   true,
+	"graphite":   true,
+	"statsd":     true,
+	"mqtt":       true,
+	"cloudwatch": true,
+}
+
 // Exporter manages the export of metrics to passive and active collectors.
 type Exporter struct {
-	ctx           context.Context
-	wg            sync.WaitGroup
-	store         *metrics.Store
-	pushInterval  time.Duration
-	hostname      string
-	omitProgLabel bool
-	emitTimestamp bool
-	pushTargets   []pushOptions
-	initDone      chan struct{}
+	ctx               context.Context
+	wg                sync.WaitGroup
+	store             *metrics.Store
+	pushInterval      time.Duration
+	pushWaker         waker.Waker // Wakes the metric push loop, if it is running.
+	hostname          string
+	omitProgLabel     bool
+	emitTimestamp     bool
+	emitObsCount      bool
+	counterSuffix     bool
+	emitLastSeen      bool
+	emitLabelSetCount bool
+	emitInstanceLabel bool
+	instance          string
+	backendInstances  map[string]string // Instance label values by backend, overriding instance; empty omits the label.
+	pushTargets       []pushOptions
+	rollups           map[string][]*rollup // Rollups to export, by metric name.
+	relabelRules      []*relabelRule       // Applied in order to each label set exported.
+	initDone          chan struct{}
+
+	pushOnlyOnStop bool // Push once when stopped, instead of periodically.
+
+	snapshotsMu  sync.Mutex // protects snapshots and lastSnapshot
+	snapshots    *lru.Cache // Snapshots of the metrics kept for diffs, by token.
+	lastSnapshot uint64     // The number of the last snapshot token.
 }
 
 // Option configures a new Exporter.
@@ -67,6 +114,104 @@ func EmitTimestamp() Option {
 	}
 }
 
+// InstanceLabel instructs the exporter to add an `instance` label with the
+// given value to every exported metric.  If value is empty the exporter's
+// hostname is used.
+func InstanceLabel(value string) Option {
+	return func(e *Exporter) error {
+		e.emitInstanceLabel = true
+		e.instance = value
+		return nil
+	}
+}
+
+// BackendInstanceLabel sets the value of the `instance` label added to the
+// metrics exported to one backend, instead of the value given to InstanceLabel,
+// and even if InstanceLabel isn't given.  An empty value omits the label from
+// that backend.  The backends are prometheus, json, varz, collectd, graphite,
+// statsd, mqtt, and cloudwatch.
+func BackendInstanceLabel(backend, value string) Option {
+	return func(e *Exporter) error {
+		if !instanceLabelBackends[backend] {
+			return errors.Errorf("unknown instance label backend %q", backend)
+		}
+		if e.backendInstances == nil {
+			e.backendInstances = make(map[string]string)
+		}
+		e.backendInstances[backend] = value
+		return nil
+	}
+}
+
+// EmitObservationCount instructs the exporter to send the number of
+// observations of each gauge as a companion `_count` metric.
+func EmitObservationCount() Option {
+	return func(e *Exporter) error {
+		e.emitObsCount = true
+		return nil
+	}
+}
+
+// EmitLastSeen instructs the exporter to send the time each label set of a
+// metric was last updated as a companion `_last_seen_seconds` metric.
+func EmitLastSeen() Option {
+	return func(e *Exporter) error {
+		e.emitLastSeen = true
+		return nil
+	}
+}
+
+// EmitLabelSetCount instructs the exporter to send the number of label sets of
+// each metric as a `metric_labelset_count` gauge.
+func EmitLabelSetCount() Option {
+	return func(e *Exporter) error {
+		e.emitLabelSetCount = true
+		return nil
+	}
+}
+
+// CounterTotalSuffix instructs the exporter to append `_total` to the
+// Prometheus names of counters that don't already end with it.
+func CounterTotalSuffix() Option {
+	return func(e *Exporter) error {
+		e.counterSuffix = true
+		return nil
+	}
+}
+
+// Rollup instructs the exporter to also emit the sum of the counter or gauge
+// named metric across the label keys in without, as a metric named
+// <metric>_without_<key>_..., to give a lower cardinality series alongside
+// the detailed one.
+func Rollup(metric string, without ...string) Option {
+	return func(e *Exporter) error {
+		if len(without) == 0 {
+			return errors.Errorf("rollup of %q needs at least one label key to sum across", metric)
+		}
+		if e.rollups == nil {
+			e.rollups = make(map[string][]*rollup)
+		}
+		e.rollups[metric] = append(e.rollups[metric], newRollup(metric, without))
+		return nil
+	}
+}
+
+// Relabel instructs the exporter to apply the rules in order to each label set
+// of each metric before it is exported, dropping or rewriting those matched.
+// Rules from repeated options are applied after those already given.
+func Relabel(rules ...RelabelRule) Option {
+	return func(e *Exporter) error {
+		for _, r := range rules {
+			rule, err := newRelabelRule(r)
+			if err != nil {
+				return err
+			}
+			e.relabelRules = append(e.relabelRules, rule)
+		}
+		return nil
+	}
+}
+
 func PushInterval(opt time.Duration) Option {
 	return func(e *Exporter) error {
 		e.pushInterval = opt
@@ -74,15 +219,36 @@ func PushInterval(opt time.Duration) Option {
 	}
 }
 
+// PushOnlyOnStop instructs the exporter to push to the push collectors once,
+// when it is stopped, instead of periodically, for a run that finishes on its
+// own, like a replay of old logs.  No routines are started that wait for the
+// context to be cancelled.
+func PushOnlyOnStop() Option {
+	return func(e *Exporter) error {
+		e.pushOnlyOnStop = true
+		return nil
+	}
+}
+
+// PushWaker wakes the exporter to push metrics to the push collectors, instead
+// of a timer every PushInterval.
+func PushWaker(w waker.Waker) Option {
+	return func(e *Exporter) error {
+		e.pushWaker = w
+		return nil
+	}
+}
+
 // New creates a new Exporter.
 func New(ctx context.Context, wg *sync.WaitGroup, store *metrics.Store, options ...Option) (*Exporter, error) {
 	if store == nil {
 		return nil, errors.New("exporter needs a Store")
 	}
 	e := &Exporter{
-		ctx:      ctx,
-		store:    store,
-		initDone: make(chan struct{}),
+		ctx:       ctx,
+		store:     store,
+		initDone:  make(chan struct{}),
+		snapshots: lru.New(maxSnapshots),
 	}
 	defer close(e.initDone)
 	if err := e.SetOption(options...); err != nil {
@@ -96,33 +262,100 @@ func New(ctx context.Context, wg *sync.WaitGroup, store *metrics.Store, options
 			return nil, errors.Wrap(err, "getting hostname")
 		}
 	}
+	if e.emitInstanceLabel && e.instance == "" {
+		e.instance = e.hostname
+	}
 
 	if *collectdSocketPath != "" {
-		o := pushOptions{"unix", *collectdSocketPath, metricToCollectd, collectdExportTotal, collectdExportSuccess}
+		filter, err := newMetricFilter(*collectdMetricsAllow, *collectdMetricsDeny)
+		if err != nil {
+			return nil, err
+		}
+		o := pushOptions{name: "collectd", net: "unix", addr: *collectdSocketPath, f: metricToCollectd, total: collectdExportTotal, success: collectdExportSuccess, interval: *collectdPushInterval, filter: filter}
 		e.RegisterPushExport(o)
 	}
 	if *graphiteHostPort != "" {
-		o := pushOptions{"tcp", *graphiteHostPort, metricToGraphite, graphiteExportTotal, graphiteExportSuccess}
+		if *graphiteCompression != "" && *graphiteCompression != gzipCompression {
+			return nil, errors.Errorf("unsupported graphite compression %q", *graphiteCompression)
+		}
+		filter, err := newMetricFilter(*graphiteMetricsAllow, *graphiteMetricsDeny)
+		if err != nil {
+			return nil, err
+		}
+		o := pushOptions{name: "graphite", net: "tcp", addr: *graphiteHostPort, f: metricToGraphite, total: graphiteExportTotal, success: graphiteExportSuccess, interval: *graphitePushInterval, compression: *graphiteCompression, filter: filter}
+		if *graphiteBufferPushes > 0 {
+			o.conn = newPushConn(*graphiteBufferPushes)
+		}
 		e.RegisterPushExport(o)
 	}
 	if *statsdHostPort != "" {
-		o := pushOptions{"udp", *statsdHostPort, metricToStatsd, statsdExportTotal, statsdExportSuccess}
+		filter, err := newMetricFilter(*statsdMetricsAllow, *statsdMetricsDeny)
+		if err != nil {
+			return nil, err
+		}
+		o := pushOptions{name: "statsd", net: "udp", addr: *statsdHostPort, f: metricToStatsd, total: statsdExportTotal, success: statsdExportSuccess, interval: *statsdPushInterval, filter: filter}
+		e.RegisterPushExport(o)
+	}
+	if *mqttBroker != "" {
+		if *mqttQoS < 0 || *mqttQoS > 1 {
+			return nil, errors.Errorf("unsupported mqtt qos %d", *mqttQoS)
+		}
+		filter, err := newMetricFilter(*mqttMetricsAllow, *mqttMetricsDeny)
+		if err != nil {
+			return nil, err
+		}
+		clientID := *mqttClientID
+		if clientID == "" {
+			clientID = "mtail-" + e.hostname
+		}
+		o := pushOptions{name: "mqtt", net: "tcp", addr: *mqttBroker, total: mqttExportTotal, success: mqttExportSuccess, interval: *mqttPushInterval, filter: filter}
+		o.mqtt = &mqttTarget{topic: *mqttTopic, perMetric: *mqttPerMetricTopics, qos: byte(*mqttQoS), clientID: clientID}
 		e.RegisterPushExport(o)
 	}
+	if *cloudWatchNamespace != "" {
+		filter, err := newMetricFilter(*cloudWatchMetricsAllow, *cloudWatchMetricsDeny)
+		if err != nil {
+			return nil, err
+		}
+		client, err := newCloudWatchClient(*cloudWatchRegion, *cloudWatchEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		o := pushOptions{name: "cloudwatch", total: cloudWatchExportTotal, success: cloudWatchExportSuccess, interval: *cloudWatchPushInterval, filter: filter}
+		o.cloudWatch = &cloudWatchTarget{namespace: *cloudWatchNamespace, client: client}
+		e.RegisterPushExport(o)
+	}
+	if e.pushOnlyOnStop {
+		return e, nil
+	}
 	e.StartMetricPush()
+	e.StartSelfStats()
 
-	// This routine manages shutdown of the Exporter.  TODO(jaq): This doesn't
-	// happen before mtail returns because of how context cancellation is set
-	// up..  How can we tie this shutdown in before mtail exits?  Should
-	// exporter be merged with httpserver?
-	go func() {
-		<-e.initDone
-		<-e.ctx.Done()
-		e.wg.Wait()
-	}()
 	return e, nil
 }
 
+// Stop waits for the metric push routines to exit after context
+// cancellation, and then pushes a final snapshot of the store to each push
+// target that was being pushed to.  Callers should only Stop the Exporter once
+// the tailer and virtual machines have drained, so that the final push
+// includes the last lines read.
+func (e *Exporter) Stop() {
+	<-e.initDone
+	e.wg.Wait()
+	for _, target := range e.pushTargets {
+		if target.waker == nil && !e.pushOnlyOnStop {
+			continue
+		}
+		glog.Infof("Pushing final metrics snapshot to %s.", target.name)
+		e.pushTo(target)
+	}
+	for _, target := range e.pushTargets {
+		if target.conn != nil {
+			target.conn.close()
+		}
+	}
+}
+
 // SetOption takes one or more option functions and applies them in order to Exporter.
 func (e *Exporter) SetOption(options ...Option) error {
 	for _, option := range options {
@@ -133,6 +366,34 @@ func (e *Exporter) SetOption(options ...Option) error {
 	return nil
 }
 
+// instanceLabel returns the value of the instance label for backend, and
+// whether it is emitted there at all.
+func (e *Exporter) instanceLabel(backend string) (string, bool) {
+	if value, ok := e.backendInstances[backend]; ok {
+		return value, value != ""
+	}
+	return e.instance, e.emitInstanceLabel
+}
+
+// withInstanceLabel returns a copy of the LabelSet l with the instance label
+// added, if the Exporter is configured to emit it to backend and l doesn't
+// already have one.
+func (e *Exporter) withInstanceLabel(backend string, l *metrics.LabelSet) *metrics.LabelSet {
+	value, ok := e.instanceLabel(backend)
+	if !ok {
+		return l
+	}
+	if _, ok := l.Labels[instanceLabelName]; ok {
+		return l
+	}
+	labels := make(map[string]string, len(l.Labels)+1)
+	for k, v := range l.Labels {
+		labels[k] = v
+	}
+	labels[instanceLabelName] = value
+	return &metrics.LabelSet{Labels: labels, Datum: l.Datum}
+}
+
 // formatLabels converts a metric name and key-value map of labels to a single
 // string for exporting to the correct output format for each export target.
 // ksep and sep mark what to use for key/val separator, and between label separators respoectively.
@@ -155,23 +416,29 @@ func formatLabels(name string, m map[string]string, ksep, sep, rep string) strin
 // sockets.
 type formatter func(string, *metrics.Metric, *metrics.LabelSet, time.Duration) string
 
-func (e *Exporter) writeSocketMetrics(c io.Writer, f formatter, exportTotal *expvar.Int, exportSuccess *expvar.Int) error {
+func (e *Exporter) writeSocketMetrics(c io.Writer, target pushOptions) error {
+	interval := e.targetInterval(target)
 	return e.store.Range(func(m *metrics.Metric) error {
 		m.RLock()
-		// Don't try to send text metrics to any push service.
-		if m.Kind == metrics.Text {
+		// Don't try to send text metrics to any push service, nor metrics
+		// filtered out for this one.
+		if m.Kind == metrics.Text || !target.filter.Allows(m.Name) {
 			m.RUnlock()
 			return nil
 		}
-		exportTotal.Add(1)
+		target.total.Add(1)
 		lc := make(chan *metrics.LabelSet)
 		go m.EmitLabelSets(lc)
 		for l := range lc {
-			line := f(e.hostname, m, l, e.pushInterval)
+			l = e.relabel(m, e.withInstanceLabel(target.name, l))
+			if l == nil {
+				continue
+			}
+			line := target.f(e.hostname, m, l, interval)
 			n, err := fmt.Fprint(c, line)
 			glog.V(2).Infof("Sent %d bytes\n", n)
 			if err == nil {
-				exportSuccess.Add(1)
+				target.success.Add(1)
 			} else {
 				return errors.Errorf("write error: %s\n", err)
 			}
@@ -181,63 +448,158 @@ func (e *Exporter) writeSocketMetrics(c io.Writer, f formatter, exportTotal *exp
 	})
 }
 
+// updateRatios sets the gauges holding the ratio of two metrics, as they are
+// only computed when exported.
+func (e *Exporter) updateRatios() {
+	if err := e.store.UpdateRatios(); err != nil {
+		glog.Info(err)
+	}
+}
+
 // PushMetrics sends metrics to each of the configured services.
 func (e *Exporter) PushMetrics() {
 	for _, target := range e.pushTargets {
-		glog.V(2).Infof("pushing to %s", target.addr)
-		conn, err := net.DialTimeout(target.net, target.addr, *writeDeadline)
-		if err != nil {
-			glog.Infof("pusher dial error: %s", err)
-			continue
-		}
-		err = conn.SetDeadline(time.Now().Add(*writeDeadline))
-		if err != nil {
-			glog.Infof("Couldn't set deadline on connection: %s", err)
+		e.pushTo(target)
+	}
+}
+
+// pushTo sends metrics to the target, recording the duration and success of
+// the push.
+func (e *Exporter) pushTo(target pushOptions) {
+	glog.V(2).Infof("pushing to %s", target.addr)
+	start := time.Now()
+	err := e.push(target)
+	duration := new(expvar.Float)
+	duration.Set(time.Since(start).Seconds())
+	pushDuration.Set(target.name, duration)
+	success := new(expvar.Int)
+	if err != nil {
+		glog.Info(err)
+	} else {
+		success.Set(1)
+	}
+	pushSuccess.Set(target.name, success)
+}
+
+// push sends metrics to the target on a new connection, or on its persistent
+// connection if it has one, or publishes them if it is an MQTT broker, or puts
+// them in CloudWatch.
+func (e *Exporter) push(target pushOptions) error {
+	e.updateRatios()
+	if target.mqtt != nil {
+		return e.publishMQTT(target)
+	}
+	if target.cloudWatch != nil {
+		return e.putCloudWatch(target)
+	}
+	if target.conn != nil {
+		var buf bytes.Buffer
+		var err error
+		if target.compression == "" {
+			err = e.writeSocketMetrics(&buf, target)
+		} else {
+			err = e.writeCompressedSocketMetrics(&buf, target)
 		}
-		err = e.writeSocketMetrics(conn, target.f, target.total, target.success)
 		if err != nil {
-			glog.Infof("pusher write error: %s", err)
+			return errors.Errorf("pusher write error: %s", err)
 		}
-		err = conn.Close()
-		if err != nil {
+		return target.conn.send(target, buf.Bytes())
+	}
+	conn, err := dialPushTarget(target.net, target.addr, *writeDeadline)
+	if err != nil {
+		return errors.Errorf("pusher dial error: %s", err)
+	}
+	err = conn.SetDeadline(time.Now().Add(*writeDeadline))
+	if err != nil {
+		glog.Infof("Couldn't set deadline on connection: %s", err)
+	}
+	if target.compression == "" {
+		err = e.writeSocketMetrics(conn, target)
+	} else {
+		err = e.writeCompressedSocketMetrics(conn, target)
+	}
+	if err != nil {
+		conn.Close()
+		return errors.Errorf("pusher write error: %s", err)
+	}
+	if err := conn.Close(); err != nil {
+		return errors.Errorf("connection close failed: %s", err)
+	}
+	return nil
+}
 
-			glog.Infof("connection close failed: %s", err)
-		}
+// writeCompressedSocketMetrics writes the metrics to c compressed, however
+// small, as the receiver decompresses everything it is sent.
+func (e *Exporter) writeCompressedSocketMetrics(c io.Writer, target pushOptions) error {
+	z := gzip.NewWriter(c)
+	if err := e.writeSocketMetrics(z, target); err != nil {
+		return err
 	}
+	return z.Close()
 }
 
-// StartMetricPush pushes metrics to the configured services each interval.
+// StartMetricPush pushes metrics to each of the configured services
+// concurrently, each time its waker wakes.  A service without its own waker
+// is woken by the push waker, or else each of its interval, or else each push
+// interval.
 func (e *Exporter) StartMetricPush() {
-	if len(e.pushTargets) <= 0 {
-		return
-	}
-	if e.pushInterval <= 0 {
-		return
-	}
-	e.wg.Add(1)
-	go func() {
-		defer e.wg.Done()
-		<-e.initDone
-		glog.Info("Started metric push.")
-		ticker := time.NewTicker(e.pushInterval)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-e.ctx.Done():
-				return
-			case <-ticker.C:
-				e.PushMetrics()
+	for i := range e.pushTargets {
+		target := &e.pushTargets[i]
+		if target.waker == nil {
+			target.waker = e.pushWaker
+		}
+		if target.waker == nil {
+			interval := e.targetInterval(*target)
+			if interval <= 0 {
+				continue
 			}
+			target.waker = waker.NewTimed(e.ctx, interval)
 		}
-	}()
+		e.wg.Add(1)
+		go func(target pushOptions) {
+			defer e.wg.Done()
+			<-e.initDone
+			glog.Infof("Started metric push to %s.", target.name)
+			for {
+				select {
+				case <-e.ctx.Done():
+					return
+				case <-target.waker.Wake():
+					e.pushTo(target)
+				}
+			}
+		}(*target)
+	}
+}
+
+// targetInterval returns the interval between pushes to the target.
+func (e *Exporter) targetInterval(target pushOptions) time.Duration {
+	if target.interval > 0 {
+		return target.interval
+	}
+	return e.pushInterval
 }
 
 type pushOptions struct {
+	name           string // Names the backend in the push metrics.
 	net, addr      string
 	f              formatter
 	total, success *expvar.Int
+	interval       time.Duration // If zero, the Exporter's push interval is used.
+	waker          waker.Waker   // If nil, set by StartMetricPush.
+
+	compression string // If gzipCompression, payloads are compressed.
+
+	filter *metricFilter // If not nil, only metrics it allows are pushed.
+
+	conn       *pushConn         // If not nil, pushes are sent on this persistent connection.
+	mqtt       *mqttTarget       // If not nil, pushes are published to this MQTT broker.
+	cloudWatch *cloudWatchTarget // If not nil, pushes are put in CloudWatch.
 }
 
+// gzipCompression names the gzip compression of push payloads.
+const gzipCompression = "gzip"
+
 // RegisterPushExport adds a push export connection to the Exporter.  Items in
 // the list must describe a Dial()able connection and will have all the metrics
 // pushed to each pushInterval.
@@ -4,10 +4,18 @@
 package exporter
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"errors"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"net"
 	"reflect"
 	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -15,6 +23,7 @@ import (
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/metrics/datum"
 	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/waker"
 )
 
 const prefix = "prefix"
@@ -48,6 +57,429 @@ func TestCreateExporter(t *testing.T) {
 	wg.Wait()
 }
 
+func TestPushWaker(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.FatalIfErr(t, err)
+	defer ln.Close()
+	// Each push is sent on a new connection, so each connection read is a snapshot.
+	snapshots := make(chan string)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			b, err := ioutil.ReadAll(c)
+			c.Close()
+			if err != nil {
+				t.Error(err)
+			}
+			snapshots <- string(b)
+		}
+	}()
+	*graphiteHostPort = ln.Addr().String()
+	*graphitePrefix = ""
+	defer func() { *graphiteHostPort = "" }()
+
+	store := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int)
+	testutil.FatalIfErr(t, store.Add(m))
+	d, err := m.GetDatum()
+	testutil.FatalIfErr(t, err)
+	ts := time.Date(2012, 7, 24, 10, 14, 0, 0, time.UTC)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w, awaken := waker.NewTest(ctx, 1)
+	var wg sync.WaitGroup
+	_, err = New(ctx, &wg, store, Hostname("gunstar"), PushWaker(w))
+	testutil.FatalIfErr(t, err)
+
+	for _, value := range []int64{37, 42} {
+		datum.SetInt(d, value, ts)
+		// Wait for the push loop to push and return to waiting.
+		awaken(1)
+		got := <-snapshots
+		testutil.ExpectNoDiff(t, metricToGraphite("gunstar", m, &metrics.LabelSet{Labels: map[string]string{}, Datum: d}, 0), got)
+	}
+	select {
+	case s := <-snapshots:
+		t.Errorf("unexpected snapshot without a wake: %q", s)
+	default:
+	}
+}
+
+// testPushListener accepts pushes from the exporter, sending the contents of
+// each connection, which is one snapshot, to the returned channel.
+func testPushListener(t *testing.T) (net.Listener, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.FatalIfErr(t, err)
+	snapshots := make(chan string, 10)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			b, err := ioutil.ReadAll(c)
+			c.Close()
+			if err != nil {
+				t.Error(err)
+			}
+			snapshots <- string(b)
+		}
+	}()
+	return ln, snapshots
+}
+
+func TestPushTargetsIndependent(t *testing.T) {
+	fastLn, fastSnapshots := testPushListener(t)
+	defer fastLn.Close()
+	slowLn, slowSnapshots := testPushListener(t)
+	defer slowLn.Close()
+	*collectdPrefix = ""
+
+	store := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int)
+	testutil.FatalIfErr(t, store.Add(m))
+	d, err := m.GetDatum()
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 37, time.Date(2012, 7, 24, 10, 14, 0, 0, time.UTC))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	e, err := New(ctx, &wg, store, Hostname("gunstar"), PushInterval(time.Minute))
+	testutil.FatalIfErr(t, err)
+	fastWaker, awakenFast := waker.NewTest(ctx, 1)
+	slowWaker, awakenSlow := waker.NewTest(ctx, 1)
+	e.RegisterPushExport(pushOptions{name: "fast", net: "tcp", addr: fastLn.Addr().String(), f: metricToCollectd, total: new(expvar.Int), success: new(expvar.Int), interval: time.Second, waker: fastWaker})
+	e.RegisterPushExport(pushOptions{name: "slow", net: "tcp", addr: slowLn.Addr().String(), f: metricToCollectd, total: new(expvar.Int), success: new(expvar.Int), interval: 10 * time.Second, waker: slowWaker})
+	e.StartMetricPush()
+
+	// The fast target is pushed to ten times for each push to the slow one.
+	for i := 0; i < 10; i++ {
+		awakenFast(1)
+		testutil.ExpectNoDiff(t, "PUTVAL \"gunstar/mtail-prog/counter-foo\" interval=1 1343124840:37\n", <-fastSnapshots)
+		select {
+		case s := <-slowSnapshots:
+			t.Fatalf("unexpected push to the slow target: %q", s)
+		default:
+		}
+	}
+	awakenSlow(1)
+	testutil.ExpectNoDiff(t, "PUTVAL \"gunstar/mtail-prog/counter-foo\" interval=10 1343124840:37\n", <-slowSnapshots)
+	select {
+	case s := <-fastSnapshots:
+		t.Errorf("unexpected push to the fast target: %q", s)
+	default:
+	}
+}
+
+func TestPushCompression(t *testing.T) {
+	ln, snapshots := testPushListener(t)
+	defer ln.Close()
+	*graphiteHostPort = ln.Addr().String()
+	*graphitePrefix = ""
+	*graphiteCompression = "gzip"
+	defer func() {
+		*graphiteHostPort = ""
+		*graphiteCompression = ""
+	}()
+
+	store := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int)
+	testutil.FatalIfErr(t, store.Add(m))
+	d, err := m.GetDatum()
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 37, time.Date(2012, 7, 24, 10, 14, 0, 0, time.UTC))
+	expected := "prog.foo 37 1343124840\n"
+
+	// Even a push this small is compressed.
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	e, err := New(ctx, &wg, store, Hostname("gunstar"))
+	testutil.FatalIfErr(t, err)
+	e.PushMetrics()
+	z, err := gzip.NewReader(bytes.NewBufferString(<-snapshots))
+	testutil.FatalIfErr(t, err)
+	b, err := ioutil.ReadAll(z)
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, expected, string(b))
+	cancel()
+	wg.Wait()
+}
+
+func TestPushMetricsAllowlist(t *testing.T) {
+	ln, snapshots := testPushListener(t)
+	defer ln.Close()
+	*graphiteHostPort = ln.Addr().String()
+	*graphitePrefix = ""
+	*graphiteMetricsAllow = "requests_*"
+	defer func() {
+		*graphiteHostPort = ""
+		*graphiteMetricsAllow = ""
+	}()
+
+	store := metrics.NewStore()
+	ts := time.Date(2012, 7, 24, 10, 14, 0, 0, time.UTC)
+	for _, name := range []string{"requests_total", "latency_ms"} {
+		m := metrics.NewMetric(name, "prog", metrics.Counter, metrics.Int, "code")
+		testutil.FatalIfErr(t, store.Add(m))
+		for _, code := range []string{"200", "500"} {
+			d, err := m.GetDatum(code)
+			testutil.FatalIfErr(t, err)
+			datum.SetInt(d, 37, ts)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	e, err := New(ctx, &wg, store, Hostname("gunstar"))
+	testutil.FatalIfErr(t, err)
+	e.PushMetrics()
+	got := strings.Split(strings.TrimSuffix(<-snapshots, "\n"), "\n")
+	sort.Strings(got)
+	expected := []string{
+		"prog.requests_total.code.200 37 1343124840",
+		"prog.requests_total.code.500 37 1343124840",
+	}
+	testutil.ExpectNoDiff(t, expected, got)
+}
+
+func TestMetricFilter(t *testing.T) {
+	f, err := newMetricFilter("requests_*,errors", "*_debug")
+	testutil.FatalIfErr(t, err)
+	for name, expected := range map[string]bool{
+		"requests_total": true,
+		"errors":         true,
+		"errors_total":   false,
+		"requests_debug": false,
+		"latency_ms":     false,
+	} {
+		if got := f.Allows(name); got != expected {
+			t.Errorf("Allows(%q): got %v, want %v", name, got, expected)
+		}
+	}
+	var none *metricFilter
+	if !none.Allows("anything") {
+		t.Error("nil filter should allow every metric")
+	}
+	if _, err := newMetricFilter("[", ""); err == nil {
+		t.Error("expecting error for bad pattern")
+	}
+}
+
+func TestPushCompressionUnsupported(t *testing.T) {
+	*graphiteHostPort = "localhost:2003"
+	*graphiteCompression = "snappy"
+	defer func() {
+		*graphiteHostPort = ""
+		*graphiteCompression = ""
+	}()
+	var wg sync.WaitGroup
+	_, err := New(context.Background(), &wg, metrics.NewStore())
+	if err == nil {
+		t.Error("expecting error for unsupported compression")
+	}
+}
+
+func TestPushMetricsInstrumentation(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.FatalIfErr(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			io.Copy(ioutil.Discard, c)
+			c.Close()
+		}
+	}()
+	// A slow backend takes a while to accept a connection, or fails to.
+	var backendDown bool
+	defer func() { dialPushTarget = net.DialTimeout }()
+	dialPushTarget = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		time.Sleep(20 * time.Millisecond)
+		if backendDown {
+			return nil, errors.New("connection refused")
+		}
+		return net.DialTimeout(network, address, timeout)
+	}
+	*graphiteHostPort = ln.Addr().String()
+	defer func() { *graphiteHostPort = "" }()
+
+	store := metrics.NewStore()
+	testutil.FatalIfErr(t, store.Add(metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int)))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	e, err := New(ctx, &wg, store, Hostname("gunstar"))
+	testutil.FatalIfErr(t, err)
+
+	e.PushMetrics()
+	if got := pushDuration.Get("graphite").(*expvar.Float).Value(); got < 0.02 {
+		t.Errorf("push duration %g, want at least 0.02 seconds", got)
+	}
+	testutil.ExpectNoDiff(t, "1", pushSuccess.Get("graphite").String())
+
+	backendDown = true
+	e.PushMetrics()
+	testutil.ExpectNoDiff(t, "0", pushSuccess.Get("graphite").String())
+}
+
+func TestPushBufferedReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.FatalIfErr(t, err)
+	defer ln.Close()
+	// The fake carbon server closes the first connection after one line, and
+	// sends each line received on the connections after it.
+	firstClosed := make(chan struct{})
+	received := make(chan string, 10)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		line, err := bufio.NewReader(c).ReadString('\n')
+		if err != nil {
+			t.Error(err)
+		}
+		received <- line
+		c.Close()
+		close(firstClosed)
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			scanner := bufio.NewScanner(c)
+			for scanner.Scan() {
+				received <- scanner.Text() + "\n"
+			}
+			c.Close()
+		}
+	}()
+	var backendDown bool
+	defer func() { dialPushTarget = net.DialTimeout }()
+	dialPushTarget = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		if backendDown {
+			return nil, errors.New("connection refused")
+		}
+		return net.DialTimeout(network, address, timeout)
+	}
+	*graphiteHostPort = ln.Addr().String()
+	*graphitePrefix = ""
+	*graphiteBufferPushes = 2
+	defer func() {
+		*graphiteHostPort = ""
+		*graphiteBufferPushes = 0
+	}()
+
+	store := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int)
+	testutil.FatalIfErr(t, store.Add(m))
+	d, err := m.GetDatum()
+	testutil.FatalIfErr(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	e, err := New(ctx, &wg, store, Hostname("gunstar"))
+	testutil.FatalIfErr(t, err)
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-received:
+			testutil.ExpectNoDiff(t, want, got)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %q", want)
+		}
+	}
+
+	datum.SetInt(d, 1, time.Unix(100, 0))
+	e.PushMetrics()
+	expect("prog.foo 1 100\n")
+	<-firstClosed
+
+	// The connection has dropped, and it can't be made again yet.
+	backendDown = true
+	datum.SetInt(d, 2, time.Unix(160, 0))
+	e.PushMetrics()
+	testutil.ExpectNoDiff(t, "0", pushSuccess.Get("graphite").String())
+
+	// Once it reconnects, the buffered push is delivered before this one.
+	backendDown = false
+	datum.SetInt(d, 3, time.Unix(220, 0))
+	e.PushMetrics()
+	testutil.ExpectNoDiff(t, "1", pushSuccess.Get("graphite").String())
+	expect("prog.foo 2 160\n")
+	expect("prog.foo 3 220\n")
+
+	cancel()
+	wg.Wait()
+	e.Stop()
+}
+
+func TestPushConnPartialWrite(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		compression string
+		expected    string
+	}{
+		// The line written in part is sent again, but not the line before it.
+		{"plain", "", "b 2 100\nc 3 100\nd 4 160\n"},
+		// The rest of a compressed payload can't be sent on a new connection.
+		{"compressed", gzipCompression, "d 4 160\n"},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			// The first connection is closed by the server in the middle of
+			// the second line, and the second is read in full.
+			received := make(chan string, 1)
+			var dials int
+			defer func() { dialPushTarget = net.DialTimeout }()
+			dialPushTarget = func(network, address string, timeout time.Duration) (net.Conn, error) {
+				client, server := net.Pipe()
+				dials++
+				if dials == 1 {
+					go func() {
+						b := make([]byte, 10)
+						if _, err := io.ReadFull(server, b); err != nil {
+							t.Error(err)
+						}
+						server.Close()
+					}()
+				} else {
+					go func() {
+						b, err := ioutil.ReadAll(server)
+						if err != nil {
+							t.Error(err)
+						}
+						received <- string(b)
+					}()
+				}
+				return client, nil
+			}
+			target := pushOptions{name: "graphite", net: "tcp", addr: "carbon:2003", compression: tc.compression}
+			pc := newPushConn(2)
+			if err := pc.send(target, []byte("a 1 100\nb 2 100\nc 3 100\n")); err == nil {
+				t.Error("expected write error")
+			}
+			testutil.FatalIfErr(t, pc.send(target, []byte("d 4 160\n")))
+			pc.close()
+			select {
+			case got := <-received:
+				testutil.ExpectNoDiff(t, tc.expected, got)
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for the second connection")
+			}
+		})
+	}
+}
+
 func FakeSocketWrite(f formatter, m *metrics.Metric) []string {
 	ret := make([]string, 0)
 	lc := make(chan *metrics.LabelSet)
@@ -184,3 +616,94 @@ func TestMetricToStatsd(t *testing.T) {
 		t.Errorf("prefixed string didn't match:\n\texpected: %v\n\treceived: %v", expected, r)
 	}
 }
+
+func TestMetricToStatsdTimestamp(t *testing.T) {
+	*statsdPrefix = ""
+	*statsdEmitTimestamp = true
+	defer func() { *statsdEmitTimestamp = false }()
+	// A datum last set in the past, as when replaying old logs.
+	ts := time.Date(2012, 7, 24, 10, 14, 0, 0, time.UTC)
+
+	scalarMetric := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int)
+	d, _ := scalarMetric.GetDatum()
+	datum.SetInt(d, 37, ts)
+	r := FakeSocketWrite(metricToStatsd, scalarMetric)
+	expected := []string{"prog.foo:37|c|T1343124840"}
+	testutil.ExpectNoDiff(t, expected, r)
+
+	gaugeMetric := metrics.NewMetric("bar", "prog", metrics.Gauge, metrics.Int, "l")
+	d, _ = gaugeMetric.GetDatum("quux")
+	datum.SetInt(d, 42, ts)
+	r = FakeSocketWrite(metricToStatsd, gaugeMetric)
+	expected = []string{"prog.bar.l.quux:42|g|T1343124840"}
+	testutil.ExpectNoDiff(t, expected, r)
+
+	// Timers don't take a timestamp.
+	timingMetric := metrics.NewMetric("foo", "prog", metrics.Timer, metrics.Int)
+	d, _ = timingMetric.GetDatum()
+	datum.SetInt(d, 37, ts)
+	r = FakeSocketWrite(metricToStatsd, timingMetric)
+	expected = []string{"prog.foo:37|ms"}
+	testutil.ExpectNoDiff(t, expected, r)
+}
+
+func TestPushInstanceLabel(t *testing.T) {
+	*collectdPrefix = ""
+	*graphitePrefix = ""
+	*statsdPrefix = ""
+	ts := time.Unix(1343124840, 0)
+	for _, tc := range []struct {
+		name     string
+		backend  string
+		f        formatter
+		opts     []Option
+		expected string
+	}{
+		{"collectd instance label", "collectd", metricToCollectd, []Option{InstanceLabel("mtail-1")},
+			"PUTVAL \"gunstar/mtail-prog/counter-foo-instance-mtail_1\" interval=60 1343124840:1\n"},
+		{"collectd backend instance label", "collectd", metricToCollectd, []Option{InstanceLabel("mtail-1"), BackendInstanceLabel("collectd", "collectd-1")},
+			"PUTVAL \"gunstar/mtail-prog/counter-foo-instance-collectd_1\" interval=60 1343124840:1\n"},
+		{"collectd backend instance label omitted", "collectd", metricToCollectd, []Option{InstanceLabel("mtail-1"), BackendInstanceLabel("collectd", "")},
+			"PUTVAL \"gunstar/mtail-prog/counter-foo\" interval=60 1343124840:1\n"},
+		{"graphite instance label", "graphite", metricToGraphite, []Option{InstanceLabel("mtail-1")},
+			"prog.foo.instance.mtail-1 1 1343124840\n"},
+		{"graphite backend instance label", "graphite", metricToGraphite, []Option{InstanceLabel("mtail-1"), BackendInstanceLabel("graphite", "graphite-1")},
+			"prog.foo.instance.graphite-1 1 1343124840\n"},
+		{"graphite backend instance label omitted", "graphite", metricToGraphite, []Option{InstanceLabel("mtail-1"), BackendInstanceLabel("graphite", "")},
+			"prog.foo 1 1343124840\n"},
+		{"statsd instance label", "statsd", metricToStatsd, []Option{InstanceLabel("mtail-1")},
+			"prog.foo.instance.mtail-1:1|c"},
+		{"statsd backend instance label without instance label", "statsd", metricToStatsd, []Option{BackendInstanceLabel("statsd", "statsd-1")},
+			"prog.foo.instance.statsd-1:1|c"},
+		{"statsd backend instance label omitted", "statsd", metricToStatsd, []Option{InstanceLabel("mtail-1"), BackendInstanceLabel("statsd", "")},
+			"prog.foo:1|c"},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			store := metrics.NewStore()
+			m := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int)
+			d, err := m.GetDatum()
+			testutil.FatalIfErr(t, err)
+			datum.SetInt(d, 1, ts)
+			testutil.FatalIfErr(t, store.Add(m))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var wg sync.WaitGroup
+			e, err := New(ctx, &wg, store, append([]Option{Hostname("gunstar")}, tc.opts...)...)
+			testutil.FatalIfErr(t, err)
+			var buf bytes.Buffer
+			target := pushOptions{name: tc.backend, f: tc.f, total: new(expvar.Int), success: new(expvar.Int), interval: time.Minute}
+			testutil.FatalIfErr(t, e.writeSocketMetrics(&buf, target))
+			testutil.ExpectNoDiff(t, tc.expected, buf.String())
+		})
+	}
+}
+
+func TestBackendInstanceLabelUnknownBackend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	if _, err := New(ctx, &wg, metrics.NewStore(), BackendInstanceLabel("nagios", "x")); err == nil {
+		t.Error("expecting error for unknown backend, got nil")
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// metricFilter selects the metrics pushed to a backend by name.  A nil
+// metricFilter allows every metric.
+type metricFilter struct {
+	allow []string // Glob patterns of the names to push, or all if empty.
+	deny  []string // Glob patterns of the names not to push, even if allowed.
+}
+
+// newMetricFilter returns a metricFilter from comma separated lists of glob
+// patterns, or nil if both are empty.
+func newMetricFilter(allow, deny string) (*metricFilter, error) {
+	if allow == "" && deny == "" {
+		return nil, nil
+	}
+	f := &metricFilter{allow: splitPatterns(allow), deny: splitPatterns(deny)}
+	for _, p := range append(f.allow, f.deny...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, errors.Wrapf(err, "bad metric name pattern %q", p)
+		}
+	}
+	return f, nil
+}
+
+func splitPatterns(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// Allows returns true if the metric named name is to be pushed.
+func (f *metricFilter) Allows(name string) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.allow) > 0 && !matchAny(f.allow, name) {
+		return false
+	}
+	return !matchAny(f.deny, name)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		// The patterns have been checked by newMetricFilter.
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
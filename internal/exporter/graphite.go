@@ -17,6 +17,16 @@ var (
 		"Host:port to graphite carbon server to write metrics to.")
 	graphitePrefix = flag.String("graphite_prefix", "",
 		"Prefix to use for graphite metrics.")
+	graphitePushInterval = flag.Duration("graphite_push_interval", 0,
+		"Interval between metric pushes to graphite, if not that of the other push collectors.")
+	graphiteCompression = flag.String("graphite_compression", "",
+		"Compression of the metrics pushed to graphite, for carbon relays that accept a compressed stream.  Either empty for none, or gzip.  Snappy is not supported.")
+	graphiteBufferPushes = flag.Int("graphite_buffer_pushes", 0,
+		"If positive, keep a persistent connection to graphite, reconnecting when it drops, and buffer up to this many pushes that couldn't be delivered to send once it is reconnected.")
+	graphiteMetricsAllow = flag.String("graphite_metrics_allow", "",
+		"Comma separated glob patterns of the names of the metrics to push to graphite, or all metrics if empty.")
+	graphiteMetricsDeny = flag.String("graphite_metrics_deny", "",
+		"Comma separated glob patterns of the names of the metrics not to push to graphite.")
 
 	graphiteExportTotal   = expvar.NewInt("graphite_export_total")
 	graphiteExportSuccess = expvar.NewInt("graphite_export_success")
@@ -9,6 +9,8 @@ import (
 	"net/http"
 
 	"github.com/golang/glog"
+
+	"github.com/google/mtail/internal/metrics"
 )
 
 var (
@@ -17,7 +19,12 @@ var (
 
 // HandleJSON exports the metrics in JSON format via HTTP.
 func (e *Exporter) HandleJSON(w http.ResponseWriter, r *http.Request) {
-	b, err := json.MarshalIndent(e.store, "", "  ")
+	e.updateRatios()
+	var v interface{} = e.store
+	if instance, ok := e.instanceLabel("json"); ok {
+		v = e.metricsWithInstanceLabel(instance)
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
 		exportJSONErrors.Add(1)
 		glog.Info("error marshalling metrics into json:", err.Error())
@@ -30,3 +37,33 @@ func (e *Exporter) HandleJSON(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
+
+// metricsWithInstanceLabel returns copies of the metrics in the store with
+// the instance label added as a key, unless they already have one.
+func (e *Exporter) metricsWithInstanceLabel(instance string) []*metrics.Metric {
+	ms := make([]*metrics.Metric, 0)
+	e.store.Range(func(m *metrics.Metric) error {
+		m.RLock()
+		defer m.RUnlock()
+		c := &metrics.Metric{Name: m.Name, Program: m.Program, Kind: m.Kind, Type: m.Type, Hidden: m.Hidden, Keys: m.Keys, Source: m.Source, Buckets: m.Buckets}
+		hasInstance := false
+		for _, k := range m.Keys {
+			if k == instanceLabelName {
+				hasInstance = true
+			}
+		}
+		if !hasInstance {
+			c.Keys = append(append([]string{}, m.Keys...), instanceLabelName)
+		}
+		for _, lv := range m.LabelValues {
+			clv := *lv
+			if !hasInstance {
+				clv.Labels = append(append([]string{}, lv.Labels...), instance)
+			}
+			c.LabelValues = append(c.LabelValues, &clv)
+		}
+		ms = append(ms, c)
+		return nil
+	})
+	return ms
+}
@@ -159,3 +159,114 @@ func TestHandleJSON(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleJSONInstanceLabel(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     []Option
+		expected string
+	}{
+		{"instance label",
+			[]Option{InstanceLabel("mtail-1")},
+			`[
+  {
+    "Name": "foo",
+    "Program": "test",
+    "Kind": 1,
+    "Type": 0,
+    "Keys": [
+      "a",
+      "instance"
+    ],
+    "LabelValues": [
+      {
+        "Labels": [
+          "1",
+          "mtail-1"
+        ],
+        "Value": {
+          "Value": 1,
+          "Time": 0
+        }
+      }
+    ]
+  }
+]`,
+		},
+		{"backend instance label",
+			[]Option{InstanceLabel("mtail-1"), BackendInstanceLabel("json", "json-1")},
+			`[
+  {
+    "Name": "foo",
+    "Program": "test",
+    "Kind": 1,
+    "Type": 0,
+    "Keys": [
+      "a",
+      "instance"
+    ],
+    "LabelValues": [
+      {
+        "Labels": [
+          "1",
+          "json-1"
+        ],
+        "Value": {
+          "Value": 1,
+          "Time": 0
+        }
+      }
+    ]
+  }
+]`,
+		},
+		{"backend instance label omitted",
+			[]Option{InstanceLabel("mtail-1"), BackendInstanceLabel("json", "")},
+			`[
+  {
+    "Name": "foo",
+    "Program": "test",
+    "Kind": 1,
+    "Type": 0,
+    "Keys": [
+      "a"
+    ],
+    "LabelValues": [
+      {
+        "Labels": [
+          "1"
+        ],
+        "Value": {
+          "Value": 1,
+          "Time": 0
+        }
+      }
+    ]
+  }
+]`,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			var wg sync.WaitGroup
+			ms := metrics.NewStore()
+			testutil.FatalIfErr(t, ms.Add(&metrics.Metric{
+				Name:        "foo",
+				Program:     "test",
+				Kind:        metrics.Counter,
+				Keys:        []string{"a"},
+				LabelValues: []*metrics.LabelValue{{Labels: []string{"1"}, Value: datum.MakeInt(1, time.Unix(0, 0))}},
+			}))
+			e, err := New(ctx, &wg, ms, append([]Option{Hostname("gunstar")}, tc.opts...)...)
+			testutil.FatalIfErr(t, err)
+			response := httptest.NewRecorder()
+			e.HandleJSON(response, &http.Request{})
+			b, err := ioutil.ReadAll(response.Body)
+			testutil.FatalIfErr(t, err)
+			testutil.ExpectNoDiff(t, tc.expected, string(b))
+			cancel()
+			wg.Wait()
+		})
+	}
+}
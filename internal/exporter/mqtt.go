@@ -0,0 +1,279 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/pkg/errors"
+)
+
+var (
+	mqttBroker = flag.String("mqtt_broker", "",
+		"Host:port of the MQTT broker to publish metrics to.")
+	mqttTopic = flag.String("mqtt_topic", "mtail",
+		"MQTT topic to publish metrics on.")
+	mqttPerMetricTopics = flag.Bool("mqtt_per_metric_topics", false,
+		"Publish each metric on a subtopic of --mqtt_topic named after it, instead of on --mqtt_topic itself.")
+	mqttQoS = flag.Int("mqtt_qos", 0,
+		"MQTT quality of service to publish metrics with, either 0 for at most once or 1 for at least once.")
+	mqttClientID = flag.String("mqtt_client_id", "",
+		"MQTT client identifier to connect to the broker with.  Defaults to mtail- and the hostname.")
+	mqttPushInterval = flag.Duration("mqtt_push_interval", 0,
+		"Interval between metric pushes to MQTT, if not that of the other push collectors.")
+	mqttMetricsAllow = flag.String("mqtt_metrics_allow", "",
+		"Comma separated glob patterns of the names of the metrics to publish to MQTT, or all metrics if empty.")
+	mqttMetricsDeny = flag.String("mqtt_metrics_deny", "",
+		"Comma separated glob patterns of the names of the metrics not to publish to MQTT.")
+
+	mqttExportTotal   = expvar.NewInt("mqtt_export_total")
+	mqttExportSuccess = expvar.NewInt("mqtt_export_success")
+)
+
+// mqttClient publishes messages to an MQTT broker.
+type mqttClient interface {
+	Publish(topic string, qos byte, payload []byte) error
+	Close() error
+}
+
+// dialMQTT connects to the MQTT broker at addr.  It is a variable so that
+// tests can fake the broker.
+var dialMQTT = func(addr, clientID string, timeout time.Duration) (mqttClient, error) {
+	conn, err := dialPushTarget("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c := &mqttConn{conn: conn, r: bufio.NewReader(conn)}
+	if err := c.connect(clientID); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// mqttTarget describes where metrics are published to an MQTT broker.
+type mqttTarget struct {
+	topic     string
+	perMetric bool // If set, each metric is published on a subtopic of topic.
+	qos       byte
+	clientID  string
+}
+
+// mqttMessage is the JSON payload published for each label set of a metric.
+type mqttMessage struct {
+	Name      string            `json:"name"`
+	Program   string            `json:"prog,omitempty"`
+	Kind      string            `json:"kind"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Value     float64           `json:"value"`
+	Timestamp int64             `json:"timestamp"`
+}
+
+// publishMQTT publishes each label set of the counters and gauges in the
+// store to the target's broker, as a JSON message.
+func (e *Exporter) publishMQTT(target pushOptions) error {
+	c, err := dialMQTT(target.addr, target.mqtt.clientID, *writeDeadline)
+	if err != nil {
+		return errors.Errorf("mqtt dial error: %s", err)
+	}
+	err = e.store.Range(func(m *metrics.Metric) error {
+		m.RLock()
+		defer m.RUnlock()
+		if m.Kind == metrics.Text || m.Kind == metrics.Histogram || !target.filter.Allows(m.Name) {
+			return nil
+		}
+		topic := target.mqtt.topic
+		if target.mqtt.perMetric {
+			topic += "/" + m.Name
+		}
+		var err error
+		lc := make(chan *metrics.LabelSet)
+		go m.EmitLabelSets(lc)
+		for l := range lc {
+			// Keep reading after an error so EmitLabelSets can finish.
+			if err != nil {
+				continue
+			}
+			if l = e.relabel(m, e.withInstanceLabel(target.name, l)); l == nil {
+				continue
+			}
+			target.total.Add(1)
+			msg := mqttMessage{
+				Name:      m.Name,
+				Kind:      strings.ToLower(m.Kind.String()),
+				Labels:    l.Labels,
+				Value:     promValueForDatum(l.Datum),
+				Timestamp: l.Datum.TimeUTC().Unix(),
+			}
+			if !e.omitProgLabel {
+				msg.Program = m.Program
+			}
+			var b []byte
+			if b, err = json.Marshal(msg); err != nil {
+				continue
+			}
+			if err = c.Publish(topic, target.mqtt.qos, b); err == nil {
+				target.success.Add(1)
+			}
+		}
+		return err
+	})
+	if cerr := c.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Errorf("mqtt publish error: %s", err)
+	}
+	return nil
+}
+
+// mqttConn is a connection to an MQTT broker using protocol version 3.1.1,
+// which can only publish.
+type mqttConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	lastID uint16 // The last packet identifier used.
+}
+
+// MQTT control packet types, in the top four bits of the first byte.
+const (
+	mqttConnect    = 1 << 4
+	mqttConnack    = 2 << 4
+	mqttPublish    = 3 << 4
+	mqttPuback     = 4 << 4
+	mqttDisconnect = 14 << 4
+)
+
+// connect sends the CONNECT packet with a clean session, and waits for the
+// broker to accept it.
+func (c *mqttConn) connect(clientID string) error {
+	var body []byte
+	body = appendMQTTString(body, "MQTT")
+	body = append(body, 4)     // protocol level 3.1.1
+	body = append(body, 0x02)  // clean session
+	body = append(body, 0, 60) // keep alive seconds
+	body = appendMQTTString(body, clientID)
+	if err := c.write(mqttConnect, body); err != nil {
+		return err
+	}
+	typ, b, err := c.read()
+	if err != nil {
+		return err
+	}
+	if typ != mqttConnack || len(b) != 2 {
+		return errors.Errorf("expecting CONNACK from broker, got packet type %d", typ>>4)
+	}
+	if b[1] != 0 {
+		return errors.Errorf("broker refused connection with return code %d", b[1])
+	}
+	return nil
+}
+
+// Publish sends payload on topic, and with QoS 1 waits for the broker to
+// acknowledge it.
+func (c *mqttConn) Publish(topic string, qos byte, payload []byte) error {
+	if err := c.conn.SetDeadline(time.Now().Add(*writeDeadline)); err != nil {
+		return err
+	}
+	body := appendMQTTString(nil, topic)
+	if qos > 0 {
+		c.lastID++
+		if c.lastID == 0 {
+			c.lastID = 1
+		}
+		body = append(body, byte(c.lastID>>8), byte(c.lastID))
+	}
+	body = append(body, payload...)
+	if err := c.write(mqttPublish|qos<<1, body); err != nil {
+		return err
+	}
+	if qos == 0 {
+		return nil
+	}
+	typ, b, err := c.read()
+	if err != nil {
+		return err
+	}
+	if typ != mqttPuback || len(b) != 2 || binary.BigEndian.Uint16(b) != c.lastID {
+		return errors.Errorf("expecting PUBACK of packet %d from broker, got packet type %d", c.lastID, typ>>4)
+	}
+	return nil
+}
+
+// Close sends the DISCONNECT packet and closes the connection.
+func (c *mqttConn) Close() error {
+	err := c.write(mqttDisconnect, nil)
+	if cerr := c.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// write sends a packet with the first byte typ and the body.
+func (c *mqttConn) write(typ byte, body []byte) error {
+	b := []byte{typ}
+	// The remaining length is encoded seven bits at a time, least
+	// significant first, with the top bit set on all but the last byte.
+	n := len(body)
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		b = append(b, d)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := c.conn.Write(append(b, body...))
+	return err
+}
+
+// read returns the first byte and body of the next packet from the broker.
+func (c *mqttConn) read() (byte, []byte, error) {
+	typ, err := c.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	var n, shift uint
+	for {
+		d, err := c.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= uint(d&0x7f) << shift
+		if d&0x80 == 0 {
+			break
+		}
+		shift += 7
+		if shift > 21 {
+			return 0, nil, errors.New("malformed remaining length from broker")
+		}
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return 0, nil, err
+	}
+	return typ & 0xf0, b, nil
+}
+
+// appendMQTTString appends s to b prefixed with its length.
+func appendMQTTString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
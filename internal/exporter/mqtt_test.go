@@ -0,0 +1,214 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+)
+
+type mqttPublished struct {
+	Topic   string
+	QoS     byte
+	Payload string
+}
+
+// fakeMQTTClient records the messages published.
+type fakeMQTTClient struct {
+	clientID  string
+	published []mqttPublished
+	closed    bool
+}
+
+func (c *fakeMQTTClient) Publish(topic string, qos byte, payload []byte) error {
+	c.published = append(c.published, mqttPublished{topic, qos, string(payload)})
+	return nil
+}
+
+func (c *fakeMQTTClient) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestPublishMQTT(t *testing.T) {
+	client := &fakeMQTTClient{}
+	origDial := dialMQTT
+	defer func() { dialMQTT = origDial }()
+	dialMQTT = func(addr, clientID string, timeout time.Duration) (mqttClient, error) {
+		client.clientID = clientID
+		return client, nil
+	}
+	*mqttBroker = "broker:1883"
+	*mqttPerMetricTopics = true
+	*mqttQoS = 1
+	defer func() {
+		*mqttBroker = ""
+		*mqttPerMetricTopics = false
+		*mqttQoS = 0
+	}()
+
+	store := metrics.NewStore()
+	c := metrics.NewMetric("requests", "prog", metrics.Counter, metrics.Int, "code")
+	testutil.FatalIfErr(t, store.Add(c))
+	d, err := c.GetDatum("200")
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 37, time.Unix(1343124840, 0))
+	g := metrics.NewMetric("temperature", "prog", metrics.Gauge, metrics.Float)
+	testutil.FatalIfErr(t, store.Add(g))
+	d, err = g.GetDatum()
+	testutil.FatalIfErr(t, err)
+	datum.SetFloat(d, 21.5, time.Unix(1343124900, 0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	e, err := New(ctx, &wg, store, Hostname("gunstar"))
+	testutil.FatalIfErr(t, err)
+	e.PushMetrics()
+	cancel()
+	wg.Wait()
+
+	testutil.ExpectNoDiff(t, "mtail-gunstar", client.clientID)
+	expected := []mqttPublished{
+		{"mtail/requests", 1, `{"name":"requests","prog":"prog","kind":"counter","labels":{"code":"200"},"value":37,"timestamp":1343124840}`},
+		{"mtail/temperature", 1, `{"name":"temperature","prog":"prog","kind":"gauge","value":21.5,"timestamp":1343124900}`},
+	}
+	testutil.ExpectNoDiff(t, expected, client.published, testutil.SortSlices(func(a, b mqttPublished) bool { return a.Topic < b.Topic }))
+	if !client.closed {
+		t.Error("expecting the client to be closed after publishing")
+	}
+}
+
+func TestPublishMQTTFilteredCounts(t *testing.T) {
+	client := &fakeMQTTClient{}
+	origDial := dialMQTT
+	defer func() { dialMQTT = origDial }()
+	dialMQTT = func(addr, clientID string, timeout time.Duration) (mqttClient, error) {
+		return client, nil
+	}
+	*mqttBroker = "broker:1883"
+	*mqttMetricsDeny = "temp*"
+	defer func() {
+		*mqttBroker = ""
+		*mqttMetricsDeny = ""
+	}()
+
+	store := metrics.NewStore()
+	c := metrics.NewMetric("requests", "prog", metrics.Counter, metrics.Int, "code")
+	testutil.FatalIfErr(t, store.Add(c))
+	for _, code := range []string{"200", "404", "500"} {
+		d, err := c.GetDatum(code)
+		testutil.FatalIfErr(t, err)
+		datum.SetInt(d, 1, time.Unix(1343124840, 0))
+	}
+	g := metrics.NewMetric("temperature", "prog", metrics.Gauge, metrics.Float)
+	testutil.FatalIfErr(t, store.Add(g))
+	d, err := g.GetDatum()
+	testutil.FatalIfErr(t, err)
+	datum.SetFloat(d, 21.5, time.Unix(1343124900, 0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	e, err := New(ctx, &wg, store, Hostname("gunstar"))
+	testutil.FatalIfErr(t, err)
+	total, success := mqttExportTotal.Value(), mqttExportSuccess.Value()
+	e.PushMetrics()
+	cancel()
+	wg.Wait()
+
+	// Only the label sets of requests are published, each counted once.
+	testutil.ExpectNoDiff(t, 3, len(client.published))
+	testutil.ExpectNoDiff(t, int64(3), mqttExportTotal.Value()-total)
+	testutil.ExpectNoDiff(t, int64(3), mqttExportSuccess.Value()-success)
+}
+
+func TestPublishMQTTBackendInstanceLabel(t *testing.T) {
+	client := &fakeMQTTClient{}
+	origDial := dialMQTT
+	defer func() { dialMQTT = origDial }()
+	dialMQTT = func(addr, clientID string, timeout time.Duration) (mqttClient, error) {
+		return client, nil
+	}
+	*mqttBroker = "broker:1883"
+	defer func() { *mqttBroker = "" }()
+
+	store := metrics.NewStore()
+	c := metrics.NewMetric("requests", "prog", metrics.Counter, metrics.Int)
+	testutil.FatalIfErr(t, store.Add(c))
+	d, err := c.GetDatum()
+	testutil.FatalIfErr(t, err)
+	datum.SetInt(d, 1, time.Unix(1343124840, 0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	e, err := New(ctx, &wg, store, Hostname("gunstar"), InstanceLabel("mtail-1"), BackendInstanceLabel("mqtt", "mqtt-1"))
+	testutil.FatalIfErr(t, err)
+	e.PushMetrics()
+	cancel()
+	wg.Wait()
+
+	expected := []mqttPublished{
+		{"mtail", 0, `{"name":"requests","prog":"prog","kind":"counter","labels":{"instance":"mqtt-1"},"value":1,"timestamp":1343124840}`},
+	}
+	testutil.ExpectNoDiff(t, expected, client.published)
+}
+
+func TestMQTTConn(t *testing.T) {
+	client, broker := net.Pipe()
+	defer client.Close()
+	done := make(chan []byte)
+	go func() {
+		defer broker.Close()
+		r := bufio.NewReader(broker)
+		c := &mqttConn{conn: broker, r: r}
+		var got []byte
+		// CONNECT, then CONNACK accepting it.
+		typ, b, err := c.read()
+		if err != nil {
+			t.Error(err)
+			close(done)
+			return
+		}
+		got = append(append(got, typ), b...)
+		if _, err := broker.Write([]byte{mqttConnack, 2, 0, 0}); err != nil {
+			t.Error(err)
+		}
+		// PUBLISH with QoS 1, then PUBACK of its packet identifier.
+		typ, b, err = c.read()
+		if err != nil {
+			t.Error(err)
+			close(done)
+			return
+		}
+		got = append(append(got, typ), b...)
+		if _, err := broker.Write([]byte{mqttPuback, 2, b[len(b)-4], b[len(b)-3]}); err != nil {
+			t.Error(err)
+		}
+		// DISCONNECT.
+		typ, _, err = c.read()
+		if err != nil {
+			t.Error(err)
+		}
+		done <- append(got, typ)
+	}()
+
+	c := &mqttConn{conn: client, r: bufio.NewReader(client)}
+	testutil.FatalIfErr(t, c.connect("id"))
+	testutil.FatalIfErr(t, c.Publish("t", 1, []byte("{}")))
+	testutil.FatalIfErr(t, c.Close())
+
+	expected := []byte{
+		mqttConnect, 0, 4, 'M', 'Q', 'T', 'T', 4, 0x02, 0, 60, 0, 2, 'i', 'd',
+		mqttPublish, 0, 1, 't', 0, 1, '{', '}',
+		mqttDisconnect,
+	}
+	testutil.ExpectNoDiff(t, expected, <-done)
+}
@@ -6,13 +6,17 @@ package exporter
 import (
 	"expvar"
 	"fmt"
+	"math"
 	"strings"
 
 	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/metrics/datum"
 
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 var (
@@ -23,6 +27,15 @@ func noHyphens(s string) string {
 	return strings.Replace(s, "-", "_", -1)
 }
 
+// promName returns the Prometheus name of a metric of kind k named name.
+func (e *Exporter) promName(name string, k metrics.Kind) string {
+	name = noHyphens(name)
+	if e.counterSuffix && k == metrics.Counter && !strings.HasSuffix(name, "_total") {
+		name += "_total"
+	}
+	return name
+}
+
 // Describe implements the prometheus.Collector interface.
 func (e *Exporter) Describe(c chan<- *prometheus.Desc) {
 	prometheus.DescribeByCollect(e, c)
@@ -30,6 +43,7 @@ func (e *Exporter) Describe(c chan<- *prometheus.Desc) {
 
 // Collect implements the prometheus.Collector interface.
 func (e *Exporter) Collect(c chan<- prometheus.Metric) {
+	e.updateRatios()
 	lastMetric := ""
 	lastSource := ""
 
@@ -42,9 +56,36 @@ func (e *Exporter) Collect(c chan<- prometheus.Metric) {
 		}
 		metricExportTotal.Add(1)
 
+		var rollups []*rollup
+		if m.Kind != metrics.Histogram {
+			rollups = e.rollups[m.Name]
+		}
+		sums := make([]rollupSums, len(rollups))
+		for i := range sums {
+			sums[i] = make(rollupSums)
+		}
+
 		lsc := make(chan *metrics.LabelSet)
 		go m.EmitLabelSets(lsc)
-		for ls := range lsc {
+		var lss []*metrics.LabelSet
+		if e.canCollapse() {
+			// Prometheus refuses a scrape with the same series twice, so
+			// sum the label sets that relabelling made the same.
+			c := newCollapsedLabelSets()
+			for ls := range lsc {
+				if ls = e.relabel(m, e.withInstanceLabel("prometheus", ls)); ls != nil {
+					c.add(ls)
+				}
+			}
+			lss = c.lss
+		} else {
+			for ls := range lsc {
+				if ls = e.relabel(m, e.withInstanceLabel("prometheus", ls)); ls != nil {
+					lss = append(lss, ls)
+				}
+			}
+		}
+		for _, ls := range lss {
 			if lastMetric != m.Name {
 				lastSource = m.Source
 				lastMetric = m.Name
@@ -61,9 +102,19 @@ func (e *Exporter) Collect(c chan<- prometheus.Metric) {
 			}
 			var pM prometheus.Metric
 			var err error
-			if m.Kind == metrics.Histogram {
+			if m.Kind == metrics.Histogram && bucketless(ls.Datum) {
+				// Without buckets only the sum and count are kept, which
+				// is a summary without quantiles.
+				pM, err = prometheus.NewConstSummary(
+					prometheus.NewDesc(e.promName(m.Name, m.Kind),
+						fmt.Sprintf("defined at %s", lastSource), keys, nil),
+					datum.GetBucketsCount(ls.Datum),
+					datum.GetBucketsSum(ls.Datum),
+					nil,
+					vals...)
+			} else if m.Kind == metrics.Histogram {
 				pM, err = prometheus.NewConstHistogram(
-					prometheus.NewDesc(noHyphens(m.Name),
+					prometheus.NewDesc(e.promName(m.Name, m.Kind),
 						fmt.Sprintf("defined at %s", lastSource), keys, nil),
 					datum.GetBucketsCount(ls.Datum),
 					datum.GetBucketsSum(ls.Datum),
@@ -71,11 +122,14 @@ func (e *Exporter) Collect(c chan<- prometheus.Metric) {
 					vals...)
 			} else {
 				pM, err = prometheus.NewConstMetric(
-					prometheus.NewDesc(noHyphens(m.Name),
+					prometheus.NewDesc(e.promName(m.Name, m.Kind),
 						fmt.Sprintf("defined at %s", lastSource), keys, nil),
 					promTypeForKind(m.Kind),
 					promValueForDatum(ls.Datum),
 					vals...)
+				if err == nil && m.Kind == metrics.Counter {
+					pM, err = withExemplar(pM, datum.GetExemplar(ls.Datum))
+				}
 			}
 			if err != nil {
 				glog.Warning(err)
@@ -91,12 +145,117 @@ func (e *Exporter) Collect(c chan<- prometheus.Metric) {
 			} else {
 				c <- pM
 			}
+			if e.emitObsCount && m.Kind == metrics.Gauge {
+				cM, err := prometheus.NewConstMetric(
+					prometheus.NewDesc(noHyphens(m.Name)+"_count",
+						fmt.Sprintf("observations of %s defined at %s", m.Name, lastSource), keys, nil),
+					prometheus.CounterValue,
+					float64(datum.GetObservations(ls.Datum)),
+					vals...)
+				if err != nil {
+					glog.Warning(err)
+				} else {
+					c <- cM
+				}
+			}
+			if e.emitLastSeen {
+				lM, err := prometheus.NewConstMetric(
+					prometheus.NewDesc(noHyphens(m.Name)+"_last_seen_seconds",
+						fmt.Sprintf("last update time of %s defined at %s", m.Name, lastSource), keys, nil),
+					prometheus.GaugeValue,
+					float64(ls.Datum.TimeUTC().UnixNano())/1e9,
+					vals...)
+				if err != nil {
+					glog.Warning(err)
+				} else {
+					c <- lM
+				}
+			}
+			for i, r := range rollups {
+				r.add(sums[i], ls)
+			}
+		}
+		if e.emitLabelSetCount {
+			keys := []string{"metric"}
+			vals := []string{m.Name}
+			if !e.omitProgLabel {
+				keys = append(keys, "prog")
+				vals = append(vals, m.Program)
+			}
+			cM, err := prometheus.NewConstMetric(
+				prometheus.NewDesc("metric_labelset_count",
+					"number of label sets of each metric", keys, nil),
+				prometheus.GaugeValue,
+				float64(len(m.LabelValues)),
+				vals...)
+			if err != nil {
+				glog.Warning(err)
+			} else {
+				c <- cM
+			}
+		}
+		for i, r := range rollups {
+			for _, s := range sums[i] {
+				var keys []string
+				var vals []string
+				if !e.omitProgLabel {
+					keys = append(keys, "prog")
+					vals = append(vals, m.Program)
+				}
+				for k, v := range s.labels {
+					keys = append(keys, k)
+					vals = append(vals, v)
+				}
+				rM, err := prometheus.NewConstMetric(
+					prometheus.NewDesc(e.promName(r.name, m.Kind),
+						fmt.Sprintf("rollup of %s defined at %s", m.Name, lastSource), keys, nil),
+					promTypeForKind(m.Kind),
+					s.value,
+					vals...)
+				if err != nil {
+					glog.Warning(err)
+					continue
+				}
+				c <- rM
+			}
 		}
 		m.RUnlock()
 		return nil
 	})
 }
 
+// exemplarMetric is a counter with an exemplar.
+type exemplarMetric struct {
+	prometheus.Metric
+	exemplar *dto.Exemplar
+}
+
+// Write implements the prometheus.Metric interface.
+func (m *exemplarMetric) Write(pb *dto.Metric) error {
+	if err := m.Metric.Write(pb); err != nil {
+		return err
+	}
+	pb.Counter.Exemplar = m.exemplar
+	return nil
+}
+
+// withExemplar returns the counter pM with the exemplar e, which may be nil.
+// The exemplar is only exported in the OpenMetrics format.
+func withExemplar(pM prometheus.Metric, e *datum.Exemplar) (prometheus.Metric, error) {
+	if e == nil {
+		return pM, nil
+	}
+	ts, err := ptypes.TimestampProto(e.Time)
+	if err != nil {
+		return nil, err
+	}
+	return &exemplarMetric{pM, &dto.Exemplar{
+		Label:     []*dto.LabelPair{{Name: proto.String("trace_id"), Value: proto.String(e.TraceID)}},
+		Value:     proto.Float64(e.Value),
+		Timestamp: ts,
+	}}, nil
+}
+
 func promTypeForKind(k metrics.Kind) prometheus.ValueType {
 	switch k {
 	case metrics.Counter:
@@ -118,3 +277,16 @@ func promValueForDatum(d datum.Datum) float64 {
 	}
 	return 0.
 }
+
+// bucketless reports whether the histogram datum d keeps only a sum and count,
+// having at most the implicit +Inf bucket.
+func bucketless(d datum.Datum) bool {
+	b := datum.GetBuckets(d).GetBuckets()
+	if len(b) > 1 {
+		return false
+	}
+	for r := range b {
+		return r.Min == 0 && math.IsInf(r.Max, +1)
+	}
+	return true
+}
@@ -14,21 +14,26 @@ import (
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/metrics/datum"
 	"github.com/google/mtail/internal/testutil"
+	"github.com/prometheus/client_golang/prometheus"
 	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/expfmt"
 )
 
 var handlePrometheusTests = []struct {
 	name      string
 	progLabel bool
+	obsCount  bool
 	metrics   []*metrics.Metric
 	expected  string
 }{
 	{"empty",
+		false,
 		false,
 		[]*metrics.Metric{},
 		"",
 	},
 	{"single",
+		false,
 		false,
 		[]*metrics.Metric{
 			{
@@ -44,6 +49,7 @@ foo{} 1
 	},
 	{"with prog label",
 		true,
+		false,
 		[]*metrics.Metric{
 			{
 				Name:        "foo",
@@ -57,6 +63,7 @@ foo{prog="test"} 1
 `,
 	},
 	{"dimensioned",
+		false,
 		false,
 		[]*metrics.Metric{
 			{
@@ -73,6 +80,7 @@ foo{a="1",b="2"} 1
 `,
 	},
 	{"gauge",
+		false,
 		false,
 		[]*metrics.Metric{
 			{
@@ -87,6 +95,7 @@ foo{} 1
 `,
 	},
 	{"timer",
+		false,
 		false,
 		[]*metrics.Metric{
 			{
@@ -101,6 +110,7 @@ foo{} 1
 `,
 	},
 	{"text",
+		false,
 		false,
 		[]*metrics.Metric{
 			{
@@ -112,6 +122,7 @@ foo{} 1
 		"",
 	},
 	{"quotes",
+		false,
 		false,
 		[]*metrics.Metric{
 			{
@@ -128,6 +139,7 @@ foo{a="str\"bang\"blah"} 1
 `,
 	},
 	{"help",
+		false,
 		false,
 		[]*metrics.Metric{
 			{
@@ -145,6 +157,7 @@ foo{} 1
 	},
 	{"2 help with label",
 		true,
+		false,
 		[]*metrics.Metric{
 			{
 				Name:        "foo",
@@ -169,6 +182,7 @@ foo{prog="test1"} 1
 	},
 	{"histo",
 		true,
+		false,
 		[]*metrics.Metric{
 			{
 				Name:        "foo",
@@ -190,6 +204,7 @@ foo_count{a="bar",prog="test"} 0
 	},
 	{"histo-count-eq-inf",
 		true,
+		false,
 		[]*metrics.Metric{
 			{
 				Name:    "foo",
@@ -225,6 +240,465 @@ foo_sum{a="bar",prog="test"} 5
 foo_count{a="bar",prog="test"} 4
 `,
 	},
+	{"histo without buckets",
+		true,
+		false,
+		[]*metrics.Metric{
+			{
+				Name:    "foo",
+				Program: "test",
+				Kind:    metrics.Histogram,
+				Keys:    []string{"a"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"bar"},
+						Value: &datum.Buckets{
+							Count: 3,
+							Sum:   90,
+						},
+					},
+				},
+				Source: "location.mtail:37",
+			},
+		},
+		`# HELP foo defined at location.mtail:37
+# TYPE foo summary
+foo_sum{a="bar",prog="test"} 90
+foo_count{a="bar",prog="test"} 3
+`,
+	},
+	{"gauge with observation count",
+		false,
+		true,
+		[]*metrics.Metric{
+			{
+				Name:        "foo",
+				Program:     "test",
+				Kind:        metrics.Gauge,
+				LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: &datum.Int{BaseDatum: datum.BaseDatum{Observations: 3}, Value: 1}}}},
+		},
+		`# HELP foo defined at 
+# TYPE foo gauge
+foo{} 1
+# HELP foo_count observations of foo defined at 
+# TYPE foo_count counter
+foo_count{} 3
+`,
+	},
+}
+
+func TestHandlePrometheusInstanceLabel(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     []Option
+		expected string
+	}{
+		{"instance label from hostname",
+			[]Option{InstanceLabel("")},
+			`# HELP foo defined at 
+# TYPE foo counter
+foo{instance="gunstar"} 1
+`,
+		},
+		{"instance label override",
+			[]Option{InstanceLabel("mtail-1")},
+			`# HELP foo defined at 
+# TYPE foo counter
+foo{instance="mtail-1"} 1
+`,
+		},
+		{"no instance label",
+			[]Option{},
+			`# HELP foo defined at 
+# TYPE foo counter
+foo{} 1
+`,
+		},
+		{"backend instance label",
+			[]Option{InstanceLabel("mtail-1"), BackendInstanceLabel("prometheus", "prom-1"), BackendInstanceLabel("graphite", "")},
+			`# HELP foo defined at 
+# TYPE foo counter
+foo{instance="prom-1"} 1
+`,
+		},
+		{"backend instance label without instance label",
+			[]Option{BackendInstanceLabel("prometheus", "prom-1")},
+			`# HELP foo defined at 
+# TYPE foo counter
+foo{instance="prom-1"} 1
+`,
+		},
+		{"backend instance label omitted",
+			[]Option{InstanceLabel("mtail-1"), BackendInstanceLabel("prometheus", "")},
+			`# HELP foo defined at 
+# TYPE foo counter
+foo{} 1
+`,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			ctx, cancel := context.WithCancel(context.Background())
+			ms := metrics.NewStore()
+			testutil.FatalIfErr(t, ms.Add(&metrics.Metric{
+				Name:        "foo",
+				Program:     "test",
+				Kind:        metrics.Counter,
+				LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeInt(1, time.Unix(0, 0))}}}))
+			opts := append([]Option{Hostname("gunstar"), OmitProgLabel()}, tc.opts...)
+			e, err := New(ctx, &wg, ms, opts...)
+			testutil.FatalIfErr(t, err)
+			r := strings.NewReader(tc.expected)
+			if err = promtest.CollectAndCompare(e, r); err != nil {
+				t.Error(err)
+			}
+			cancel()
+			wg.Wait()
+		})
+	}
+}
+
+func TestHandlePrometheusRollup(t *testing.T) {
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	ms := metrics.NewStore()
+	testutil.FatalIfErr(t, ms.Add(&metrics.Metric{
+		Name:    "requests",
+		Program: "test",
+		Kind:    metrics.Counter,
+		Keys:    []string{"instance", "handler"},
+		LabelValues: []*metrics.LabelValue{
+			{Labels: []string{"a", "/"}, Value: datum.MakeInt(1, time.Unix(0, 0))},
+			{Labels: []string{"b", "/"}, Value: datum.MakeInt(2, time.Unix(0, 0))},
+			{Labels: []string{"a", "/api"}, Value: datum.MakeInt(4, time.Unix(0, 0))},
+			{Labels: []string{"b", "/api"}, Value: datum.MakeInt(8, time.Unix(0, 0))},
+		},
+		Source: "location.mtail:37",
+	}))
+	e, err := New(ctx, &wg, ms, Hostname("gunstar"), OmitProgLabel(), Rollup("requests", "instance"))
+	testutil.FatalIfErr(t, err)
+	expected := `# HELP requests defined at location.mtail:37
+# TYPE requests counter
+requests{handler="/",instance="a"} 1
+requests{handler="/",instance="b"} 2
+requests{handler="/api",instance="a"} 4
+requests{handler="/api",instance="b"} 8
+# HELP requests_without_instance rollup of requests defined at location.mtail:37
+# TYPE requests_without_instance counter
+requests_without_instance{handler="/"} 3
+requests_without_instance{handler="/api"} 12
+`
+	if err = promtest.CollectAndCompare(e, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+	cancel()
+	wg.Wait()
+}
+
+func TestHandlePrometheusCounterTotalSuffix(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		kind     metrics.Kind
+		expected string
+	}{
+		{"requests",
+			metrics.Counter,
+			`# HELP requests_total defined at 
+# TYPE requests_total counter
+requests_total{} 1
+`,
+		},
+		{"requests_total",
+			metrics.Counter,
+			`# HELP requests_total defined at 
+# TYPE requests_total counter
+requests_total{} 1
+`,
+		},
+		{"queue_depth",
+			metrics.Gauge,
+			`# HELP queue_depth defined at 
+# TYPE queue_depth gauge
+queue_depth{} 1
+`,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			ctx, cancel := context.WithCancel(context.Background())
+			ms := metrics.NewStore()
+			testutil.FatalIfErr(t, ms.Add(&metrics.Metric{
+				Name:        tc.name,
+				Program:     "test",
+				Kind:        tc.kind,
+				LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeInt(1, time.Unix(0, 0))}}}))
+			e, err := New(ctx, &wg, ms, Hostname("gunstar"), OmitProgLabel(), CounterTotalSuffix())
+			testutil.FatalIfErr(t, err)
+			r := strings.NewReader(tc.expected)
+			if err = promtest.CollectAndCompare(e, r); err != nil {
+				t.Error(err)
+			}
+			cancel()
+			wg.Wait()
+		})
+	}
+}
+
+func TestHandlePrometheusLastSeen(t *testing.T) {
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("requests", "test", metrics.Counter, metrics.Int, "endpoint")
+	testutil.FatalIfErr(t, ms.Add(m))
+	e, err := New(ctx, &wg, ms, Hostname("gunstar"), OmitProgLabel(), EmitLastSeen())
+	testutil.FatalIfErr(t, err)
+	inc := func(endpoint string, ts int64) {
+		t.Helper()
+		d, err := m.GetDatum(endpoint)
+		testutil.FatalIfErr(t, err)
+		datum.IncIntBy(d, 1, time.Unix(ts, 0))
+	}
+
+	inc("/a", 100)
+	inc("/b", 100)
+	expected := `# HELP requests defined at 
+# TYPE requests counter
+requests{endpoint="/a"} 1
+requests{endpoint="/b"} 1
+# HELP requests_last_seen_seconds last update time of requests defined at 
+# TYPE requests_last_seen_seconds gauge
+requests_last_seen_seconds{endpoint="/a"} 100
+requests_last_seen_seconds{endpoint="/b"} 100
+`
+	if err = promtest.CollectAndCompare(e, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+
+	// Only /a keeps receiving traffic, so the last seen time of /b freezes.
+	inc("/a", 160)
+	inc("/a", 220)
+	expected = `# HELP requests defined at 
+# TYPE requests counter
+requests{endpoint="/a"} 3
+requests{endpoint="/b"} 1
+# HELP requests_last_seen_seconds last update time of requests defined at 
+# TYPE requests_last_seen_seconds gauge
+requests_last_seen_seconds{endpoint="/a"} 220
+requests_last_seen_seconds{endpoint="/b"} 100
+`
+	if err = promtest.CollectAndCompare(e, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+	cancel()
+	wg.Wait()
+}
+
+func TestHandlePrometheusLabelSetCount(t *testing.T) {
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	ms := metrics.NewStore()
+	requests := metrics.NewMetric("requests", "test", metrics.Counter, metrics.Int, "endpoint")
+	testutil.FatalIfErr(t, ms.Add(requests))
+	failures := metrics.NewMetric("errors", "test", metrics.Counter, metrics.Int, "code")
+	testutil.FatalIfErr(t, ms.Add(failures))
+	e, err := New(ctx, &wg, ms, Hostname("gunstar"), EmitLabelSetCount())
+	testutil.FatalIfErr(t, err)
+
+	for _, endpoint := range []string{"/a", "/b", "/c"} {
+		_, err := requests.GetDatum(endpoint)
+		testutil.FatalIfErr(t, err)
+	}
+	_, err = failures.GetDatum("500")
+	testutil.FatalIfErr(t, err)
+	expected := `# HELP metric_labelset_count number of label sets of each metric
+# TYPE metric_labelset_count gauge
+metric_labelset_count{metric="errors",prog="test"} 1
+metric_labelset_count{metric="requests",prog="test"} 3
+`
+	if err = promtest.CollectAndCompare(e, strings.NewReader(expected), "metric_labelset_count"); err != nil {
+		t.Error(err)
+	}
+
+	testutil.FatalIfErr(t, requests.RemoveDatum("/b"))
+	testutil.FatalIfErr(t, failures.RemoveDatum("500"))
+	expected = `# HELP metric_labelset_count number of label sets of each metric
+# TYPE metric_labelset_count gauge
+metric_labelset_count{metric="errors",prog="test"} 0
+metric_labelset_count{metric="requests",prog="test"} 2
+`
+	if err = promtest.CollectAndCompare(e, strings.NewReader(expected), "metric_labelset_count"); err != nil {
+		t.Error(err)
+	}
+	cancel()
+	wg.Wait()
+}
+
+func TestHandlePrometheusRelabel(t *testing.T) {
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("requests", "test", metrics.Counter, metrics.Int, "env", "endpoint")
+	testutil.FatalIfErr(t, ms.Add(m))
+	e, err := New(ctx, &wg, ms, Hostname("gunstar"), OmitProgLabel(), Relabel(
+		RelabelRule{Labels: map[string]string{"env": "dev"}, Action: RelabelDrop},
+		RelabelRule{Metric: "req*", Labels: map[string]string{"endpoint": "/user/.*"}, Action: RelabelReplace, TargetLabel: "endpoint", Replacement: "/user/:id"},
+	))
+	testutil.FatalIfErr(t, err)
+	for _, labels := range [][]string{
+		{"prod", "/"},
+		{"prod", "/user/1"},
+		{"dev", "/"},
+		{"dev", "/user/2"},
+	} {
+		d, err := m.GetDatum(labels...)
+		testutil.FatalIfErr(t, err)
+		datum.SetInt(d, 1, time.Unix(0, 0))
+	}
+	expected := `# HELP requests defined at 
+# TYPE requests counter
+requests{endpoint="/",env="prod"} 1
+requests{endpoint="/user/:id",env="prod"} 1
+`
+	if err = promtest.CollectAndCompare(e, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+	// The store keeps the original labels.
+	if lv := m.FindLabelValueOrNil([]string{"prod", "/user/1"}); lv == nil {
+		t.Error("expected label set prod /user/1 to be unchanged in the store")
+	}
+	cancel()
+	wg.Wait()
+}
+
+func TestHandlePrometheusRelabelCollapsed(t *testing.T) {
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("requests", "test", metrics.Counter, metrics.Int, "endpoint")
+	testutil.FatalIfErr(t, ms.Add(m))
+	h := metrics.NewMetric("latency", "test", metrics.Histogram, metrics.Buckets, "endpoint")
+	h.Buckets = []datum.Range{{Min: 0, Max: 1}, {Min: 1, Max: math.Inf(+1)}}
+	testutil.FatalIfErr(t, ms.Add(h))
+	e, err := New(ctx, &wg, ms, Hostname("gunstar"), OmitProgLabel(), Relabel(
+		RelabelRule{Labels: map[string]string{"endpoint": "/user/.*"}, Action: RelabelReplace, TargetLabel: "endpoint", Replacement: "/user/:id"},
+	))
+	testutil.FatalIfErr(t, err)
+	for i, endpoint := range []string{"/user/1", "/user/2", "/"} {
+		d, err := m.GetDatum(endpoint)
+		testutil.FatalIfErr(t, err)
+		datum.SetInt(d, int64(i+1), time.Unix(0, 0))
+		d, err = h.GetDatum(endpoint)
+		testutil.FatalIfErr(t, err)
+		datum.Observe(d, float64(i)+0.5, time.Unix(0, 0))
+	}
+	// Both /user/ series become one, summing their values.
+	expected := `# HELP latency defined at 
+# TYPE latency histogram
+latency_bucket{endpoint="/",le="1"} 0
+latency_bucket{endpoint="/",le="+Inf"} 1
+latency_sum{endpoint="/"} 2.5
+latency_count{endpoint="/"} 1
+latency_bucket{endpoint="/user/:id",le="1"} 1
+latency_bucket{endpoint="/user/:id",le="+Inf"} 2
+latency_sum{endpoint="/user/:id"} 2
+latency_count{endpoint="/user/:id"} 2
+# HELP requests defined at 
+# TYPE requests counter
+requests{endpoint="/"} 3
+requests{endpoint="/user/:id"} 3
+`
+	if err = promtest.CollectAndCompare(e, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+	cancel()
+	wg.Wait()
+}
+
+func TestHandlePrometheusRatio(t *testing.T) {
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	ms := metrics.NewStore()
+	num := metrics.NewMetric("errors", "test", metrics.Counter, metrics.Int)
+	testutil.FatalIfErr(t, ms.Add(num))
+	den := metrics.NewMetric("requests", "test", metrics.Counter, metrics.Int)
+	testutil.FatalIfErr(t, ms.Add(den))
+	g := metrics.NewMetric("error_ratio", "test", metrics.Gauge, metrics.Float)
+	testutil.FatalIfErr(t, ms.Add(g))
+	g.SetRatio(num, den)
+	e, err := New(ctx, &wg, ms, Hostname("gunstar"), OmitProgLabel())
+	testutil.FatalIfErr(t, err)
+	// The ratio is computed at each collection, from the values at the time.
+	for _, v := range []struct {
+		errors, requests int64
+		ratio            string
+	}{{1, 4, "0.25"}, {3, 4, "0.75"}} {
+		d, err := num.GetDatum()
+		testutil.FatalIfErr(t, err)
+		datum.SetInt(d, v.errors, time.Unix(0, 0))
+		d, err = den.GetDatum()
+		testutil.FatalIfErr(t, err)
+		datum.SetInt(d, v.requests, time.Unix(0, 0))
+		expected := `# HELP error_ratio defined at 
+# TYPE error_ratio gauge
+error_ratio ` + v.ratio + `
+`
+		if err = promtest.CollectAndCompare(e, strings.NewReader(expected), "error_ratio"); err != nil {
+			t.Error(err)
+		}
+	}
+	cancel()
+	wg.Wait()
+}
+
+func TestRelabelBadRule(t *testing.T) {
+	for _, r := range []RelabelRule{
+		{Metric: "[", Action: RelabelDrop},
+		{Labels: map[string]string{"env": "("}, Action: RelabelDrop},
+		{Action: RelabelReplace, Replacement: "x"},
+		{Action: RelabelAction(42)},
+	} {
+		var wg sync.WaitGroup
+		ctx, cancel := context.WithCancel(context.Background())
+		if _, err := New(ctx, &wg, metrics.NewStore(), Hostname("gunstar"), Relabel(r)); err == nil {
+			t.Errorf("expected error for rule %+v", r)
+		}
+		cancel()
+		wg.Wait()
+	}
+}
+
+func TestHandlePrometheusExemplar(t *testing.T) {
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	ms := metrics.NewStore()
+	d := datum.MakeInt(0, time.Unix(0, 0))
+	datum.IncIntBy(d, 1, time.Unix(1600000000, 0))
+	datum.SetExemplar(d, &datum.Exemplar{TraceID: "4bf92f3577b34da6", Value: 1, Time: time.Unix(1600000000, 0)})
+	testutil.FatalIfErr(t, ms.Add(&metrics.Metric{
+		Name:        "requests_total",
+		Program:     "test",
+		Kind:        metrics.Counter,
+		LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: d}}}))
+	e, err := New(ctx, &wg, ms, Hostname("gunstar"), OmitProgLabel())
+	testutil.FatalIfErr(t, err)
+	reg := prometheus.NewRegistry()
+	testutil.FatalIfErr(t, reg.Register(e))
+	mfs, err := reg.Gather()
+	testutil.FatalIfErr(t, err)
+	var b strings.Builder
+	enc := expfmt.NewEncoder(&b, expfmt.FmtOpenMetrics)
+	for _, mf := range mfs {
+		testutil.FatalIfErr(t, enc.Encode(mf))
+	}
+	expected := `# HELP requests defined at 
+# TYPE requests counter
+requests_total 1.0 # {trace_id="4bf92f3577b34da6"} 1.0 1.6e+09
+`
+	testutil.ExpectNoDiff(t, expected, b.String())
+	cancel()
+	wg.Wait()
 }
 
 func TestHandlePrometheus(t *testing.T) {
@@ -243,6 +717,9 @@ func TestHandlePrometheus(t *testing.T) {
 			if !tc.progLabel {
 				opts = append(opts, OmitProgLabel())
 			}
+			if tc.obsCount {
+				opts = append(opts, EmitObservationCount())
+			}
 			e, err := New(ctx, &wg, ms, opts...)
 			testutil.FatalIfErr(t, err)
 			r := strings.NewReader(tc.expected)
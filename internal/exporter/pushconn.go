@@ -0,0 +1,127 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"expvar"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+var (
+	// pushBufferDropped counts the pushes to each backend dropped from the
+	// buffer of a persistent connection because it was full.
+	pushBufferDropped = expvar.NewMap("exporter_push_buffer_dropped_total")
+)
+
+// pushConn is a persistent connection to a push target, reconnected when it
+// drops.  Pushes that could not be delivered are buffered, and sent in order
+// once the connection is made again.
+type pushConn struct {
+	mu      sync.Mutex
+	conn    net.Conn // nil when not connected
+	pending [][]byte // Payloads not yet delivered, oldest first.
+	max     int      // The most payloads kept in pending.
+}
+
+func newPushConn(max int) *pushConn {
+	return &pushConn{max: max}
+}
+
+// send delivers payload to the target, after any payloads buffered from
+// earlier pushes, connecting to it first if need be.  If the connection
+// fails, the payloads not delivered are kept for the next send, dropping the
+// oldest if there are too many, and only the part of a payload not yet
+// written is sent again.
+func (pc *pushConn) send(target pushOptions, payload []byte) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.pending = append(pc.pending, payload)
+	if len(pc.pending) > pc.max {
+		dropped := len(pc.pending) - pc.max
+		pushBufferDropped.Add(target.name, int64(dropped))
+		glog.Infof("Dropping %d buffered pushes to %s.", dropped, target.name)
+		pc.pending = pc.pending[dropped:]
+	}
+	if pc.conn != nil && !connAlive(pc.conn) {
+		glog.Infof("Connection to %s dropped, reconnecting.", target.name)
+		pc.closeLocked()
+	}
+	if pc.conn == nil {
+		conn, err := dialPushTarget(target.net, target.addr, *writeDeadline)
+		if err != nil {
+			return errors.Errorf("pusher dial error: %s", err)
+		}
+		pc.conn = conn
+	}
+	if err := pc.conn.SetWriteDeadline(time.Now().Add(*writeDeadline)); err != nil {
+		glog.Infof("Couldn't set deadline on connection: %s", err)
+	}
+	for len(pc.pending) > 0 {
+		if n, err := pc.conn.Write(pc.pending[0]); err != nil {
+			pc.closeLocked()
+			if pc.pending[0] = unwritten(target, pc.pending[0], n); len(pc.pending[0]) == 0 {
+				pc.pending = pc.pending[1:]
+			}
+			return errors.Errorf("pusher write error: %s", err)
+		}
+		pc.pending = pc.pending[1:]
+	}
+	return nil
+}
+
+// unwritten returns what is left to send of payload once n bytes of it have
+// been written to a connection that then failed.  The rest must start a line
+// on the next connection, so the line written in part is sent again.  A
+// compressed payload can't be resumed on another connection, so once any of
+// it has been written the rest is dropped.
+func unwritten(target pushOptions, payload []byte, n int) []byte {
+	if n == 0 {
+		return payload
+	}
+	if target.compression != "" {
+		pushBufferDropped.Add(target.name, 1)
+		glog.Infof("Dropping the rest of a compressed push to %s written in part.", target.name)
+		return nil
+	}
+	return payload[bytes.LastIndexByte(payload[:n], '\n')+1:]
+}
+
+// close closes the connection, if it is connected.
+func (pc *pushConn) close() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.closeLocked()
+}
+
+func (pc *pushConn) closeLocked() {
+	if pc.conn == nil {
+		return
+	}
+	if err := pc.conn.Close(); err != nil {
+		glog.Info(err)
+	}
+	pc.conn = nil
+}
+
+// connAlive returns false if the peer of c, which never sends anything, has
+// closed it.  A write to a closed connection can still succeed once, losing
+// what was written, so this is checked before writing.
+func connAlive(c net.Conn) bool {
+	if err := c.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return false
+	}
+	var b [1]byte
+	_, err := c.Read(b[:])
+	if err == nil {
+		return true
+	}
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
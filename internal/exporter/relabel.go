@@ -0,0 +1,232 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/pkg/errors"
+)
+
+// RelabelAction is what a RelabelRule does to the label sets it matches.
+type RelabelAction int
+
+const (
+	// RelabelDrop stops the matched label sets from being exported.
+	RelabelDrop RelabelAction = iota
+	// RelabelKeep stops the label sets not matched from being exported.
+	RelabelKeep
+	// RelabelReplace sets the label TargetLabel of the matched label sets to
+	// Replacement.
+	RelabelReplace
+)
+
+// UnmarshalText sets the action from its name in a relabel config: one of
+// drop, keep, or replace.
+func (a *RelabelAction) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "drop":
+		*a = RelabelDrop
+	case "keep":
+		*a = RelabelKeep
+	case "replace":
+		*a = RelabelReplace
+	default:
+		return errors.Errorf("unknown relabel action %q", text)
+	}
+	return nil
+}
+
+// RelabelRule selects label sets of metrics by the metric name and their
+// label values, and drops, keeps, or rewrites them when they are exported.
+type RelabelRule struct {
+	Metric      string            `json:"metric"` // Glob pattern of the metric names matched, or all if empty.
+	Labels      map[string]string `json:"labels"` // Regular expressions the whole of each label's value must match.
+	Action      RelabelAction     `json:"action"`
+	TargetLabel string            `json:"target_label"` // The label set by RelabelReplace.
+	Replacement string            `json:"replacement"`  // The value RelabelReplace sets.
+}
+
+// relabelRule is a RelabelRule with its patterns checked and compiled.
+type relabelRule struct {
+	RelabelRule
+	labels map[string]*regexp.Regexp
+}
+
+func newRelabelRule(r RelabelRule) (*relabelRule, error) {
+	if _, err := path.Match(r.Metric, ""); err != nil {
+		return nil, errors.Wrapf(err, "bad metric name pattern %q", r.Metric)
+	}
+	switch r.Action {
+	case RelabelDrop, RelabelKeep:
+	case RelabelReplace:
+		if r.TargetLabel == "" {
+			return nil, errors.New("relabel replace rule needs a target label")
+		}
+	default:
+		return nil, errors.Errorf("unknown relabel action %d", r.Action)
+	}
+	rule := &relabelRule{RelabelRule: r, labels: make(map[string]*regexp.Regexp, len(r.Labels))}
+	for k, v := range r.Labels {
+		re, err := regexp.Compile("^(?:" + v + ")$")
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad pattern for label %q", k)
+		}
+		rule.labels[k] = re
+	}
+	return rule, nil
+}
+
+// matches returns true if the label set ls of metric m is selected by r.  A
+// label missing from ls is matched as the empty string.
+func (r *relabelRule) matches(m *metrics.Metric, ls *metrics.LabelSet) bool {
+	if r.Metric != "" {
+		// The pattern has been checked by newRelabelRule.
+		if ok, _ := path.Match(r.Metric, m.Name); !ok {
+			return false
+		}
+	}
+	for k, re := range r.labels {
+		if !re.MatchString(ls.Labels[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+// relabel returns the label set ls of metric m as rewritten by the relabel
+// rules in order, or nil if it is not to be exported.  ls itself is not
+// modified.
+func (e *Exporter) relabel(m *metrics.Metric, ls *metrics.LabelSet) *metrics.LabelSet {
+	copied := false
+	for _, r := range e.relabelRules {
+		match := r.matches(m, ls)
+		switch r.Action {
+		case RelabelDrop:
+			if match {
+				return nil
+			}
+		case RelabelKeep:
+			if !match {
+				return nil
+			}
+		case RelabelReplace:
+			if !match {
+				continue
+			}
+			if !copied {
+				labels := make(map[string]string, len(ls.Labels)+1)
+				for k, v := range ls.Labels {
+					labels[k] = v
+				}
+				ls = &metrics.LabelSet{Labels: labels, Datum: ls.Datum}
+				copied = true
+			}
+			ls.Labels[r.TargetLabel] = r.Replacement
+		}
+	}
+	return ls
+}
+
+// canCollapse returns true if the relabel rules can rewrite two label sets of
+// a metric to the same labels.
+func (e *Exporter) canCollapse() bool {
+	for _, r := range e.relabelRules {
+		if r.Action == RelabelReplace {
+			return true
+		}
+	}
+	return false
+}
+
+// labelsID returns a string identifying the label names and values in labels.
+func labelsID(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var id strings.Builder
+	for _, k := range keys {
+		id.WriteString(k)
+		id.WriteByte(0)
+		id.WriteString(labels[k])
+		id.WriteByte(0)
+	}
+	return id.String()
+}
+
+// collapsedLabelSets merges the label sets of one metric that were relabelled
+// to the same labels, keeping the order they were first seen in.
+type collapsedLabelSets struct {
+	index map[string]int
+	lss   []*metrics.LabelSet
+}
+
+func newCollapsedLabelSets() *collapsedLabelSets {
+	return &collapsedLabelSets{index: make(map[string]int)}
+}
+
+// add adds ls, or sums its datum into that of the label set already added with
+// the same labels.
+func (c *collapsedLabelSets) add(ls *metrics.LabelSet) {
+	id := labelsID(ls.Labels)
+	i, ok := c.index[id]
+	if !ok {
+		c.index[id] = len(c.lss)
+		c.lss = append(c.lss, ls)
+		return
+	}
+	c.lss[i] = &metrics.LabelSet{Labels: ls.Labels, Datum: sumDatums(c.lss[i].Datum, ls.Datum)}
+}
+
+// sumDatums returns a new datum holding the sum of the datums a and b of the
+// same metric, with the later of their times and exemplars.
+func sumDatums(a, b datum.Datum) datum.Datum {
+	ts := a.TimeUTC()
+	if b.TimeUTC().After(ts) {
+		ts = b.TimeUTC()
+	}
+	var d datum.Datum
+	switch a := a.(type) {
+	case *datum.Int:
+		s := datum.MakeInt(a.Get()+datum.GetInt(b), ts).(*datum.Int)
+		s.Observations = datum.GetObservations(a) + datum.GetObservations(b)
+		d = s
+	case *datum.Float:
+		s := datum.MakeFloat(a.Get()+datum.GetFloat(b), ts).(*datum.Float)
+		s.Observations = datum.GetObservations(a) + datum.GetObservations(b)
+		d = s
+	case *datum.Buckets:
+		s := &datum.Buckets{}
+		counts := make(map[float64]uint64)
+		a.RLock()
+		for _, bc := range a.Buckets {
+			s.AddBucket(bc.Range)
+			counts[bc.Range.Max] += bc.Count
+		}
+		a.RUnlock()
+		for r, n := range datum.GetBuckets(b).GetBuckets() {
+			counts[r.Max] += n
+		}
+		// The buckets of both come from the same metric, so all the bounds are found.
+		_ = s.Merge(counts, a.GetSum()+datum.GetBucketsSum(b), ts)
+		d = s
+	default:
+		return a
+	}
+	ea, eb := datum.GetExemplar(a), datum.GetExemplar(b)
+	if ea == nil || (eb != nil && eb.Time.After(ea.Time)) {
+		ea = eb
+	}
+	if ea != nil {
+		datum.SetExemplar(d, ea)
+	}
+	return d
+}
@@ -0,0 +1,57 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"strings"
+
+	"github.com/google/mtail/internal/metrics"
+)
+
+// rollup describes a lower cardinality series to export alongside a metric,
+// by summing its datums across some of its label keys.
+type rollup struct {
+	metric  string              // Name of the metric to roll up.
+	without map[string]struct{} // Label keys summed across.
+	name    string              // Name of the exported rollup series.
+}
+
+func newRollup(metric string, without []string) *rollup {
+	r := &rollup{
+		metric:  metric,
+		without: make(map[string]struct{}, len(without)),
+		name:    metric + "_without_" + strings.Join(without, "_"),
+	}
+	for _, k := range without {
+		r.without[k] = struct{}{}
+	}
+	return r
+}
+
+// rollupSeries is the running sum of one label set of a rollup.
+type rollupSeries struct {
+	labels map[string]string
+	value  float64
+}
+
+// rollupSums accumulates the series of a rollup, keyed by their labels.
+type rollupSums map[string]*rollupSeries
+
+// add sums the datum of ls into the series with the labels of ls not summed across.
+func (r *rollup) add(sums rollupSums, ls *metrics.LabelSet) {
+	labels := make(map[string]string, len(ls.Labels))
+	for k, v := range ls.Labels {
+		if _, ok := r.without[k]; ok {
+			continue
+		}
+		labels[k] = v
+	}
+	id := labelsID(labels)
+	s, ok := sums[id]
+	if !ok {
+		s = &rollupSeries{labels: labels}
+		sums[id] = s
+	}
+	s.value += promValueForDatum(ls.Datum)
+}
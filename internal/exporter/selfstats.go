@@ -0,0 +1,65 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"expvar"
+	"runtime"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	// openFds, maxFds, and goroutines report on the resource usage of the
+	// mtail process itself, so that file descriptor exhaustion can be
+	// spotted before it causes logs to go unread.
+	openFds    = expvar.NewInt("open_fds")
+	maxFds     = expvar.NewInt("max_fds")
+	goroutines = expvar.NewInt("goroutines")
+)
+
+// defaultSelfStatsInterval is used to refresh the process gauges when the
+// Exporter has no push interval configured.
+const defaultSelfStatsInterval = time.Minute
+
+// updateSelfStats refreshes the process gauges from the runtime and the
+// operating system.
+func updateSelfStats() {
+	goroutines.Set(int64(runtime.NumGoroutine()))
+	if n, err := countOpenFds(); err != nil {
+		glog.V(1).Infof("Couldn't count open file descriptors: %s", err)
+	} else {
+		openFds.Set(n)
+	}
+	if n, err := fdLimit(); err != nil {
+		glog.V(1).Infof("Couldn't read file descriptor limit: %s", err)
+	} else {
+		maxFds.Set(n)
+	}
+}
+
+// StartSelfStats refreshes the process gauges once immediately, and then each
+// push interval until the Exporter's context is cancelled.
+func (e *Exporter) StartSelfStats() {
+	updateSelfStats()
+	interval := e.pushInterval
+	if interval <= 0 {
+		interval = defaultSelfStatsInterval
+	}
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-e.ctx.Done():
+				return
+			case <-ticker.C:
+				updateSelfStats()
+			}
+		}
+	}()
+}
@@ -0,0 +1,35 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// +build !windows
+
+package exporter
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestSelfStats(t *testing.T) {
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := New(ctx, &wg, metrics.NewStore(), Hostname("gunstar"))
+	testutil.FatalIfErr(t, err)
+
+	if openFds.Value() <= 0 {
+		t.Errorf("open_fds not positive: %d", openFds.Value())
+	}
+	if openFds.Value() >= maxFds.Value() {
+		t.Errorf("open_fds %d not below max_fds %d", openFds.Value(), maxFds.Value())
+	}
+	const tolerance = 5
+	if d := goroutines.Value() - int64(runtime.NumGoroutine()); d < -tolerance || d > tolerance {
+		t.Errorf("goroutines %d not within %d of runtime.NumGoroutine() %d", goroutines.Value(), tolerance, runtime.NumGoroutine())
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// +build !windows
+
+package exporter
+
+import (
+	"os"
+	"syscall"
+)
+
+// countOpenFds returns the number of file descriptors held open by this
+// process.
+func countOpenFds() (int64, error) {
+	d, err := os.Open("/dev/fd")
+	if err != nil {
+		return 0, err
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return 0, err
+	}
+	// Don't count the descriptor used to read the directory.
+	return int64(len(names) - 1), nil
+}
+
+// fdLimit returns the soft limit on the number of open file descriptors.
+func fdLimit() (int64, error) {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
+		return 0, err
+	}
+	return int64(rlim.Cur), nil
+}
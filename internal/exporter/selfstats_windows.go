@@ -0,0 +1,16 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import "errors"
+
+var errNoFdStats = errors.New("file descriptor stats are not supported on windows")
+
+func countOpenFds() (int64, error) {
+	return 0, errNoFdStats
+}
+
+func fdLimit() (int64, error) {
+	return 0, errNoFdStats
+}
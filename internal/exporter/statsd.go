@@ -17,6 +17,14 @@ var (
 		"Host:port to statsd server to write metrics to.")
 	statsdPrefix = flag.String("statsd_prefix", "",
 		"Prefix to use for statsd metrics.")
+	statsdPushInterval = flag.Duration("statsd_push_interval", 0,
+		"Interval between metric pushes to statsd, if not that of the other push collectors.")
+	statsdMetricsAllow = flag.String("statsd_metrics_allow", "",
+		"Comma separated glob patterns of the names of the metrics to push to statsd, or all metrics if empty.")
+	statsdMetricsDeny = flag.String("statsd_metrics_deny", "",
+		"Comma separated glob patterns of the names of the metrics not to push to statsd.")
+	statsdEmitTimestamp = flag.Bool("statsd_emit_timestamp", false,
+		"Send the time each counter and gauge was last updated, as a DogStatsD |T timestamp, instead of leaving the statsd server to use the time it is received.")
 
 	statsdExportTotal   = expvar.NewInt("statsd_export_total")
 	statsdExportSuccess = expvar.NewInt("statsd_export_success")
@@ -34,9 +42,14 @@ func metricToStatsd(hostname string, m *metrics.Metric, l *metrics.LabelSet, _ t
 	case metrics.Timer:
 		t = "ms" // StatsD Timer
 	}
-	return fmt.Sprintf("%s%s.%s:%s|%s",
+	s := fmt.Sprintf("%s%s.%s:%s|%s",
 		*statsdPrefix,
 		m.Program,
 		formatLabels(m.Name, l.Labels, ".", ".", "_"),
 		l.Datum.ValueString(), t)
+	// Timestamps are only accepted on counters and gauges.
+	if *statsdEmitTimestamp && (m.Kind == metrics.Counter || m.Kind == metrics.Gauge) {
+		s += "|T" + l.Datum.TimeString()
+	}
+	return s
 }
@@ -22,6 +22,7 @@ const varzFormat = "%s{%s} %s\n"
 // HandleVarz exports the metrics in Varz format via HTTP.
 func (e *Exporter) HandleVarz(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-type", "text/plain")
+	e.updateRatios()
 
 	e.store.Range(func(m *metrics.Metric) error {
 		select {
@@ -31,10 +32,21 @@ func (e *Exporter) HandleVarz(w http.ResponseWriter, r *http.Request) {
 		}
 		m.RLock()
 		exportVarzTotal.Add(1)
+		// The instance is always exported to varz, unless omitted for it.
+		instance := e.hostname
+		if e.emitInstanceLabel {
+			instance = e.instance
+		}
+		if value, ok := e.backendInstances["varz"]; ok {
+			instance = value
+		}
 		lc := make(chan *metrics.LabelSet)
 		go m.EmitLabelSets(lc)
 		for l := range lc {
-			line := metricToVarz(m, l, e.omitProgLabel, e.hostname)
+			if l = e.relabel(m, l); l == nil {
+				continue
+			}
+			line := metricToVarz(m, l, e.omitProgLabel, instance)
 			fmt.Fprint(w, line)
 		}
 		m.RUnlock()
@@ -51,7 +63,9 @@ func metricToVarz(m *metrics.Metric, l *metrics.LabelSet, omitProgLabel bool, ho
 	if !omitProgLabel {
 		s = append(s, fmt.Sprintf("prog=%s", m.Program))
 	}
-	s = append(s, fmt.Sprintf("instance=%s", hostname))
+	if hostname != "" {
+		s = append(s, fmt.Sprintf("instance=%s", hostname))
+	}
 	return fmt.Sprintf(varzFormat,
 		m.Name,
 		strings.Join(s, ","),
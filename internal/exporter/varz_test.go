@@ -92,3 +92,37 @@ func TestHandleVarz(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleVarzInstanceLabel(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     []Option
+		expected string
+	}{
+		{"instance label", []Option{InstanceLabel("mtail-1")}, "foo{prog=test,instance=mtail-1} 1\n"},
+		{"backend instance label", []Option{InstanceLabel("mtail-1"), BackendInstanceLabel("varz", "varz-1")}, "foo{prog=test,instance=varz-1} 1\n"},
+		{"backend instance label omitted", []Option{BackendInstanceLabel("varz", "")}, "foo{prog=test} 1\n"},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			ctx, cancel := context.WithCancel(context.Background())
+			ms := metrics.NewStore()
+			testutil.FatalIfErr(t, ms.Add(&metrics.Metric{
+				Name:        "foo",
+				Program:     "test",
+				Kind:        metrics.Counter,
+				LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeInt(1, time.Unix(1397586900, 0))}},
+			}))
+			e, err := New(ctx, &wg, ms, append([]Option{Hostname("gunstar")}, tc.opts...)...)
+			testutil.FatalIfErr(t, err)
+			response := httptest.NewRecorder()
+			e.HandleVarz(response, &http.Request{})
+			b, err := ioutil.ReadAll(response.Body)
+			testutil.FatalIfErr(t, err)
+			testutil.ExpectNoDiff(t, tc.expected, string(b))
+			cancel()
+			wg.Wait()
+		})
+	}
+}
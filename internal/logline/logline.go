@@ -11,9 +11,16 @@ type LogLine struct {
 
 	Filename string // The log filename that this line was read from
 	Line     string // The text of the log line itself up to the newline.
+
+	SourceHost string // The host that sent this line, for network sources.  Empty for lines read from files.
 }
 
 // New creates a new LogLine object.
 func New(ctx context.Context, filename string, line string) *LogLine {
-	return &LogLine{ctx, filename, line}
+	return &LogLine{Context: ctx, Filename: filename, Line: line}
+}
+
+// NewFromHost creates a new LogLine object for a line received from host.
+func NewFromHost(ctx context.Context, filename string, host string, line string) *LogLine {
+	return &LogLine{Context: ctx, Filename: filename, Line: line, SourceHost: host}
 }
@@ -0,0 +1,194 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+
+	"github.com/google/mtail/internal/metrics/datum"
+)
+
+// checkpointMetric is a Metric as read from a checkpoint.
+type checkpointMetric struct {
+	Name        string
+	Program     string
+	Kind        Kind
+	Type        Type
+	Keys        []string
+	LabelValues []checkpointLabelValue
+}
+
+// checkpointLabelValue is a LabelValue as read from a checkpoint.  The datum
+// is decoded once the type of its metric is known.
+type checkpointLabelValue struct {
+	Labels []string
+	Value  checkpointDatum
+	Expiry time.Duration
+}
+
+// checkpointDatum has the fields of the JSON encodings of all the datum types.
+type checkpointDatum struct {
+	Value        json.RawMessage
+	Time         int64
+	Observations uint64
+	HalfLife     int64
+	Buckets      map[string]uint64
+	Count        uint64
+	Sum          float64
+}
+
+// WriteCheckpoint writes the metrics in the Store as JSON to the file at
+// pathname, replacing it atomically so a crash never leaves a partial
+// checkpoint.
+func (s *Store) WriteCheckpoint(pathname string) error {
+	b, err := s.MarshalJSON()
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal metrics into json")
+	}
+	f, err := ioutil.TempFile(filepath.Dir(pathname), filepath.Base(pathname)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "failed to create checkpoint")
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return errors.Wrap(err, "failed to write checkpoint")
+	}
+	// Flush the new checkpoint to disk before it replaces the old one, or a
+	// crash soon after the rename can leave the name pointing at an empty file.
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return errors.Wrap(err, "failed to sync checkpoint")
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "failed to write checkpoint")
+	}
+	return errors.Wrap(os.Rename(f.Name(), pathname), "failed to replace checkpoint")
+}
+
+// RestoreCheckpoint sets the metrics in the Store to the values in the
+// checkpoint at pathname written by WriteCheckpoint.  Only metrics already in
+// the Store are restored, and only if their kind, type, and keys are
+// unchanged, so the programs must be loaded first.  If ttl is positive, datums
+// last updated longer than ttl ago are not restored.  A missing checkpoint is
+// not an error, as there is none on the first start.
+func (s *Store) RestoreCheckpoint(pathname string, ttl time.Duration) error {
+	b, err := ioutil.ReadFile(pathname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			glog.Infof("No checkpoint at %q to restore", pathname)
+			return nil
+		}
+		return errors.Wrap(err, "failed to read checkpoint")
+	}
+	var cms []checkpointMetric
+	if err := json.Unmarshal(b, &cms); err != nil {
+		return errors.Wrapf(err, "failed to parse checkpoint %q", pathname)
+	}
+	now := time.Now()
+	for _, cm := range cms {
+		m := s.FindMetricOrNil(cm.Name, cm.Program)
+		if m == nil || m.Kind != cm.Kind || m.Type != cm.Type || len(m.Keys) != len(cm.Keys) || (len(m.Keys) > 0 && !reflect.DeepEqual(m.Keys, cm.Keys)) {
+			glog.V(1).Infof("Not restoring metric %s from program %s, as it has changed", cm.Name, cm.Program)
+			continue
+		}
+		for _, clv := range cm.LabelValues {
+			if ttl > 0 && now.Sub(time.Unix(0, clv.Value.Time)) > ttl {
+				continue
+			}
+			d, err := m.GetDatum(clv.Labels...)
+			if err != nil {
+				return err
+			}
+			if err := restoreDatum(d, clv.Value); err != nil {
+				return errors.Wrapf(err, "failed to restore metric %s labels %q", cm.Name, clv.Labels)
+			}
+			if clv.Expiry > 0 {
+				if err := m.ExpireDatum(clv.Expiry, clv.Labels...); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// restoreDatum sets d to the value of the checkpointed datum cd.
+func restoreDatum(d datum.Datum, cd checkpointDatum) error {
+	switch d := d.(type) {
+	case *datum.Int:
+		var v int64
+		if err := json.Unmarshal(cd.Value, &v); err != nil {
+			return err
+		}
+		atomic.StoreInt64(&d.Value, v)
+		atomic.StoreUint64(&d.Observations, cd.Observations)
+		atomic.StoreInt64(&d.Time, cd.Time)
+	case *datum.Float:
+		var v float64
+		if err := json.Unmarshal(cd.Value, &v); err != nil {
+			return err
+		}
+		atomic.StoreUint64(&d.Valuebits, math.Float64bits(v))
+		atomic.StoreUint64(&d.Observations, cd.Observations)
+		atomic.StoreInt64(&d.HalfLife, cd.HalfLife)
+		atomic.StoreInt64(&d.Time, cd.Time)
+	case *datum.String:
+		var v string
+		if err := json.Unmarshal(cd.Value, &v); err != nil {
+			return err
+		}
+		d.Set(v, time.Unix(0, cd.Time))
+	case *datum.Buckets:
+		d.Lock()
+		defer d.Unlock()
+		for i, b := range d.Buckets {
+			d.Buckets[i].Count = cd.Buckets[strconv.FormatFloat(b.Range.Max, 'g', -1, 64)]
+		}
+		d.Count = cd.Count
+		d.Sum = cd.Sum
+		atomic.StoreInt64(&d.Time, cd.Time)
+	default:
+		return errors.Errorf("can't restore datum of type %T", d)
+	}
+	return nil
+}
+
+// StartCheckpointLoop runs a permanent goroutine to write a checkpoint of the
+// Store to pathname every interval.
+func (s *Store) StartCheckpointLoop(ctx context.Context, pathname string, interval time.Duration) {
+	if interval <= 0 {
+		glog.Infof("Metric store checkpoints disabled")
+		return
+	}
+	go func() {
+		glog.Infof("Starting metric store checkpoint loop every %s", interval.String())
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.WriteCheckpoint(pathname); err != nil {
+					glog.Info(err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
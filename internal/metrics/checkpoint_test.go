@@ -0,0 +1,106 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package metrics
+
+import (
+	"math"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/testutil"
+)
+
+// checkpointedMetrics returns the metrics declared by a program, as they are
+// when the program is loaded.
+func checkpointedMetrics() []*Metric {
+	h := NewMetric("latency", "prog", Histogram, Buckets)
+	h.Buckets = []datum.Range{{Min: 0, Max: 1}, {Min: 1, Max: 2}}
+	return []*Metric{
+		NewMetric("requests", "prog", Counter, Int, "code"),
+		NewMetric("queue_length", "prog", Gauge, Float),
+		NewMetric("version", "prog", Text, String),
+		h,
+		// A metric whose keys change when the program is updated isn't restored.
+		NewMetric("errors", "prog", Counter, Int),
+	}
+}
+
+func TestCheckpointRestore(t *testing.T) {
+	pathname := filepath.Join(testutil.TestTempDir(t), "checkpoint.json")
+	now := time.Now().Truncate(time.Second)
+	stale := now.Add(-2 * time.Hour)
+
+	s := NewStore()
+	ms := checkpointedMetrics()
+	for _, m := range ms {
+		testutil.FatalIfErr(t, s.Add(m))
+	}
+	d, _ := ms[0].GetDatum("200")
+	datum.IncIntBy(d, 37, now)
+	d, _ = ms[0].GetDatum("404")
+	datum.IncIntBy(d, 3, stale)
+	d, _ = ms[1].GetDatum()
+	datum.SetFloat(d, 4.5, now)
+	d, _ = ms[2].GetDatum()
+	datum.SetString(d, "v1.2", now)
+	d, _ = ms[3].GetDatum()
+	for _, v := range []float64{0.5, 1.5, 5} {
+		datum.Observe(d, v, now)
+	}
+	d, _ = ms[4].GetDatum()
+	datum.IncIntBy(d, 1, now)
+	testutil.FatalIfErr(t, s.WriteCheckpoint(pathname))
+
+	// Restart, reloading the programs with errors now keyed by code.
+	s = NewStore()
+	ms = checkpointedMetrics()
+	ms[4] = NewMetric("errors", "prog", Counter, Int, "code")
+	for _, m := range ms {
+		testutil.FatalIfErr(t, s.Add(m))
+	}
+	testutil.FatalIfErr(t, s.RestoreCheckpoint(pathname, time.Hour))
+
+	expected := []*Metric{
+		{
+			Name: "requests", Program: "prog", Kind: Counter, Type: Int, Keys: []string{"code"},
+			LabelValues: []*LabelValue{{Labels: []string{"200"}, Value: &datum.Int{BaseDatum: datum.BaseDatum{Time: now.UnixNano()}, Value: 37}}},
+		},
+		{
+			Name: "queue_length", Program: "prog", Kind: Gauge, Type: Float, Keys: []string{},
+			LabelValues: []*LabelValue{{Value: &datum.Float{BaseDatum: datum.BaseDatum{Time: now.UnixNano(), Observations: 1}, Valuebits: math.Float64bits(4.5)}}},
+		},
+		{
+			Name: "version", Program: "prog", Kind: Text, Type: String, Keys: []string{},
+			LabelValues: []*LabelValue{{Value: &datum.String{BaseDatum: datum.BaseDatum{Time: now.UnixNano()}, Value: "v1.2"}}},
+		},
+		{
+			Name: "latency", Program: "prog", Kind: Histogram, Type: Buckets, Keys: []string{},
+			LabelValues: []*LabelValue{{Value: &datum.Buckets{
+				BaseDatum: datum.BaseDatum{Time: now.UnixNano()},
+				Buckets: []datum.BucketCount{
+					{Range: datum.Range{Min: 0, Max: 1}, Count: 1},
+					{Range: datum.Range{Min: 1, Max: 2}, Count: 1},
+					{Range: datum.Range{Min: 2, Max: math.Inf(+1)}, Count: 1},
+				},
+				Count: 3,
+				Sum:   7,
+			}}},
+			Buckets: []datum.Range{{Min: 0, Max: 1}, {Min: 1, Max: 2}},
+		},
+		{
+			Name: "errors", Program: "prog", Kind: Counter, Type: Int, Keys: []string{"code"},
+			LabelValues: []*LabelValue{},
+		},
+	}
+	testutil.ExpectNoDiff(t, expected, ms, testutil.IgnoreUnexported(Metric{}, sync.RWMutex{}, datum.String{}))
+}
+
+func TestRestoreMissingCheckpoint(t *testing.T) {
+	s := NewStore()
+	testutil.FatalIfErr(t, s.Add(NewMetric("requests", "prog", Counter, Int)))
+	testutil.FatalIfErr(t, s.RestoreCheckpoint(filepath.Join(testutil.TestTempDir(t), "missing.json"), 0))
+}
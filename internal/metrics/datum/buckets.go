@@ -56,6 +56,52 @@ func (d *Buckets) Observe(v float64, ts time.Time) {
 	d.stamp(ts)
 }
 
+// Merge adds counts, a map of bucket upper bounds to the number of values
+// observed in each, to the buckets of d, and adds sum to the sum, at time ts.
+// If any bound is not the upper bound of a bucket, d is unchanged.
+func (d *Buckets) Merge(counts map[float64]uint64, sum float64, ts time.Time) error {
+	d.Lock()
+	defer d.Unlock()
+
+	indexes := make(map[float64]int, len(counts))
+	for bound := range counts {
+		i := -1
+		for j, b := range d.Buckets {
+			if b.Range.Max == bound {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			return fmt.Errorf("no bucket with upper bound %g", bound)
+		}
+		indexes[bound] = i
+	}
+	for bound, count := range counts {
+		d.Buckets[indexes[bound]].Count += count
+		d.Count += count
+	}
+	d.Sum += sum
+
+	d.stamp(ts)
+	return nil
+}
+
+// Reset sets the count of each bucket and the sum to zero at time ts.
+func (d *Buckets) Reset(ts time.Time) {
+	d.Lock()
+	defer d.Unlock()
+
+	for i := range d.Buckets {
+		d.Buckets[i].Count = 0
+	}
+
+	d.Count = 0
+	d.Sum = 0
+
+	d.stamp(ts)
+}
+
 func (d *Buckets) GetCount() uint64 {
 	d.RLock()
 	defer d.RUnlock()
@@ -114,4 +160,4 @@ func (r *Range) MarshalJSON() ([]byte, error) {
 	}{fmt.Sprintf("%v", r.Min), fmt.Sprintf("%v", r.Max)}
 
 	return json.Marshal(j)
-}
\ No newline at end of file
+}
@@ -45,3 +45,24 @@ func TestMakeBucket(t *testing.T) {
 		t.Errorf("missing buckets from BucketsByMax: expected %d, got %v", len(r)+1, len(bs))
 	}
 }
+
+func TestBucketsMerge(t *testing.T) {
+	b := datum.MakeBuckets([]datum.Range{{0, 1}, {1, 2}, {2, math.Inf(+1)}}, time.Unix(37, 42)).(*datum.Buckets)
+	ts := time.Unix(37, 31)
+	if err := b.Merge(map[float64]uint64{1: 2, math.Inf(+1): 1}, 7, ts); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Merge(map[float64]uint64{2: 1, 3: 1}, 3, ts); err == nil {
+		t.Error("expected error merging a bound that is not a bucket")
+	}
+	if r := datum.GetBucketsCount(b); r != 3 {
+		t.Errorf("count not 3, got %v", r)
+	}
+	if r := datum.GetBucketsSum(b); r != 7 {
+		t.Errorf("sum not 7, got %v", r)
+	}
+	bs := datum.GetBucketsCumByMax(b)
+	if bs[1] != 2 || bs[2] != 2 || bs[math.Inf(+1)] != 3 {
+		t.Errorf("unexpected cumulative buckets %v", bs)
+	}
+}
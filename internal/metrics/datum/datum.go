@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"math"
 	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -28,9 +29,22 @@ type Datum interface {
 
 // BaseDatum is a struct used to record timestamps across all Datum implementations.
 type BaseDatum struct {
-	Time int64 // nanoseconds since unix epoch
+	Time         int64     // nanoseconds since unix epoch
+	Observations uint64    // number of Set calls that contributed to the value
+	Exemplar     *Exemplar // the last exemplar attached to an update, if any
 }
 
+// Exemplar links an update of a Datum to the trace of the request that caused
+// it.
+type Exemplar struct {
+	TraceID string
+	Value   float64   // The value of the update.
+	Time    time.Time // When the update happened.
+}
+
+// exemplarMu protects the exemplars of all Datums, which are rarely set.
+var exemplarMu sync.RWMutex
+
 var zeroTime time.Time
 
 func (d *BaseDatum) stamp(timestamp time.Time) {
@@ -41,6 +55,11 @@ func (d *BaseDatum) stamp(timestamp time.Time) {
 	}
 }
 
+// observe records that a new value has been set on this Datum.
+func (d *BaseDatum) observe() {
+	atomic.AddUint64(&d.Observations, 1)
+}
+
 // TimeString returns the timestamp of this Datum as a string.
 func (d *BaseDatum) TimeString() string {
 	return fmt.Sprintf("%d", atomic.LoadInt64(&d.Time)/1e9)
@@ -72,16 +91,18 @@ func NewBuckets(buckets []Range) Datum {
 }
 
 // MakeInt creates a new integer datum with the provided value and timestamp.
+// The initial value does not count as an observation.
 func MakeInt(v int64, ts time.Time) Datum {
-	d := &Int{}
-	d.Set(v, ts)
+	d := &Int{Value: v}
+	d.stamp(ts)
 	return d
 }
 
 // MakeFloat creates a new floating-point datum with the provided value and timestamp.
+// The initial value does not count as an observation.
 func MakeFloat(v float64, ts time.Time) Datum {
-	d := &Float{}
-	d.Set(v, ts)
+	d := &Float{Valuebits: math.Float64bits(v)}
+	d.stamp(ts)
 	return d
 }
 
@@ -142,6 +163,48 @@ func GetString(d Datum) string {
 	}
 }
 
+// GetObservations returns the number of times a value has been set on d, or
+// panics if d is not an Int or Float Datum.
+func GetObservations(d Datum) uint64 {
+	switch d := d.(type) {
+	case *Int:
+		return atomic.LoadUint64(&d.Observations)
+	case *Float:
+		return atomic.LoadUint64(&d.Observations)
+	default:
+		panic(fmt.Sprintf("datum %v is not an Int or Float", d))
+	}
+}
+
+// SetExemplar attaches e to the Int or Float Datum d, replacing any earlier
+// exemplar, or panics if d is not an Int or Float Datum.
+func SetExemplar(d Datum, e *Exemplar) {
+	exemplarMu.Lock()
+	defer exemplarMu.Unlock()
+	switch d := d.(type) {
+	case *Int:
+		d.Exemplar = e
+	case *Float:
+		d.Exemplar = e
+	default:
+		panic(fmt.Sprintf("datum %v is not an Int or Float", d))
+	}
+}
+
+// GetExemplar returns the exemplar last attached to d, or nil if there is none
+// or d is not an Int or Float Datum.
+func GetExemplar(d Datum) *Exemplar {
+	exemplarMu.RLock()
+	defer exemplarMu.RUnlock()
+	switch d := d.(type) {
+	case *Int:
+		return d.Exemplar
+	case *Float:
+		return d.Exemplar
+	}
+	return nil
+}
+
 // SetInt sets an integer datum to the provided value and timestamp, or panics if the Datum is not an IntDatum.
 func SetInt(d Datum, v int64, ts time.Time) {
 	switch d := d.(type) {
@@ -196,6 +259,23 @@ func DecIntBy(d Datum, v int64, ts time.Time) {
 	}
 }
 
+// Reset sets a Datum to its zero value at time ts: zero for numbers and
+// buckets, and the empty string for strings.
+func Reset(d Datum, ts time.Time) {
+	switch d := d.(type) {
+	case *Int:
+		d.Set(0, ts)
+	case *Float:
+		d.Set(0, ts)
+	case *String:
+		d.Set("", ts)
+	case *Buckets:
+		d.Reset(ts)
+	default:
+		panic(fmt.Sprintf("datum %v is not resettable", d))
+	}
+}
+
 func GetBuckets(d Datum) *Buckets {
 	switch d := d.(type) {
 	case *Buckets:
@@ -34,6 +34,21 @@ func TestDatumSetAndValue(t *testing.T) {
 	}
 }
 
+func TestDatumObservations(t *testing.T) {
+	d := NewInt()
+	for i := 0; i < 3; i++ {
+		SetInt(d, int64(i), time.Unix(37, 42))
+	}
+	if r := GetObservations(d); r != 3 {
+		t.Errorf("d observations not 3, got %v", r)
+	}
+	b, err := json.Marshal(d)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	testutil.ExpectNoDiff(t, `{"Value":2,"Time":37000000042,"Observations":3}`, string(b))
+}
+
 var datumJSONTests = []struct {
 	datum    Datum
 	expected string
@@ -11,10 +11,12 @@ import (
 	"time"
 )
 
-// Float describes a floating point value at a given timestamp.
+// Float describes a floating point value at a given timestamp.  If HalfLife
+// is set, the value decays exponentially from its timestamp until it is read.
 type Float struct {
 	BaseDatum
 	Valuebits uint64
+	HalfLife  int64 // nanoseconds, or zero if the value doesn't decay
 }
 
 // ValueString returns the value of the Float as a string.
@@ -22,22 +24,52 @@ func (d *Float) ValueString() string {
 	return fmt.Sprintf("%g", d.Get())
 }
 
-// Set sets value of the Float at the timestamp ts.
+// Set sets value of the Float at the timestamp ts, and counts it as an observation.
 func (d *Float) Set(v float64, ts time.Time) {
 	atomic.StoreUint64(&d.Valuebits, math.Float64bits(v))
+	d.observe()
 	d.stamp(ts)
 }
 
-// Get returns the floating-point value.
+// SetDecaying sets value of the Float at the timestamp ts, like Set, and makes
+// it decay from then on with the half life h.
+func (d *Float) SetDecaying(v float64, h time.Duration, ts time.Time) {
+	atomic.StoreInt64(&d.HalfLife, int64(h))
+	d.Set(v, ts)
+}
+
+// Get returns the floating-point value, decayed to the current time if it has
+// a half life.
 func (d *Float) Get() float64 {
-	return math.Float64frombits(atomic.LoadUint64(&d.Valuebits))
+	return d.GetAt(time.Now())
+}
+
+// GetAt returns the floating-point value as of now, decayed for the time since
+// its timestamp if it has a half life.
+func (d *Float) GetAt(now time.Time) float64 {
+	v := math.Float64frombits(atomic.LoadUint64(&d.Valuebits))
+	if h := atomic.LoadInt64(&d.HalfLife); h > 0 {
+		if elapsed := now.Sub(d.TimeUTC()); elapsed > 0 {
+			v *= math.Exp2(-float64(elapsed) / float64(h))
+		}
+	}
+	return v
 }
 
-// MarshalJSON returns a JSON encoding of the Float.
+// MarshalJSON returns a JSON encoding of the Float.  A decaying Float is
+// encoded with its value as of now, and now as its timestamp, so that it
+// decays from there when restored.
 func (d *Float) MarshalJSON() ([]byte, error) {
 	j := struct {
-		Value float64
-		Time  int64
-	}{d.Get(), atomic.LoadInt64(&d.Time)}
+		Value        float64
+		Time         int64
+		Observations uint64 `json:",omitempty"`
+		HalfLife     int64  `json:",omitempty"`
+	}{d.Get(), atomic.LoadInt64(&d.Time), atomic.LoadUint64(&d.Observations), atomic.LoadInt64(&d.HalfLife)}
+	if j.HalfLife > 0 {
+		now := time.Now()
+		j.Value = d.GetAt(now)
+		j.Time = now.UnixNano()
+	}
 	return json.Marshal(j)
 }
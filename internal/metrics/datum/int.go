@@ -16,9 +16,10 @@ type Int struct {
 	Value int64
 }
 
-// Set sets the value of the Int to the value at timestamp.
+// Set sets the value of the Int to the value at timestamp, and counts it as an observation.
 func (d *Int) Set(value int64, timestamp time.Time) {
 	atomic.StoreInt64(&d.Value, value)
+	d.observe()
 	d.stamp(timestamp)
 }
 
@@ -47,8 +48,9 @@ func (d *Int) ValueString() string {
 // MarshalJSON returns a JSON encoding of the Int.
 func (d *Int) MarshalJSON() ([]byte, error) {
 	j := struct {
-		Value int64
-		Time  int64
-	}{d.Get(), atomic.LoadInt64(&d.Time)}
+		Value        int64
+		Time         int64
+		Observations uint64 `json:",omitempty"`
+	}{d.Get(), atomic.LoadInt64(&d.Time), atomic.LoadUint64(&d.Observations)}
 	return json.Marshal(j)
 }
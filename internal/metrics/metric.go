@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"math/rand"
 	"reflect"
+	"strings"
 	"sync"
 	"time"
 
@@ -90,6 +91,13 @@ type Metric struct {
 	LabelValues []*LabelValue `json:",omitempty"`
 	Source      string        `json:",omitempty"`
 	Buckets     []datum.Range `json:",omitempty"`
+
+	ratio *ratioOf // If not nil, this gauge holds the ratio of these metrics.
+}
+
+// ratioOf names the metrics that a gauge is the ratio of.
+type ratioOf struct {
+	num, den *Metric
 }
 
 // NewMetric returns a new empty metric of dimension len(keys).
@@ -243,7 +251,14 @@ func (lv *LabelValue) UnmarshalJSON(b []byte) error {
 	if err != nil {
 		return err
 	}
-	lv.Value = datum.MakeInt(i, time.Unix(t/1e9, t%1e9))
+	d := datum.MakeInt(i, time.Unix(t/1e9, t%1e9)).(*datum.Int)
+	if o, ok := valObj["Observations"]; ok {
+		err = json.Unmarshal(*o, &d.Observations)
+		if err != nil {
+			return err
+		}
+	}
+	lv.Value = d
 	return nil
 }
 
@@ -253,6 +268,86 @@ func (m *Metric) String() string {
 	return fmt.Sprintf("Metric: name=%s program=%s kind=%v type=%s hidden=%v keys=%v labelvalues=%v source=%s buckets=%v", m.Name, m.Program, m.Kind, m.Type, m.Hidden, m.Keys, m.LabelValues, m.Source, m.Buckets)
 }
 
+// SetRatio makes the gauge m hold the ratio of the datums of num to the datums
+// of den with the same labels, as computed by UpdateRatio.
+func (m *Metric) SetRatio(num, den *Metric) {
+	m.RLock()
+	set := m.ratio != nil && m.ratio.num == num && m.ratio.den == den
+	m.RUnlock()
+	if set {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.ratio = &ratioOf{num, den}
+}
+
+// UpdateRatio sets each datum of m, if it was given a ratio by SetRatio, to
+// the datum of the numerator with the same labels divided by that of the
+// denominator, or to zero where the denominator is zero or missing.  It is
+// called when metrics are exported, so that the ratio is current however its
+// metrics were updated, and is computed only as often as it is read.
+func (m *Metric) UpdateRatio() error {
+	m.RLock()
+	r := m.ratio
+	m.RUnlock()
+	if r == nil {
+		return nil
+	}
+	type fraction struct {
+		labels   []string
+		num, den float64
+		ts       time.Time
+	}
+	// Read both metrics before setting the gauge, so that no two locks are
+	// held at once.
+	var fractions []*fraction
+	byLabels := make(map[string]*fraction)
+	r.den.RLock()
+	for _, lv := range r.den.LabelValues {
+		f := &fraction{labels: lv.Labels, den: datumFloat(lv.Value), ts: lv.Value.TimeUTC()}
+		fractions = append(fractions, f)
+		byLabels[strings.Join(lv.Labels, "\x00")] = f
+	}
+	r.den.RUnlock()
+	r.num.RLock()
+	for _, lv := range r.num.LabelValues {
+		f, ok := byLabels[strings.Join(lv.Labels, "\x00")]
+		if !ok {
+			f = &fraction{labels: lv.Labels}
+			fractions = append(fractions, f)
+		}
+		f.num = datumFloat(lv.Value)
+		if ts := lv.Value.TimeUTC(); ts.After(f.ts) {
+			f.ts = ts
+		}
+	}
+	r.num.RUnlock()
+	for _, f := range fractions {
+		d, err := m.GetDatum(f.labels...)
+		if err != nil {
+			return err
+		}
+		var q float64
+		if f.den != 0 {
+			q = f.num / f.den
+		}
+		datum.SetFloat(d, q, f.ts)
+	}
+	return nil
+}
+
+// datumFloat returns the value of the Int or Float datum d as a float.
+func datumFloat(d datum.Datum) float64 {
+	switch d := d.(type) {
+	case *datum.Int:
+		return float64(d.Get())
+	case *datum.Float:
+		return d.Get()
+	}
+	return 0
+}
+
 // SetSource sets the source of a metric, describing where in user programmes it was defined.
 func (m *Metric) SetSource(source string) {
 	m.Lock()
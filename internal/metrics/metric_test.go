@@ -191,17 +191,37 @@ func TestMetricJSONRoundTrip(t *testing.T) {
 			return false
 		}
 
-		return testutil.ExpectNoDiff(t, m, r, testutil.IgnoreUnexported(sync.RWMutex{}))
+		return testutil.ExpectNoDiff(t, m, r, testutil.IgnoreUnexported(Metric{}, sync.RWMutex{}))
 	}
 	if err := quick.Check(f, nil); err != nil {
 		t.Error(err)
 	}
 }
 
+func TestMetricJSONRoundTripObservations(t *testing.T) {
+	m := NewMetric("foo", "prog", Gauge, Int)
+	d, err := m.GetDatum()
+	testutil.FatalIfErr(t, err)
+	for i := 0; i < 3; i++ {
+		datum.SetInt(d, int64(i), time.Unix(37, 42))
+	}
+
+	j, err := json.Marshal(m)
+	testutil.FatalIfErr(t, err)
+	r := newMetric(0)
+	testutil.FatalIfErr(t, json.Unmarshal(j, &r))
+
+	rd, err := r.GetDatum()
+	testutil.FatalIfErr(t, err)
+	if o := datum.GetObservations(rd); o != 3 {
+		t.Errorf("observations not 3 after round trip, got %d", o)
+	}
+}
+
 func TestTimer(t *testing.T) {
 	m := NewMetric("test", "prog", Timer, Int)
 	n := NewMetric("test", "prog", Timer, Int)
-	testutil.ExpectNoDiff(t, m, n, testutil.IgnoreUnexported(sync.RWMutex{}))
+	testutil.ExpectNoDiff(t, m, n, testutil.IgnoreUnexported(Metric{}, sync.RWMutex{}))
 	d, _ := m.GetDatum()
 	datum.IncIntBy(d, 1, time.Now().UTC())
 	lv := m.FindLabelValueOrNil([]string{})
@@ -146,6 +146,14 @@ func (s *Store) Range(f func(*Metric) error) error {
 	return nil
 }
 
+// UpdateRatios sets the gauges in the Store that hold the ratio of two metrics to
+// their current ratio, before the metrics are exported.
+func (s *Store) UpdateRatios() error {
+	return s.Range(func(m *Metric) error {
+		return m.UpdateRatio()
+	})
+}
+
 // Gc iterates through the Store looking for metrics that have been marked
 // for expiry, and removing them if their expiration time has passed.
 func (s *Store) Gc() error {
@@ -0,0 +1,34 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestExcludeLinesPattern(t *testing.T) {
+	testutil.SkipIfShort(t)
+	logDir := testutil.TestTempDir(t)
+
+	m, stopM := mtail.TestStartServer(t, 1, mtail.LogPathPatterns(logDir+"/*"), mtail.ProgramPath("../../examples/linecount.mtail"), mtail.ExcludeLinesPattern(`GET /healthz`))
+	defer stopM()
+
+	logFile := filepath.Join(logDir, "log")
+
+	filteredCheck := m.ExpectMapExpvarDeltaWithDeadline("lines_filtered_total", logFile, 2)
+	lineCountCheck := m.ExpectExpvarDeltaWithDeadline("lines_total", 1)
+
+	f := testutil.TestOpenFile(t, logFile)
+	m.PollWatched(1) // Force sync to EOF
+
+	testutil.WriteString(t, f, "GET /healthz\nGET /index.html\nGET /healthz\n")
+	m.PollWatched(1)
+
+	filteredCheck()
+	lineCountCheck()
+}
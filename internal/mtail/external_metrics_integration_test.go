@@ -0,0 +1,73 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/testutil"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestExternalMetrics(t *testing.T) {
+	testutil.SkipIfShort(t)
+	tmpDir := testutil.TestTempDir(t)
+	logDir := filepath.Join(tmpDir, "logs")
+	testutil.FatalIfErr(t, os.Mkdir(logDir, 0700))
+	sockListenAddr := filepath.Join(tmpDir, "mtail_test.sock")
+
+	requests := metrics.NewMetric("app_requests_total", "app", metrics.Counter, metrics.Int, "handler")
+	_, stopM := mtail.TestStartServer(t, 1, mtail.LogPathPatterns(logDir+"/*"), mtail.ProgramPath("../../examples/linecount.mtail"), mtail.BindUnixSocket(sockListenAddr), mtail.ExternalMetrics(requests))
+	defer stopM()
+
+	// The application updates its metric after the server has started.
+	d, err := requests.GetDatum("checkout")
+	testutil.FatalIfErr(t, err)
+	datum.IncIntBy(d, 3, time.Now())
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sockListenAddr)
+			},
+		},
+	}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get("http://unix/metrics")
+	testutil.FatalIfErr(t, err)
+	var p expfmt.TextParser
+	families, err := p.TextToMetricFamilies(resp.Body)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, resp.Body.Close())
+
+	// The program's own metrics are still exported.
+	if _, ok := families["lines_total"]; !ok {
+		t.Errorf("expecting lines_total in metrics, got %v", families)
+	}
+	family, ok := families["app_requests_total"]
+	if !ok {
+		t.Fatalf("expecting app_requests_total in metrics, got %v", families)
+	}
+	if len(family.Metric) != 1 {
+		t.Fatalf("expecting one app_requests_total series, got %v", family.Metric)
+	}
+	labels := make(map[string]string)
+	for _, l := range family.Metric[0].Label {
+		labels[l.GetName()] = l.GetValue()
+	}
+	testutil.ExpectNoDiff(t, map[string]string{"prog": "app", "handler": "checkout"}, labels)
+	if got := family.Metric[0].GetCounter().GetValue(); got != 3 {
+		t.Errorf("app_requests_total is %g, want 3", got)
+	}
+}
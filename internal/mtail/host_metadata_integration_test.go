@@ -0,0 +1,65 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail_test
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/waker"
+)
+
+// mockMetadata is a MetadataProvider that returns fixed metadata.
+type mockMetadata map[string]string
+
+func (m mockMetadata) Metadata(context.Context) (map[string]string, error) {
+	return m, nil
+}
+
+func TestHostMetadata(t *testing.T) {
+	testutil.SkipIfShort(t)
+	tmpDir := testutil.TestTempDir(t)
+	progFile := filepath.Join(tmpDir, "meta.mtail")
+	testutil.WriteString(t, testutil.TestOpenFile(t, progFile), `counter requests by zone, rack
+/GET/ {
+  requests[getmeta("zone"), getmeta("rack")]++
+}
+`)
+	logFile := filepath.Join(tmpDir, "log")
+	testutil.WriteString(t, testutil.TestOpenFile(t, logFile), "GET /\nGET /about\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waker, _ := waker.NewTest(ctx, 0) // oneshot means we should never need to wake the stream
+	store := metrics.NewStore()
+	m, err := mtail.New(ctx, store, mtail.ProgramPath(progFile), mtail.LogPathPatterns(logFile), mtail.OneShot, mtail.HostMetadata(mockMetadata{"zone": "us-east1-b"}), mtail.LogPatternPollWaker(waker), mtail.LogstreamPollWaker(waker))
+	testutil.FatalIfErr(t, err)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		testutil.FatalIfErr(t, m.Run())
+	}()
+	// Oneshot mode means we can wait for shutdown before cancelling.
+	wg.Wait()
+	cancel()
+
+	r := store.FindMetricOrNil("requests", "meta.mtail")
+	if r == nil {
+		t.Fatal("requests metric not found")
+	}
+	// The unknown rack key is empty.
+	lv := r.FindLabelValueOrNil([]string{"us-east1-b", ""})
+	if lv == nil {
+		t.Fatalf("expecting requests labelled with the mocked zone, got %v", r)
+	}
+	if got := datum.GetInt(lv.Value); got != 2 {
+		t.Errorf("requests in zone us-east1-b = %d, want 2", got)
+	}
+}
@@ -5,7 +5,9 @@ package mtail
 
 import (
 	"html/template"
+	"net"
 	"net/http"
+	"strings"
 
 	"github.com/golang/glog"
 )
@@ -35,7 +37,7 @@ func (m *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		BindAddress string
 		BuildInfo   string
 	}{
-		m.listener.Addr().String(),
+		listenAddresses(m.listeners()),
 		m.buildInfo.String(),
 	}
 	w.Header().Add("Content-type", "text/html")
@@ -61,3 +63,12 @@ func FaviconHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
+
+// listenAddresses describes the addresses the HTTP server listens on.
+func listenAddresses(listeners []net.Listener) string {
+	var addrs []string
+	for _, l := range listeners {
+		addrs = append(addrs, l.Addr().String())
+	}
+	return strings.Join(addrs, " and ")
+}
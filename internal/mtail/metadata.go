@@ -0,0 +1,88 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MetadataProvider fetches metadata about the host mtail runs on, such as its
+// zone, for programs to read with getmeta().  It is called once at startup.
+type MetadataProvider interface {
+	Metadata(ctx context.Context) (map[string]string, error)
+}
+
+// gceMetadataURL is the instance directory of the Google Compute Engine
+// metadata server.
+const gceMetadataURL = "http://metadata.google.internal/computeMetadata/v1/instance/"
+
+// gceMetadataTimeout bounds the time spent fetching from the metadata server,
+// so that mtail still starts when it is unreachable.
+const gceMetadataTimeout = 5 * time.Second
+
+// gceMetadataKeys maps the getmeta() keys to their paths on the metadata
+// server.
+var gceMetadataKeys = map[string]string{
+	"zone":          "zone",
+	"machine_type":  "machine-type",
+	"instance_name": "name",
+	"instance_id":   "id",
+}
+
+// GCEMetadata returns a MetadataProvider that fetches the zone, machine_type,
+// instance_name, and instance_id of a Google Compute Engine instance from its
+// metadata server.
+func GCEMetadata() MetadataProvider {
+	return &gceMetadata{url: gceMetadataURL, client: http.DefaultClient}
+}
+
+type gceMetadata struct {
+	url    string
+	client *http.Client
+}
+
+func (g *gceMetadata) Metadata(ctx context.Context) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, gceMetadataTimeout)
+	defer cancel()
+	md := make(map[string]string, len(gceMetadataKeys))
+	for key, p := range gceMetadataKeys {
+		v, err := g.get(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		// The zone and machine type are given as resource paths, like
+		// projects/123/zones/us-central1-a.
+		md[key] = path.Base(v)
+	}
+	return md, nil
+}
+
+// get returns the value at path p on the metadata server.
+func (g *gceMetadata) get(ctx context.Context, p string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.url+p, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to fetch %s from the metadata server", p)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("failed to fetch %s from the metadata server: %s", p, resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read %s from the metadata server", p)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
@@ -0,0 +1,46 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestGCEMetadata(t *testing.T) {
+	values := map[string]string{
+		"/zone":         "projects/123/zones/us-east1-b",
+		"/machine-type": "projects/123/machineTypes/e2-small",
+		"/name":         "web-1",
+		"/id":           "4567",
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			http.Error(w, "missing Metadata-Flavor", http.StatusForbidden)
+			return
+		}
+		v, ok := values[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(v))
+	}))
+	defer ts.Close()
+
+	g := &gceMetadata{url: ts.URL + "/", client: ts.Client()}
+	md, err := g.Metadata(context.Background())
+	testutil.FatalIfErr(t, err)
+	expected := map[string]string{"zone": "us-east1-b", "machine_type": "e2-small", "instance_name": "web-1", "instance_id": "4567"}
+	testutil.ExpectNoDiff(t, expected, md)
+
+	delete(values, "/id")
+	if _, err := g.Metadata(context.Background()); err == nil {
+		t.Error("expecting error when the metadata server has no instance id")
+	}
+}
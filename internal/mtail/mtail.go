@@ -5,12 +5,16 @@ package mtail
 
 import (
 	"context"
+	"encoding/json"
 	"expvar"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/pprof"
+	"strconv"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/golang/glog"
 	"github.com/google/mtail/internal/exporter"
@@ -19,6 +23,7 @@ import (
 	"github.com/google/mtail/internal/tailer"
 	"github.com/google/mtail/internal/vm"
 	"github.com/google/mtail/internal/waker"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/version"
@@ -39,19 +44,33 @@ type Server struct {
 
 	reg *prometheus.Registry
 
-	listener net.Listener // Configured with bind address.
+	listener     net.Listener // Configured with bind address.
+	unixListener net.Listener // Configured with unix socket path.
 
-	buildInfo          BuildInfo // go build information
-	programPath        string    // path to programs to load
-	logPathPatterns    []string  // list of patterns to watch for log files to tail
-	ignoreRegexPattern string
+	buildInfo              BuildInfo               // go build information
+	programPath            string                  // path to programs to load
+	namespacedProgramPaths []namespacedProgramPath // more paths to programs to load, each with a metric namespace
+	rollups                []rollup                // metrics to also export summed across some of their label keys
+	relabelConfig          string                  // path of a JSON file of relabel rules applied to exported label sets
+	backendInstances       []backendInstanceLabel  // instance label values for single backends, overriding instanceLabel
+	logPathPatterns        []string                // list of patterns to watch for log files to tail
+	ignoreRegexPattern     string
+	logStartOffsets        []logStartOffset // byte offsets to start reading some logs at
+	logEncoding            string           // character encoding of logs without a byte order mark
+	recordDelimiter        string           // character separating records in the logs, possibly escaped
+	excludeLinesPattern    string           // regular expression matching lines to drop before the programs
+	linesFullPolicy        string           // what to do with a line read when its log's queue is full
+	tailzPathPrefix        string           // directory that logs not matching a pattern may be added under
 
 	oneShot      bool // if set, mtail reads log files from the beginning, once, then exits
+	replay       bool // if set, mtail also pushes the metrics once the log files have been read in one-shot mode
 	compileOnly  bool // if set, mtail compiles programs then exits
 	dumpAst      bool // if set, mtail prints the program syntax tree after parse
 	dumpAstTypes bool // if set, mtail prints the program syntax tree after type checking
 	dumpBytecode bool // if set, mtail prints the program bytecode after code generation
 
+	adminEndpoints bool // if set, serve the HTTP endpoints that change which logs are tailed
+
 	overrideLocation     *time.Location // Timezone location to use when parsing timestamps
 	staleLogGcWaker      waker.Waker    // Wake to run stale log gc
 	logPatternPollWaker  waker.Waker    // Wake to poll for log patterns
@@ -61,6 +80,20 @@ type Server struct {
 	omitMetricSource     bool           // if set, do not link the source program to a metric
 	omitProgLabel        bool           // if set, do not put the program name in the metric labels
 	emitMetricTimestamp  bool           // if set, emit the metric's recorded timestamp
+	emitObservationCount bool           // if set, emit the observation count of gauges
+	counterTotalSuffix   bool           // if set, append _total to the Prometheus names of counters lacking it
+	openMetrics          bool           // if set, serve /metrics in the OpenMetrics format to scrapers that accept it
+	emitLastSeen         bool           // if set, emit the last update time of each label set
+	emitLabelSetCount    bool           // if set, emit the number of label sets of each metric
+	emitInstanceLabel    bool           // if set, add an instance label to exported metrics
+	instanceLabel        string         // value of the instance label; defaults to the hostname
+	vmLineQueueSize      int            // if nonzero, drop lines for programs with this many lines queued
+	vmWorkers            int            // if more than one, run this many VMs for each program
+	deadLetterFile       string         // if set, append lines that no program matched to this file
+	deadLetterSample     int            // if nonzero, keep this many of the last lines that no program matched
+	checkpoint           checkpoint     // if the pathname is set, checkpoint the metrics there and restore them on start
+
+	metadataProvider MetadataProvider // if set, fetches the host metadata for getmeta() at startup
 }
 
 // initLoader constructs a new program loader and performs the initial load of program files in the program directory.
@@ -92,6 +125,29 @@ func (m *Server) initLoader() error {
 	if m.overrideLocation != nil {
 		opts = append(opts, vm.OverrideLocation(m.overrideLocation))
 	}
+	if m.vmLineQueueSize > 0 {
+		opts = append(opts, vm.DropLinesWhenFull(m.vmLineQueueSize))
+	}
+	if m.vmWorkers > 1 {
+		opts = append(opts, vm.Workers(m.vmWorkers))
+	}
+	if m.deadLetterFile != "" {
+		opts = append(opts, vm.DeadLetterFile(m.deadLetterFile))
+	}
+	if m.deadLetterSample > 0 {
+		opts = append(opts, vm.DeadLetterSample(m.deadLetterSample))
+	}
+	if m.metadataProvider != nil {
+		md, err := m.metadataProvider.Metadata(m.ctx)
+		if err != nil {
+			glog.Warningf("Couldn't fetch host metadata, so getmeta() returns empty strings: %s", err)
+		} else {
+			opts = append(opts, vm.HostMetadata(md))
+		}
+	}
+	for _, p := range m.namespacedProgramPaths {
+		opts = append(opts, vm.NamespacedProgramPath(p.path, p.namespace))
+	}
 	var err error
 	m.l, err = vm.NewLoader(m.lines, &m.wg, m.programPath, m.store, opts...)
 	if err != nil {
@@ -102,21 +158,54 @@ func (m *Server) initLoader() error {
 
 // initExporter sets up an Exporter for this Server.
 func (m *Server) initExporter() (err error) {
-	if m.oneShot {
+	if m.oneShot && !m.replay {
 		// This is a hack to avoid a race in test, but assume that in oneshot
 		// mode we don't want to export anything.
 		return nil
 	}
 	opts := []exporter.Option{}
+	if m.replay {
+		opts = append(opts, exporter.PushOnlyOnStop())
+	}
 	if m.omitProgLabel {
 		opts = append(opts, exporter.OmitProgLabel())
 	}
 	if m.emitMetricTimestamp {
 		opts = append(opts, exporter.EmitTimestamp())
 	}
+	if m.emitObservationCount {
+		opts = append(opts, exporter.EmitObservationCount())
+	}
+	if m.emitLastSeen {
+		opts = append(opts, exporter.EmitLastSeen())
+	}
+	if m.emitLabelSetCount {
+		opts = append(opts, exporter.EmitLabelSetCount())
+	}
+	// OpenMetrics counters must be named with _total, and the names must not
+	// change with the format a scraper asks for.
+	if m.counterTotalSuffix || m.openMetrics {
+		opts = append(opts, exporter.CounterTotalSuffix())
+	}
+	if m.emitInstanceLabel {
+		opts = append(opts, exporter.InstanceLabel(m.instanceLabel))
+	}
+	for _, b := range m.backendInstances {
+		opts = append(opts, exporter.BackendInstanceLabel(b.backend, b.value))
+	}
 	if m.metricPushInterval > 0 {
 		opts = append(opts, exporter.PushInterval(m.metricPushInterval))
 	}
+	for _, r := range m.rollups {
+		opts = append(opts, exporter.Rollup(r.metric, r.without...))
+	}
+	if m.relabelConfig != "" {
+		rules, err := readRelabelConfig(m.relabelConfig)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, exporter.Relabel(rules...))
+	}
 	m.e, err = exporter.New(m.ctx, &m.wg, m.store, opts...)
 	if err != nil {
 		return err
@@ -131,6 +220,49 @@ func (m *Server) initExporter() (err error) {
 	return nil
 }
 
+// initCheckpoint restores the metrics from the last checkpoint, and starts
+// writing new ones.  The programs must be loaded first, so their metrics are
+// in the store.
+func (m *Server) initCheckpoint() error {
+	if m.checkpoint.pathname == "" || m.compileOnly {
+		return nil
+	}
+	if err := m.store.RestoreCheckpoint(m.checkpoint.pathname, m.checkpoint.ttl); err != nil {
+		return err
+	}
+	m.store.StartCheckpointLoop(m.ctx, m.checkpoint.pathname, m.checkpoint.interval)
+	return nil
+}
+
+// parseRecordDelimiter returns the ASCII byte given by s, which is either that
+// character or a Go escape sequence for it.
+func parseRecordDelimiter(s string) (byte, error) {
+	d := s
+	if len(s) > 1 {
+		var err error
+		if d, err = strconv.Unquote(`"` + s + `"`); err != nil {
+			return 0, errors.Wrapf(err, "can't parse record delimiter %q", s)
+		}
+	}
+	if len(d) != 1 || d[0] >= utf8.RuneSelf {
+		return 0, errors.Errorf("record delimiter %q is not a single ASCII character", s)
+	}
+	return d[0], nil
+}
+
+// readRelabelConfig returns the relabel rules in the JSON file at pathname.
+func readRelabelConfig(pathname string) ([]exporter.RelabelRule, error) {
+	b, err := ioutil.ReadFile(pathname)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read relabel config")
+	}
+	var rules []exporter.RelabelRule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse relabel config %q", pathname)
+	}
+	return rules, nil
+}
+
 // initTailer sets up and starts a Tailer for this Server.
 func (m *Server) initTailer() (err error) {
 	opts := []tailer.Option{
@@ -140,19 +272,58 @@ func (m *Server) initTailer() (err error) {
 		tailer.StaleLogGcWaker(m.staleLogGcWaker),
 		tailer.LogstreamPollWaker(m.logstreamPollWaker),
 	}
+	for _, o := range m.logStartOffsets {
+		opts = append(opts, tailer.StartOffset(o.pathname, o.offset))
+	}
+	if m.logEncoding != "" {
+		opts = append(opts, tailer.LogEncoding(m.logEncoding))
+	}
+	if m.recordDelimiter != "" {
+		d, err := parseRecordDelimiter(m.recordDelimiter)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, tailer.RecordDelimiter(d))
+	}
+	if m.excludeLinesPattern != "" {
+		opts = append(opts, tailer.ExcludePattern(m.excludeLinesPattern))
+	}
+	if m.linesFullPolicy != "" {
+		opts = append(opts, tailer.LinesFullPolicy(m.linesFullPolicy))
+	}
+	if m.adminEndpoints && m.tailzPathPrefix != "" {
+		opts = append(opts, tailer.AddPathPrefix(m.tailzPathPrefix))
+	}
 	if m.oneShot {
 		opts = append(opts, tailer.OneShot)
 	}
+	if m.compileOnly {
+		// No logs are read in compile-only mode, so the tailer finishes at
+		// once rather than waiting for paths to be added.
+		opts = []tailer.Option{tailer.OneShot}
+	}
 	m.t, err = tailer.New(m.ctx, &m.wg, m.lines, opts...)
 	return
 }
 
 // initHttpServer begins the http server.
+// adminHandler returns h if the admin endpoints are enabled, or else a handler
+// refusing all requests.
+func (m *Server) adminHandler(h http.HandlerFunc) http.HandlerFunc {
+	if m.adminEndpoints {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Admin endpoints are disabled; start mtail with --enable_admin_endpoints", http.StatusForbidden)
+	}
+}
+
 func (m *Server) initHttpServer() error {
 	initDone := make(chan struct{})
 	defer close(initDone)
 
-	if m.listener == nil {
+	listeners := m.listeners()
+	if len(listeners) == 0 {
 		glog.Info("no listen address configured, not starting http server")
 		return nil
 	}
@@ -161,8 +332,15 @@ func (m *Server) initHttpServer() error {
 	mux.HandleFunc("/favicon.ico", FaviconHandler)
 	mux.Handle("/", m)
 	mux.Handle("/progz", http.HandlerFunc(m.l.ProgzHandler))
+	mux.HandleFunc("/progz/status", http.HandlerFunc(m.l.ProgramStatusHandler))
+	mux.HandleFunc("/progz/enable", m.adminHandler(m.l.ProgramEnableHandler))
+	mux.HandleFunc("/progz/disable", m.adminHandler(m.l.ProgramDisableHandler))
+	mux.HandleFunc("/tailz/paths", http.HandlerFunc(m.t.TailedPathsHandler))
+	mux.HandleFunc("/tailz/add", m.adminHandler(m.t.AddPathHandler))
+	mux.HandleFunc("/tailz/remove", m.adminHandler(m.t.RemovePathHandler))
 	mux.HandleFunc("/json", http.HandlerFunc(m.e.HandleJSON))
-	mux.Handle("/metrics", promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/json/diff", http.HandlerFunc(m.e.HandleDiff))
+	mux.Handle("/metrics", promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{EnableOpenMetrics: m.openMetrics}))
 	mux.HandleFunc("/varz", http.HandlerFunc(m.e.HandleVarz))
 	mux.Handle("/debug/vars", expvar.Handler())
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
@@ -177,18 +355,22 @@ func (m *Server) initHttpServer() error {
 	}
 
 	var wg sync.WaitGroup
-	errc := make(chan error, 1)
 
-	// This goroutine runs the http server.
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		<-initDone
-		glog.Infof("Listening on %s", m.listener.Addr())
-		if err := srv.Serve(m.listener); err != nil && err != http.ErrServerClosed {
-			errc <- err
-		}
-	}()
+	// These goroutines run the http server on each listener.  Shutdown
+	// closes the listeners, which removes the unix socket.
+	errc := make(chan error, len(listeners))
+	for _, l := range listeners {
+		l := l
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-initDone
+			glog.Infof("Listening on %s", l.Addr())
+			if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+				errc <- err
+			}
+		}()
+	}
 
 	// This goroutine manages http server shutdown.
 	go func() {
@@ -212,6 +394,17 @@ func (m *Server) initHttpServer() error {
 	return nil
 }
 
+// listeners returns the listeners configured for the HTTP server.
+func (m *Server) listeners() []net.Listener {
+	var r []net.Listener
+	for _, l := range []net.Listener{m.listener, m.unixListener} {
+		if l != nil {
+			r = append(r, l)
+		}
+	}
+	return r
+}
+
 // New creates a Server from the supplied Options.  The Server is started by
 // the time New returns, it watches the LogPatterns for files, starts tailing
 // their changes and sends any new lines found to the virtual machines loaded
@@ -236,11 +429,34 @@ func New(ctx context.Context, store *metrics.Store, options ...Option) (*Server,
 		"log_rotations_total": prometheus.NewDesc("log_rotations_total", "number of log rotation events per log file", []string{"logfile"}, nil),
 		"log_truncates_total": prometheus.NewDesc("log_truncates_total", "number of log truncation events log file", []string{"logfile"}, nil),
 		"log_lines_total":     prometheus.NewDesc("log_lines_total", "number of lines read per log file", []string{"logfile"}, nil),
+		// internal/tailer/logstream/decode.go
+		"lines_filtered_total": prometheus.NewDesc("lines_filtered_total", "number of lines dropped by the exclude pattern per log file", []string{"logfile"}, nil),
+		// internal/tailer/logstream/droppolicy.go
+		"log_lines_blocked_total":        prometheus.NewDesc("log_lines_blocked_total", "number of lines that waited for room in the lines queue per log file", []string{"logfile"}, nil),
+		"log_lines_dropped_newest_total": prometheus.NewDesc("log_lines_dropped_newest_total", "number of lines read and dropped because the lines queue was full per log file", []string{"logfile"}, nil),
+		"log_lines_dropped_oldest_total": prometheus.NewDesc("log_lines_dropped_oldest_total", "number of queued lines dropped to make room for a newer line per log file", []string{"logfile"}, nil),
 		// internal/vm/loader.go
 		"lines_total":               prometheus.NewDesc("lines_total", "number of lines received by the program loader", nil, nil),
 		"prog_loads_total":          prometheus.NewDesc("prog_loads_total", "number of program load events by program source filename", []string{"prog"}, nil),
 		"prog_load_errors_total":    prometheus.NewDesc("prog_load_errors_total", "number of errors encountered when loading per program source filename", []string{"prog"}, nil),
 		"prog_runtime_errors_total": prometheus.NewDesc("prog_runtime_errors_total", "number of errors encountered when executing programs per source filename", []string{"prog"}, nil),
+		"vm_lines_dropped_total":    prometheus.NewDesc("vm_lines_dropped_total", "number of lines dropped because the program's queue was full per program source filename", []string{"prog"}, nil),
+		"lines_unmatched_total":     prometheus.NewDesc("lines_unmatched_total", "number of lines that matched no pattern in any program, if dead letters are collected", nil, nil),
+		"vm_lines_queued":           prometheus.NewDesc("vm_lines_queued", "number of lines waiting to be processed per program source filename", []string{"prog"}, nil),
+		// internal/vm/vm.go
+		"timestamp_parse_errors_total": prometheus.NewDesc("timestamp_parse_errors_total", "number of timestamps that strptime could not parse per program source filename", []string{"prog"}, nil),
+		"vm_kv_gauges_dropped_total":   prometheus.NewDesc("vm_kv_gauges_dropped_total", "number of keys not set by kv_gauges because the gauge had too many per program source filename", []string{"prog"}, nil),
+		"bytes_processed_total":        prometheus.NewDesc("bytes_processed_total", "number of bytes of the lines processed per program source filename", []string{"prog"}, nil),
+		"vm_warmup_skipped_total":      prometheus.NewDesc("vm_warmup_skipped_total", "number of lines skipped during the warmup of the program per program source filename", []string{"prog"}, nil),
+		// internal/exporter/export.go
+		"exporter_push_duration_seconds": prometheus.NewDesc("exporter_push_duration_seconds", "time taken by the last push of metrics per backend", []string{"backend"}, nil),
+		"exporter_push_success":          prometheus.NewDesc("exporter_push_success", "1 if the last push of metrics per backend succeeded, 0 if it failed", []string{"backend"}, nil),
+		// internal/exporter/pushconn.go
+		"exporter_push_buffer_dropped_total": prometheus.NewDesc("exporter_push_buffer_dropped_total", "number of pushes dropped from the buffer of a persistent connection because it was full per backend", []string{"backend"}, nil),
+		// internal/exporter/selfstats.go
+		"open_fds":   prometheus.NewDesc("open_fds", "number of file descriptors held open by mtail", nil, nil),
+		"max_fds":    prometheus.NewDesc("max_fds", "limit on the number of file descriptors mtail may open", nil, nil),
+		"goroutines": prometheus.NewDesc("goroutines", "number of goroutines running in mtail", nil, nil),
 	}
 	m.reg.MustRegister(
 		prometheus.NewGoCollector(),
@@ -257,6 +473,9 @@ func New(ctx context.Context, store *metrics.Store, options ...Option) (*Server,
 	if err := m.initLoader(); err != nil {
 		return nil, err
 	}
+	if err := m.initCheckpoint(); err != nil {
+		return nil, err
+	}
 	if err := m.initTailer(); err != nil {
 		return nil, err
 	}
@@ -276,7 +495,11 @@ func (m *Server) SetOption(options ...Option) error {
 	return nil
 }
 
-// Run awaits mtail's shutdown.
+// Run awaits mtail's shutdown.  Shutdown is ordered: once the context is
+// cancelled the Tailer stops tailing new logs and drains its logstreams, the
+// Loader's virtual machines process the remaining lines, and only then does
+// the Exporter push its final snapshot of the metrics, and the final
+// checkpoint be written.
 // TODO(jaq): remove this once the test server is able to trigger polls on the components.
 func (m *Server) Run() error {
 	m.wg.Wait()
@@ -284,5 +507,13 @@ func (m *Server) Run() error {
 		glog.Info("compile-only is set, exiting")
 		return nil
 	}
+	if m.e != nil {
+		m.e.Stop()
+	}
+	if m.checkpoint.pathname != "" {
+		if err := m.store.WriteCheckpoint(m.checkpoint.pathname); err != nil {
+			return err
+		}
+	}
 	return nil
 }
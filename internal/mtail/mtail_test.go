@@ -4,9 +4,12 @@
 package mtail
 
 import (
+	"expvar"
 	"fmt"
 	"runtime"
 	"testing"
+
+	"github.com/google/mtail/internal/testutil"
 )
 
 func TestBuildInfo(t *testing.T) {
@@ -28,3 +31,51 @@ func TestBuildInfo(t *testing.T) {
 		t.Errorf("Unexpected build info string, want: %q, got: %q", buildInfoWant, buildInfoGot)
 	}
 }
+
+func TestExpvarsExported(t *testing.T) {
+	m := TestMakeServer(t, 0, LogPathPatterns(testutil.TestTempDir(t)+"/*"), ProgramPath("../../examples/linecount.mtail"))
+	defer m.cancel()
+
+	// The expvar collector only exports the keys the maps already have.
+	names := []string{
+		"bytes_processed_total",
+		"vm_kv_gauges_dropped_total",
+		"vm_warmup_skipped_total",
+		"exporter_push_buffer_dropped_total",
+		"log_lines_blocked_total",
+		"log_lines_dropped_newest_total",
+		"log_lines_dropped_oldest_total",
+	}
+	for _, name := range names {
+		expvar.Get(name).(*expvar.Map).Add(t.Name(), 1)
+	}
+	families, err := m.reg.Gather()
+	testutil.FatalIfErr(t, err)
+	exported := map[string]bool{}
+	for _, f := range families {
+		exported[f.GetName()] = true
+	}
+	for _, name := range names {
+		if !exported["mtail_"+name] {
+			t.Errorf("expecting mtail_%s in the exported metrics", name)
+		}
+	}
+}
+
+func TestParseRecordDelimiter(t *testing.T) {
+	for s, expected := range map[string]byte{
+		";":    ';',
+		`\x00`: 0,
+		`\t`:   '\t',
+		`"`:    '"',
+	} {
+		d, err := parseRecordDelimiter(s)
+		testutil.FatalIfErr(t, err)
+		testutil.ExpectNoDiff(t, expected, d)
+	}
+	for _, s := range []string{`\xff`, "ab", `\q`, "é"} {
+		if _, err := parseRecordDelimiter(s); err == nil {
+			t.Errorf("expecting an error for record delimiter %q", s)
+		}
+	}
+}
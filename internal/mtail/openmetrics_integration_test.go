@@ -0,0 +1,116 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/testutil"
+)
+
+const openMetricsAccept = "application/openmetrics-text; version=0.0.1,text/plain;version=0.0.4;q=0.5,*/*;q=0.1"
+
+func TestOpenMetrics(t *testing.T) {
+	testutil.SkipIfShort(t)
+	for _, tc := range []struct {
+		name        string
+		options     []mtail.Option
+		contentType string
+		expected    []string // Lines expected in the OpenMetrics scrape.
+		unexpected  []string
+		textName    string // The name of the counter in the text format scrape.
+	}{
+		{
+			name:        "disabled",
+			contentType: "text/plain",
+			expected:    []string{"# TYPE requests counter"},
+			unexpected:  []string{"# EOF", "trace_id"},
+			textName:    "requests{",
+		},
+		{
+			name:        "enabled",
+			options:     []mtail.Option{mtail.EnableOpenMetrics},
+			contentType: "application/openmetrics-text",
+			expected:    []string{"# TYPE requests counter", `requests_total{prog="requests.mtail"} 1.0 # {trace_id="abc123"}`, "# EOF"},
+			textName:    "requests_total{",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tmpDir := testutil.TestTempDir(t)
+			progFile := filepath.Join(tmpDir, "requests.mtail")
+			testutil.WriteString(t, testutil.TestOpenFile(t, progFile), `counter requests
+/trace_id=(?P<trace_id>[0-9a-f]+)/ {
+  exemplar_inc(requests, $trace_id)
+}
+`)
+			logDir := filepath.Join(tmpDir, "logs")
+			testutil.FatalIfErr(t, os.Mkdir(logDir, 0700))
+			sockListenAddr := filepath.Join(tmpDir, "mtail_test.sock")
+
+			opts := append([]mtail.Option{mtail.LogPathPatterns(logDir + "/*"), mtail.ProgramPath(progFile), mtail.BindUnixSocket(sockListenAddr)}, tc.options...)
+			m, stopM := mtail.TestStartServer(t, 1, opts...)
+			defer stopM()
+
+			lineCountCheck := m.ExpectExpvarDeltaWithDeadline("lines_total", 1)
+
+			f := testutil.TestOpenFile(t, filepath.Join(logDir, "log"))
+			m.PollWatched(1) // Force sync to EOF
+
+			testutil.WriteString(t, f, "GET / trace_id=abc123\n")
+			m.PollWatched(1)
+			lineCountCheck()
+
+			client := &http.Client{
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+						var d net.Dialer
+						return d.DialContext(ctx, "unix", sockListenAddr)
+					},
+				},
+			}
+			defer client.CloseIdleConnections()
+			scrape := func(accept string) (string, string) {
+				t.Helper()
+				req, err := http.NewRequest("GET", "http://unix/metrics", nil)
+				testutil.FatalIfErr(t, err)
+				req.Header.Set("Accept", accept)
+				resp, err := client.Do(req)
+				testutil.FatalIfErr(t, err)
+				defer resp.Body.Close()
+				b, err := ioutil.ReadAll(resp.Body)
+				testutil.FatalIfErr(t, err)
+				return resp.Header.Get("Content-Type"), string(b)
+			}
+
+			contentType, body := scrape(openMetricsAccept)
+			if !strings.HasPrefix(contentType, tc.contentType) {
+				t.Errorf("Content-Type %q, expected %s", contentType, tc.contentType)
+			}
+			for _, line := range tc.expected {
+				if !strings.Contains(body, line) {
+					t.Errorf("expected %q in scrape:\n%s", line, body)
+				}
+			}
+			for _, line := range tc.unexpected {
+				if strings.Contains(body, line) {
+					t.Errorf("unexpected %q in scrape:\n%s", line, body)
+				}
+			}
+
+			// The counter has the same name in the Prometheus text format.
+			if _, body := scrape("text/plain"); !strings.Contains(body, tc.textName) {
+				t.Errorf("expected %q in text scrape:\n%s", tc.textName, body)
+			}
+		})
+	}
+}
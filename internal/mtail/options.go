@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"contrib.go.opencensus.io/exporter/jaeger"
+	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/waker"
 	"go.opencensus.io/trace"
 )
@@ -38,6 +39,25 @@ func (opt logPathPatterns) apply(m *Server) error {
 	return nil
 }
 
+// ExternalMetrics adds metrics maintained outside of mtail programs, such as
+// by an application embedding the Server, to its store, so that they are
+// exported alongside the metrics of the programs.  The caller updates their
+// datums directly.  Each metric's Program is exported as its prog label.
+func ExternalMetrics(ms ...*metrics.Metric) Option {
+	return externalMetrics(ms)
+}
+
+type externalMetrics []*metrics.Metric
+
+func (opt externalMetrics) apply(m *Server) error {
+	for _, em := range opt {
+		if err := m.store.Add(em); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // IgnoreRegexPattern sets the regex pattern to ignore files.
 type IgnoreRegexPattern string
 
@@ -46,6 +66,53 @@ func (opt IgnoreRegexPattern) apply(m *Server) error {
 	return nil
 }
 
+// LogEncoding sets the character encoding of the logs, such as utf-16le or
+// latin1, for logs that don't start with a byte order mark.
+type LogEncoding string
+
+func (opt LogEncoding) apply(m *Server) error {
+	m.logEncoding = string(opt)
+	return nil
+}
+
+// RecordDelimiter sets the character that separates records in the logs,
+// instead of newline.  It is a single ASCII character, or a Go escape sequence
+// for one such as \x00 or \t.
+type RecordDelimiter string
+
+func (opt RecordDelimiter) apply(m *Server) error {
+	m.recordDelimiter = string(opt)
+	return nil
+}
+
+// ExcludeLinesPattern sets the regular expression matching lines to drop from
+// all logs before they reach the programs.
+type ExcludeLinesPattern string
+
+func (opt ExcludeLinesPattern) apply(m *Server) error {
+	m.excludeLinesPattern = string(opt)
+	return nil
+}
+
+// TailzPathPrefix sets the directory that logs may be added under with a POST
+// to /tailz/add, as well as those matching the LogPathPatterns.
+type TailzPathPrefix string
+
+func (opt TailzPathPrefix) apply(m *Server) error {
+	m.tailzPathPrefix = string(opt)
+	return nil
+}
+
+// LinesFullPolicy sets what to do with a line read from a log when the
+// programs haven't yet taken the lines queued from that log: block,
+// drop-newest, or drop-oldest.
+type LinesFullPolicy string
+
+func (opt LinesFullPolicy) apply(m *Server) error {
+	m.linesFullPolicy = string(opt)
+	return nil
+}
+
 // BindAddress sets the HTTP server address in Server.
 func BindAddress(address, port string) Option {
 	return &bindAddress{address, port}
@@ -65,15 +132,16 @@ func (opt bindAddress) apply(m *Server) error {
 	return err
 }
 
-// BindUnixSocket sets the UNIX socket path in Server.
+// BindUnixSocket sets the UNIX socket path in Server.  The HTTP server listens
+// on it as well as any address set by BindAddress, and removes it on shutdown.
 type BindUnixSocket string
 
 func (opt BindUnixSocket) apply(m *Server) error {
-	if m.listener != nil {
-		return fmt.Errorf("HTTP server bind address already supplied")
+	if m.unixListener != nil {
+		return fmt.Errorf("HTTP server unix socket already supplied")
 	}
 	var err error
-	m.listener, err = net.Listen("unix", string(opt))
+	m.unixListener, err = net.Listen("unix", string(opt))
 	return err
 }
 
@@ -156,6 +224,18 @@ var OneShot = &niladicOption{
 		return nil
 	}}
 
+// Replay sets replay mode in the Server, for backfilling metrics from old
+// logs.  As in one-shot mode, the logs are read from the start until the end,
+// and then Run returns, but the metrics are pushed once to the push
+// collectors at the end.  The time of each metric is the timestamp last
+// parsed by its program, so the collectors receive the times in the logs.
+var Replay = &niladicOption{
+	func(m *Server) error {
+		m.oneShot = true
+		m.replay = true
+		return nil
+	}}
+
 // CompileOnly sets compile-only mode in the Server.
 var CompileOnly = &niladicOption{
 	func(m *Server) error {
@@ -184,6 +264,16 @@ var DumpBytecode = &niladicOption{
 		return nil
 	}}
 
+// EnableAdminEndpoints sets the Server to serve the HTTP endpoints that change
+// its state, like /tailz/add, /tailz/remove, /progz/enable, and
+// /progz/disable.  Only enable them if untrusted
+// clients can't reach the HTTP server.
+var EnableAdminEndpoints = &niladicOption{
+	func(m *Server) error {
+		m.adminEndpoints = true
+		return nil
+	}}
+
 // SyslogUseCurrentYear instructs the Server to use the current year for year-less log timestamp during parsing.
 var SyslogUseCurrentYear = &niladicOption{
 	func(m *Server) error {
@@ -212,6 +302,72 @@ var EmitMetricTimestamp = &niladicOption{
 		return nil
 	}}
 
+// EmitObservationCount tells the Server to export the number of observations of each gauge.
+var EmitObservationCount = &niladicOption{
+	func(m *Server) error {
+		m.emitObservationCount = true
+		return nil
+	}}
+
+// EmitLastSeen tells the Server to export the time each label set was last updated.
+var EmitLastSeen = &niladicOption{
+	func(m *Server) error {
+		m.emitLastSeen = true
+		return nil
+	}}
+
+// EmitLabelSetCount tells the Server to export the number of label sets of each metric.
+var EmitLabelSetCount = &niladicOption{
+	func(m *Server) error {
+		m.emitLabelSetCount = true
+		return nil
+	}}
+
+// CounterTotalSuffix tells the Server to export counters to Prometheus with
+// names ending in _total.
+var CounterTotalSuffix = &niladicOption{
+	func(m *Server) error {
+		m.counterTotalSuffix = true
+		return nil
+	}}
+
+// EnableOpenMetrics tells the Server to serve /metrics in the OpenMetrics
+// format, with exemplars, to scrapers that ask for it.  Counters are then
+// exported with names ending in _total, as with CounterTotalSuffix.
+var EnableOpenMetrics = &niladicOption{
+	func(m *Server) error {
+		m.openMetrics = true
+		return nil
+	}}
+
+// InstanceLabel tells the Server to add an instance label with the given value
+// to all exported metrics.  An empty value means use the hostname.
+type InstanceLabel string
+
+func (opt InstanceLabel) apply(m *Server) error {
+	m.emitInstanceLabel = true
+	m.instanceLabel = string(opt)
+	return nil
+}
+
+// BackendInstanceLabel tells the Server to add an instance label with the given
+// value to the metrics exported to one backend, instead of the value of
+// InstanceLabel, and even if InstanceLabel isn't given.  An empty value omits
+// the label from that backend.
+func BackendInstanceLabel(backend, value string) Option {
+	return &backendInstanceLabel{backend, value}
+}
+
+type backendInstanceLabel struct {
+	backend string
+	value   string
+}
+
+func (opt backendInstanceLabel) apply(m *Server) error {
+	m.backendInstances = append(m.backendInstances, opt)
+	return nil
+}
+
 // JaegerReporter creates a new jaeger reporter that sends to the given Jaeger endpoint address.
 type JaegerReporter string
 
@@ -229,6 +385,132 @@ func (opt JaegerReporter) apply(m *Server) error {
 	return nil
 }
 
+// DropLinesWhenFull sets the number of lines queued for each program, after
+// which further lines are dropped for that program instead of waiting for it.
+type DropLinesWhenFull int
+
+func (opt DropLinesWhenFull) apply(m *Server) error {
+	m.vmLineQueueSize = int(opt)
+	return nil
+}
+
+// VMWorkers sets the number of virtual machines run for each program, which
+// process its lines concurrently.
+type VMWorkers int
+
+func (opt VMWorkers) apply(m *Server) error {
+	m.vmWorkers = int(opt)
+	return nil
+}
+
+// DeadLetterFile sets a file to append the lines that matched no pattern in
+// any program to.
+type DeadLetterFile string
+
+func (opt DeadLetterFile) apply(m *Server) error {
+	m.deadLetterFile = string(opt)
+	return nil
+}
+
+// DeadLetterSample sets the number of the last lines that matched no pattern
+// in any program to keep in the lines_unmatched_sample expvar.
+type DeadLetterSample int
+
+func (opt DeadLetterSample) apply(m *Server) error {
+	m.deadLetterSample = int(opt)
+	return nil
+}
+
+// HostMetadata instructs the Server to fetch metadata about the host from p
+// at startup, for programs to read with getmeta().  If the fetch fails,
+// getmeta() returns the empty string for every key.
+func HostMetadata(p MetadataProvider) Option {
+	return &hostMetadata{p}
+}
+
+type hostMetadata struct {
+	p MetadataProvider
+}
+
+func (opt hostMetadata) apply(m *Server) error {
+	m.metadataProvider = opt.p
+	return nil
+}
+
+// Checkpoint instructs the Server to write the values of all metrics to the
+// file at pathname every interval and on shutdown, and to restore them from
+// it on start, so counters continue across restarts.  If ttl is positive,
+// datums last updated longer than ttl ago are not restored.
+func Checkpoint(pathname string, interval, ttl time.Duration) Option {
+	return &checkpoint{pathname, interval, ttl}
+}
+
+type checkpoint struct {
+	pathname      string
+	interval, ttl time.Duration
+}
+
+func (opt checkpoint) apply(m *Server) error {
+	m.checkpoint = opt
+	return nil
+}
+
+// NamespacedProgramPath adds a path to find mtail programs in the Server, whose
+// metrics are exported with names prefixed by namespace.
+func NamespacedProgramPath(path, namespace string) Option {
+	return &namespacedProgramPath{path, namespace}
+}
+
+type namespacedProgramPath struct {
+	path, namespace string
+}
+
+func (opt namespacedProgramPath) apply(m *Server) error {
+	m.namespacedProgramPaths = append(m.namespacedProgramPaths, opt)
+	return nil
+}
+
+// LogStartOffset makes the Server start reading the log at pathname from the
+// byte offset when it is first tailed, instead of from its end.
+func LogStartOffset(pathname string, offset int64) Option {
+	return &logStartOffset{pathname, offset}
+}
+
+type logStartOffset struct {
+	pathname string
+	offset   int64
+}
+
+func (opt logStartOffset) apply(m *Server) error {
+	m.logStartOffsets = append(m.logStartOffsets, opt)
+	return nil
+}
+
+// Rollup makes the Server also export the sum of the counter or gauge named
+// metric across the label keys in without, alongside the metric itself.
+func Rollup(metric string, without ...string) Option {
+	return &rollup{metric, without}
+}
+
+type rollup struct {
+	metric  string
+	without []string
+}
+
+func (opt rollup) apply(m *Server) error {
+	m.rollups = append(m.rollups, opt)
+	return nil
+}
+
+// RelabelConfig sets the path of a JSON file holding a list of relabel rules,
+// which the Server applies in order to each label set it exports.
+type RelabelConfig string
+
+func (opt RelabelConfig) apply(m *Server) error {
+	m.relabelConfig = string(opt)
+	return nil
+}
+
 // MetricPushInterval sets the interval between metrics pushes to passive collectors.
 type MetricPushInterval time.Duration
 
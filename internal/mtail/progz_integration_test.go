@@ -0,0 +1,55 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestProgzEnableDisableAdminEndpoints(t *testing.T) {
+	testutil.SkipIfShort(t)
+	for _, tc := range []struct {
+		name    string
+		options []mtail.Option
+		want    int
+	}{
+		{"disabled", nil, http.StatusForbidden},
+		{"enabled", []mtail.Option{mtail.EnableAdminEndpoints}, http.StatusOK},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tmpDir := testutil.TestTempDir(t)
+			sockListenAddr := filepath.Join(tmpDir, "mtail_test.sock")
+			options := append(tc.options, mtail.LogPathPatterns(tmpDir+"/*.log"), mtail.ProgramPath("../../examples/linecount.mtail"), mtail.BindUnixSocket(sockListenAddr))
+			_, stopM := mtail.TestStartServer(t, 1, options...)
+			defer stopM()
+
+			client := &http.Client{
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+						var d net.Dialer
+						return d.DialContext(ctx, "unix", sockListenAddr)
+					},
+				},
+			}
+			defer client.CloseIdleConnections()
+			for _, endpoint := range []string{"/progz/disable", "/progz/enable"} {
+				resp, err := client.PostForm("http://unix"+endpoint, url.Values{"prog": {"linecount.mtail"}})
+				testutil.FatalIfErr(t, err)
+				testutil.FatalIfErr(t, resp.Body.Close())
+				if resp.StatusCode != tc.want {
+					t.Errorf("POST %s: unexpected status %s", endpoint, resp.Status)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestRecordDelimiter(t *testing.T) {
+	testutil.SkipIfShort(t)
+	logDir := testutil.TestTempDir(t)
+
+	m, stopM := mtail.TestStartServer(t, 1, mtail.LogPathPatterns(logDir+"/*"), mtail.ProgramPath("../../examples/linecount.mtail"), mtail.RecordDelimiter(`\x00`))
+	defer stopM()
+
+	logFile := filepath.Join(logDir, "log")
+
+	lineCountCheck := m.ExpectMapExpvarDeltaWithDeadline("log_lines_total", logFile, 2)
+
+	f := testutil.TestOpenFile(t, logFile)
+	m.PollWatched(1) // Force sync to EOF
+
+	// The newline is part of the first record.
+	testutil.WriteString(t, f, "first\nrecord\x00second record\x00")
+	m.PollWatched(1)
+
+	lineCountCheck()
+}
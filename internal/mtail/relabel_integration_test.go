@@ -0,0 +1,94 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/testutil"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestRelabelConfig(t *testing.T) {
+	testutil.SkipIfShort(t)
+	tmpDir := testutil.TestTempDir(t)
+	progFile := filepath.Join(tmpDir, "requests.mtail")
+	testutil.WriteString(t, testutil.TestOpenFile(t, progFile), `counter requests by endpoint
+/^GET (?P<endpoint>\S+)$/ {
+  requests[$endpoint]++
+}
+`)
+	configFile := filepath.Join(tmpDir, "relabel.json")
+	testutil.WriteString(t, testutil.TestOpenFile(t, configFile), `[
+  {"metric": "req*", "labels": {"endpoint": "/user/.*"}, "action": "replace", "target_label": "endpoint", "replacement": "/user/:id"}
+]`)
+	logDir := filepath.Join(tmpDir, "logs")
+	testutil.FatalIfErr(t, os.Mkdir(logDir, 0700))
+	sockListenAddr := filepath.Join(tmpDir, "mtail_test.sock")
+
+	m, stopM := mtail.TestStartServer(t, 1, mtail.LogPathPatterns(logDir+"/*"), mtail.ProgramPath(progFile), mtail.BindUnixSocket(sockListenAddr), mtail.RelabelConfig(configFile))
+	defer stopM()
+
+	lineCountCheck := m.ExpectExpvarDeltaWithDeadline("lines_total", 4)
+
+	f := testutil.TestOpenFile(t, filepath.Join(logDir, "log"))
+	m.PollWatched(1) // Force sync to EOF
+
+	testutil.WriteString(t, f, "GET /user/1\nGET /user/2\nGET /user/2\nGET /\n")
+	m.PollWatched(1)
+	lineCountCheck()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sockListenAddr)
+			},
+		},
+	}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get("http://unix/metrics")
+	testutil.FatalIfErr(t, err)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %s", resp.Status)
+	}
+	var p expfmt.TextParser
+	families, err := p.TextToMetricFamilies(resp.Body)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, resp.Body.Close())
+
+	family, ok := families["requests"]
+	if !ok {
+		t.Fatalf("expecting requests in metrics, got %v", families)
+	}
+	got := map[string]float64{}
+	for _, metric := range family.GetMetric() {
+		for _, l := range metric.GetLabel() {
+			if l.GetName() == "endpoint" {
+				got[l.GetValue()] = metric.GetCounter().GetValue()
+			}
+		}
+	}
+	testutil.ExpectNoDiff(t, map[string]float64{"/": 1, "/user/:id": 3}, got)
+}
+
+func TestRelabelConfigBad(t *testing.T) {
+	testutil.SkipIfShort(t)
+	tmpDir := testutil.TestTempDir(t)
+	configFile := filepath.Join(tmpDir, "relabel.json")
+	testutil.WriteString(t, testutil.TestOpenFile(t, configFile), `[{"action": "explode"}]`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := mtail.New(ctx, metrics.NewStore(), mtail.LogPathPatterns(tmpDir+"/*"), mtail.RelabelConfig(configFile)); err == nil {
+		t.Error("expected error for bad relabel config")
+	}
+}
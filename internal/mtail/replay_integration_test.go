@@ -0,0 +1,82 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail_test
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/testutil"
+)
+
+const replayProgram = `counter requests_total
+
+/^(?P<date>\S+) GET / {
+  strptime($date, "2006-01-02T15:04:05Z07:00")
+  requests_total++
+}
+`
+
+func TestReplay(t *testing.T) {
+	testutil.SkipIfShort(t)
+	tmpDir := testutil.TestTempDir(t)
+
+	progFile := filepath.Join(tmpDir, "replay.mtail")
+	testutil.FatalIfErr(t, ioutil.WriteFile(progFile, []byte(replayProgram), 0600))
+	logFile := filepath.Join(tmpDir, "log")
+	testutil.FatalIfErr(t, ioutil.WriteFile(logFile, []byte("2019-03-01T10:00:00Z GET /\n2019-03-01T10:01:00Z GET /\n2019-03-01T10:02:30Z GET /\n"), 0600))
+	last := time.Date(2019, 3, 1, 10, 2, 30, 0, time.UTC)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.FatalIfErr(t, err)
+	defer l.Close()
+	testutil.SetFlag(t, "graphite_host_port", l.Addr().String())
+
+	pushed := make(chan []string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(pushed)
+			return
+		}
+		defer conn.Close()
+		var lines []string
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		pushed <- lines
+	}()
+
+	m := mtail.TestMakeServer(t, 0, mtail.Replay, mtail.LogPathPatterns(logFile), mtail.ProgramPath(progFile))
+
+	// The server finishes on its own once the log is read.
+	errc := make(chan error, 1)
+	go func() {
+		errc <- m.Run()
+	}()
+	select {
+	case err := <-errc:
+		testutil.FatalIfErr(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for replay to complete")
+	}
+
+	d := m.GetProgramMetric("requests_total", "replay.mtail")
+	if got := d.TimeUTC(); !got.Equal(last) {
+		t.Errorf("requests_total time is %s, want the last log timestamp %s", got, last)
+	}
+
+	select {
+	case lines := <-pushed:
+		testutil.ExpectNoDiff(t, []string{"replay.mtail.requests_total 3 1551434550"}, lines)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for final push")
+	}
+}
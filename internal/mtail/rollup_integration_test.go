@@ -0,0 +1,76 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/testutil"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestRollup(t *testing.T) {
+	testutil.SkipIfShort(t)
+	tmpDir := testutil.TestTempDir(t)
+	progFile := filepath.Join(tmpDir, "requests.mtail")
+	testutil.WriteString(t, testutil.TestOpenFile(t, progFile), `counter requests by instance, handler
+/^(?P<instance>\S+) (?P<handler>\S+)$/ {
+  requests[$instance, $handler]++
+}
+`)
+	logDir := filepath.Join(tmpDir, "logs")
+	testutil.FatalIfErr(t, os.Mkdir(logDir, 0700))
+	sockListenAddr := filepath.Join(tmpDir, "mtail_test.sock")
+
+	m, stopM := mtail.TestStartServer(t, 1, mtail.LogPathPatterns(logDir+"/*"), mtail.ProgramPath(progFile), mtail.BindUnixSocket(sockListenAddr), mtail.Rollup("requests", "instance"))
+	defer stopM()
+
+	lineCountCheck := m.ExpectExpvarDeltaWithDeadline("lines_total", 4)
+
+	f := testutil.TestOpenFile(t, filepath.Join(logDir, "log"))
+	m.PollWatched(1) // Force sync to EOF
+
+	testutil.WriteString(t, f, "a /\nb /\nb /\na /api\n")
+	m.PollWatched(1)
+	lineCountCheck()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sockListenAddr)
+			},
+		},
+	}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get("http://unix/metrics")
+	testutil.FatalIfErr(t, err)
+	var p expfmt.TextParser
+	families, err := p.TextToMetricFamilies(resp.Body)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, resp.Body.Close())
+
+	family, ok := families["requests_without_instance"]
+	if !ok {
+		t.Fatalf("expecting requests_without_instance in metrics, got %v", families)
+	}
+	got := map[string]float64{}
+	for _, metric := range family.GetMetric() {
+		for _, l := range metric.GetLabel() {
+			if l.GetName() == "instance" {
+				t.Errorf("unexpected instance label on rollup %v", metric)
+			}
+			if l.GetName() == "handler" {
+				got[l.GetValue()] = metric.GetCounter().GetValue()
+			}
+		}
+	}
+	testutil.ExpectNoDiff(t, map[string]float64{"/": 3, "/api": 1}, got)
+}
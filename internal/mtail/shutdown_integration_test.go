@@ -0,0 +1,69 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail_test
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestShutdownFlushesFinalWrite(t *testing.T) {
+	testutil.SkipIfShort(t)
+	logDir := testutil.TestTempDir(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.FatalIfErr(t, err)
+	defer l.Close()
+	testutil.SetFlag(t, "graphite_host_port", l.Addr().String())
+
+	pushed := make(chan []string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(pushed)
+			return
+		}
+		defer conn.Close()
+		var lines []string
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		pushed <- lines
+	}()
+
+	// A long push interval means the only push is the one made at shutdown.
+	m, stopM := mtail.TestStartServer(t, 1, mtail.LogPathPatterns(logDir+"/*"), mtail.ProgramPath("../../examples/linecount.mtail"), mtail.MetricPushInterval(time.Hour))
+
+	logFile := filepath.Join(logDir, "log")
+	f := testutil.TestOpenFile(t, logFile)
+	m.PollWatched(1) // Force sync to EOF
+
+	testutil.WriteString(t, f, "1\n2\n")
+	m.PollWatched(1)
+
+	// Write one more line, and shut down before the logstream is polled again.
+	testutil.WriteString(t, f, "3\n")
+	stopM()
+
+	select {
+	case lines := <-pushed:
+		want := "linecount.mtail.lines_total 3 "
+		for _, line := range lines {
+			if strings.HasPrefix(line, want) {
+				return
+			}
+		}
+		t.Errorf("final push did not contain %q: %q", want, lines)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for final push")
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/testutil"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestSourceHostLabel(t *testing.T) {
+	testutil.SkipIfShort(t)
+	tmpDir := testutil.TestTempDir(t)
+	progFile := filepath.Join(tmpDir, "hosts.mtail")
+	testutil.WriteString(t, testutil.TestOpenFile(t, progFile), `counter lines_by_host by host
+// {
+  lines_by_host[source_host()]++
+}
+`)
+	sockListenAddr := filepath.Join(tmpDir, "mtail_test.sock")
+
+	// Find a free port for the log to listen on.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.FatalIfErr(t, err)
+	addr := l.Addr().String()
+	testutil.FatalIfErr(t, l.Close())
+
+	m, stopM := mtail.TestStartServer(t, 1, mtail.LogPathPatterns("tcp://"+addr), mtail.ProgramPath(progFile), mtail.BindUnixSocket(sockListenAddr))
+	defer stopM()
+
+	lineCountCheck := m.ExpectExpvarDeltaWithDeadline("lines_total", 2)
+
+	c, err := net.Dial("tcp", addr)
+	testutil.FatalIfErr(t, err)
+	_, err = c.Write([]byte("1\n2\n"))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, c.Close())
+
+	lineCountCheck()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sockListenAddr)
+			},
+		},
+	}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get("http://unix/metrics")
+	testutil.FatalIfErr(t, err)
+	var p expfmt.TextParser
+	families, err := p.TextToMetricFamilies(resp.Body)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, resp.Body.Close())
+
+	family, ok := families["lines_by_host"]
+	if !ok {
+		t.Fatalf("expecting lines_by_host in metrics, got %v", families)
+	}
+	// The lines are exported with the host that sent them as a label.
+	got := map[string]float64{}
+	for _, metric := range family.GetMetric() {
+		for _, l := range metric.GetLabel() {
+			if l.GetName() == "host" {
+				got[l.GetValue()] = metric.GetCounter().GetValue()
+			}
+		}
+	}
+	testutil.ExpectNoDiff(t, map[string]float64{"127.0.0.1": 2}, got)
+}
@@ -0,0 +1,43 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/testutil"
+)
+
+// TestReadFromSSH follows a log on a remote host through a fake ssh on the
+// PATH, which writes some lines and then waits for its standard input to
+// close, as the remote tail would.
+func TestReadFromSSH(t *testing.T) {
+	testutil.SkipIfShort(t)
+	tmpDir := testutil.TestTempDir(t)
+
+	progDir := filepath.Join(tmpDir, "progs")
+	testutil.FatalIfErr(t, os.Mkdir(progDir, 0700))
+	binDir := filepath.Join(tmpDir, "bin")
+	testutil.FatalIfErr(t, os.Mkdir(binDir, 0700))
+	// The lines are written once the test is ready to count them.
+	ready := filepath.Join(tmpDir, "ready")
+	script := "#!/bin/sh\nwhile [ ! -e " + ready + " ]; do sleep 0.01; done\nprintf '1\\n2\\n3\\n'\ncat >/dev/null\n"
+	testutil.FatalIfErr(t, ioutil.WriteFile(filepath.Join(binDir, "ssh"), []byte(script), 0700))
+	oldPath := os.Getenv("PATH")
+	testutil.FatalIfErr(t, os.Setenv("PATH", binDir+string(os.PathListSeparator)+oldPath))
+	defer os.Setenv("PATH", oldPath)
+
+	m, stopM := mtail.TestStartServer(t, 1, mtail.LogPathPatterns("ssh://user@host/var/log/app.log"), mtail.ProgramPath(progDir))
+	defer stopM()
+
+	lineCountCheck := m.ExpectExpvarDeltaWithDeadline("lines_total", 3)
+
+	testutil.FatalIfErr(t, ioutil.WriteFile(ready, nil, 0600))
+
+	lineCountCheck()
+}
@@ -0,0 +1,159 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/tailer"
+	"github.com/google/mtail/internal/testutil"
+)
+
+// tailzClient makes requests to the /tailz endpoints of the mtail listening on
+// the unix socket sockListenAddr.
+type tailzClient struct {
+	t      *testing.T
+	client *http.Client
+}
+
+func newTailzClient(t *testing.T, sockListenAddr string) *tailzClient {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sockListenAddr)
+			},
+		},
+	}
+	return &tailzClient{t, client}
+}
+
+// post posts pathname to endpoint, and fails the test unless the response has
+// the status want.
+func (c *tailzClient) post(endpoint, pathname string, want int) {
+	c.t.Helper()
+	resp, err := c.client.PostForm("http://unix"+endpoint, url.Values{"path": {pathname}})
+	testutil.FatalIfErr(c.t, err)
+	testutil.FatalIfErr(c.t, resp.Body.Close())
+	if resp.StatusCode != want {
+		c.t.Fatalf("POST %s: unexpected status %s", endpoint, resp.Status)
+	}
+}
+
+func (c *tailzClient) tailedPaths() []tailer.TailedPath {
+	c.t.Helper()
+	resp, err := c.client.Get("http://unix/tailz/paths")
+	testutil.FatalIfErr(c.t, err)
+	defer resp.Body.Close()
+	var paths []tailer.TailedPath
+	testutil.FatalIfErr(c.t, json.NewDecoder(resp.Body).Decode(&paths))
+	return paths
+}
+
+func TestTailPathsAddedAndRemoved(t *testing.T) {
+	testutil.SkipIfShort(t)
+	tmpDir := testutil.TestTempDir(t)
+	sockListenAddr := filepath.Join(tmpDir, "mtail_test.sock")
+	logDir := filepath.Join(tmpDir, "logs")
+	testutil.FatalIfErr(t, os.Mkdir(logDir, 0700))
+	logFile := filepath.Join(logDir, "log")
+
+	// No log patterns are given; the log is only tailed once added.
+	m, stopM := mtail.TestStartServer(t, 1, mtail.ProgramPath("../../examples/linecount.mtail"), mtail.BindUnixSocket(sockListenAddr), mtail.EnableAdminEndpoints, mtail.TailzPathPrefix(logDir))
+	defer stopM()
+
+	c := newTailzClient(t, sockListenAddr)
+	defer c.client.CloseIdleConnections()
+
+	f := testutil.TestOpenFile(t, logFile)
+	defer f.Close()
+
+	logCountCheck := m.ExpectExpvarDeltaWithDeadline("log_count", 1)
+	c.post("/tailz/add", logFile, http.StatusOK)
+	logCountCheck()
+	testutil.ExpectNoDiff(t, []tailer.TailedPath{{Pathname: logFile, Added: true}}, c.tailedPaths())
+
+	linesCheck := m.ExpectProgMetricDeltaWithDeadline("lines_total", "linecount.mtail", 3)
+	m.PollWatched(1) // Force sync to EOF
+	for i := 1; i <= 3; i++ {
+		testutil.WriteString(t, f, fmt.Sprintf("%d\n", i))
+	}
+	m.PollWatched(1)
+	linesCheck()
+
+	logCloseCheck := m.ExpectMapExpvarDeltaWithDeadline("log_closes_total", logFile, 1)
+	logCountCheck = m.ExpectExpvarDeltaWithDeadline("log_count", -1)
+	c.post("/tailz/remove", logFile, http.StatusOK)
+	logCloseCheck()
+	logCountCheck()
+	testutil.ExpectNoDiff(t, []tailer.TailedPath{}, c.tailedPaths())
+
+	// The stream stays torn down across polls, and can't be removed again.
+	m.PollWatched(0)
+	testutil.ExpectNoDiff(t, []tailer.TailedPath{}, c.tailedPaths())
+	c.post("/tailz/remove", logFile, http.StatusNotFound)
+
+	// Paths outside the prefix can't be added.
+	c.post("/tailz/add", filepath.Join(tmpDir, "elsewhere.log"), http.StatusForbidden)
+	c.post("/tailz/add", "/etc/passwd", http.StatusForbidden)
+}
+
+func TestTailPathsAdminEndpointsDisabled(t *testing.T) {
+	testutil.SkipIfShort(t)
+	tmpDir := testutil.TestTempDir(t)
+	sockListenAddr := filepath.Join(tmpDir, "mtail_test.sock")
+	logFile := filepath.Join(tmpDir, "log")
+
+	_, stopM := mtail.TestStartServer(t, 1, mtail.LogPathPatterns(tmpDir+"/*.log"), mtail.ProgramPath("../../examples/linecount.mtail"), mtail.BindUnixSocket(sockListenAddr), mtail.TailzPathPrefix(tmpDir))
+	defer stopM()
+
+	c := newTailzClient(t, sockListenAddr)
+	defer c.client.CloseIdleConnections()
+
+	c.post("/tailz/add", logFile, http.StatusForbidden)
+	c.post("/tailz/remove", logFile, http.StatusForbidden)
+	testutil.ExpectNoDiff(t, []tailer.TailedPath{}, c.tailedPaths())
+}
+
+// TestTailPathsRemovedPatternMatch checks that a log matching a pattern that
+// is removed is not tailed again when the patterns are next polled.
+func TestTailPathsRemovedPatternMatch(t *testing.T) {
+	testutil.SkipIfShort(t)
+	tmpDir := testutil.TestTempDir(t)
+	sockListenAddr := filepath.Join(tmpDir, "mtail_test.sock")
+	logFile := filepath.Join(tmpDir, "app.log")
+	f := testutil.TestOpenFile(t, logFile)
+	defer f.Close()
+
+	m, stopM := mtail.TestStartServer(t, 1, mtail.LogPathPatterns(tmpDir+"/*.log"), mtail.ProgramPath("../../examples/linecount.mtail"), mtail.BindUnixSocket(sockListenAddr), mtail.EnableAdminEndpoints)
+	defer stopM()
+
+	c := newTailzClient(t, sockListenAddr)
+	defer c.client.CloseIdleConnections()
+
+	testutil.ExpectNoDiff(t, []tailer.TailedPath{{Pathname: logFile}}, c.tailedPaths())
+
+	logCountCheck := m.ExpectExpvarDeltaWithDeadline("log_count", -1)
+	c.post("/tailz/remove", logFile, http.StatusOK)
+	logCountCheck()
+
+	m.PollWatched(0)
+	m.PollWatched(0)
+	testutil.ExpectNoDiff(t, []tailer.TailedPath{}, c.tailedPaths())
+
+	// It is tailed again once added, as it matches a pattern.
+	logCountCheck = m.ExpectExpvarDeltaWithDeadline("log_count", 1)
+	c.post("/tailz/add", logFile, http.StatusOK)
+	logCountCheck()
+	testutil.ExpectNoDiff(t, []tailer.TailedPath{{Pathname: logFile, Added: true}}, c.tailedPaths())
+}
@@ -0,0 +1,48 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail_test
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestReadFromFramedTCP(t *testing.T) {
+	testutil.SkipIfShort(t)
+	tmpDir := testutil.TestTempDir(t)
+
+	progDir := filepath.Join(tmpDir, "progs")
+	testutil.FatalIfErr(t, os.Mkdir(progDir, 0700))
+
+	// Find a free port for the log to listen on.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.FatalIfErr(t, err)
+	addr := l.Addr().String()
+	testutil.FatalIfErr(t, l.Close())
+
+	m, stopM := mtail.TestStartServer(t, 1, mtail.LogPathPatterns("tcp+framed://"+addr), mtail.ProgramPath(progDir))
+	defer stopM()
+
+	lineCountCheck := m.ExpectExpvarDeltaWithDeadline("lines_total", 2)
+
+	c, err := net.Dial("tcp", addr)
+	testutil.FatalIfErr(t, err)
+	var b []byte
+	for _, record := range []string{"1", "2\n3"} {
+		var header [4]byte
+		binary.BigEndian.PutUint32(header[:], uint32(len(record)))
+		b = append(append(b, header[:]...), record...)
+	}
+	_, err = c.Write(b)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, c.Close())
+
+	lineCountCheck()
+}
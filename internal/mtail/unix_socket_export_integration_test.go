@@ -4,13 +4,18 @@
 package mtail_test
 
 import (
+	"context"
 	"net"
+	"net/http"
+	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/google/mtail/internal/mtail"
 	"github.com/google/mtail/internal/testutil"
+	"github.com/prometheus/common/expfmt"
 )
 
 func TestBasicUNIXSockets(t *testing.T) {
@@ -28,3 +33,48 @@ func TestBasicUNIXSockets(t *testing.T) {
 	_, err = net.DialUnix("unix", nil, addr)
 	testutil.FatalIfErr(t, err)
 }
+
+func TestScrapeUNIXSocket(t *testing.T) {
+	testutil.SkipIfShort(t)
+	tmpDir := testutil.TestTempDir(t)
+	logDir := filepath.Join(tmpDir, "logs")
+	testutil.FatalIfErr(t, os.Mkdir(logDir, 0700))
+	sockListenAddr := filepath.Join(tmpDir, "mtail_test.sock")
+
+	_, stopM := mtail.TestStartServer(t, 1, mtail.LogPathPatterns(logDir+"/*"), mtail.ProgramPath("../../examples/linecount.mtail"), mtail.BindUnixSocket(sockListenAddr))
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sockListenAddr)
+			},
+		},
+	}
+	resp, err := client.Get("http://unix/metrics")
+	testutil.FatalIfErr(t, err)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status %s", resp.Status)
+	}
+	var p expfmt.TextParser
+	families, err := p.TextToMetricFamilies(resp.Body)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, resp.Body.Close())
+	if _, ok := families["mtail_prog_loads_total"]; !ok {
+		t.Errorf("expecting mtail_prog_loads_total in metrics, got %v", families)
+	}
+	client.CloseIdleConnections()
+
+	stopM()
+	// The socket is removed once the HTTP server has shut down.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(sockListenAddr); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("socket %s not removed after shutdown", sockListenAddr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/mtail/internal/mtail"
+	"github.com/google/mtail/internal/testutil"
+)
+
+func TestReadFromUnixSocket(t *testing.T) {
+	testutil.SkipIfShort(t)
+	tmpDir := testutil.TestTempDir(t)
+
+	progDir := filepath.Join(tmpDir, "progs")
+	testutil.FatalIfErr(t, os.Mkdir(progDir, 0700))
+	sockName := filepath.Join(tmpDir, "log.sock")
+
+	m, stopM := mtail.TestStartServer(t, 1, mtail.LogPathPatterns("unix://"+sockName), mtail.ProgramPath(progDir))
+	defer stopM()
+
+	lineCountCheck := m.ExpectExpvarDeltaWithDeadline("lines_total", 3)
+
+	c, err := net.Dial("unix", sockName)
+	testutil.FatalIfErr(t, err)
+	_, err = c.Write([]byte("1\n2\n3\n"))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, c.Close())
+
+	lineCountCheck()
+}
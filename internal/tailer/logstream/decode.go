@@ -7,17 +7,26 @@ import (
 	"bytes"
 	"context"
 	"expvar"
+	"regexp"
 	"unicode/utf8"
 
 	"github.com/golang/glog"
 	"github.com/google/mtail/internal/logline"
 )
 
-// logLines counts the number of lines read per log file
-var logLines = expvar.NewMap("log_lines_total")
+var (
+	// logLines counts the number of lines read per log file
+	logLines = expvar.NewMap("log_lines_total")
+	// linesFiltered counts the number of lines dropped by the exclude pattern per log file
+	linesFiltered = expvar.NewMap("lines_filtered_total")
+)
 
-// decodeAndSend transforms the byte addary `b` into unicode in `partial`, sending to the llp as each newline is decoded.
-func decodeAndSend(ctx context.Context, lines chan<- *logline.LogLine, pathname string, n int, b []byte, partial *bytes.Buffer) {
+// decodeAndSend transforms the byte addary `b` into unicode in `partial`, sending to the llp as each delimiter is decoded.
+// host names the sender of `b` for network sources, and is empty otherwise.
+// Lines matching exclude, if not nil, are dropped.  A carriage return before a newline
+// delimiter is dropped, so that CRLF and LF line endings read the same.
+func decodeAndSend(ctx context.Context, lines *lineQueue, pathname string, host string, n int, b []byte, partial *bytes.Buffer, delimiter byte, exclude *regexp.Regexp) {
+	delim := rune(delimiter)
 	var (
 		rune  rune
 		width int
@@ -25,17 +34,32 @@ func decodeAndSend(ctx context.Context, lines chan<- *logline.LogLine, pathname
 	for i := 0; i < len(b) && i < n; i += width {
 		rune, width = utf8.DecodeRune(b[i:])
 		switch {
-		case rune != '\n':
+		case rune != delim:
 			partial.WriteRune(rune)
 		default:
-			sendLine(ctx, pathname, partial, lines)
+			if delim == '\n' {
+				trimCR(partial)
+			}
+			sendLine(ctx, pathname, host, partial, lines, exclude)
 		}
 	}
 }
 
-func sendLine(ctx context.Context, pathname string, partial *bytes.Buffer, lines chan<- *logline.LogLine) {
+// trimCR removes a trailing carriage return from partial.
+func trimCR(partial *bytes.Buffer) {
+	if b := partial.Bytes(); len(b) > 0 && b[len(b)-1] == '\r' {
+		partial.Truncate(len(b) - 1)
+	}
+}
+
+func sendLine(ctx context.Context, pathname string, host string, partial *bytes.Buffer, lines *lineQueue, exclude *regexp.Regexp) {
 	glog.V(2).Infof("sendline")
 	logLines.Add(pathname, 1)
-	lines <- logline.New(ctx, pathname, partial.String())
+	if exclude != nil && exclude.MatchString(partial.String()) {
+		linesFiltered.Add(pathname, 1)
+		partial.Reset()
+		return
+	}
+	lines.send(logline.NewFromHost(ctx, pathname, host, partial.String()))
 	partial.Reset()
 }
@@ -0,0 +1,116 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logstream
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/mtail/internal/logline"
+)
+
+var (
+	// linesBlocked counts the lines that had to wait for room in the queue of
+	// their log stream, per log file.
+	linesBlocked = expvar.NewMap("log_lines_blocked_total")
+	// linesDroppedNewest counts the lines read and discarded because the queue
+	// of their log stream was full, per log file.
+	linesDroppedNewest = expvar.NewMap("log_lines_dropped_newest_total")
+	// linesDroppedOldest counts the lines evicted from the queue of their log
+	// stream to make room for a newer one, per log file.
+	linesDroppedOldest = expvar.NewMap("log_lines_dropped_oldest_total")
+)
+
+// DropPolicy names what a log stream does with a line it has read when its
+// queue for the lines channel is full.
+type DropPolicy string
+
+// The policies for a full queue.
+const (
+	// Block waits for room in the queue, so no lines are lost but reading
+	// stalls until the programs catch up.
+	Block DropPolicy = "block"
+	// DropNewest discards the line read.
+	DropNewest DropPolicy = "drop-newest"
+	// DropOldest discards the oldest line in the queue to make room for the
+	// line read.
+	DropOldest DropPolicy = "drop-oldest"
+)
+
+// ParseDropPolicy returns the DropPolicy named by s, ignoring case.  An empty s
+// is Block.
+func ParseDropPolicy(s string) (DropPolicy, error) {
+	switch p := DropPolicy(strings.ToLower(s)); p {
+	case "":
+		return Block, nil
+	case Block, DropNewest, DropOldest:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unsupported lines channel policy %q", s)
+	}
+}
+
+// defaultQueueSize is the number of lines read that a log stream queues for
+// the lines channel before its DropPolicy applies.
+const defaultQueueSize = 64
+
+// lineQueue is the bounded queue of lines read by one log stream, which are
+// forwarded from it to the lines channel shared by all logs.  Lines are only
+// dropped from a stream's own queue, so a busy log can't drop the lines of
+// another.
+type lineQueue struct {
+	c      chan *logline.LogLine
+	policy DropPolicy // what to do with a line when c is full
+}
+
+func newLineQueue(size int, policy DropPolicy) *lineQueue {
+	return &lineQueue{c: make(chan *logline.LogLine, size), policy: policy}
+}
+
+// forward sends the lines queued to lines until the producers are all done,
+// and notifies `wg` when the last has been sent.
+func (q *lineQueue) forward(wg *sync.WaitGroup, producers *sync.WaitGroup, lines chan<- *logline.LogLine) {
+	go func() {
+		producers.Wait()
+		close(q.c)
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for ll := range q.c {
+			lines <- ll
+		}
+	}()
+}
+
+// send puts ll on the queue, and if the queue is full then follows its policy.
+func (q *lineQueue) send(ll *logline.LogLine) {
+	select {
+	case q.c <- ll:
+		return
+	default:
+	}
+	switch q.policy {
+	case DropNewest:
+		linesDroppedNewest.Add(ll.Filename, 1)
+	case DropOldest:
+		select {
+		case old := <-q.c:
+			linesDroppedOldest.Add(old.Filename, 1)
+		default:
+			// The forwarder took the oldest line in the meantime.
+		}
+		select {
+		case q.c <- ll:
+		default:
+			// Another connection to the same stream took the room made.
+			linesDroppedNewest.Add(ll.Filename, 1)
+		}
+	default:
+		linesBlocked.Add(ll.Filename, 1)
+		q.c <- ll
+	}
+}
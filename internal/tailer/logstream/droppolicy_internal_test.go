@@ -0,0 +1,120 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logstream
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/testutil"
+)
+
+// counterValue returns the value of key in the expvar map m, or zero.
+func counterValue(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestSendBlock(t *testing.T) {
+	name := t.Name()
+	q := newLineQueue(1, Block)
+	q.send(logline.New(context.Background(), name, "1"))
+	testutil.ExpectNoDiff(t, int64(0), counterValue(linesBlocked, name))
+
+	sent := make(chan struct{})
+	go func() {
+		q.send(logline.New(context.Background(), name, "2"))
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		t.Fatal("send returned with the queue full")
+	case <-time.After(10 * time.Millisecond):
+	}
+	testutil.ExpectNoDiff(t, "1", (<-q.c).Line)
+	<-sent
+	testutil.ExpectNoDiff(t, "2", (<-q.c).Line)
+	testutil.ExpectNoDiff(t, int64(1), counterValue(linesBlocked, name))
+}
+
+func TestSendDropNewest(t *testing.T) {
+	name := t.Name()
+	q := newLineQueue(1, DropNewest)
+	q.send(logline.New(context.Background(), name, "1"))
+	q.send(logline.New(context.Background(), name, "2"))
+
+	testutil.ExpectNoDiff(t, "1", (<-q.c).Line)
+	testutil.ExpectNoDiff(t, 0, len(q.c))
+	testutil.ExpectNoDiff(t, int64(1), counterValue(linesDroppedNewest, name))
+	testutil.ExpectNoDiff(t, int64(0), counterValue(linesDroppedOldest, name))
+}
+
+func TestSendDropOldest(t *testing.T) {
+	name := t.Name()
+	q := newLineQueue(1, DropOldest)
+	q.send(logline.New(context.Background(), name, "1"))
+	q.send(logline.New(context.Background(), name, "2"))
+
+	testutil.ExpectNoDiff(t, "2", (<-q.c).Line)
+	testutil.ExpectNoDiff(t, 0, len(q.c))
+	testutil.ExpectNoDiff(t, int64(1), counterValue(linesDroppedOldest, name))
+	testutil.ExpectNoDiff(t, int64(0), counterValue(linesDroppedNewest, name))
+}
+
+// TestDropOldestKeepsOtherStreams checks that a stream dropping the oldest
+// line only ever drops its own, while another stream's lines wait for room in
+// the shared lines channel.
+func TestDropOldestKeepsOtherStreams(t *testing.T) {
+	busy, quiet := t.Name()+"/busy", t.Name()+"/quiet"
+	lines := make(chan *logline.LogLine)
+	var wg, busyProducers, quietProducers sync.WaitGroup
+
+	quietQ := newLineQueue(1, DropOldest)
+	quietProducers.Add(1)
+	quietQ.forward(&wg, &quietProducers, lines)
+	quietQ.send(logline.New(context.Background(), quiet, "q"))
+	quietProducers.Done()
+
+	busyQ := newLineQueue(1, DropOldest)
+	busyProducers.Add(1)
+	busyQ.forward(&wg, &busyProducers, lines)
+	for _, l := range []string{"1", "2", "3", "4"} {
+		busyQ.send(logline.New(context.Background(), busy, l))
+	}
+	busyProducers.Done()
+
+	go func() {
+		wg.Wait()
+		close(lines)
+	}()
+	received := map[string]int{}
+	for ll := range lines {
+		received[ll.Filename]++
+	}
+	testutil.ExpectNoDiff(t, 1, received[quiet])
+	testutil.ExpectNoDiff(t, int64(0), counterValue(linesDroppedOldest, quiet))
+	testutil.ExpectNoDiff(t, int64(4), int64(received[busy])+counterValue(linesDroppedOldest, busy))
+}
+
+func TestParseDropPolicy(t *testing.T) {
+	for s, expected := range map[string]DropPolicy{
+		"":            Block,
+		"block":       Block,
+		"Drop-Newest": DropNewest,
+		"drop-oldest": DropOldest,
+	} {
+		p, err := ParseDropPolicy(s)
+		testutil.FatalIfErr(t, err)
+		testutil.ExpectNoDiff(t, expected, p)
+	}
+	if _, err := ParseDropPolicy("drop-all"); err == nil {
+		t.Error("expecting an error for an unknown policy")
+	}
+}
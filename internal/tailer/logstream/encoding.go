@@ -0,0 +1,164 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logstream
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Encoding names the character encoding of a log, which is transcoded to
+// UTF-8 as it is read.
+type Encoding string
+
+// The encodings that logs can be read from.
+const (
+	UTF8    Encoding = "utf-8"
+	UTF16LE Encoding = "utf-16le"
+	UTF16BE Encoding = "utf-16be"
+	Latin1  Encoding = "latin1"
+)
+
+// ParseEncoding returns the Encoding named by s, ignoring case.  An empty s is
+// UTF-8.
+func ParseEncoding(s string) (Encoding, error) {
+	switch e := Encoding(strings.ToLower(s)); e {
+	case "", "utf8":
+		return UTF8, nil
+	case "iso-8859-1":
+		return Latin1, nil
+	case UTF8, UTF16LE, UTF16BE, Latin1:
+		return e, nil
+	default:
+		return "", fmt.Errorf("unsupported log encoding %q", s)
+	}
+}
+
+// byteOrderMarks are the byte order marks that start a log to give its
+// encoding.
+var byteOrderMarks = []struct {
+	bom []byte
+	enc Encoding
+}{
+	{[]byte{0xEF, 0xBB, 0xBF}, UTF8},
+	{[]byte{0xFF, 0xFE}, UTF16LE},
+	{[]byte{0xFE, 0xFF}, UTF16BE},
+}
+
+// detectBOM returns the encoding given by the byte order mark at the start of
+// b, and the length of the mark, or zero if there is none.
+func detectBOM(b []byte) (Encoding, int) {
+	for _, m := range byteOrderMarks {
+		if bytes.HasPrefix(b, m.bom) {
+			return m.enc, len(m.bom)
+		}
+	}
+	return "", 0
+}
+
+// isBOMPrefix returns true if b is too short to tell if it starts with a byte
+// order mark.
+func isBOMPrefix(b []byte) bool {
+	for _, m := range byteOrderMarks {
+		if len(b) < len(m.bom) && bytes.HasPrefix(m.bom, b) {
+			return true
+		}
+	}
+	return false
+}
+
+// transcoder converts the bytes of a log to UTF-8 as they are read.  A code
+// unit or surrogate pair split across reads is kept until the rest of it is
+// read.
+type transcoder struct {
+	enc   Encoding
+	sniff bool   // The next bytes are the start of the log, and may be a byte order mark.
+	carry []byte // Bytes left over from the last read.
+}
+
+// newTranscoder returns a transcoder from enc.  If atStart is true, the bytes
+// are read from the start of the log, and a byte order mark there is removed
+// and overrides enc.
+func newTranscoder(enc Encoding, atStart bool) *transcoder {
+	return &transcoder{enc: enc, sniff: atStart}
+}
+
+// Reset prepares the transcoder for reading from the start of the log again,
+// such as after it is truncated.
+func (tc *transcoder) Reset() {
+	tc.sniff = true
+	tc.carry = nil
+}
+
+// Transcode returns the UTF-8 encoding of b.
+func (tc *transcoder) Transcode(b []byte) []byte {
+	if tc.sniff {
+		tc.carry = append(tc.carry, b...)
+		if isBOMPrefix(tc.carry) {
+			return nil
+		}
+		tc.sniff = false
+		b = tc.carry
+		tc.carry = nil
+		if enc, n := detectBOM(b); n > 0 {
+			tc.enc = enc
+			b = b[n:]
+		}
+	}
+	switch tc.enc {
+	case UTF16LE, UTF16BE:
+		return tc.transcodeUTF16(b)
+	case Latin1:
+		out := make([]byte, 0, 2*len(b))
+		for _, c := range b {
+			out = appendRune(out, rune(c))
+		}
+		return out
+	default:
+		return b
+	}
+}
+
+// transcodeUTF16 returns the UTF-8 encoding of the UTF-16 in b, after any
+// bytes carried over from the last call.
+func (tc *transcoder) transcodeUTF16(b []byte) []byte {
+	if len(tc.carry) > 0 {
+		b = append(tc.carry, b...)
+		tc.carry = nil
+	}
+	out := make([]byte, 0, len(b))
+	unit := func(i int) rune {
+		if tc.enc == UTF16LE {
+			return rune(b[i]) | rune(b[i+1])<<8
+		}
+		return rune(b[i])<<8 | rune(b[i+1])
+	}
+	i := 0
+	for ; i+1 < len(b); i += 2 {
+		r := unit(i)
+		if utf16.IsSurrogate(r) {
+			if i+3 >= len(b) {
+				// The other half of the pair hasn't been read yet.
+				break
+			}
+			r = utf16.DecodeRune(r, unit(i+2))
+			if r != utf8.RuneError {
+				i += 2
+			}
+		}
+		out = appendRune(out, r)
+	}
+	tc.carry = append([]byte(nil), b[i:]...)
+	return out
+}
+
+// appendRune appends the UTF-8 encoding of r to b.
+func appendRune(b []byte, r rune) []byte {
+	var buf [utf8.UTFMax]byte
+	n := utf8.EncodeRune(buf[:], r)
+	return append(b, buf[:n]...)
+}
@@ -9,11 +9,11 @@ import (
 	"expvar"
 	"io"
 	"os"
+	"regexp"
 	"sync"
 	"time"
 
 	"github.com/golang/glog"
-	"github.com/google/mtail/internal/logline"
 	"github.com/google/mtail/internal/waker"
 )
 
@@ -31,13 +31,18 @@ var (
 // The latter is potentially lossy as far as mtail is concerned, if the last
 // logs are not read before truncation occurs.  When an EOF is read, the
 // goroutine tests for both truncation and inode change and resets or spins off
-// a new goroutine and closes itself down.  The shared context is used for
-// cancellation.
+// a new goroutine and closes itself down.  A truncation that is written past
+// the offset already read before the next EOF can't be seen in the file size,
+// so after each wakeup the last bytes read are also checked to still be in
+// the file.  The shared context is used for cancellation.
 type fileStream struct {
 	ctx   context.Context
-	lines chan<- *logline.LogLine
+	lines *lineQueue // where to send the lines read
 
-	pathname string // Given name for the underlying file on the filesystem
+	pathname  string         // Given name for the underlying file on the filesystem
+	delimiter byte           // Record delimiter
+	exclude   *regexp.Regexp // Drop records matching this pattern, if not nil
+	encoding  Encoding       // Encoding of the file, unless it starts with a byte order mark
 
 	mu           sync.RWMutex // protects following fields.
 	lastReadTime time.Time    // Last time a log line was read from this file
@@ -48,9 +53,9 @@ type fileStream struct {
 }
 
 // newFileStream creates a new log stream from a regular file.
-func newFileStream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, fi os.FileInfo, lines chan<- *logline.LogLine, streamFromStart bool) (LogStream, error) {
-	fs := &fileStream{ctx: ctx, pathname: pathname, lastReadTime: time.Now(), lines: lines, stopChan: make(chan struct{})}
-	if err := fs.stream(ctx, wg, waker, fi, streamFromStart); err != nil {
+func newFileStream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, fi os.FileInfo, lines *lineQueue, streamFromStart bool, opts options) (LogStream, error) {
+	fs := &fileStream{ctx: ctx, pathname: pathname, delimiter: opts.delimiter, exclude: opts.exclude, encoding: opts.encoding, lastReadTime: time.Now(), lines: lines, stopChan: make(chan struct{})}
+	if err := fs.stream(ctx, wg, waker, fi, streamFromStart, opts.offset); err != nil {
 		return nil, err
 	}
 	return fs, nil
@@ -62,7 +67,7 @@ func (fs *fileStream) LastReadTime() time.Time {
 	return fs.lastReadTime
 }
 
-func (fs *fileStream) stream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, fi os.FileInfo, streamFromStart bool) error {
+func (fs *fileStream) stream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, fi os.FileInfo, streamFromStart bool, offset int64) error {
 	fd, err := os.OpenFile(fs.pathname, os.O_RDONLY, 0600)
 	if err != nil {
 		logErrors.Add(fs.pathname, 1)
@@ -70,7 +75,23 @@ func (fs *fileStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wake
 	}
 	logOpens.Add(fs.pathname, 1)
 	glog.V(2).Infof("%v: opened new file", fd)
-	if !streamFromStart {
+	atStart := true
+	if offset >= 0 {
+		if offset > fi.Size() {
+			glog.Warningf("%s: start offset %d is past the end of the file, starting from its size %d", fs.pathname, offset, fi.Size())
+			offset = fi.Size()
+		}
+		if _, err := fd.Seek(offset, io.SeekStart); err != nil {
+			logErrors.Add(fs.pathname, 1)
+			if err := fd.Close(); err != nil {
+				logErrors.Add(fs.pathname, 1)
+				glog.Info(err)
+			}
+			return err
+		}
+		glog.V(2).Infof("%v: seeked to %d", fd, offset)
+		atStart = offset == 0
+	} else if !streamFromStart {
 		if _, err := fd.Seek(0, io.SeekEnd); err != nil {
 			logErrors.Add(fs.pathname, 1)
 			if err := fd.Close(); err != nil {
@@ -80,11 +101,24 @@ func (fs *fileStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wake
 			return err
 		}
 		glog.V(2).Infof("%v: seeked to end", fd)
+		atStart = fi.Size() == 0
+	}
+	tc := newTranscoder(fs.encoding, atStart)
+	if !atStart {
+		// Look for a byte order mark at the start of the file, which has
+		// already been passed.
+		hdr := make([]byte, 3)
+		n, _ := fd.ReadAt(hdr, 0)
+		if enc, m := detectBOM(hdr[:n]); m > 0 {
+			tc = newTranscoder(enc, false)
+		}
 	}
 	b := make([]byte, defaultReadBufferSize)
+	last := tailBefore(fd, tailCheckSize) // The last bytes read, to detect a rewrite.
 	partial := bytes.NewBufferString("")
 	started := make(chan struct{})
 	var total int
+	var drainDeadline time.Time // Set once cancelled, to bound the read to EOF.
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -105,8 +139,10 @@ func (fs *fileStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wake
 
 			if count > 0 {
 				total += count
+				last = keepTail(last, b[:count])
 				glog.V(2).Infof("%v: decode and send", fd)
-				decodeAndSend(ctx, fs.lines, fs.pathname, count, b[:count], partial)
+				decoded := tc.Transcode(b[:count])
+				decodeAndSend(ctx, fs.lines, fs.pathname, "", len(decoded), decoded, partial, fs.delimiter, fs.exclude)
 				fs.mu.Lock()
 				fs.lastReadTime = time.Now()
 				fs.mu.Unlock()
@@ -134,7 +170,7 @@ func (fs *fileStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wake
 					if os.IsNotExist(serr) {
 						glog.V(2).Infof("%v: source no longer exists, exiting", fd)
 						if partial.Len() > 0 {
-							sendLine(ctx, fs.pathname, partial, fs.lines)
+							sendLine(ctx, fs.pathname, "", partial, fs.lines, fs.exclude)
 						}
 						fs.mu.Lock()
 						fs.completed = true
@@ -146,7 +182,7 @@ func (fs *fileStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wake
 				}
 				if !os.SameFile(fi, newfi) {
 					glog.V(2).Infof("%v: adding a new file routine", fd)
-					if err := fs.stream(ctx, wg, waker, newfi, true); err != nil {
+					if err := fs.stream(ctx, wg, waker, newfi, true, -1); err != nil {
 						glog.Info(err)
 					}
 					// We're at EOF so there's nothing left to read here.
@@ -165,25 +201,26 @@ func (fs *fileStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wake
 				// the current seek offset.
 				if newfi.Size() < currentOffset {
 					glog.V(2).Infof("%v: truncate? currentoffset is %d and size is %d", fd, currentOffset, newfi.Size())
-					// About to lose all remaining data because of the truncate so flush the accumulator.
-					if partial.Len() > 0 {
-						sendLine(ctx, fs.pathname, partial, fs.lines)
-					}
-					p, serr := fd.Seek(0, io.SeekStart)
-					if serr != nil {
-						logErrors.Add(fs.pathname, 1)
-						glog.Info(serr)
-					}
-					glog.V(2).Infof("%v: Seeked to %d", fd, p)
-					fileTruncates.Add(fs.pathname, 1)
+					fs.restart(ctx, fd, tc, partial)
+					last = last[:0]
 					continue
 				}
 			}
 
-			// No error implies there is more to read in this file, unless it
-			// looks like context is Done.
-			if err == nil && ctx.Err() == nil {
-				continue
+			// No error implies there is more to read in this file.  If the
+			// context is Done, keep draining the file towards EOF, but give
+			// up once the drain deadline has passed.
+			if err == nil {
+				if ctx.Err() == nil {
+					continue
+				}
+				if drainDeadline.IsZero() {
+					drainDeadline = time.Now().Add(defaultDrainTimeout)
+				}
+				if time.Now().Before(drainDeadline) {
+					continue
+				}
+				glog.V(2).Infof("%v: drain deadline exceeded", fd)
 			}
 
 		Sleep:
@@ -193,7 +230,7 @@ func (fs *fileStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wake
 				case <-fs.stopChan:
 					glog.V(2).Infof("%v: stream has been stopped, exiting", fd)
 					if partial.Len() > 0 {
-						sendLine(ctx, fs.pathname, partial, fs.lines)
+						sendLine(ctx, fs.pathname, "", partial, fs.lines, fs.exclude)
 					}
 					fs.mu.Lock()
 					fs.completed = true
@@ -202,7 +239,7 @@ func (fs *fileStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wake
 				case <-ctx.Done():
 					glog.V(2).Infof("%v: stream has been cancelled, exiting", fd)
 					if partial.Len() > 0 {
-						sendLine(ctx, fs.pathname, partial, fs.lines)
+						sendLine(ctx, fs.pathname, "", partial, fs.lines, fs.exclude)
 					}
 					fs.mu.Lock()
 					fs.completed = true
@@ -233,6 +270,14 @@ func (fs *fileStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wake
 				// sleep until next Wake()
 				glog.V(2).Infof("%v: Wake received", fd)
 			}
+
+			// If the file has been truncated and written to again past the
+			// current offset while waiting, the bytes last read are gone.
+			if t := tailBefore(fd, len(last)); len(last) > 0 && t != nil && !bytes.Equal(t, last) {
+				glog.V(2).Infof("%v: last bytes read have changed, truncated", fd)
+				fs.restart(ctx, fd, tc, partial)
+				last = last[:0]
+			}
 		}
 	}()
 
@@ -240,6 +285,52 @@ func (fs *fileStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wake
 	return nil
 }
 
+// restart reads a truncated file from the start again.
+func (fs *fileStream) restart(ctx context.Context, fd *os.File, tc *transcoder, partial *bytes.Buffer) {
+	// About to lose all remaining data because of the truncate so flush the accumulator.
+	if partial.Len() > 0 {
+		sendLine(ctx, fs.pathname, "", partial, fs.lines, fs.exclude)
+	}
+	p, serr := fd.Seek(0, io.SeekStart)
+	if serr != nil {
+		logErrors.Add(fs.pathname, 1)
+		glog.Info(serr)
+	}
+	glog.V(2).Infof("%v: Seeked to %d", fd, p)
+	tc.Reset()
+	fileTruncates.Add(fs.pathname, 1)
+}
+
+// tailCheckSize is the number of bytes last read that are checked to detect a
+// truncated and rewritten file.
+const tailCheckSize = 64
+
+// tailBefore returns up to n bytes of fd from just before its current offset.
+func tailBefore(fd *os.File, n int) []byte {
+	off, err := fd.Seek(0, io.SeekCurrent)
+	if err != nil {
+		glog.Info(err)
+		return nil
+	}
+	if off < int64(n) {
+		n = int(off)
+	}
+	b := make([]byte, n)
+	m, _ := fd.ReadAt(b, off-int64(n))
+	return b[:m]
+}
+
+// keepTail appends b to last, keeping only the last tailCheckSize bytes.
+func keepTail(last, b []byte) []byte {
+	if len(b) >= tailCheckSize {
+		return append(last[:0], b[len(b)-tailCheckSize:]...)
+	}
+	if over := len(last) + len(b) - tailCheckSize; over > 0 {
+		last = append(last[:0], last[over:]...)
+	}
+	return append(last, b...)
+}
+
 func (fs *fileStream) IsComplete() bool {
 	fs.mu.RLock()
 	defer fs.mu.RUnlock()
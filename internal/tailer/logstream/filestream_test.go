@@ -5,10 +5,13 @@ package logstream_test
 
 import (
 	"context"
+	"encoding/binary"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sync"
 	"testing"
+	"unicode/utf16"
 
 	"github.com/golang/glog"
 	"github.com/google/mtail/internal/logline"
@@ -39,7 +42,7 @@ func TestFileStreamRead(t *testing.T) {
 	close(lines)
 	received := testutil.LinesReceived(lines)
 	expected := []*logline.LogLine{
-		{context.TODO(), name, "yo"},
+		{context.TODO(), name, "yo", ""},
 	}
 	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
 
@@ -51,6 +54,304 @@ func TestFileStreamRead(t *testing.T) {
 
 }
 
+func TestFileStreamReadCRLF(t *testing.T) {
+	var wg sync.WaitGroup
+
+	tmpDir := testutil.TestTempDir(t)
+
+	name := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, name)
+	lines := make(chan *logline.LogLine, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	waker, awaken := waker.NewTest(ctx, 1)
+	fs, err := logstream.New(ctx, &wg, waker, name, lines, true)
+	testutil.FatalIfErr(t, err)
+	awaken(1)
+
+	testutil.WriteString(t, f, "a\r\nb\n")
+	awaken(1)
+
+	fs.Stop()
+	wg.Wait()
+	close(lines)
+	received := testutil.LinesReceived(lines)
+	expected := []*logline.LogLine{
+		{context.TODO(), name, "a", ""},
+		{context.TODO(), name, "b", ""},
+	}
+	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+	cancel()
+	wg.Wait()
+}
+
+// utf16LE encodes s as UTF-16LE.
+func utf16LE(s string) string {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	return string(b)
+}
+
+func TestFileStreamReadUTF16LE(t *testing.T) {
+	var wg sync.WaitGroup
+
+	tmpDir := testutil.TestTempDir(t)
+
+	name := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, name)
+	lines := make(chan *logline.LogLine, 3)
+	ctx, cancel := context.WithCancel(context.Background())
+	waker, awaken := waker.NewTest(ctx, 1)
+	fs, err := logstream.New(ctx, &wg, waker, name, lines, true)
+	testutil.FatalIfErr(t, err)
+	awaken(1)
+
+	testutil.WriteString(t, f, "\xFF\xFE"+utf16LE("GET /café\n"))
+	awaken(1)
+	// A surrogate pair split across writes.
+	second := utf16LE("\U0001F600 ok\n")
+	testutil.WriteString(t, f, second[:3])
+	awaken(1)
+	testutil.WriteString(t, f, second[3:])
+	awaken(1)
+
+	fs.Stop()
+	wg.Wait()
+	close(lines)
+	received := testutil.LinesReceived(lines)
+	expected := []*logline.LogLine{
+		{context.TODO(), name, "GET /café", ""},
+		{context.TODO(), name, "\U0001F600 ok", ""},
+	}
+	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+	if !regexp.MustCompile(`^GET /caf\x{e9}$`).MatchString(received[0].Line) {
+		t.Errorf("decoded line %q doesn't match", received[0].Line)
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestFileStreamReadUTF16LEFromEnd(t *testing.T) {
+	var wg sync.WaitGroup
+
+	tmpDir := testutil.TestTempDir(t)
+
+	name := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, name)
+	testutil.WriteString(t, f, "\xFF\xFE"+utf16LE("old\n"))
+	lines := make(chan *logline.LogLine, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	waker, awaken := waker.NewTest(ctx, 1)
+	fs, err := logstream.New(ctx, &wg, waker, name, lines, false)
+	testutil.FatalIfErr(t, err)
+	awaken(1)
+
+	testutil.WriteString(t, f, utf16LE("new\n"))
+	awaken(1)
+
+	fs.Stop()
+	wg.Wait()
+	close(lines)
+	received := testutil.LinesReceived(lines)
+	expected := []*logline.LogLine{
+		{context.TODO(), name, "new", ""},
+	}
+	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+
+	cancel()
+	wg.Wait()
+}
+
+func TestFileStreamReadLatin1(t *testing.T) {
+	var wg sync.WaitGroup
+
+	tmpDir := testutil.TestTempDir(t)
+
+	name := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, name)
+	lines := make(chan *logline.LogLine, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	waker, awaken := waker.NewTest(ctx, 1)
+	fs, err := logstream.New(ctx, &wg, waker, name, lines, true, logstream.Latin1)
+	testutil.FatalIfErr(t, err)
+	awaken(1)
+
+	testutil.WriteString(t, f, "caf\xe9\n")
+	awaken(1)
+
+	fs.Stop()
+	wg.Wait()
+	close(lines)
+	received := testutil.LinesReceived(lines)
+	expected := []*logline.LogLine{
+		{context.TODO(), name, "café", ""},
+	}
+	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+
+	cancel()
+	wg.Wait()
+}
+
+func TestFileStreamReadNulDelimited(t *testing.T) {
+	var wg sync.WaitGroup
+
+	tmpDir := testutil.TestTempDir(t)
+
+	name := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, name)
+	lines := make(chan *logline.LogLine, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	waker, awaken := waker.NewTest(ctx, 1)
+	fs, err := logstream.New(ctx, &wg, waker, name, lines, true, logstream.RecordDelimiter('\x00'))
+	testutil.FatalIfErr(t, err)
+	awaken(1)
+
+	testutil.WriteString(t, f, "yo\x00multi\nline\x00")
+	awaken(1)
+
+	fs.Stop()
+	wg.Wait()
+	close(lines)
+	received := testutil.LinesReceived(lines)
+	expected := []*logline.LogLine{
+		{context.TODO(), name, "yo", ""},
+		{context.TODO(), name, "multi\nline", ""},
+	}
+	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+
+	cancel()
+	wg.Wait()
+}
+
+func TestFileStreamReadExclude(t *testing.T) {
+	var wg sync.WaitGroup
+
+	tmpDir := testutil.TestTempDir(t)
+
+	name := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, name)
+	lines := make(chan *logline.LogLine, 3)
+	ctx, cancel := context.WithCancel(context.Background())
+	waker, awaken := waker.NewTest(ctx, 1)
+	filteredCheck := testutil.ExpectMapExpvarDeltaWithDeadline(t, "lines_filtered_total", name, 2)
+	fs, err := logstream.New(ctx, &wg, waker, name, lines, true, logstream.ExcludePattern(regexp.MustCompile(`GET /healthz`)))
+	testutil.FatalIfErr(t, err)
+	awaken(1)
+
+	testutil.WriteString(t, f, "GET /index.html\nGET /healthz\nGET /api\nGET /healthz\n")
+	awaken(1)
+
+	fs.Stop()
+	wg.Wait()
+	close(lines)
+	received := testutil.LinesReceived(lines)
+	expected := []*logline.LogLine{
+		{context.TODO(), name, "GET /index.html", ""},
+		{context.TODO(), name, "GET /api", ""},
+	}
+	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+	filteredCheck()
+
+	cancel()
+	wg.Wait()
+}
+
+func TestFileStreamReadFromOffset(t *testing.T) {
+	var wg sync.WaitGroup
+
+	tmpDir := testutil.TestTempDir(t)
+
+	name := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, name)
+	testutil.WriteString(t, f, "line one\nline two\nline three\n")
+	lines := make(chan *logline.LogLine, 3)
+	ctx, cancel := context.WithCancel(context.Background())
+	waker, awaken := waker.NewTest(ctx, 1)
+	fs, err := logstream.New(ctx, &wg, waker, name, lines, false, logstream.StartOffset(len("line one\n")))
+	testutil.FatalIfErr(t, err)
+	awaken(1)
+
+	testutil.WriteString(t, f, "line four\n")
+	awaken(1)
+
+	fs.Stop()
+	wg.Wait()
+	close(lines)
+	received := testutil.LinesReceived(lines)
+	expected := []*logline.LogLine{
+		{context.TODO(), name, "line two", ""},
+		{context.TODO(), name, "line three", ""},
+		{context.TODO(), name, "line four", ""},
+	}
+	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+
+	cancel()
+	wg.Wait()
+}
+
+func TestFileStreamReadFromOffsetZero(t *testing.T) {
+	var wg sync.WaitGroup
+
+	tmpDir := testutil.TestTempDir(t)
+
+	name := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, name)
+	testutil.WriteString(t, f, "line one\nline two\n")
+	lines := make(chan *logline.LogLine, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	waker, awaken := waker.NewTest(ctx, 1)
+	fs, err := logstream.New(ctx, &wg, waker, name, lines, false, logstream.StartOffset(0))
+	testutil.FatalIfErr(t, err)
+	awaken(1)
+
+	fs.Stop()
+	wg.Wait()
+	close(lines)
+	received := testutil.LinesReceived(lines)
+	expected := []*logline.LogLine{
+		{context.TODO(), name, "line one", ""},
+		{context.TODO(), name, "line two", ""},
+	}
+	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+
+	cancel()
+	wg.Wait()
+}
+
+func TestFileStreamReadFromOffsetPastEnd(t *testing.T) {
+	var wg sync.WaitGroup
+
+	tmpDir := testutil.TestTempDir(t)
+
+	name := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, name)
+	testutil.WriteString(t, f, "line one\n")
+	lines := make(chan *logline.LogLine, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	waker, awaken := waker.NewTest(ctx, 1)
+	fs, err := logstream.New(ctx, &wg, waker, name, lines, true, logstream.StartOffset(1000))
+	testutil.FatalIfErr(t, err)
+	awaken(1)
+
+	testutil.WriteString(t, f, "line two\n")
+	awaken(1)
+
+	fs.Stop()
+	wg.Wait()
+	close(lines)
+	received := testutil.LinesReceived(lines)
+	expected := []*logline.LogLine{
+		{context.TODO(), name, "line two", ""},
+	}
+	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+
+	cancel()
+	wg.Wait()
+}
+
 func TestFileStreamRotation(t *testing.T) {
 	var wg sync.WaitGroup
 
@@ -87,8 +388,8 @@ func TestFileStreamRotation(t *testing.T) {
 
 	received := testutil.LinesReceived(lines)
 	expected := []*logline.LogLine{
-		{context.TODO(), name, "1"},
-		{context.TODO(), name, "2"},
+		{context.TODO(), name, "1", ""},
+		{context.TODO(), name, "2", ""},
 	}
 	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
 
@@ -125,9 +426,76 @@ func TestFileStreamTruncation(t *testing.T) {
 	received := testutil.LinesReceived(lines)
 
 	expected := []*logline.LogLine{
-		{context.TODO(), name, "1"},
-		{context.TODO(), name, "2"},
-		{context.TODO(), name, "3"},
+		{context.TODO(), name, "1", ""},
+		{context.TODO(), name, "2", ""},
+		{context.TODO(), name, "3", ""},
+	}
+	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+
+	cancel()
+	wg.Wait()
+}
+
+func TestFileStreamRepeatedTruncation(t *testing.T) {
+	var wg sync.WaitGroup
+
+	tmpDir := testutil.TestTempDir(t)
+
+	name := filepath.Join(tmpDir, "log")
+	f := testutil.OpenLogFile(t, name)
+	lines := make(chan *logline.LogLine, 14)
+	ctx, cancel := context.WithCancel(context.Background())
+	waker, awaken := waker.NewTest(ctx, 1)
+	fs, err := logstream.New(ctx, &wg, waker, name, lines, true)
+	testutil.FatalIfErr(t, err)
+	awaken(1)
+
+	testutil.WriteString(t, f, "1\n2\n3\n")
+	awaken(1)
+	// Truncate and write less than was read, then append to it.
+	testutil.FatalIfErr(t, f.Truncate(0))
+	_, err = f.Seek(0, 0)
+	testutil.FatalIfErr(t, err)
+	testutil.WriteString(t, f, "4\n")
+	awaken(1)
+	testutil.WriteString(t, f, "5\n6\n")
+	awaken(1)
+	// And again, appending more than was there before the truncation.
+	testutil.FatalIfErr(t, f.Truncate(0))
+	_, err = f.Seek(0, 0)
+	testutil.FatalIfErr(t, err)
+	testutil.WriteString(t, f, "7\n")
+	awaken(1)
+	testutil.WriteString(t, f, "8\n9\n10\n")
+	awaken(1)
+	// And again, writing past the offset read to before the next read.
+	testutil.FatalIfErr(t, f.Truncate(0))
+	_, err = f.Seek(0, 0)
+	testutil.FatalIfErr(t, err)
+	testutil.WriteString(t, f, "11\n12\n13\n14\n")
+	awaken(1)
+
+	fs.Stop()
+	wg.Wait()
+	close(lines)
+
+	received := testutil.LinesReceived(lines)
+
+	expected := []*logline.LogLine{
+		{context.TODO(), name, "1", ""},
+		{context.TODO(), name, "2", ""},
+		{context.TODO(), name, "3", ""},
+		{context.TODO(), name, "4", ""},
+		{context.TODO(), name, "5", ""},
+		{context.TODO(), name, "6", ""},
+		{context.TODO(), name, "7", ""},
+		{context.TODO(), name, "8", ""},
+		{context.TODO(), name, "9", ""},
+		{context.TODO(), name, "10", ""},
+		{context.TODO(), name, "11", ""},
+		{context.TODO(), name, "12", ""},
+		{context.TODO(), name, "13", ""},
+		{context.TODO(), name, "14", ""},
 	}
 	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
 
@@ -159,7 +527,7 @@ func TestFileStreamFinishedBecauseCancel(t *testing.T) {
 
 	received := testutil.LinesReceived(lines)
 	expected := []*logline.LogLine{
-		{context.TODO(), name, "yo"},
+		{context.TODO(), name, "yo", ""},
 	}
 	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
 
@@ -198,7 +566,7 @@ func TestFileStreamPartialRead(t *testing.T) {
 	close(lines)
 	received := testutil.LinesReceived(lines)
 	expected := []*logline.LogLine{
-		{context.TODO(), name, "yo"},
+		{context.TODO(), name, "yo", ""},
 	}
 	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
 
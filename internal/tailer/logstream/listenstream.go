@@ -0,0 +1,264 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logstream
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// unixScheme prefixes the pathname given to New to request a listening Unix
+// domain stream socket at that path.
+const unixScheme = "unix://"
+
+// framedUnixScheme prefixes the pathname given to New to request a listening
+// Unix domain stream socket at that path, reading length-prefixed records
+// instead of delimited ones.
+const framedUnixScheme = "unix+framed://"
+
+// tcpScheme prefixes the pathname given to New to request a listening TCP
+// socket at that host:port address.
+const tcpScheme = "tcp://"
+
+// framedTCPScheme prefixes the pathname given to New to request a listening
+// TCP socket at that host:port address, reading length-prefixed records
+// instead of delimited ones.
+const framedTCPScheme = "tcp+framed://"
+
+// maxFrameLength is the longest length-prefixed record read.  A connection
+// declaring a longer one is closed, as it is probably not framed at all.
+const maxFrameLength = 1 << 20
+
+// listenStream listens on a Unix domain or TCP stream socket and reads records
+// from every connection accepted on it.
+type listenStream struct {
+	ctx   context.Context
+	lines *lineQueue // where to send the lines read
+
+	pathname  string         // Name of the log, by which its lines and metrics are known
+	network   string         // Network of the listening socket, unix or tcp
+	address   string         // Address of the listening socket, a path or host:port
+	delimiter byte           // Record delimiter
+	framed    bool           // Records are prefixed by their length instead of delimited
+	exclude   *regexp.Regexp // Drop records matching this pattern, if not nil
+
+	mu           sync.RWMutex // protects following fields
+	completed    bool         // This listenstream is completed and can no longer be used.
+	lastReadTime time.Time    // Last time a log line was read from any connection
+	addr         net.Addr     // Address the socket is listening on
+
+	stopOnce sync.Once     // Ensure stopChan only closed once.
+	stopChan chan struct{} // Close to start graceful shutdown.
+}
+
+// newListenStream creates a log stream listening on the network address, and
+// naming the lines read pathname.
+func newListenStream(ctx context.Context, wg *sync.WaitGroup, pathname string, network string, address string, lines *lineQueue, framed bool, opts options) (LogStream, error) {
+	us := &listenStream{ctx: ctx, pathname: pathname, network: network, address: address, delimiter: opts.delimiter, framed: framed, exclude: opts.exclude, lastReadTime: time.Now(), lines: lines, stopChan: make(chan struct{})}
+	if err := us.stream(ctx, wg); err != nil {
+		return nil, err
+	}
+	return us, nil
+}
+
+func (us *listenStream) LastReadTime() time.Time {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+	return us.lastReadTime
+}
+
+func (us *listenStream) stream(ctx context.Context, wg *sync.WaitGroup) error {
+	l, err := net.Listen(us.network, us.address)
+	if err != nil {
+		logErrors.Add(us.pathname, 1)
+		return err
+	}
+	if ul, ok := l.(*net.UnixListener); ok {
+		// Closing the listener removes the socket file.
+		ul.SetUnlinkOnClose(true)
+	}
+	logOpens.Add(us.pathname, 1)
+	glog.V(2).Infof("listening on new socket %v", l.Addr())
+	us.mu.Lock()
+	us.addr = l.Addr()
+	us.mu.Unlock()
+	localHost, err := os.Hostname()
+	if err != nil {
+		glog.V(2).Infof("%s: couldn't get hostname: %s", us.pathname, err)
+	}
+	wg.Add(2)
+	// Stop accepting new connections on shutdown; established connections
+	// are read until their peer closes them, or the context is cancelled.
+	go func() {
+		defer wg.Done()
+		select {
+		case <-us.stopChan:
+			glog.V(2).Infof("%s: stream has been stopped, closing listener", us.pathname)
+		case <-ctx.Done():
+			glog.V(2).Infof("%s: context has been cancelled, closing listener", us.pathname)
+		}
+		if err := l.Close(); err != nil {
+			logErrors.Add(us.pathname, 1)
+			glog.Info(err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		var connWg sync.WaitGroup
+		defer func() {
+			connWg.Wait()
+			logCloses.Add(us.pathname, 1)
+			us.mu.Lock()
+			us.completed = true
+			us.mu.Unlock()
+		}()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				if !us.stopping() {
+					logErrors.Add(us.pathname, 1)
+					glog.Info(err)
+				}
+				return
+			}
+			glog.V(2).Infof("%s: accepted new connection %v", us.pathname, c)
+			connWg.Add(1)
+			go us.read(ctx, &connWg, c, localHost)
+		}
+	}()
+	return nil
+}
+
+// read sends the records read from c until its peer closes it or the context
+// is cancelled.
+func (us *listenStream) read(ctx context.Context, wg *sync.WaitGroup, c net.Conn, localHost string) {
+	defer wg.Done()
+	done := make(chan struct{})
+	defer close(done)
+	// Unblock the read below on cancellation.
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := c.SetReadDeadline(time.Now()); err != nil {
+				glog.V(2).Infof("%s: %s", us.pathname, err)
+			}
+		case <-done:
+		}
+	}()
+	var total int
+	defer func() {
+		glog.V(2).Infof("%v: read total %d bytes from %s", c, total, us.pathname)
+		glog.V(2).Infof("%v: closing connection", c)
+		if err := c.Close(); err != nil {
+			logErrors.Add(us.pathname, 1)
+			glog.Info(err)
+		}
+	}()
+	host := sourceHost(c.RemoteAddr(), localHost)
+	if us.framed {
+		total = us.readFrames(ctx, c, host)
+		return
+	}
+	b := make([]byte, defaultReadBufferSize)
+	partial := bytes.NewBufferString("")
+	for {
+		n, err := c.Read(b)
+		if n > 0 {
+			total += n
+			decodeAndSend(ctx, us.lines, us.pathname, host, n, b[:n], partial, us.delimiter, us.exclude)
+			us.mu.Lock()
+			us.lastReadTime = time.Now()
+			us.mu.Unlock()
+		}
+		if err != nil {
+			// EOF means the peer closed the connection.  Errors after
+			// cancellation are from the deadline set above.
+			if err != io.EOF && ctx.Err() == nil {
+				logErrors.Add(us.pathname, 1)
+				glog.Info(err)
+			}
+			if partial.Len() > 0 {
+				sendLine(ctx, us.pathname, host, partial, us.lines, us.exclude)
+			}
+			return
+		}
+	}
+}
+
+// readFrames sends the records read from c, each prefixed by its length as a
+// four byte big-endian integer, until its peer closes it or the context is
+// cancelled.  It returns the number of bytes read.
+func (us *listenStream) readFrames(ctx context.Context, c net.Conn, host string) int {
+	r := bufio.NewReaderSize(c, defaultReadBufferSize)
+	var total int
+	var header [4]byte
+	frame := new(bytes.Buffer)
+	for {
+		_, err := io.ReadFull(r, header[:])
+		if err == nil {
+			total += len(header)
+			length := binary.BigEndian.Uint32(header[:])
+			if length > maxFrameLength {
+				logErrors.Add(us.pathname, 1)
+				glog.Infof("%s: record length %d exceeds the maximum of %d, closing connection", us.pathname, length, maxFrameLength)
+				return total
+			}
+			var n int64
+			n, err = io.CopyN(frame, r, int64(length))
+			total += int(n)
+			if err == nil {
+				sendLine(ctx, us.pathname, host, frame, us.lines, us.exclude)
+				us.mu.Lock()
+				us.lastReadTime = time.Now()
+				us.mu.Unlock()
+				continue
+			}
+			// The peer closed the connection partway through a record.
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		// EOF between records means the peer closed the connection.  Errors
+		// after cancellation are from the deadline set by read.
+		if err != io.EOF && ctx.Err() == nil {
+			logErrors.Add(us.pathname, 1)
+			glog.Info(err)
+		}
+		return total
+	}
+}
+
+// stopping returns true if the stream has been asked to shut down.
+func (us *listenStream) stopping() bool {
+	select {
+	case <-us.stopChan:
+		return true
+	case <-us.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func (us *listenStream) IsComplete() bool {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+	return us.completed
+}
+
+func (us *listenStream) Stop() {
+	us.stopOnce.Do(func() {
+		close(us.stopChan)
+	})
+}
@@ -0,0 +1,156 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logstream
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/waker"
+)
+
+// dialListenStream connects to the socket ls is listening on.
+func dialListenStream(t *testing.T, ls LogStream) net.Conn {
+	t.Helper()
+	us := ls.(*listenStream)
+	us.mu.RLock()
+	addr := us.addr
+	us.mu.RUnlock()
+	c, err := net.Dial(addr.Network(), addr.String())
+	testutil.FatalIfErr(t, err)
+	return c
+}
+
+// frame returns s prefixed by its length as a four byte big-endian integer.
+func frame(s string) []byte {
+	b := make([]byte, 4, 4+len(s))
+	binary.BigEndian.PutUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func TestTCPStreamRead(t *testing.T) {
+	var wg sync.WaitGroup
+
+	name := "tcp://127.0.0.1:0"
+	lines := make(chan *logline.LogLine, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	lineCountCheck := testutil.ExpectMapExpvarDeltaWithDeadline(t, "log_lines_total", name, 2)
+	ts, err := New(ctx, &wg, waker.NewTestAlways(), name, lines, false)
+	testutil.FatalIfErr(t, err)
+
+	c := dialListenStream(t, ts)
+	_, err = c.Write([]byte("1\n2\n"))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, c.Close())
+	lineCountCheck()
+
+	ts.Stop()
+	wg.Wait()
+	close(lines)
+
+	received := testutil.LinesReceived(lines)
+	expected := []*logline.LogLine{
+		{Filename: name, Line: "1", SourceHost: "127.0.0.1"},
+		{Filename: name, Line: "2", SourceHost: "127.0.0.1"},
+	}
+	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+	cancel()
+	wg.Wait()
+}
+
+// TestFramedTCPStreamShortReads writes records a few bytes at a time, so that
+// their headers and bodies are each split across reads.
+func TestFramedTCPStreamShortReads(t *testing.T) {
+	var wg sync.WaitGroup
+
+	name := "tcp+framed://127.0.0.1:0"
+	lines := make(chan *logline.LogLine, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	lineCountCheck := testutil.ExpectMapExpvarDeltaWithDeadline(t, "log_lines_total", name, 2)
+	ts, err := New(ctx, &wg, waker.NewTestAlways(), name, lines, false)
+	testutil.FatalIfErr(t, err)
+
+	c := dialListenStream(t, ts)
+	b := append(frame("first"), frame("second\nline")...)
+	for len(b) > 0 {
+		n := 3
+		if n > len(b) {
+			n = len(b)
+		}
+		_, err = c.Write(b[:n])
+		testutil.FatalIfErr(t, err)
+		b = b[n:]
+		time.Sleep(time.Millisecond)
+	}
+	testutil.FatalIfErr(t, c.Close())
+	lineCountCheck()
+
+	ts.Stop()
+	wg.Wait()
+	close(lines)
+
+	received := testutil.LinesReceived(lines)
+	expected := []*logline.LogLine{
+		{Filename: name, Line: "first", SourceHost: "127.0.0.1"},
+		{Filename: name, Line: "second\nline", SourceHost: "127.0.0.1"},
+	}
+	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+	cancel()
+	wg.Wait()
+}
+
+// TestFramedTCPStreamFrameTooLong checks that a connection declaring a record
+// longer than maxFrameLength is closed, and that the stream still reads from
+// other connections.
+func TestFramedTCPStreamFrameTooLong(t *testing.T) {
+	var wg sync.WaitGroup
+
+	name := "tcp+framed://127.0.0.1:0"
+	lines := make(chan *logline.LogLine, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	errorCheck := testutil.ExpectMapExpvarDeltaWithDeadline(t, "log_errors_total", name, 1)
+	ts, err := New(ctx, &wg, waker.NewTestAlways(), name, lines, false)
+	testutil.FatalIfErr(t, err)
+
+	c := dialListenStream(t, ts)
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], maxFrameLength+1)
+	_, err = c.Write(header[:])
+	testutil.FatalIfErr(t, err)
+	// The stream closes the connection without waiting for the record.
+	testutil.FatalIfErr(t, c.SetReadDeadline(time.Now().Add(5*time.Second)))
+	if n, err := c.Read(make([]byte, 1)); err == nil {
+		t.Errorf("read %d bytes from a connection that should be closed", n)
+	}
+	testutil.FatalIfErr(t, c.Close())
+	errorCheck()
+
+	lineCountCheck := testutil.ExpectMapExpvarDeltaWithDeadline(t, "log_lines_total", name, 1)
+	c = dialListenStream(t, ts)
+	_, err = c.Write(frame("ok"))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, c.Close())
+	lineCountCheck()
+
+	ts.Stop()
+	wg.Wait()
+	close(lines)
+
+	received := testutil.LinesReceived(lines)
+	expected := []*logline.LogLine{
+		{Filename: name, Line: "ok", SourceHost: "127.0.0.1"},
+	}
+	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+	cancel()
+	wg.Wait()
+}
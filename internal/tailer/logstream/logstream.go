@@ -10,9 +10,12 @@ package logstream
 
 import (
 	"context"
+	"errors"
 	"expvar"
 	"fmt"
 	"os"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
 
@@ -36,18 +39,124 @@ type LogStream interface {
 	IsComplete() bool        // True if the logstream has completed work and cannot recover.  The caller should clean up this logstream, creating a new logstream on a pathname if necessary.
 }
 
+// Errors returned by New, which callers can test for with errors.Is to tell a
+// log that may yet become readable from one that never will.
+var (
+	ErrUnsupportedScheme = errors.New("unsupported log scheme")
+	ErrUnsupportedType   = errors.New("unsupported file object type")
+	ErrNotFound          = errors.New("log not found")
+	ErrPermission        = errors.New("permission denied")
+)
+
+// streamError is an error from New of one of the kinds above.  The underlying
+// error, such as an *os.PathError, is kept so that it can still be unwrapped.
+type streamError struct {
+	kind error
+	err  error
+}
+
+func (e *streamError) Error() string { return e.err.Error() }
+
+func (e *streamError) Unwrap() error { return e.err }
+
+func (e *streamError) Is(target error) bool { return target == e.kind }
+
+// classifyError returns err as a streamError of ErrNotFound or ErrPermission
+// if it is one of those, or else err unchanged.
+func classifyError(err error) error {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return &streamError{ErrNotFound, err}
+	case errors.Is(err, os.ErrPermission):
+		return &streamError{ErrPermission, err}
+	default:
+		return err
+	}
+}
+
+// schemePattern matches the scheme of a pathname given as a URL.
+var schemePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*://`)
+
+// IsURL returns true if pathname is given as a URL, such as unix://path or
+// ssh://host/path, rather than as a path on the filesystem.
+func IsURL(pathname string) bool {
+	return schemePattern.MatchString(pathname)
+}
+
 // defaultReadTimeout contains the timeout for reads from nonblocking read sources.
 const defaultReadTimeout = 10 * time.Millisecond
 
 // defaultReadBufferSize the size of the buffer for reading bytes into
 const defaultReadBufferSize = 4096
 
+// DefaultDelimiter is the byte that separates records in a log source, unless
+// another is given to New with RecordDelimiter.
+const DefaultDelimiter byte = '\n'
+
+// defaultDrainTimeout bounds how long a stream keeps reading towards EOF once
+// its context has been cancelled.
+const defaultDrainTimeout = time.Second
+
 // New creates a LogStream from the file object located at the absolute path
 // `pathname`.  The LogStream will watch `ctx` for a cancellation signal, and
 // notify the `wg` when it is Done.  Log lines will be sent to the `lines`
-// channel.  `seekToStart` is only used for testing and only works for regular
-// files that can be seeked.
-func New(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, lines chan<- *logline.LogLine, streamFromStart bool) (LogStream, error) {
+// channel, one for each record in the log, read as configured by `options`.
+// Lines read are queued by each LogStream, and the DropPolicy option says what
+// to do with a line read when its queue is full.
+// A `pathname` of the form unix://path creates and listens on a Unix domain
+// stream socket at path, reading from each connection accepted.
+// A `pathname` of the form unix+framed://path does the same, but reads records
+// each prefixed by their length as a four byte big-endian integer, which may
+// contain the delimiter.
+// Pathnames of the form tcp://host:port and tcp+framed://host:port do the same
+// on a listening TCP socket at that address, naming the lines read by the
+// whole pathname.
+// A `pathname` of the form ssh://user@host/path follows the log at path on
+// host by running tail over SSH, reconnecting when the connection drops.
+// `seekToStart` is only used for testing and only works for regular files
+// that can be seeked.
+// Errors opening the log match ErrUnsupportedScheme, ErrUnsupportedType,
+// ErrNotFound, or ErrPermission with errors.Is where they apply.
+func New(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, lines chan<- *logline.LogLine, streamFromStart bool, options ...Option) (LogStream, error) {
+	opts := defaultOptions
+	for _, opt := range options {
+		if err := opt.apply(&opts); err != nil {
+			return nil, err
+		}
+	}
+	// The stream's goroutines are done once they have queued their last
+	// line, and the forwarder is done once it has sent it.
+	var producers sync.WaitGroup
+	q := newLineQueue(defaultQueueSize, opts.policy)
+	ls, err := newLogStream(ctx, &producers, waker, pathname, q, streamFromStart, opts)
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	q.forward(wg, &producers, lines)
+	return ls, nil
+}
+
+func newLogStream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, lines *lineQueue, streamFromStart bool, opts options) (LogStream, error) {
+	if strings.HasPrefix(pathname, unixScheme) {
+		path := strings.TrimPrefix(pathname, unixScheme)
+		return newListenStream(ctx, wg, path, "unix", path, lines, false, opts)
+	}
+	if strings.HasPrefix(pathname, framedUnixScheme) {
+		path := strings.TrimPrefix(pathname, framedUnixScheme)
+		return newListenStream(ctx, wg, path, "unix", path, lines, true, opts)
+	}
+	if strings.HasPrefix(pathname, tcpScheme) {
+		return newListenStream(ctx, wg, pathname, "tcp", strings.TrimPrefix(pathname, tcpScheme), lines, false, opts)
+	}
+	if strings.HasPrefix(pathname, framedTCPScheme) {
+		return newListenStream(ctx, wg, pathname, "tcp", strings.TrimPrefix(pathname, framedTCPScheme), lines, true, opts)
+	}
+	if strings.HasPrefix(pathname, sshScheme) {
+		return newSSHStream(ctx, wg, pathname, lines, opts)
+	}
+	if scheme := schemePattern.FindString(pathname); scheme != "" {
+		return nil, &streamError{ErrUnsupportedScheme, fmt.Errorf("unsupported log scheme %q in %q", scheme, pathname)}
+	}
 	fi, err := os.Stat(pathname)
 	if err != nil {
 		logErrors.Add(pathname, 1)
@@ -55,12 +164,12 @@ func New(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname st
 	}
 	switch m := fi.Mode(); {
 	case m.IsRegular():
-		return newFileStream(ctx, wg, waker, pathname, fi, lines, streamFromStart)
+		return newFileStream(ctx, wg, waker, pathname, fi, lines, streamFromStart, opts)
 	case m&os.ModeType == os.ModeNamedPipe:
-		return newPipeStream(ctx, wg, waker, pathname, fi, lines)
+		return newPipeStream(ctx, wg, waker, pathname, fi, lines, opts)
 	case m&os.ModeType == os.ModeSocket:
-		return newSocketStream(ctx, wg, waker, pathname, fi, lines)
+		return newSocketStream(ctx, wg, waker, pathname, fi, lines, opts)
 	default:
-		return nil, fmt.Errorf("unsupported file object type at %q", pathname)
+		return nil, &streamError{ErrUnsupportedType, fmt.Errorf("unsupported file object type at %q", pathname)}
 	}
 }
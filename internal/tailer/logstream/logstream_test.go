@@ -0,0 +1,74 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logstream_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/tailer/logstream"
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/waker"
+)
+
+func newTestStream(t *testing.T, pathname string) error {
+	t.Helper()
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() { cancel(); wg.Wait() }()
+	lines := make(chan *logline.LogLine, 1)
+	ls, err := logstream.New(ctx, &wg, waker.NewTestAlways(), pathname, lines, false)
+	if err == nil {
+		ls.Stop()
+	}
+	return err
+}
+
+func TestNewErrors(t *testing.T) {
+	tmpDir := testutil.TestTempDir(t)
+
+	for _, tc := range []struct {
+		name     string
+		pathname string
+		want     error
+	}{
+		{"unsupported scheme", "gopher://example.com/log", logstream.ErrUnsupportedScheme},
+		{"unsupported type", tmpDir, logstream.ErrUnsupportedType},
+		{"not found", filepath.Join(tmpDir, "missing"), logstream.ErrNotFound},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := newTestStream(t, tc.pathname)
+			if !errors.Is(err, tc.want) {
+				t.Errorf("expected error matching %q, got %v", tc.want, err)
+			}
+		})
+	}
+
+	// The underlying error can still be tested for.
+	if err := newTestStream(t, filepath.Join(tmpDir, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected error matching os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestNewPermissionDenied(t *testing.T) {
+	// Can't force a permission denied error if run as root.
+	testutil.SkipIfRoot(t)
+	tmpDir := testutil.TestTempDir(t)
+
+	name := filepath.Join(tmpDir, "log")
+	f, err := os.OpenFile(name, os.O_CREATE, 0)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, f.Close())
+
+	err = newTestStream(t, name)
+	if !errors.Is(err, logstream.ErrPermission) {
+		t.Errorf("expected error matching %q, got %v", logstream.ErrPermission, err)
+	}
+}
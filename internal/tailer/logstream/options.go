@@ -0,0 +1,81 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logstream
+
+import (
+	"fmt"
+	"regexp"
+	"unicode/utf8"
+)
+
+// options are how a LogStream reads its log, as set by the Options given to New.
+type options struct {
+	offset    int64          // Byte offset to start reading a regular file at, or -1 for none
+	delimiter byte           // Record delimiter
+	exclude   *regexp.Regexp // Drop records matching this pattern, if not nil
+	encoding  Encoding       // Encoding of a regular file, unless it starts with a byte order mark
+	policy    DropPolicy     // What to do with a line when the queue is full
+}
+
+// defaultOptions are the options of a LogStream given no Options.
+var defaultOptions = options{offset: -1, delimiter: DefaultDelimiter, encoding: UTF8, policy: Block}
+
+// Option configures a new LogStream.
+type Option interface {
+	apply(*options) error
+}
+
+// RecordDelimiter sets the byte that separates records in the log, instead of
+// DefaultDelimiter.  It must be an ASCII byte.
+type RecordDelimiter byte
+
+func (opt RecordDelimiter) apply(o *options) error {
+	if opt >= utf8.RuneSelf {
+		return fmt.Errorf("record delimiter %q is not an ASCII byte", byte(opt))
+	}
+	o.delimiter = byte(opt)
+	return nil
+}
+
+// StartOffset makes a regular file be read from the byte offset, or from its
+// end if it is shorter, and then followed.  An offset of zero reads the file
+// from its start.
+type StartOffset int64
+
+func (opt StartOffset) apply(o *options) error {
+	if opt < 0 {
+		return fmt.Errorf("start offset must not be negative, not %d", int64(opt))
+	}
+	o.offset = int64(opt)
+	return nil
+}
+
+// ExcludePattern drops the records matching re, if not nil, instead of sending
+// them.
+func ExcludePattern(re *regexp.Regexp) Option {
+	return &excludePattern{re}
+}
+
+type excludePattern struct {
+	*regexp.Regexp
+}
+
+func (opt excludePattern) apply(o *options) error {
+	o.exclude = opt.Regexp
+	return nil
+}
+
+// An Encoding is also an Option, which sets the encoding that a regular file
+// is transcoded to UTF-8 from, unless the file starts with a byte order mark.
+func (opt Encoding) apply(o *options) error {
+	o.encoding = opt
+	return nil
+}
+
+// A DropPolicy is also an Option, which decides what to do with a line read
+// when the queue of the LogStream is full.
+func (opt DropPolicy) apply(o *options) error {
+	o.policy = opt
+	return nil
+}
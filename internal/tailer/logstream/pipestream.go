@@ -9,28 +9,30 @@ import (
 	"errors"
 	"io"
 	"os"
+	"regexp"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/golang/glog"
-	"github.com/google/mtail/internal/logline"
 	"github.com/google/mtail/internal/waker"
 )
 
 type pipeStream struct {
 	ctx   context.Context
-	lines chan<- *logline.LogLine
+	lines *lineQueue // where to send the lines read
 
-	pathname string // Given name for the underlying named pipe on the filesystem
+	pathname  string         // Given name for the underlying named pipe on the filesystem
+	delimiter byte           // Record delimiter
+	exclude   *regexp.Regexp // Drop records matching this pattern, if not nil
 
 	mu           sync.RWMutex // protects following fields
 	completed    bool         // This pipestream is completed and can no longer be used.
 	lastReadTime time.Time    // Last time a log line was read from this named pipe
 }
 
-func newPipeStream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, fi os.FileInfo, lines chan<- *logline.LogLine) (LogStream, error) {
-	ps := &pipeStream{ctx: ctx, pathname: pathname, lastReadTime: time.Now(), lines: lines}
+func newPipeStream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, fi os.FileInfo, lines *lineQueue, opts options) (LogStream, error) {
+	ps := &pipeStream{ctx: ctx, pathname: pathname, delimiter: opts.delimiter, exclude: opts.exclude, lastReadTime: time.Now(), lines: lines}
 	if err := ps.stream(ctx, wg, waker, fi); err != nil {
 		return nil, err
 	}
@@ -83,7 +85,7 @@ func (ps *pipeStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wake
 
 			if n > 0 {
 				total += n
-				decodeAndSend(ps.ctx, ps.lines, ps.pathname, n, b[:n], partial)
+				decodeAndSend(ps.ctx, ps.lines, ps.pathname, "", n, b[:n], partial, ps.delimiter, ps.exclude)
 				// Update the last read time if we were able to read anything.
 				ps.mu.Lock()
 				ps.lastReadTime = time.Now()
@@ -131,7 +133,7 @@ func (ps *pipeStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wake
 				case <-ctx.Done():
 					glog.V(2).Infof("%v: context has been cancelled, exiting", fd)
 					if partial.Len() > 0 {
-						sendLine(ctx, ps.pathname, partial, ps.lines)
+						sendLine(ctx, ps.pathname, "", partial, ps.lines, ps.exclude)
 					}
 					ps.mu.Lock()
 					ps.completed = true
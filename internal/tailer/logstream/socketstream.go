@@ -10,19 +10,21 @@ import (
 	"io"
 	"net"
 	"os"
+	"regexp"
 	"sync"
 	"time"
 
 	"github.com/golang/glog"
-	"github.com/google/mtail/internal/logline"
 	"github.com/google/mtail/internal/waker"
 )
 
 type socketStream struct {
 	ctx   context.Context
-	lines chan<- *logline.LogLine
+	lines *lineQueue // where to send the lines read
 
-	pathname string // Given name for the underlying socket path on the filesystem
+	pathname  string         // Given name for the underlying socket path on the filesystem
+	delimiter byte           // Record delimiter
+	exclude   *regexp.Regexp // Drop records matching this pattern, if not nil
 
 	mu           sync.RWMutex // protects following fields
 	completed    bool         // This pipestream is completed and can no longer be used.
@@ -32,8 +34,8 @@ type socketStream struct {
 	stopChan chan struct{} // Close to start graceful shutdown.
 }
 
-func newSocketStream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, fi os.FileInfo, lines chan<- *logline.LogLine) (LogStream, error) {
-	ss := &socketStream{ctx: ctx, pathname: pathname, lastReadTime: time.Now(), lines: lines, stopChan: make(chan struct{})}
+func newSocketStream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, fi os.FileInfo, lines *lineQueue, opts options) (LogStream, error) {
+	ss := &socketStream{ctx: ctx, pathname: pathname, delimiter: opts.delimiter, exclude: opts.exclude, lastReadTime: time.Now(), lines: lines, stopChan: make(chan struct{})}
 	if err := ss.stream(ctx, wg, waker, fi); err != nil {
 		return nil, err
 	}
@@ -53,6 +55,10 @@ func (ss *socketStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wa
 		return err
 	}
 	glog.V(2).Infof("opened new socket %v", c)
+	localHost, err := os.Hostname()
+	if err != nil {
+		glog.V(2).Infof("%s: couldn't get hostname: %s", ss.pathname, err)
+	}
 	wg.Add(1)
 	var total int
 	go func() {
@@ -73,17 +79,19 @@ func (ss *socketStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wa
 		b := make([]byte, 0, defaultReadBufferSize)
 		capB := cap(b)
 		partial := bytes.NewBufferString("")
+		var host string
 		var timedout bool
 		for {
 			if err := c.SetReadDeadline(time.Now().Add(defaultReadTimeout)); err != nil {
 				glog.V(2).Infof("%s: %s", ss.pathname, err)
 			}
 
-			n, err := c.Read(b[:capB])
+			n, addr, err := c.ReadFrom(b[:capB])
 
 			if n > 0 {
 				total += n
-				decodeAndSend(ss.ctx, ss.lines, ss.pathname, n, b[:n], partial)
+				host = sourceHost(addr, localHost)
+				decodeAndSend(ss.ctx, ss.lines, ss.pathname, host, n, b[:n], partial, ss.delimiter, ss.exclude)
 				ss.mu.Lock()
 				ss.lastReadTime = time.Now()
 				ss.mu.Unlock()
@@ -121,7 +129,7 @@ func (ss *socketStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wa
 				case <-ss.stopChan:
 					glog.V(2).Infof("%v: stream has been stopped, exiting", c)
 					if partial.Len() > 0 {
-						sendLine(ctx, ss.pathname, partial, ss.lines)
+						sendLine(ctx, ss.pathname, host, partial, ss.lines, ss.exclude)
 					}
 					ss.mu.Lock()
 					ss.completed = true
@@ -130,7 +138,7 @@ func (ss *socketStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wa
 				case <-ctx.Done():
 					glog.V(2).Infof("%v: context has been cancelled, exiting", c)
 					if partial.Len() > 0 {
-						sendLine(ctx, ss.pathname, partial, ss.lines)
+						sendLine(ctx, ss.pathname, host, partial, ss.lines, ss.exclude)
 					}
 					ss.mu.Lock()
 					ss.completed = true
@@ -165,6 +173,18 @@ func (ss *socketStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wa
 	return nil
 }
 
+// sourceHost returns the host that sent a datagram from addr.  Unix domain
+// sockets can only be written to from this host, so their peers are
+// attributed to localHost.
+func sourceHost(addr net.Addr, localHost string) string {
+	if addr != nil {
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			return host
+		}
+	}
+	return localHost
+}
+
 func (ss *socketStream) IsComplete() bool {
 	ss.mu.RLock()
 	defer ss.mu.RUnlock()
@@ -0,0 +1,69 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logstream
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/waker"
+)
+
+// TestSocketStreamSourceHost constructs the socket stream directly, because
+// logstream.New can't stat a socket that doesn't yet exist.
+func TestSocketStreamSourceHost(t *testing.T) {
+	var wg sync.WaitGroup
+
+	name := filepath.Join(testutil.TestTempDir(t), "sock")
+
+	lines := make(chan *logline.LogLine, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	waker, awaken := waker.NewTest(ctx, 1)
+
+	var producers sync.WaitGroup
+	q := newLineQueue(defaultQueueSize, Block)
+	ss, err := newSocketStream(ctx, &producers, waker, name, nil, q, defaultOptions)
+	testutil.FatalIfErr(t, err)
+	q.forward(&wg, &producers, lines)
+
+	s, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	testutil.FatalIfErr(t, err)
+	_, err = s.Write([]byte("1\n"))
+	testutil.FatalIfErr(t, err)
+	awaken(1)
+
+	ss.Stop()
+	cancel()
+	wg.Wait()
+	close(lines)
+
+	hostname, err := os.Hostname()
+	testutil.FatalIfErr(t, err)
+	received := testutil.LinesReceived(lines)
+	expected := []*logline.LogLine{
+		{Filename: name, Line: "1", SourceHost: hostname},
+	}
+	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+}
+
+func TestSourceHost(t *testing.T) {
+	for _, tc := range []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 514}, "192.0.2.1"},
+		{&net.UnixAddr{Name: "", Net: "unixgram"}, "localhost"},
+		{nil, "localhost"},
+	} {
+		if got := sourceHost(tc.addr, "localhost"); got != tc.want {
+			t.Errorf("sourceHost(%v) = %q, want %q", tc.addr, got, tc.want)
+		}
+	}
+}
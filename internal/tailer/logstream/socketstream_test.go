@@ -6,6 +6,7 @@ package logstream_test
 import (
 	"context"
 	"net"
+	"os"
 	"path/filepath"
 	"sync"
 	"testing"
@@ -43,9 +44,11 @@ func TestSocketStreamRead(t *testing.T) {
 	wg.Wait()
 	close(lines)
 
+	hostname, err := os.Hostname()
+	testutil.FatalIfErr(t, err)
 	received := testutil.LinesReceived(lines)
 	expected := []*logline.LogLine{
-		{context.TODO(), name, "1"},
+		{context.TODO(), name, "1", hostname},
 	}
 	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
 
@@ -87,9 +90,11 @@ func TestSocketStreamCompletedBecauseSocketClosed(t *testing.T) {
 	wg.Wait()
 	close(lines)
 
+	hostname, err := os.Hostname()
+	testutil.FatalIfErr(t, err)
 	received := testutil.LinesReceived(lines)
 	expected := []*logline.LogLine{
-		{context.TODO(), name, "1"},
+		{context.TODO(), name, "1", hostname},
 	}
 	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
 
@@ -128,9 +133,11 @@ func TestSocketStreamCompletedBecauseCancel(t *testing.T) {
 	wg.Wait()
 	close(lines)
 
+	hostname, err := os.Hostname()
+	testutil.FatalIfErr(t, err)
 	received := testutil.LinesReceived(lines)
 	expected := []*logline.LogLine{
-		{context.TODO(), name, "1"},
+		{context.TODO(), name, "1", hostname},
 	}
 	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
 
@@ -0,0 +1,251 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logstream
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// sshScheme prefixes the pathname given to New to request a log on a remote
+// host, read over SSH, as in ssh://user@host/path/to/log.
+const sshScheme = "ssh://"
+
+var (
+	// sshMinBackoff is the wait before the first attempt to reconnect a
+	// dropped SSH connection.  The wait doubles after each failed attempt, up
+	// to sshMaxBackoff.
+	sshMinBackoff = time.Second
+	sshMaxBackoff = time.Minute
+
+	// sshDial connects to the remote host and starts following the log.  It is
+	// a variable so that tests can replace the SSH transport.
+	sshDial = dialSSH
+)
+
+// sshStream follows a log on a remote host by running tail over SSH, and
+// reconnects when the connection drops.
+type sshStream struct {
+	ctx   context.Context
+	lines *lineQueue // where to send the lines read
+
+	pathname  string         // The ssh:// URL of the log
+	url       *url.URL       // The parsed pathname
+	delimiter byte           // Record delimiter
+	exclude   *regexp.Regexp // Drop records matching this pattern, if not nil
+
+	mu           sync.RWMutex // protects following fields
+	completed    bool         // This sshstream is completed and can no longer be used.
+	lastReadTime time.Time    // Last time a log line was read from the remote host
+
+	stopOnce sync.Once     // Ensure stopChan only closed once.
+	stopChan chan struct{} // Close to start graceful shutdown.
+}
+
+func newSSHStream(ctx context.Context, wg *sync.WaitGroup, pathname string, lines *lineQueue, opts options) (LogStream, error) {
+	u, err := url.Parse(pathname)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" || u.Path == "" {
+		return nil, fmt.Errorf("%q is not of the form ssh://user@host/path/to/log", pathname)
+	}
+	ss := &sshStream{ctx: ctx, pathname: pathname, url: u, delimiter: opts.delimiter, exclude: opts.exclude, lastReadTime: time.Now(), lines: lines, stopChan: make(chan struct{})}
+	ss.stream(ctx, wg)
+	return ss, nil
+}
+
+// sshArgs returns the arguments to ssh that follow the log at u.  The remote
+// command is ended when the connection closes: tail runs in the background,
+// and is killed once the remote standard input closes.  Only lines written
+// after connecting are read, so lines written while disconnected are lost.
+func sshArgs(u *url.URL) []string {
+	args := []string{"-o", "BatchMode=yes", "-o", "ServerAliveInterval=30"}
+	if port := u.Port(); port != "" {
+		args = append(args, "-p", port)
+	}
+	target := u.Hostname()
+	if u.User != nil {
+		target = u.User.Username() + "@" + target
+	}
+	quoted := "'" + strings.ReplaceAll(u.Path, "'", `'\''`) + "'"
+	return append(args, target, "tail -n 0 -F "+quoted+" & cat >/dev/null; kill $!")
+}
+
+// dialSSH runs ssh to follow the log at u, returning its output.  Closing it
+// ends the connection, and so the remote command.
+func dialSSH(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+	cmd := exec.CommandContext(ctx, "ssh", sshArgs(u)...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &sshConn{cmd: cmd, stdin: stdin, stdout: stdout}, nil
+}
+
+// sshConn is the output of a running ssh command.
+type sshConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+}
+
+func (c *sshConn) Read(b []byte) (int, error) {
+	return c.stdout.Read(b)
+}
+
+// Close closes the standard input of ssh so the remote command ends, and kills
+// ssh in case the connection is hung.
+func (c *sshConn) Close() error {
+	c.stdin.Close()
+	// The process may have already exited if the connection dropped.
+	c.cmd.Process.Kill()
+	if err := c.cmd.Wait(); err != nil {
+		glog.V(2).Infof("ssh exited: %s", err)
+	}
+	return nil
+}
+
+func (ss *sshStream) LastReadTime() time.Time {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	return ss.lastReadTime
+}
+
+// stream connects to the remote host and reads from it until the stream is
+// stopped or the context cancelled, reconnecting with backoff each time the
+// connection drops or fails.
+func (ss *sshStream) stream(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer func() {
+			ss.mu.Lock()
+			ss.completed = true
+			ss.mu.Unlock()
+		}()
+		backoff := sshMinBackoff
+		for {
+			c, err := sshDial(ctx, ss.url)
+			if err != nil {
+				logErrors.Add(ss.pathname, 1)
+				glog.Infof("%s: %s", ss.pathname, err)
+			} else {
+				logOpens.Add(ss.pathname, 1)
+				if ss.read(ctx, c) {
+					backoff = sshMinBackoff
+				}
+				logCloses.Add(ss.pathname, 1)
+			}
+			if ss.stopping() {
+				return
+			}
+			glog.Infof("%s: reconnecting in %s", ss.pathname, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-ss.stopChan:
+				return
+			case <-ctx.Done():
+				return
+			}
+			backoff *= 2
+			if backoff > sshMaxBackoff {
+				backoff = sshMaxBackoff
+			}
+		}
+	}()
+}
+
+// read sends the records read from c until the connection drops, the stream
+// is stopped, or the context is cancelled.  It returns true if anything was
+// read.
+func (ss *sshStream) read(ctx context.Context, c io.ReadCloser) bool {
+	var closeOnce sync.Once
+	closeConn := func() {
+		closeOnce.Do(func() {
+			if err := c.Close(); err != nil {
+				logErrors.Add(ss.pathname, 1)
+				glog.Info(err)
+			}
+		})
+	}
+	done := make(chan struct{})
+	defer close(done)
+	defer closeConn()
+	// Unblock the read below on shutdown.
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-ss.stopChan:
+		case <-done:
+			return
+		}
+		closeConn()
+	}()
+	var total int
+	b := make([]byte, defaultReadBufferSize)
+	partial := bytes.NewBufferString("")
+	for {
+		n, err := c.Read(b)
+		if n > 0 {
+			total += n
+			decodeAndSend(ctx, ss.lines, ss.pathname, ss.url.Hostname(), n, b[:n], partial, ss.delimiter, ss.exclude)
+			ss.mu.Lock()
+			ss.lastReadTime = time.Now()
+			ss.mu.Unlock()
+		}
+		if err != nil {
+			if !ss.stopping() {
+				logErrors.Add(ss.pathname, 1)
+				glog.Infof("%s: connection lost after reading %d bytes: %s", ss.pathname, total, err)
+			}
+			if partial.Len() > 0 {
+				sendLine(ctx, ss.pathname, ss.url.Hostname(), partial, ss.lines, ss.exclude)
+			}
+			return total > 0
+		}
+	}
+}
+
+// stopping returns true if the stream has been asked to shut down.
+func (ss *sshStream) stopping() bool {
+	select {
+	case <-ss.stopChan:
+		return true
+	case <-ss.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func (ss *sshStream) IsComplete() bool {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	return ss.completed
+}
+
+// Stop closes the connection, as a remote log never reaches EOF.
+func (ss *sshStream) Stop() {
+	ss.stopOnce.Do(func() {
+		close(ss.stopChan)
+	})
+}
@@ -0,0 +1,105 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logstream
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/waker"
+)
+
+// fakeSSHConn is a connection from the fake SSH transport, written to by the
+// test.
+type fakeSSHConn struct {
+	*io.PipeReader
+	w      *io.PipeWriter
+	closed chan struct{}
+}
+
+func (c *fakeSSHConn) Close() error {
+	close(c.closed)
+	return c.PipeReader.Close()
+}
+
+// fakeSSHTransport replaces the SSH transport, returning a channel that
+// receives each connection dialled, and a func to restore the real transport.
+func fakeSSHTransport() (<-chan *fakeSSHConn, func()) {
+	conns := make(chan *fakeSSHConn, 1)
+	oldDial, oldBackoff := sshDial, sshMinBackoff
+	sshDial = func(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+		r, w := io.Pipe()
+		c := &fakeSSHConn{PipeReader: r, w: w, closed: make(chan struct{})}
+		conns <- c
+		return c, nil
+	}
+	sshMinBackoff = time.Millisecond
+	return conns, func() {
+		sshDial, sshMinBackoff = oldDial, oldBackoff
+	}
+}
+
+func TestSSHStreamReconnects(t *testing.T) {
+	var wg sync.WaitGroup
+	conns, restore := fakeSSHTransport()
+	defer restore()
+
+	name := "ssh://user@host/var/log/app.log"
+	lines := make(chan *logline.LogLine, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ss, err := New(ctx, &wg, waker.NewTestAlways(), name, lines, false)
+	testutil.FatalIfErr(t, err)
+
+	c := <-conns
+	_, err = c.w.Write([]byte("1\n"))
+	testutil.FatalIfErr(t, err)
+	// Drop the connection.
+	testutil.FatalIfErr(t, c.w.Close())
+
+	c = <-conns
+	_, err = c.w.Write([]byte("2\n"))
+	testutil.FatalIfErr(t, err)
+
+	cancel()
+	select {
+	case <-c.closed:
+	case <-time.After(time.Second):
+		t.Error("connection not closed on cancellation")
+	}
+	wg.Wait()
+	close(lines)
+
+	received := testutil.LinesReceived(lines)
+	expected := []*logline.LogLine{
+		{Filename: name, Line: "1", SourceHost: "host"},
+		{Filename: name, Line: "2", SourceHost: "host"},
+	}
+	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+
+	if !ss.IsComplete() {
+		t.Errorf("expecting sshstream to be complete because cancelled")
+	}
+}
+
+func TestSSHArgs(t *testing.T) {
+	u, err := url.Parse("ssh://admin@legacy:2222/var/log/it's.log")
+	testutil.FatalIfErr(t, err)
+	expected := []string{"-o", "BatchMode=yes", "-o", "ServerAliveInterval=30", "-p", "2222", "admin@legacy", `tail -n 0 -F '/var/log/it'\''s.log' & cat >/dev/null; kill $!`}
+	testutil.ExpectNoDiff(t, expected, sshArgs(u))
+}
+
+func TestSSHStreamBadURL(t *testing.T) {
+	var wg sync.WaitGroup
+	_, err := New(context.Background(), &wg, waker.NewTestAlways(), "ssh://host", nil, false)
+	if err == nil {
+		t.Error("expecting error for ssh url without a path")
+	}
+}
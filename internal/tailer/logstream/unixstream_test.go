@@ -0,0 +1,107 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logstream_test
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/tailer/logstream"
+	"github.com/google/mtail/internal/testutil"
+	"github.com/google/mtail/internal/waker"
+)
+
+func TestUnixStreamRead(t *testing.T) {
+	var wg sync.WaitGroup
+
+	tmpDir := testutil.TestTempDir(t)
+
+	name := filepath.Join(tmpDir, "sock")
+
+	lines := make(chan *logline.LogLine, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	lineCountCheck := testutil.ExpectMapExpvarDeltaWithDeadline(t, "log_lines_total", name, 2)
+	us, err := logstream.New(ctx, &wg, waker.NewTestAlways(), "unix://"+name, lines, false)
+	testutil.FatalIfErr(t, err)
+
+	s, err := net.DialUnix("unix", nil, &net.UnixAddr{name, "unix"})
+	testutil.FatalIfErr(t, err)
+	_, err = s.Write([]byte("1\n2\n"))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, s.Close())
+	lineCountCheck()
+
+	us.Stop()
+	wg.Wait()
+	close(lines)
+
+	hostname, err := os.Hostname()
+	testutil.FatalIfErr(t, err)
+	received := testutil.LinesReceived(lines)
+	expected := []*logline.LogLine{
+		{context.TODO(), name, "1", hostname},
+		{context.TODO(), name, "2", hostname},
+	}
+	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+
+	if !us.IsComplete() {
+		t.Errorf("expecting unixstream to be complete because stopped")
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("expecting socket %q to be removed, stat: %v", name, err)
+	}
+	cancel()
+	wg.Wait()
+}
+
+func TestFramedUnixStreamRead(t *testing.T) {
+	var wg sync.WaitGroup
+
+	tmpDir := testutil.TestTempDir(t)
+
+	name := filepath.Join(tmpDir, "sock")
+
+	lines := make(chan *logline.LogLine, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	lineCountCheck := testutil.ExpectMapExpvarDeltaWithDeadline(t, "log_lines_total", name, 2)
+	us, err := logstream.New(ctx, &wg, waker.NewTestAlways(), "unix+framed://"+name, lines, false)
+	testutil.FatalIfErr(t, err)
+
+	s, err := net.DialUnix("unix", nil, &net.UnixAddr{name, "unix"})
+	testutil.FatalIfErr(t, err)
+	var b []byte
+	for _, frame := range []string{"first", "second\nline"} {
+		var header [4]byte
+		binary.BigEndian.PutUint32(header[:], uint32(len(frame)))
+		b = append(b, header[:]...)
+		b = append(b, frame...)
+	}
+	_, err = s.Write(b)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, s.Close())
+	lineCountCheck()
+
+	us.Stop()
+	wg.Wait()
+	close(lines)
+
+	hostname, err := os.Hostname()
+	testutil.FatalIfErr(t, err)
+	received := testutil.LinesReceived(lines)
+	expected := []*logline.LogLine{
+		{context.TODO(), name, "first", hostname},
+		{context.TODO(), name, "second\nline", hostname},
+	}
+	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+	cancel()
+	wg.Wait()
+}
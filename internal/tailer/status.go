@@ -4,10 +4,13 @@
 package tailer
 
 import (
+	"encoding/json"
 	"expvar"
 	"html/template"
 	"io"
+	"net/http"
 
+	"github.com/golang/glog"
 	"github.com/google/mtail/internal/tailer/logstream"
 )
 
@@ -82,3 +85,69 @@ func (t *Tailer) WriteStatusHTML(w io.Writer) error {
 	}
 	return tpl.Execute(w, data)
 }
+
+// AddPathHandler tails the pathname given by the path parameter of a POST
+// request, so that an orchestrator can tell mtail which logs to read instead
+// of it matching patterns.
+func (t *Tailer) AddPathHandler(w http.ResponseWriter, r *http.Request) {
+	pathname, ok := pathParam(w, r)
+	if !ok {
+		return
+	}
+	if err := t.AddPath(pathname); err != nil {
+		if err == ErrPathNotAllowed {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+// RemovePathHandler stops tailing the pathname given by the path parameter of
+// a POST request.
+func (t *Tailer) RemovePathHandler(w http.ResponseWriter, r *http.Request) {
+	pathname, ok := pathParam(w, r)
+	if !ok {
+		return
+	}
+	if err := t.RemovePath(pathname); err != nil {
+		if err == ErrPathNotTailed {
+			http.Error(w, "No tailed path found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+// pathParam returns the path parameter of a POST request, or writes an error
+// to w and returns false.
+func pathParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return "", false
+	}
+	pathname := r.FormValue("path")
+	if pathname == "" {
+		http.Error(w, "No path given", http.StatusBadRequest)
+		return "", false
+	}
+	return pathname, true
+}
+
+// TailedPathsHandler exports the pathnames being tailed as JSON.
+func (t *Tailer) TailedPathsHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := json.MarshalIndent(t.TailedPaths(), "", "  ")
+	if err != nil {
+		glog.Info("error marshalling tailed paths into json:", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	if _, err := w.Write(b); err != nil {
+		glog.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
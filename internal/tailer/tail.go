@@ -13,6 +13,8 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -37,10 +39,26 @@ type Tailer struct {
 
 	globPatternsMu     sync.RWMutex        // protects `globPatterns'
 	globPatterns       map[string]struct{} // glob patterns to match newly created logs in dir paths against
+	urls               map[string]struct{} // log URLs like unix:// and ssh://, tailed as given instead of matched
 	ignoreRegexPattern *regexp.Regexp
 
+	pathsMu sync.RWMutex        // protects `paths' and `removed'
+	paths   map[string]struct{} // absolute pathnames added with AddPath, tailed whether or not they match a pattern
+	removed map[string]struct{} // absolute pathnames removed with RemovePath, not tailed even if they match a pattern
+
+	addPathPrefix string // directory that AddPath may add pathnames under, when they match no pattern
+
 	oneShot bool
 
+	recordDelimiter byte           // byte separating records in each log
+	excludePattern  *regexp.Regexp // records matching this are dropped before reaching the VM
+
+	encoding logstream.Encoding // encoding of logs without a byte order mark
+
+	linesPolicy logstream.DropPolicy // what logstreams do with a line when their queue is full
+
+	startOffsets map[string]int64 // Byte offsets to start reading at, by absolute pathname, until first tailed.
+
 	pollMu sync.Mutex // protects Poll()
 
 	logstreamPollWaker waker.Waker                    // Used for waking idle logstreams
@@ -86,6 +104,95 @@ func (opt IgnoreRegex) apply(t *Tailer) error {
 	return nil
 }
 
+// RecordDelimiter sets the byte that separates records in the logs, instead of newline.
+type RecordDelimiter byte
+
+func (opt RecordDelimiter) apply(t *Tailer) error {
+	t.recordDelimiter = byte(opt)
+	return nil
+}
+
+// ExcludePattern sets the regular expression matching records to drop from all logs before they are sent to the VM.
+type ExcludePattern string
+
+func (opt ExcludePattern) apply(t *Tailer) error {
+	if opt == "" {
+		return nil
+	}
+	re, err := regexp.Compile(string(opt))
+	if err != nil {
+		return err
+	}
+	t.excludePattern = re
+	return nil
+}
+
+// LogEncoding sets the character encoding of the logs, from which they are
+// transcoded to UTF-8, unless a log starts with a byte order mark.
+type LogEncoding string
+
+func (opt LogEncoding) apply(t *Tailer) error {
+	enc, err := logstream.ParseEncoding(string(opt))
+	if err != nil {
+		return err
+	}
+	t.encoding = enc
+	return nil
+}
+
+// LinesFullPolicy sets what logstreams do with a line they have read when
+// their queue for the lines channel is full: block, drop-newest, or
+// drop-oldest.
+type LinesFullPolicy string
+
+func (opt LinesFullPolicy) apply(t *Tailer) error {
+	p, err := logstream.ParseDropPolicy(string(opt))
+	if err != nil {
+		return err
+	}
+	t.linesPolicy = p
+	return nil
+}
+
+// AddPathPrefix sets the directory that AddPath may add pathnames under, as
+// well as those matching the LogPatterns.
+type AddPathPrefix string
+
+func (opt AddPathPrefix) apply(t *Tailer) error {
+	if opt == "" {
+		return nil
+	}
+	absPath, err := filepath.Abs(string(opt))
+	if err != nil {
+		return err
+	}
+	t.addPathPrefix = absPath
+	return nil
+}
+
+// StartOffset makes the first logstream on pathname start reading at the byte
+// offset, rather than at the end of the log.
+func StartOffset(pathname string, offset int64) Option {
+	return &startOffset{pathname, offset}
+}
+
+type startOffset struct {
+	pathname string
+	offset   int64
+}
+
+func (opt startOffset) apply(t *Tailer) error {
+	if opt.offset < 0 {
+		return fmt.Errorf("start offset of %q must not be negative, not %d", opt.pathname, opt.offset)
+	}
+	absPath, err := filepath.Abs(opt.pathname)
+	if err != nil {
+		return err
+	}
+	t.startOffsets[absPath] = opt.offset
+	return nil
+}
+
 // StaleLogGcWaker triggers garbage collection runs for stale logs in the tailer.
 func StaleLogGcWaker(w waker.Waker) Option {
 	return &staleLogGcWaker{w}
@@ -134,17 +241,26 @@ func New(ctx context.Context, wg *sync.WaitGroup, lines chan<- *logline.LogLine,
 		return nil, errors.New("Tailer needs a lines channel")
 	}
 	t := &Tailer{
-		ctx:          ctx,
-		lines:        lines,
-		initDone:     make(chan struct{}),
-		globPatterns: make(map[string]struct{}),
-		logstreams:   make(map[string]logstream.LogStream),
+		ctx:             ctx,
+		lines:           lines,
+		initDone:        make(chan struct{}),
+		globPatterns:    make(map[string]struct{}),
+		urls:            make(map[string]struct{}),
+		paths:           make(map[string]struct{}),
+		removed:         make(map[string]struct{}),
+		logstreams:      make(map[string]logstream.LogStream),
+		startOffsets:    make(map[string]int64),
+		recordDelimiter: logstream.DefaultDelimiter,
+		encoding:        logstream.UTF8,
+		linesPolicy:     logstream.Block,
 	}
 	defer close(t.initDone)
 	if err := t.SetOption(options...); err != nil {
 		return nil, err
 	}
-	if len(t.globPatterns) == 0 {
+	// Without patterns there is nothing to read, unless paths may yet be
+	// added under the AddPathPrefix with AddPath.
+	if len(t.globPatterns) == 0 && len(t.urls) == 0 && (t.oneShot || t.addPathPrefix == "") {
 		glog.Info("No patterns to tail, tailer done.")
 		close(t.lines)
 		return t, nil
@@ -191,7 +307,15 @@ func (t *Tailer) SetOption(options ...Option) error {
 }
 
 // AddPattern adds a pattern to the list of patterns to filter filenames against.
+// A pattern given as a URL, such as unix://path, is instead tailed as given.
 func (t *Tailer) AddPattern(pattern string) error {
+	if logstream.IsURL(pattern) {
+		glog.V(2).Infof("AddPattern: URL %s", pattern)
+		t.globPatternsMu.Lock()
+		t.urls[pattern] = struct{}{}
+		t.globPatternsMu.Unlock()
+		return nil
+	}
 	absPath, err := filepath.Abs(pattern)
 	if err != nil {
 		glog.V(2).Infof("Couldn't canonicalize path %q: %s", pattern, err)
@@ -204,6 +328,140 @@ func (t *Tailer) AddPattern(pattern string) error {
 	return nil
 }
 
+// Errors returned by AddPath and RemovePath.
+var (
+	ErrPathNotAllowed = errors.New("path matches no log pattern and is not under the added path prefix")
+	ErrPathNotTailed  = errors.New("path is not tailed")
+)
+
+// AddPath adds pathname to the logs that are tailed.  It is tailed at once if
+// it exists, or else once it is created.  The pathname must match one of the
+// patterns or be under the AddPathPrefix.  A pathname given as a URL, such as
+// unix://path, is tailed as given.
+func (t *Tailer) AddPath(pathname string) error {
+	absPath, err := canonicalPath(pathname)
+	if err != nil {
+		return err
+	}
+	if !t.mayAdd(absPath) {
+		return ErrPathNotAllowed
+	}
+	glog.V(2).Infof("AddPath: %s", absPath)
+	t.pathsMu.Lock()
+	t.paths[absPath] = struct{}{}
+	delete(t.removed, absPath)
+	t.pathsMu.Unlock()
+	return t.tailAddedPath(absPath)
+}
+
+// mayAdd returns true if absPath matches one of the patterns or is under the
+// AddPathPrefix.
+func (t *Tailer) mayAdd(absPath string) bool {
+	if t.addPathPrefix != "" && strings.HasPrefix(absPath, t.addPathPrefix+string(filepath.Separator)) {
+		return true
+	}
+	t.globPatternsMu.RLock()
+	defer t.globPatternsMu.RUnlock()
+	if _, ok := t.urls[absPath]; ok {
+		return true
+	}
+	for pattern := range t.globPatterns {
+		if ok, _ := filepath.Match(pattern, absPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalPath returns the absolute path of pathname, or pathname unchanged
+// if it is a URL.
+func canonicalPath(pathname string) (string, error) {
+	if logstream.IsURL(pathname) {
+		return pathname, nil
+	}
+	return filepath.Abs(pathname)
+}
+
+// tailAddedPath tails absPath, a pathname added with AddPath, if it exists.
+func (t *Tailer) tailAddedPath(absPath string) error {
+	if logstream.IsURL(absPath) {
+		return t.TailPath(absPath)
+	}
+	if _, err := os.Stat(absPath); err != nil {
+		if os.IsNotExist(err) {
+			glog.V(2).Infof("added path %q does not exist yet", absPath)
+			return nil
+		}
+		return err
+	}
+	return t.TailPath(absPath)
+}
+
+// RemovePath stops tailing pathname, whether it was added with AddPath or
+// matched a pattern, and it is not tailed again unless it is added.  The
+// lines already written to it are read before its logstream completes.
+func (t *Tailer) RemovePath(pathname string) error {
+	absPath, err := canonicalPath(pathname)
+	if err != nil {
+		return err
+	}
+	t.logstreamsMu.Lock()
+	defer t.logstreamsMu.Unlock()
+	t.pathsMu.Lock()
+	_, added := t.paths[absPath]
+	l, tailed := t.logstreams[absPath]
+	if !added && !tailed {
+		t.pathsMu.Unlock()
+		return ErrPathNotTailed
+	}
+	delete(t.paths, absPath)
+	t.removed[absPath] = struct{}{}
+	t.pathsMu.Unlock()
+	glog.V(2).Infof("RemovePath: %s", absPath)
+	if tailed {
+		l.Stop()
+		delete(t.logstreams, absPath)
+		logCount.Add(-1)
+		glog.Infof("Stopped tailing %s", absPath)
+	}
+	return nil
+}
+
+// isRemoved returns true if absPath was removed with RemovePath.
+func (t *Tailer) isRemoved(absPath string) bool {
+	t.pathsMu.RLock()
+	defer t.pathsMu.RUnlock()
+	_, ok := t.removed[absPath]
+	return ok
+}
+
+// TailedPath describes a pathname being tailed, as returned by TailedPaths.
+type TailedPath struct {
+	Pathname string `json:"pathname"`
+	Added    bool   `json:"added"` // True if the pathname was added with AddPath.
+}
+
+// TailedPaths returns the pathnames with a logstream, and those added with
+// AddPath that are yet to be created, sorted by pathname.
+func (t *Tailer) TailedPaths() []TailedPath {
+	t.logstreamsMu.RLock()
+	t.pathsMu.RLock()
+	paths := make([]TailedPath, 0, len(t.logstreams))
+	for pathname := range t.logstreams {
+		_, added := t.paths[pathname]
+		paths = append(paths, TailedPath{Pathname: pathname, Added: added})
+	}
+	for pathname := range t.paths {
+		if _, ok := t.logstreams[pathname]; !ok {
+			paths = append(paths, TailedPath{Pathname: pathname, Added: true})
+		}
+	}
+	t.pathsMu.RUnlock()
+	t.logstreamsMu.RUnlock()
+	sort.Slice(paths, func(i, j int) bool { return paths[i].Pathname < paths[j].Pathname })
+	return paths
+}
+
 func (t *Tailer) Ignore(pathname string) (bool, error) {
 	absPath, err := filepath.Abs(pathname)
 	if err != nil {
@@ -235,10 +493,15 @@ func (t *Tailer) SetIgnorePattern(pattern string) error {
 	return nil
 }
 
-// TailPath registers a filesystem pathname to be tailed.
+// TailPath registers a filesystem pathname to be tailed.  No new pathnames
+// are tailed once the Tailer is shutting down.
 func (t *Tailer) TailPath(pathname string) error {
 	t.logstreamsMu.Lock()
 	defer t.logstreamsMu.Unlock()
+	if t.ctx.Err() != nil {
+		glog.V(2).Infof("shutting down, not tailing %q", pathname)
+		return nil
+	}
 	if l, ok := t.logstreams[pathname]; ok {
 		if !l.IsComplete() {
 			glog.V(2).Infof("already got a logstream on %q", pathname)
@@ -247,10 +510,16 @@ func (t *Tailer) TailPath(pathname string) error {
 		logCount.Add(-1) // Removing the current entry before re-adding.
 		glog.V(2).Infof("Existing logstream is finished, creating a new one.")
 	}
-	l, err := logstream.New(t.ctx, &t.wg, t.logstreamPollWaker, pathname, t.lines, t.oneShot)
+	// The start offset only applies to the first logstream on the pathname.
+	opts := []logstream.Option{logstream.RecordDelimiter(t.recordDelimiter), logstream.ExcludePattern(t.excludePattern), t.encoding, t.linesPolicy}
+	if offset, ok := t.startOffsets[pathname]; ok {
+		opts = append(opts, logstream.StartOffset(offset))
+	}
+	l, err := logstream.New(t.ctx, &t.wg, t.logstreamPollWaker, pathname, t.lines, t.oneShot, opts...)
 	if err != nil {
 		return err
 	}
+	delete(t.startOffsets, pathname)
 	if t.oneShot {
 		glog.V(2).Infof("Starting oneshot read at startup of %q", pathname)
 		l.Stop()
@@ -350,12 +619,34 @@ func (t *Tailer) PollLogPatterns() error {
 			if err != nil {
 				return err
 			}
+			if t.isRemoved(absPath) {
+				continue
+			}
 			glog.V(2).Infof("watched path is %q", absPath)
 			if err := t.TailPath(absPath); err != nil {
 				glog.Info(err)
 			}
 		}
 	}
+	for url := range t.urls {
+		if t.isRemoved(url) {
+			continue
+		}
+		if err := t.TailPath(url); err != nil {
+			glog.Info(err)
+		}
+	}
+	t.pathsMu.RLock()
+	added := make([]string, 0, len(t.paths))
+	for absPath := range t.paths {
+		added = append(added, absPath)
+	}
+	t.pathsMu.RUnlock()
+	for _, absPath := range added {
+		if err := t.tailAddedPath(absPath); err != nil {
+			glog.Info(err)
+		}
+	}
 	return nil
 }
 
@@ -9,6 +9,7 @@ import (
 	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/google/mtail/internal/logline"
@@ -62,10 +63,51 @@ func TestHandleLogUpdate(t *testing.T) {
 
 	received := testutil.LinesReceived(lines)
 	expected := []*logline.LogLine{
-		{context.Background(), logfile, "a"},
-		{context.Background(), logfile, "b"},
-		{context.Background(), logfile, "c"},
-		{context.Background(), logfile, "d"},
+		{context.Background(), logfile, "a", ""},
+		{context.Background(), logfile, "b", ""},
+		{context.Background(), logfile, "c", ""},
+		{context.Background(), logfile, "d", ""},
+	}
+	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
+}
+
+func TestAddPatternURL(t *testing.T) {
+	ta, lines, _, dir, stop := makeTestTail(t)
+
+	url := "unix://" + filepath.Join(dir, "log.sock")
+	testutil.FatalIfErr(t, ta.AddPattern(url))
+	testutil.FatalIfErr(t, ta.Poll())
+
+	ta.logstreamsMu.RLock()
+	_, ok := ta.logstreams[url]
+	ta.logstreamsMu.RUnlock()
+	if !ok {
+		t.Errorf("URL %q not tailed as given: %+#v", url, ta.logstreams)
+	}
+
+	stop()
+	testutil.ExpectNoDiff(t, 0, len(testutil.LinesReceived(lines)))
+}
+
+// TestTailStartOffsetZero checks that a start offset of zero reads the log
+// from its start, rather than from its end like a log without one.
+func TestTailStartOffsetZero(t *testing.T) {
+	ta, lines, awaken, dir, stop := makeTestTail(t)
+
+	logfile := filepath.Join(dir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	testutil.WriteString(t, f, "a\nb\n")
+
+	testutil.FatalIfErr(t, ta.SetOption(StartOffset(logfile, 0)))
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+	awaken(1)
+
+	stop()
+
+	received := testutil.LinesReceived(lines)
+	expected := []*logline.LogLine{
+		{context.Background(), logfile, "a", ""},
+		{context.Background(), logfile, "b", ""},
 	}
 	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
 }
@@ -101,11 +143,11 @@ func TestHandleLogTruncate(t *testing.T) {
 
 	received := testutil.LinesReceived(lines)
 	expected := []*logline.LogLine{
-		{context.Background(), logfile, "a"},
-		{context.Background(), logfile, "b"},
-		{context.Background(), logfile, "c"},
-		{context.Background(), logfile, "d"},
-		{context.Background(), logfile, "e"},
+		{context.Background(), logfile, "a", ""},
+		{context.Background(), logfile, "b", ""},
+		{context.Background(), logfile, "c", ""},
+		{context.Background(), logfile, "d", ""},
+		{context.Background(), logfile, "e", ""},
 	}
 	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
 }
@@ -132,11 +174,40 @@ func TestHandleLogUpdatePartialLine(t *testing.T) {
 
 	received := testutil.LinesReceived(lines)
 	expected := []*logline.LogLine{
-		{context.Background(), logfile, "ab"},
+		{context.Background(), logfile, "ab", ""},
 	}
 	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
 }
 
+// TestHandleLogUpdatesWithJitteredPolling writes to a file over several poll
+// cycles of a jittered waker; every line must still be read.
+func TestHandleLogUpdatesWithJitteredPolling(t *testing.T) {
+	tmpDir := testutil.TestTempDir(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	lines := make(chan *logline.LogLine, 5)
+	var wg sync.WaitGroup
+	ta, err := New(ctx, &wg, lines, LogPatterns([]string{tmpDir}), LogstreamPollWaker(waker.NewJitteredTimed(ctx, 5*time.Millisecond, 0.5)))
+	testutil.FatalIfErr(t, err)
+
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+
+	for _, want := range []string{"a", "b", "c", "d", "e"} {
+		testutil.WriteString(t, f, want+"\n")
+		select {
+		case line := <-lines:
+			if line.Line != want {
+				t.Errorf("read %q, want %q", line.Line, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("line %q not read", want)
+		}
+	}
+	cancel()
+	wg.Wait()
+}
+
 func TestTailerOpenRetries(t *testing.T) {
 	// Can't force a permission denied error if run as root.
 	testutil.SkipIfRoot(t)
@@ -177,7 +248,7 @@ func TestTailerOpenRetries(t *testing.T) {
 
 	received := testutil.LinesReceived(lines)
 	expected := []*logline.LogLine{
-		{context.Background(), logfile, ""},
+		{context.Background(), logfile, "", ""},
 	}
 	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
 }
@@ -242,8 +313,8 @@ func TestTailExpireStaleHandles(t *testing.T) {
 
 	received := testutil.LinesReceived(lines)
 	expected := []*logline.LogLine{
-		{context.Background(), log1, "1"},
-		{context.Background(), log2, "2"},
+		{context.Background(), log1, "1", ""},
+		{context.Background(), log2, "2", ""},
 	}
 	testutil.ExpectNoDiff(t, expected, received, testutil.IgnoreFields(logline.LogLine{}, "Context"))
 
@@ -106,6 +106,21 @@ func (n *CaprefTerm) Type() types.Type {
 	return types.Error // sym not defined due to undefined capref error
 }
 
+// FieldTerm is a reference to a field of the log line, like `$F[2]'.
+type FieldTerm struct {
+	P     position.Position
+	Name  string
+	Index Node
+}
+
+func (n *FieldTerm) Pos() *position.Position {
+	return &n.P
+}
+
+func (n *FieldTerm) Type() types.Type {
+	return types.String
+}
+
 type BuiltinExpr struct {
 	P    position.Position
 	Name string
@@ -429,6 +444,77 @@ func (n *StopStmt) Type() types.Type {
 	return types.None
 }
 
+// CaseInsensitive is the name of the pragma that makes every regular
+// expression in a program match without regard to case.
+const CaseInsensitive = "case_insensitive"
+
+// These pragmas choose the timestamp used when strptime can't parse the
+// timestamp in a line: the current time, which is the default; none, by
+// skipping the line; or the last timestamp that was parsed.
+const (
+	TimestampFallbackWallclock = "timestamp_fallback_wallclock"
+	TimestampFallbackSkip      = "timestamp_fallback_skip"
+	TimestampFallbackPrevious  = "timestamp_fallback_previous"
+)
+
+// FieldSeparator is the name of the pragma that sets the string splitting the
+// log line into the fields read by `$F[n]'.
+const FieldSeparator = "field_separator"
+
+// Warmup is the name of the pragma that sets how long after a program is
+// loaded to skip the lines sent to it, like `pragma warmup "30s"'.
+const Warmup = "warmup"
+
+// Pragma sets a program-wide compiler option.
+type Pragma struct {
+	P     position.Position
+	Name  string
+	Value string // The string argument of the pragma, if it takes one.
+}
+
+func (n *Pragma) Pos() *position.Position {
+	return &n.P
+}
+
+func (n *Pragma) Type() types.Type {
+	return types.None
+}
+
+// TableDecl declares a static table of string keys to string values, for use
+// with the lookup() builtin.
+type TableDecl struct {
+	P      position.Position
+	Name   string
+	Keys   []string
+	Values []string
+	Symbol *symbol.Symbol
+}
+
+func (n *TableDecl) Pos() *position.Position {
+	return &n.P
+}
+
+func (n *TableDecl) Type() types.Type {
+	return types.None
+}
+
+// RegexSetDecl declares a static set of regular expressions, for use with the
+// matches_any() builtin.
+type RegexSetDecl struct {
+	P        position.Position
+	Name     string
+	Patterns []string
+	Symbol   *symbol.Symbol
+}
+
+func (n *RegexSetDecl) Pos() *position.Position {
+	return &n.P
+}
+
+func (n *RegexSetDecl) Type() types.Type {
+	return types.None
+}
+
 // MergePosition returns the union of two positions such that the result contains both inputs.
 func MergePosition(a, b *position.Position) *position.Position {
 	if a == nil {
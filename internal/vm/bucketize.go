@@ -0,0 +1,48 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// bucketList maps numbers to labels by the ascending boundaries between them,
+// for bucketize().  There is one more label than boundaries.
+type bucketList struct {
+	bounds []float64
+	labels []string
+}
+
+// parseBucketList returns the bucketList of the comma separated boundaries and
+// labels.
+func parseBucketList(boundaries, labels string) (*bucketList, error) {
+	b := &bucketList{labels: strings.Split(labels, ",")}
+	for _, s := range strings.Split(boundaries, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bucketize boundary %q", s)
+		}
+		if n := len(b.bounds); n > 0 && f <= b.bounds[n-1] {
+			return nil, errors.Errorf("bucketize boundaries %q are not in ascending order", boundaries)
+		}
+		b.bounds = append(b.bounds, f)
+	}
+	if len(b.labels) != len(b.bounds)+1 {
+		return nil, errors.Errorf("bucketize needs one more label than boundaries, not %d labels for %d boundaries", len(b.labels), len(b.bounds))
+	}
+	for i, l := range b.labels {
+		b.labels[i] = strings.TrimSpace(l)
+	}
+	return b, nil
+}
+
+// Label returns the label of the bucket containing x.  A value on a boundary
+// belongs to the bucket above it.
+func (b *bucketList) Label(x float64) string {
+	return b.labels[sort.Search(len(b.bounds), func(i int) bool { return b.bounds[i] > x })]
+}
@@ -91,6 +91,7 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 
 	case *ast.VarDecl:
 		n.Symbol = symbol.NewSymbol(n.Name, symbol.VarSymbol, n.Pos())
+		n.Symbol.Binding = n
 		if alt := c.scope.Insert(n.Symbol); alt != nil {
 			c.errors.Add(n.Pos(), fmt.Sprintf("Redeclaration of metric `%s' previously declared at %s", n.Name, alt.Pos))
 			c.depth--
@@ -138,6 +139,14 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 				glog.V(2).Infof("Found patternsymbol Sym %v", sym)
 				sym.Used = true
 				n.Symbol = sym
+			} else if sym := c.scope.Lookup(n.Name, symbol.TableSymbol); sym != nil {
+				glog.V(2).Infof("Found tablesymbol Sym %v", sym)
+				sym.Used = true
+				n.Symbol = sym
+			} else if sym := c.scope.Lookup(n.Name, symbol.RegexSetSymbol); sym != nil {
+				glog.V(2).Infof("Found regexsetsymbol Sym %v", sym)
+				sym.Used = true
+				n.Symbol = sym
 			} else {
 				// Apply a terribly bad heuristic to choose a suggestion.
 				sug := fmt.Sprintf("Try adding `counter %s' to the top of the program.", n.Name)
@@ -217,6 +226,93 @@ func (c *checker) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		n.Symbol.Type = types.Pattern
 		return c, n
 
+	case *ast.TableDecl:
+		n.Symbol = symbol.NewSymbol(n.Name, symbol.TableSymbol, n.Pos())
+		if alt := c.scope.Insert(n.Symbol); alt != nil {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Redeclaration of table `%s' previously declared at %s", n.Name, alt.Pos))
+			c.depth--
+			return nil, n
+		}
+		n.Symbol.Binding = n
+		n.Symbol.Type = types.Table
+		seen := make(map[string]bool, len(n.Keys))
+		for _, k := range n.Keys {
+			if seen[k] {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Duplicate key %q in table `%s'.", k, n.Name))
+			}
+			seen[k] = true
+		}
+		return c, n
+
+	case *ast.RegexSetDecl:
+		n.Symbol = symbol.NewSymbol(n.Name, symbol.RegexSetSymbol, n.Pos())
+		if alt := c.scope.Insert(n.Symbol); alt != nil {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Redeclaration of regexset `%s' previously declared at %s", n.Name, alt.Pos))
+			c.depth--
+			return nil, n
+		}
+		n.Symbol.Binding = n
+		n.Symbol.Type = types.RegexSet
+		if len(n.Patterns) == 0 {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Empty regexset `%s'.\n\tTry adding some patterns to the regexset.", n.Name))
+		}
+		for _, p := range n.Patterns {
+			if plen := len(p); plen > kMaxRegexpLen {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Exceeded maximum regular expression pattern length of %d bytes with %d.\n\tExcessively long patterns are likely to cause compilation and runtime performance problems.", kMaxRegexpLen, plen))
+				continue
+			}
+			if _, err := types.ParseRegexp(p); err != nil {
+				c.errors.Add(n.Pos(), err.Error())
+			}
+		}
+		return c, n
+
+	case *ast.BuiltinExpr:
+		if n.Name == "reset" || n.Name == "ratio" || n.Name == "top_k" || n.Name == "kv_gauges" {
+			// A metric named without an index is parsed as an index with no
+			// keys, but reset(), ratio(), top_k(), and kv_gauges() take whole
+			// metrics.
+			if args, ok := n.Args.(*ast.ExprList); ok {
+				for i, arg := range args.Children {
+					if e, ok := arg.(*ast.IndexedExpr); ok && len(e.Index.(*ast.ExprList).Children) == 0 {
+						args.Children[i] = e.Lhs
+					}
+				}
+			}
+			return c, n
+		}
+		// Tables and regexsets are named by an argument, so give a better hint
+		// than the IdTerm would if it isn't declared.
+		var (
+			i     int
+			kind  symbol.SymbolKind
+			decl  string
+			title string
+		)
+		switch n.Name {
+		case "lookup":
+			i, kind, decl, title = 0, symbol.TableSymbol, "table", "Table"
+		case "matches_any":
+			i, kind, decl, title = 1, symbol.RegexSetSymbol, "regexset", "Regexset"
+		default:
+			return c, n
+		}
+		if args, ok := n.Args.(*ast.ExprList); ok && len(args.Children) > i {
+			arg := args.Children[i]
+			if e, ok := arg.(*ast.IndexedExpr); ok {
+				arg = e.Lhs
+			}
+			if id, ok := arg.(*ast.IdTerm); ok && id.Symbol == nil {
+				if c.scope.Lookup(id.Name, kind) == nil {
+					c.errors.Add(id.Pos(), fmt.Sprintf("%s `%s' not declared.\n\tTry adding `%s %s { ... }' earlier in the program.", title, id.Name, decl, id.Name))
+					n.SetType(types.Error)
+					c.depth--
+					return nil, n
+				}
+			}
+		}
+		return c, n
+
 	case *ast.DelStmt:
 		n.N = ast.Walk(c, n.N)
 		return c, n
@@ -261,10 +357,16 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 		return n
 
 	case *ast.CondStmt:
+		var ok bool
 		switch n.Cond.(type) {
 		case *ast.BinaryExpr, *ast.PatternExpr, *ast.PatternFragment, *ast.OtherwiseStmt:
 			// OK as conditions
-		default:
+			ok = true
+		case *ast.BuiltinExpr:
+			// Builtins returning Bool, like changed(), are OK as conditions.
+			ok = types.Equals(n.Cond.Type(), types.Bool)
+		}
+		if !ok {
 			c.errors.Add(n.Cond.Pos(), fmt.Sprintf("Can't interpret %s as a boolean expression here.\n\tTry using comparison operators to make the condition explicit.", n.Cond.Type()))
 		}
 		c.checkSymbolUsage()
@@ -422,6 +524,23 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 			// Tr <= Tl
 			// ⇒ O ⊢ e : Tl
 			glog.V(2).Infof("lt %q, rt %q", lT, rT)
+			if n.Op == parser.ADD_ASSIGN && types.Equals(rT, types.String) && !types.Equals(lT, types.String) {
+				// Adding a string to a number, so promote the string to the
+				// type of the left, or Int if it is not yet known.  The
+				// string is only parsed when the statement is executed, so
+				// it is not parsed if a condition guards the statement.
+				if !types.Equals(lT, types.Float) {
+					if err := types.Unify(types.Int, lT); err != nil {
+						c.errors.Add(n.Pos(), fmt.Sprintf("Can't add a string to a %s.", lT))
+						n.SetType(types.Error)
+						return n
+					}
+				}
+				conv := &ast.ConvExpr{N: n.Rhs}
+				conv.SetType(lT.Root())
+				n.Rhs = conv
+				rT = lT
+			}
 			rType = lT
 			// TODO(jaq): the rT <= lT relationship is not correctly encoded here.
 			t := types.LeastUpperBound(lT, rT)
@@ -635,7 +754,24 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 		typs = append(typs, rType)
 
 		fn := types.Function(typs...)
-		fresh := types.FreshType(types.Builtins[n.Name])
+		builtinType := types.Builtins[n.Name]
+		if n.Name == "field" && len(typs) == 4 {
+			// The separator argument to field() is optional.
+			builtinType = types.Function(types.String, types.Int, types.String, types.String)
+		}
+		if n.Name == "merge_buckets" && len(typs) == 4 {
+			// The sum argument to merge_buckets() is optional.
+			builtinType = types.Function(types.Float, types.String, types.Float, types.None)
+		}
+		if n.Name == "url_host" && len(typs) == 3 {
+			// The with port argument to url_host() is optional.
+			builtinType = types.Function(types.String, types.Int, types.String)
+		}
+		if n.Name == "first_seen" && len(typs) == 3 {
+			// The TTL argument to first_seen() is optional.
+			builtinType = types.Function(types.String, types.Int, types.Bool)
+		}
+		fresh := types.FreshType(builtinType)
 		err := types.Unify(fresh, fn)
 		if err != nil {
 			c.errors.Add(n.Pos(), fmt.Sprintf("call to `%s': %s", n.Name, err))
@@ -673,12 +809,158 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 				return n
 			}
 
+		case "bucketize":
+			// If the boundaries and labels are defined at compile time, check
+			// that there is a label for each bucket.
+			args := n.Args.(*ast.ExprList).Children
+			if b, ok := args[1].(*ast.StringLit); ok {
+				if l, ok := args[2].(*ast.StringLit); ok {
+					if nb, nl := strings.Count(b.Text, ",")+1, strings.Count(l.Text, ",")+1; nl != nb+1 {
+						c.errors.Add(l.Pos(), fmt.Sprintf("Expecting %d labels for the %d boundaries of bucketize(), not %d.", nb+1, nb, nl))
+						n.SetType(types.Error)
+						return n
+					}
+				}
+			}
+
 		case "tolower":
 			if !types.Equals(fn.Args[0], types.String) {
 				c.errors.Add(n.Args.(*ast.ExprList).Children[0].Pos(), fmt.Sprintf("Expecting a String for argument 1 of tolower(), not %v.", fn.Args[0]))
 				n.SetType(types.Error)
 				return n
 			}
+
+		case "reset":
+			// The argument is a whole metric, not one of its datums.
+			v, ok := n.Args.(*ast.ExprList).Children[0].(*ast.IdTerm)
+			if !ok || v.Symbol == nil || v.Symbol.Kind != symbol.VarSymbol {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[0].Pos(), "Expecting a metric for argument 1 of reset().\n\tTry naming the metric without an index to reset all of its values.")
+				n.SetType(types.Error)
+				return n
+			}
+			v.Lvalue = true
+
+		case "ratio":
+			// The arguments are whole metrics with the same keys, the first a
+			// gauge set to the ratio of the other two.
+			var decls []*ast.VarDecl
+			for i, arg := range n.Args.(*ast.ExprList).Children {
+				v, ok := arg.(*ast.IdTerm)
+				if !ok || v.Symbol == nil || v.Symbol.Kind != symbol.VarSymbol {
+					c.errors.Add(arg.Pos(), fmt.Sprintf("Expecting a metric for argument %d of ratio().\n\tTry naming the metric without an index to use all of its values.", i+1))
+					n.SetType(types.Error)
+					return n
+				}
+				decls = append(decls, v.Symbol.Binding.(*ast.VarDecl))
+			}
+			if decls[0].Kind != metrics.Gauge {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[0].Pos(), fmt.Sprintf("Expecting a gauge for argument 1 of ratio(), not %s `%s'.", decls[0].Kind, decls[0].Name))
+				n.SetType(types.Error)
+				return n
+			}
+			for i, d := range decls[1:] {
+				if strings.Join(d.Keys, ",") != strings.Join(decls[0].Keys, ",") {
+					c.errors.Add(n.Args.(*ast.ExprList).Children[i+1].Pos(), fmt.Sprintf("Expecting metrics with the same keys for ratio(), but `%s' is by %q and `%s' is by %q.", decls[0].Name, decls[0].Keys, d.Name, d.Keys))
+					n.SetType(types.Error)
+					return n
+				}
+			}
+			id := n.Args.(*ast.ExprList).Children[0].(*ast.IdTerm)
+			id.Lvalue = true
+			// The gauge holds a fraction.
+			valueType := id.Symbol.Type
+			if t, ok := valueType.(*types.Operator); ok && types.IsDimension(t) {
+				valueType = t.Args[len(t.Args)-1]
+			}
+			if err := types.Unify(valueType, types.Float); err != nil {
+				c.errors.Add(id.Pos(), fmt.Sprintf("Expecting a float gauge for argument 1 of ratio(): %s", err))
+				n.SetType(types.Error)
+				return n
+			}
+
+		case "top_k":
+			// The first argument is a whole gauge with one key, set to the
+			// counts of the most frequent keys.
+			arg := n.Args.(*ast.ExprList).Children[0]
+			v, ok := arg.(*ast.IdTerm)
+			if !ok || v.Symbol == nil || v.Symbol.Kind != symbol.VarSymbol {
+				c.errors.Add(arg.Pos(), "Expecting a metric for argument 1 of top_k().\n\tTry naming the metric without an index; its key is set by top_k().")
+				n.SetType(types.Error)
+				return n
+			}
+			decl := v.Symbol.Binding.(*ast.VarDecl)
+			if decl.Kind != metrics.Gauge || len(decl.Keys) != 1 {
+				c.errors.Add(arg.Pos(), fmt.Sprintf("Expecting a gauge with one key for argument 1 of top_k(), not %s `%s' by %q.", decl.Kind, decl.Name, decl.Keys))
+				n.SetType(types.Error)
+				return n
+			}
+			v.Lvalue = true
+			// The gauge holds counts.
+			valueType := v.Symbol.Type
+			if t, ok := valueType.(*types.Operator); ok && types.IsDimension(t) {
+				valueType = t.Args[len(t.Args)-1]
+			}
+			if err := types.Unify(valueType, types.Int); err != nil {
+				c.errors.Add(v.Pos(), fmt.Sprintf("Expecting an integer gauge for argument 1 of top_k(): %s", err))
+				n.SetType(types.Error)
+				return n
+			}
+
+		case "kv_gauges":
+			// The first argument is a whole gauge with one key, set to the
+			// value of each key in the line.
+			arg := n.Args.(*ast.ExprList).Children[0]
+			v, ok := arg.(*ast.IdTerm)
+			if !ok || v.Symbol == nil || v.Symbol.Kind != symbol.VarSymbol {
+				c.errors.Add(arg.Pos(), "Expecting a metric for argument 1 of kv_gauges().\n\tTry naming the metric without an index; its key is set by kv_gauges().")
+				n.SetType(types.Error)
+				return n
+			}
+			decl := v.Symbol.Binding.(*ast.VarDecl)
+			if decl.Kind != metrics.Gauge || len(decl.Keys) != 1 {
+				c.errors.Add(arg.Pos(), fmt.Sprintf("Expecting a gauge with one key for argument 1 of kv_gauges(), not %s `%s' by %q.", decl.Kind, decl.Name, decl.Keys))
+				n.SetType(types.Error)
+				return n
+			}
+			v.Lvalue = true
+			valueType := v.Symbol.Type
+			if t, ok := valueType.(*types.Operator); ok && types.IsDimension(t) {
+				valueType = t.Args[len(t.Args)-1]
+			}
+			if err := types.Unify(valueType, types.Float); err != nil {
+				c.errors.Add(v.Pos(), fmt.Sprintf("Expecting a float gauge for argument 1 of kv_gauges(): %s", err))
+				n.SetType(types.Error)
+				return n
+			}
+
+		case "set_info":
+			// The argument is a datum of a gauge, whose other datums are removed.
+			var v *ast.IdTerm
+			switch arg := n.Args.(*ast.ExprList).Children[0].(type) {
+			case *ast.IdTerm:
+				v = arg
+			case *ast.IndexedExpr:
+				v, _ = arg.Lhs.(*ast.IdTerm)
+			}
+			if v == nil || v.Symbol == nil || v.Symbol.Kind != symbol.VarSymbol || v.Symbol.Binding.(*ast.VarDecl).Kind != metrics.Gauge {
+				c.errors.Add(n.Args.(*ast.ExprList).Children[0].Pos(), "Expecting a gauge for argument 1 of set_info().")
+				n.SetType(types.Error)
+				return n
+			}
+			v.Lvalue = true
+
+		case "decay_set", "approx_distinct", "moving_avg", "tumbling_inc", "exemplar_inc", "window_max", "observe", "observe_seconds", "merge_buckets", "mark_seen", "since_seen", "rate":
+			// The first argument is the variable to set, not its value.
+			switch v := n.Args.(*ast.ExprList).Children[0].(type) {
+			case *ast.IdTerm:
+				v.Lvalue = true
+			case *ast.IndexedExpr:
+				v.Lhs.(*ast.IdTerm).Lvalue = true
+			default:
+				c.errors.Add(v.Pos(), fmt.Sprintf("Expecting a variable for argument 1 of %s().", n.Name))
+				n.SetType(types.Error)
+				return n
+			}
 		}
 		return n
 
@@ -703,6 +985,47 @@ func (c *checker) VisitAfter(node ast.Node) ast.Node {
 		n.Pattern = pe.pattern.String()
 		return n
 
+	case *ast.FieldTerm:
+		if n.Name != "F" {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Can't index `$%s'.\n\tTry `$F[n]' to get the nth field of the line.", n.Name))
+			return n
+		}
+		t := n.Index.Type()
+		if types.IsErrorType(t) {
+			return n
+		}
+		if err := types.Unify(types.Int, t); err != nil {
+			c.errors.Add(n.Index.Pos(), fmt.Sprintf("Expecting an Int for the index of `$F', not %v.", t))
+		}
+		return n
+
+	case *ast.Pragma:
+		switch n.Name {
+		case ast.CaseInsensitive, ast.TimestampFallbackWallclock, ast.TimestampFallbackSkip, ast.TimestampFallbackPrevious:
+			if n.Value != "" {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Pragma `%s' doesn't take a value.", n.Name))
+				return n
+			}
+		case ast.FieldSeparator:
+			if n.Value == "" {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Pragma `%s' needs a separator string.", n.Name))
+				return n
+			}
+		case ast.Warmup:
+			if d, err := time.ParseDuration(n.Value); err != nil || d <= 0 {
+				c.errors.Add(n.Pos(), fmt.Sprintf("Pragma `%s' needs a positive duration string, like \"30s\".", n.Name))
+				return n
+			}
+		default:
+			c.errors.Add(n.Pos(), fmt.Sprintf("Unknown pragma `%s'.", n.Name))
+			return n
+		}
+		if c.scope.Parent != nil {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Pragma `%s' must be at the top level of the program.", n.Name))
+			return n
+		}
+		return n
+
 	case *ast.DelStmt:
 		if ix, ok := n.N.(*ast.IndexedExpr); ok {
 			if len(ix.Index.(*ast.ExprList).Children) == 0 {
@@ -55,6 +55,55 @@ var checkerInvalidPrograms = []struct {
 		"/blurg(?P<x>[[:alph:]])/ {}\n",
 		[]string{"invalid regex 3:1:1-24: error parsing regexp: invalid character class range: `[:alph:]`"}},
 
+	{"undeclared table",
+		"lookup(t, \"a\", \"b\")\n",
+		[]string{"undeclared table:1:8: Table `t' not declared.", "\tTry adding `table t { ... }' earlier in the program."}},
+
+	{"lookup not a table",
+		"counter t\nlookup(t, \"a\", \"b\")\n",
+		[]string{"lookup not a table:2:8: Table `t' not declared.", "\tTry adding `table t { ... }' earlier in the program.",
+			"lookup not a table:1:9: Declaration of variable `t' here is never used."}},
+
+	{"duplicate table key",
+		"table t {\n\"a\": \"b\",\n\"a\": \"c\"\n}\nlookup(t, \"a\", \"b\")\n",
+		[]string{"duplicate table key:1:1-5: Duplicate key \"a\" in table `t'."}},
+
+	{"undeclared regexset",
+		"matches_any(\"a\", s)\n",
+		[]string{"undeclared regexset:1:18: Regexset `s' not declared.", "\tTry adding `regexset s { ... }' earlier in the program."}},
+
+	{"empty regexset",
+		"regexset s {}\nmatches_any(\"a\", s)\n",
+		[]string{"empty regexset:1:1-8: Empty regexset `s'.", "\tTry adding some patterns to the regexset."}},
+
+	{"invalid regexset pattern",
+		"regexset s {\n/a(/\n}\nmatches_any(\"a\", s)\n",
+		[]string{"invalid regexset pattern:1:1-8: error parsing regexp: missing closing ): `a(`"}},
+
+	{"unknown pragma",
+		"pragma foo\n",
+		[]string{"unknown pragma:1:8-10: Unknown pragma `foo'."}},
+
+	{"pragma missing value",
+		"pragma field_separator\n",
+		[]string{"pragma missing value:1:8-22: Pragma `field_separator' needs a separator string."}},
+
+	{"pragma with unexpected value",
+		"pragma case_insensitive \"x\"\n",
+		[]string{"pragma with unexpected value:1:8-23: Pragma `case_insensitive' doesn't take a value."}},
+
+	{"index of capref",
+		"/(?P<x>.*)/ {\n$x[1]\n}\n",
+		[]string{"index of capref:2:1-2: Can't index `$x'.", "\tTry `$F[n]' to get the nth field of the line."}},
+
+	{"pragma warmup invalid duration",
+		"pragma warmup \"soon\"\n",
+		[]string{"pragma warmup invalid duration:1:8-13: Pragma `warmup' needs a positive duration string, like \"30s\"."}},
+
+	{"nested pragma",
+		"/foo/ {\npragma case_insensitive\n}\n",
+		[]string{"nested pragma:2:8-23: Pragma `case_insensitive' must be at the top level of the program."}},
+
 	{"duplicate declaration",
 		"counter foo\ncounter foo\n",
 		[]string{"duplicate declaration:2:9-11: Redeclaration of metric `foo' previously declared at duplicate declaration:1:9-11",
@@ -114,6 +163,11 @@ counter bar by a, b
 		[]string{
 			"bad strptime format:1:33-53: invalid time format string \"2017-10-16 06:50:25\"", "\tRefer to the documentation at https://golang.org/pkg/time/#pkg-constants for advice."}},
 
+	{"bucketize label count",
+		`bucketize(0.5, "0.1,1", "fast,slow")
+`,
+		[]string{"bucketize label count:1:25-35: Expecting 3 labels for the 2 boundaries of bucketize(), not 2."}},
+
 	{"undefined const regex",
 		"/foo / + X + / bar/ {}\n",
 		[]string{"undefined const regex:1:10: Identifier `X' not declared.", "\tTry adding `const X /.../' earlier in the program."}},
@@ -193,6 +247,46 @@ del $0
 }`,
 		[]string{"delete incorrect object:3:7: Cannot delete this.", "\tTry deleting from a dimensioned metric with this as an index."}},
 
+	{"reset a datum",
+		`counter requests by code
+/restart/ {
+  reset(requests["200"])
+}`,
+		[]string{"reset a datum:3:9-22: Expecting a metric for argument 1 of reset().", "\tTry naming the metric without an index to reset all of its values."}},
+
+	{"ratio of counter",
+		`counter errors
+counter total
+counter error_ratio
+ratio(error_ratio, errors, total)
+`,
+		[]string{"ratio of counter:4:7-17: Expecting a gauge for argument 1 of ratio(), not Counter `error_ratio'."}},
+
+	{"ratio keys differ",
+		`counter errors by code
+counter total
+gauge error_ratio by code
+ratio(error_ratio, errors, total)
+`,
+		[]string{"ratio keys differ:4:28-32: Expecting metrics with the same keys for ratio(), but `error_ratio' is by [\"code\"] and `total' is by []."}},
+
+	{"top_k without a key",
+		`gauge requests
+top_k(requests, "a", 3)
+`,
+		[]string{"top_k without a key:2:7-14: Expecting a gauge with one key for argument 1 of top_k(), not Gauge `requests' by []."}},
+
+	{"set_info of a counter",
+		`counter build_info by version
+set_info(build_info["1.0"])
+`,
+		[]string{"set_info of a counter:2:10-25: Expecting a gauge for argument 1 of set_info()."}},
+	{"kv_gauges without a key",
+		`gauge stats
+kv_gauges(stats, "a=1", 10)
+`,
+		[]string{"kv_gauges without a key:2:11-15: Expecting a gauge with one key for argument 1 of kv_gauges(), not Gauge `stats' by []."}},
+
 	{"pattern fragment plus anything",
 		`gauge e
 // + e {
@@ -242,6 +336,10 @@ l++=l
 		`tolower(2)
 `, []string{"tolower non string:1:9: Expecting a String for argument 1 of tolower(), not Int."}},
 
+	{"field too many args",
+		`field("a b", 1, " ", 2)
+`, []string{"field too many args:1:23: call to `field': type mismatch; expected String→Int→String received incomplete type"}},
+
 	{"dec non var",
 		`strptime("", "")--
 `, []string{"dec non var:1:16: Expecting a variable here."}},
@@ -460,6 +558,28 @@ gauge foo
 /(?P<value_ms>-?\d+)/ {
   foo += $value_ms / 1000.0
 }`},
+
+	{"bucketize", `
+counter requests by speed
+/(?P<latency_ms>\d+)ms/ {
+  requests[bucketize($latency_ms, "100,1000", "fast,ok,slow")]++
+}`},
+
+	{"add string capture to counter", `
+counter bytes
+/(?P<status>\d{3}) (?P<size>\S+)/ {
+  $status == 200 {
+    bytes += $size
+  }
+}`},
+
+	{"field with optional separator", `
+text a
+text b
+/(?P<line>.*)/ {
+  a = field($line, 2)
+  b = field($line, 2, ",")
+}`},
 }
 
 func TestCheckValidPrograms(t *testing.T) {
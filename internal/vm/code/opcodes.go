@@ -45,6 +45,48 @@ const (
 	Sget                     // Pop a datum off the stack, and push its string value back on the stack.
 	Tolower                  // Convert the string at the top of the stack to lowercase.
 	Length                   // Compute the length of a string.
+	Normpath                 // Replace identifier segments of the path at the top of the stack with placeholders.
+	B64decode                // Decode the base64 string at the top of the stack.
+	Changed                  // Compare TOS with the value last seen for the key below it, and push whether it differs.
+	Lookup                   // Look up the key below TOS in the table at operand, and push the value, or TOS if the key is missing.
+	Inset                    // Push whether the string below TOS is listed in the file named at TOS.
+	Decayset                 // Decay a datum by the half life at TOS, then add the value below it.
+	Now                      // Push the current wall clock time, in seconds since the epoch.
+	Approxdist               // Add the string at TOS to the sketch for the datum below it, and set the datum to the sketch's estimate.
+	Field                    // Push the field of a string numbered by TOS, or below the separator at TOS if operand is 3.
+	Matchany                 // Push whether the string at TOS matches any pattern of the regexset at operand.
+	Stripansi                // Remove ANSI escape sequences from the string at the top of the stack.
+	Movingavg                // Add the value below TOS to the samples of the datum below it, and set the datum to their average over the window at TOS.
+	Queryparam               // Push the first value of the query parameter named at TOS in the URL below it.
+	Markseen                 // Record the timestamp register as the time the datum at TOS was last seen.
+	Setinfo                  // Set the datum of the metric at TOS named by the operand keys below it to 1, and remove the others.
+	Sinceseen                // Push the seconds since the datum at TOS was last seen.
+	Rate                     // Push the per second rate of increase of the datum below TOS over the window of seconds at TOS.
+	Bucketize                // Push the label at TOS of the bucket of the value below the boundaries below it.
+	Tumbleinc                // Increment the datum below TOS, resetting it first in each new window of the seconds at TOS.
+	Exemplar                 // Increment the datum below TOS, and attach the trace ID at TOS to the increment as its exemplar.
+	Loglevel                 // Replace the log line at the top of the stack with its normalized level.
+	Observe                  // Observe the value at TOS in the histogram datum below it.
+	Statclass                // Replace the HTTP status code at the top of the stack with its class.
+	Syslogpri                // Replace the line below TOS with the part named at TOS of its syslog priority.
+	Observesec               // Observe the seconds in the string at TOS in the histogram datum below it, unless the string is "-".
+	Mergebkts                // Add the bucket counts in the string below TOS, and the sum at TOS if operand is 3, to the histogram datum below them.
+	Buckethash               // Push the bucket below the number of buckets at TOS that the string below it hashes to.
+	Windowmax                // Raise the datum below TOS to the value below it, resetting it first in each new window of the seconds at TOS.
+	Reset                    // Set every datum of the metric at TOS to zero.
+	Csvfield                 // Push the field numbered by TOS of the CSV record below it.
+	Linefield                // Push the field of the input line numbered by TOS, split by the program's field separator.
+	Hourofday                // Replace the timestamp at the top of the stack with its hour of the day.
+	Dayofweek                // Replace the timestamp at the top of the stack with its day of the week.
+	Aftergap                 // Push whether the key below TOS was last seen longer ago than the seconds at TOS.
+	Progver                  // Push the hash of the program source.
+	Linelen                  // Push the length in bytes of the input line.
+	Expbucket                // Replace the value below the base at TOS with the index of its exponential bucket.
+	Kvgauges                 // Set the gauge below the line below TOS to the numeric values of the line's key=value pairs, keeping at most TOS keys.
+	Firstseen                // Push whether the key at TOS, or below the TTL at TOS if operand is 2, has not been seen before.
+	Urlhost                  // Replace the URL or authority at TOS, or below the with port flag at TOS if operand is 2, with its host.
+	Ratio                    // Make the gauge third from TOS hold the ratio of the metric below TOS to the metric at TOS when exported.
+	Topk                     // Count the string below TOS for the metric below it, and set the metric to the counts of the number at TOS of most frequent strings.
 	Cat                      // string concatenation
 	Setmatched               // Set "matched" flag
 	Otherwise                // Only match if "matched" flag is false.
@@ -60,7 +102,10 @@ const (
 	Fpow
 	Fset // Floating point assignment
 
-	Getfilename // Push input.Filename onto the stack.
+	Getfilename   // Push input.Filename onto the stack.
+	Getsourcehost // Push input.SourceHost onto the stack.
+	Getmeta       // Replace the key at TOS with its value in the host metadata.
+	Parsedur      // Parse the duration string at the top of the stack, and push its value in seconds.
 
 	// Conversions
 	I2f // int to float
@@ -78,62 +123,107 @@ const (
 )
 
 var opNames = map[Opcode]string{
-	Stop:        "stop",
-	Match:       "match",
-	Smatch:      "smatch",
-	Cmp:         "cmp",
-	Jnm:         "jnm",
-	Jm:          "jm",
-	Jmp:         "jmp",
-	Inc:         "inc",
-	Strptime:    "strptime",
-	Timestamp:   "timestamp",
-	Settime:     "settime",
-	Push:        "push",
-	Capref:      "capref",
-	Str:         "str",
-	Sset:        "sset",
-	Iset:        "iset",
-	Iadd:        "iadd",
-	Isub:        "isub",
-	Imul:        "imul",
-	Idiv:        "idiv",
-	Imod:        "imod",
-	Ipow:        "ipow",
-	Shl:         "shl",
-	Shr:         "shr",
-	And:         "and",
-	Or:          "or",
-	Xor:         "xor",
-	Not:         "not",
-	Neg:         "neg",
-	Mload:       "mload",
-	Dload:       "dload",
-	Iget:        "iget",
-	Fget:        "fget",
-	Sget:        "sget",
-	Tolower:     "tolower",
-	Length:      "length",
-	Cat:         "cat",
-	Setmatched:  "setmatched",
-	Otherwise:   "otherwise",
-	Del:         "del",
-	Fadd:        "fadd",
-	Fsub:        "fsub",
-	Fmul:        "fmul",
-	Fdiv:        "fdiv",
-	Fmod:        "fmod",
-	Fpow:        "fpow",
-	Fset:        "fset",
-	Getfilename: "getfilename",
-	I2f:         "i2f",
-	S2i:         "s2i",
-	S2f:         "s2f",
-	I2s:         "i2s",
-	F2s:         "f2s",
-	Icmp:        "icmp",
-	Fcmp:        "fcmp",
-	Scmp:        "scmp",
+	Stop:          "stop",
+	Match:         "match",
+	Smatch:        "smatch",
+	Cmp:           "cmp",
+	Jnm:           "jnm",
+	Jm:            "jm",
+	Jmp:           "jmp",
+	Inc:           "inc",
+	Strptime:      "strptime",
+	Timestamp:     "timestamp",
+	Settime:       "settime",
+	Push:          "push",
+	Capref:        "capref",
+	Str:           "str",
+	Sset:          "sset",
+	Iset:          "iset",
+	Iadd:          "iadd",
+	Isub:          "isub",
+	Imul:          "imul",
+	Idiv:          "idiv",
+	Imod:          "imod",
+	Ipow:          "ipow",
+	Shl:           "shl",
+	Shr:           "shr",
+	And:           "and",
+	Or:            "or",
+	Xor:           "xor",
+	Not:           "not",
+	Neg:           "neg",
+	Mload:         "mload",
+	Dload:         "dload",
+	Iget:          "iget",
+	Fget:          "fget",
+	Sget:          "sget",
+	Tolower:       "tolower",
+	Length:        "length",
+	Normpath:      "normpath",
+	B64decode:     "b64decode",
+	Changed:       "changed",
+	Lookup:        "lookup",
+	Inset:         "inset",
+	Decayset:      "decayset",
+	Field:         "field",
+	Now:           "now",
+	Approxdist:    "approxdist",
+	Matchany:      "matchany",
+	Stripansi:     "stripansi",
+	Movingavg:     "movingavg",
+	Queryparam:    "queryparam",
+	Markseen:      "markseen",
+	Setinfo:       "setinfo",
+	Sinceseen:     "sinceseen",
+	Rate:          "rate",
+	Bucketize:     "bucketize",
+	Tumbleinc:     "tumbleinc",
+	Exemplar:      "exemplar",
+	Loglevel:      "loglevel",
+	Observe:       "observe",
+	Statclass:     "statclass",
+	Syslogpri:     "syslogpri",
+	Observesec:    "observesec",
+	Mergebkts:     "mergebkts",
+	Buckethash:    "buckethash",
+	Windowmax:     "windowmax",
+	Reset:         "reset",
+	Csvfield:      "csvfield",
+	Linefield:     "linefield",
+	Hourofday:     "hourofday",
+	Dayofweek:     "dayofweek",
+	Aftergap:      "aftergap",
+	Progver:       "progver",
+	Linelen:       "linelen",
+	Expbucket:     "expbucket",
+	Kvgauges:      "kvgauges",
+	Firstseen:     "firstseen",
+	Ratio:         "ratio",
+	Topk:          "topk",
+	Urlhost:       "urlhost",
+	Cat:           "cat",
+	Setmatched:    "setmatched",
+	Otherwise:     "otherwise",
+	Del:           "del",
+	Fadd:          "fadd",
+	Fsub:          "fsub",
+	Fmul:          "fmul",
+	Fdiv:          "fdiv",
+	Fmod:          "fmod",
+	Fpow:          "fpow",
+	Fset:          "fset",
+	Getfilename:   "getfilename",
+	Getsourcehost: "getsourcehost",
+	Getmeta:       "getmeta",
+	Parsedur:      "parsedur",
+	I2f:           "i2f",
+	S2i:           "s2i",
+	S2f:           "s2f",
+	I2s:           "i2s",
+	F2s:           "f2s",
+	Icmp:          "icmp",
+	Fcmp:          "fcmp",
+	Scmp:          "scmp",
 }
 
 func (o Opcode) String() string {
@@ -31,11 +31,41 @@ type codegen struct {
 
 	l     []int           // Label table for recording jump destinations.
 	decos []*ast.DecoStmt // Decorator stack to unwind when entering decorated blocks.
+
+	caseInsensitive bool // Set by pragma to compile all regular expressions case-insensitively.
 }
 
 // CodeGen is the function that compiles the program to bytecode and data.
 func CodeGen(name string, n ast.Node) (*object.Object, error) {
 	c := &codegen{name: name}
+	// Pragmas apply to the whole program, so find them before any code is generated.
+	if sl, ok := n.(*ast.StmtList); ok {
+		for _, s := range sl.Children {
+			p, ok := s.(*ast.Pragma)
+			if !ok {
+				continue
+			}
+			switch p.Name {
+			case ast.CaseInsensitive:
+				c.caseInsensitive = true
+			case ast.TimestampFallbackWallclock:
+				c.obj.TimestampFallback = object.TimestampFallbackWallclock
+			case ast.TimestampFallbackSkip:
+				c.obj.TimestampFallback = object.TimestampFallbackSkip
+			case ast.TimestampFallbackPrevious:
+				c.obj.TimestampFallback = object.TimestampFallbackPrevious
+			case ast.FieldSeparator:
+				c.obj.FieldSeparator = p.Value
+			case ast.Warmup:
+				d, err := time.ParseDuration(p.Value)
+				if err != nil {
+					c.errorf(p.Pos(), "%s", err)
+					continue
+				}
+				c.obj.Warmup = d
+			}
+		}
+	}
 	_ = ast.Walk(c, n)
 	c.writeJumps()
 	if len(c.errors) > 0 {
@@ -125,7 +155,9 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 			}
 		}
 
-		if n.Kind == metrics.Histogram {
+		// A histogram without buckets only keeps the sum and count of its
+		// observations.
+		if n.Kind == metrics.Histogram && len(n.Buckets) > 0 {
 			if len(n.Buckets) < 2 {
 				c.errorf(n.Pos(), "a histogram need at least two boundaries")
 				return nil, n
@@ -166,6 +198,32 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		c.obj.Metrics = append(c.obj.Metrics, m)
 		return nil, n
 
+	case *ast.TableDecl:
+		t := make(map[string]string, len(n.Keys))
+		for i, k := range n.Keys {
+			t[k] = n.Values[i]
+		}
+		n.Symbol.Addr = len(c.obj.Tables)
+		c.obj.Tables = append(c.obj.Tables, t)
+		return nil, n
+
+	case *ast.RegexSetDecl:
+		var res []*regexp.Regexp
+		for _, p := range n.Patterns {
+			if c.caseInsensitive {
+				p = "(?i)" + p
+			}
+			re, err := regexp.Compile(p)
+			if err != nil {
+				c.errorf(n.Pos(), "%s", err)
+				return nil, n
+			}
+			res = append(res, re)
+		}
+		n.Symbol.Addr = len(c.obj.RegexSets)
+		c.obj.RegexSets = append(c.obj.RegexSets, res)
+		return nil, n
+
 	case *ast.CondStmt:
 		lElse := c.newLabel()
 		lEnd := c.newLabel()
@@ -189,7 +247,12 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 		return nil, n
 
 	case *ast.PatternExpr:
-		re, err := regexp.Compile(n.Pattern)
+		pattern := n.Pattern
+		if c.caseInsensitive {
+			// Patterns can still override this with the inline flag `(?-i)'.
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
 		if err != nil {
 			c.errorf(n.Pos(), "%s", err)
 			return nil, n
@@ -261,6 +324,11 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 			c.emit(n, code.S2i, nil)
 		}
 
+	case *ast.FieldTerm:
+		ast.Walk(c, n.Index)
+		c.emit(n, code.Linefield, nil)
+		return nil, n
+
 	case *ast.IndexedExpr:
 		if args, ok := n.Index.(*ast.ExprList); ok {
 			for _, arg := range args.Children {
@@ -305,6 +373,31 @@ func (c *codegen) VisitBefore(node ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.OtherwiseStmt:
 		c.emit(n, code.Otherwise, nil)
 
+	case *ast.BuiltinExpr:
+		if n.Name == "set_info" {
+			ast.Walk(c, n.Args.(*ast.ExprList).Children[0])
+			// overwrite the dload instruction, leaving the metric and keys
+			pc := c.pc()
+			c.obj.Program[pc].Opcode = code.Setinfo
+			return nil, n
+		}
+		if n.Name != "reset" && n.Name != "ratio" && n.Name != "top_k" && n.Name != "kv_gauges" {
+			break
+		}
+		// The builtin takes whole metrics, not their datums, so load only the
+		// metrics.
+		args := n.Args.(*ast.ExprList).Children
+		for i, arg := range args {
+			if (n.Name == "top_k" || n.Name == "kv_gauges") && i > 0 {
+				// Only the first argument of top_k() and kv_gauges() is a metric.
+				ast.Walk(c, arg)
+				continue
+			}
+			c.emit(n, code.Mload, arg.(*ast.IdTerm).Symbol.Addr)
+		}
+		c.emit(n, builtin[n.Name], len(args))
+		return nil, n
+
 	case *ast.DelStmt:
 		if n.Expiry > 0 {
 			c.emit(n, code.Push, n.Expiry)
@@ -395,13 +488,57 @@ func getOpcodeForType(op int, opT types.Type) (code.Opcode, error) {
 }
 
 var builtin = map[string]code.Opcode{
-	"getfilename": code.Getfilename,
-	"len":         code.Length,
-	"settime":     code.Settime,
-	"strptime":    code.Strptime,
-	"strtol":      code.S2i,
-	"timestamp":   code.Timestamp,
-	"tolower":     code.Tolower,
+	"after_gap":       code.Aftergap,
+	"approx_distinct": code.Approxdist,
+	"base64decode":    code.B64decode,
+	"bucket_hash":     code.Buckethash,
+	"bucketize":       code.Bucketize,
+	"changed":         code.Changed,
+	"csv_field":       code.Csvfield,
+	"day_of_week":     code.Dayofweek,
+	"decay_set":       code.Decayset,
+	"exemplar_inc":    code.Exemplar,
+	"exp_bucket":      code.Expbucket,
+	"field":           code.Field,
+	"first_seen":      code.Firstseen,
+	"getfilename":     code.Getfilename,
+	"source_host":     code.Getsourcehost,
+	"linelen":         code.Linelen,
+	"getmeta":         code.Getmeta,
+	"in_set":          code.Inset,
+	"kv_gauges":       code.Kvgauges,
+	"len":             code.Length,
+	"loglevel":        code.Loglevel,
+	"lookup":          code.Lookup,
+	"hour_of_day":     code.Hourofday,
+	"mark_seen":       code.Markseen,
+	"matches_any":     code.Matchany,
+	"merge_buckets":   code.Mergebkts,
+	"moving_avg":      code.Movingavg,
+	"normalize_path":  code.Normpath,
+	"now":             code.Now,
+	"observe":         code.Observe,
+	"observe_seconds": code.Observesec,
+	"parse_duration":  code.Parsedur,
+	"program_version": code.Progver,
+	"query_param":     code.Queryparam,
+	"ratio":           code.Ratio,
+	"top_k":           code.Topk,
+	"reset":           code.Reset,
+	"set_info":        code.Setinfo,
+	"settime":         code.Settime,
+	"since_seen":      code.Sinceseen,
+	"rate":            code.Rate,
+	"status_class":    code.Statclass,
+	"syslog_pri":      code.Syslogpri,
+	"strip_ansi":      code.Stripansi,
+	"strptime":        code.Strptime,
+	"strtol":          code.S2i,
+	"timestamp":       code.Timestamp,
+	"tolower":         code.Tolower,
+	"tumbling_inc":    code.Tumbleinc,
+	"url_host":        code.Urlhost,
+	"window_max":      code.Windowmax,
 }
 
 func (c *codegen) VisitAfter(node ast.Node) ast.Node {
@@ -426,6 +563,36 @@ func (c *codegen) VisitAfter(node ast.Node) ast.Node {
 				return n
 			}
 
+		case "lookup":
+			// The table is named by the first argument, which emits no code;
+			// the operand is its address instead.
+			arg := n.Args.(*ast.ExprList).Children[0]
+			if e, ok := arg.(*ast.IndexedExpr); ok {
+				arg = e.Lhs
+			}
+			c.emit(n, code.Lookup, arg.(*ast.IdTerm).Symbol.Addr)
+
+		case "observe", "observe_seconds":
+			// Only a histogram can observe values.
+			arg := n.Args.(*ast.ExprList).Children[0]
+			if e, ok := arg.(*ast.IndexedExpr); ok {
+				arg = e.Lhs
+			}
+			if m, ok := arg.(*ast.IdTerm).Symbol.Binding.(*metrics.Metric); !ok || m.Kind != metrics.Histogram {
+				c.errorf(arg.Pos(), "Expecting a histogram for argument 1 of %s().", n.Name)
+				return n
+			}
+			c.emit(n, builtin[n.Name], arglen)
+
+		case "matches_any":
+			// The regexset is named by the second argument, which emits no
+			// code; the operand is its address instead.
+			arg := n.Args.(*ast.ExprList).Children[1]
+			if e, ok := arg.(*ast.IndexedExpr); ok {
+				arg = e.Lhs
+			}
+			c.emit(n, code.Matchany, arg.(*ast.IdTerm).Symbol.Addr)
+
 		default:
 			c.emit(n, builtin[n.Name], arglen)
 		}
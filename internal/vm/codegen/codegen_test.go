@@ -345,6 +345,124 @@ strtol("deadbeef", 16)
 			{code.Str, 0, 1},
 			{code.Push, int64(16), 1},
 			{code.S2i, 2, 1}}},
+	{"normalize_path", `
+normalize_path("/user/1/profile")
+`,
+		[]code.Instr{
+			{code.Str, 0, 1},
+			{code.Normpath, 1, 1}}},
+	{"loglevel", `
+loglevel("[ERROR] disk full")
+`,
+		[]code.Instr{
+			{code.Str, 0, 1},
+			{code.Loglevel, 1, 1}}},
+	{"query_param", `
+query_param("/cart?action=checkout", "action")
+`,
+		[]code.Instr{
+			{code.Str, 0, 1},
+			{code.Str, 1, 1},
+			{code.Queryparam, 2, 1}}},
+	{"bucket_hash", `
+bucket_hash("alice", 8)
+`,
+		[]code.Instr{
+			{code.Str, 0, 1},
+			{code.Push, int64(8), 1},
+			{code.Buckethash, 2, 1}}},
+	{"url_host", `
+url_host("https://example.com/", 1)
+`,
+		[]code.Instr{
+			{code.Str, 0, 1},
+			{code.Push, int64(1), 1},
+			{code.Urlhost, 2, 1}}},
+	{"csv_field", `
+csv_field("a,b", 2)
+`,
+		[]code.Instr{
+			{code.Str, 0, 1},
+			{code.Push, int64(2), 1},
+			{code.Csvfield, 2, 1}}},
+	{"line field", `
+pragma field_separator "|"
+$F[2]
+`,
+		[]code.Instr{
+			{code.Push, int64(2), 2},
+			{code.Linefield, nil, 2}}},
+	{"first_seen", `
+first_seen("a", 60)
+`,
+		[]code.Instr{
+			{code.Str, 0, 1},
+			{code.Push, int64(60), 1},
+			{code.Firstseen, 2, 1}}},
+	{"after_gap", `
+after_gap("a", 300)
+`,
+		[]code.Instr{
+			{code.Str, 0, 1},
+			{code.Push, int64(300), 1},
+			{code.Aftergap, 2, 1}}},
+	{"exp_bucket", `
+exp_bucket(3.0, 2.0)
+`,
+		[]code.Instr{
+			{code.Push, 3.0, 1},
+			{code.Push, 2.0, 1},
+			{code.Expbucket, 2, 1}}},
+	{"status_class", `
+status_class(404)
+`,
+		[]code.Instr{
+			{code.Push, int64(404), 1},
+			{code.Statclass, 1, 1}}},
+	{"syslog_pri", `
+syslog_pri("<134>hello", "facility")
+`,
+		[]code.Instr{
+			{code.Str, 0, 1},
+			{code.Str, 1, 1},
+			{code.Syslogpri, 2, 1}}},
+	{"hour_of_day", `
+hour_of_day(timestamp())
+`,
+		[]code.Instr{
+			{code.Timestamp, 0, 1},
+			{code.Hourofday, 1, 1}}},
+	{"day_of_week", `
+day_of_week(1600000000)
+`,
+		[]code.Instr{
+			{code.Push, int64(1600000000), 1},
+			{code.Dayofweek, 1, 1}}},
+	{"strip_ansi", `
+strip_ansi("plain")
+`,
+		[]code.Instr{
+			{code.Str, 0, 1},
+			{code.Stripansi, 1, 1}}},
+	{"lookup", `
+table t {
+  "a": "b"
+}
+lookup(t, "a", "c")
+`,
+		[]code.Instr{
+			{code.Str, 0, 4},
+			{code.Str, 1, 4},
+			{code.Lookup, 0, 4}}},
+	{"matches_any", `
+regexset s {
+  /a/, /b/
+}
+matches_any("c", s)
+`,
+		[]code.Instr{
+			{code.Str, 0, 4},
+			{code.Matchany, 0, 4}}},
 	{"float", `
 20.0
 `,
@@ -425,6 +543,86 @@ del a["string"] after 1h
 			{code.Mload, 0, 2},
 			{code.Expire, 1, 2}},
 	},
+	{"set_info", `
+gauge a by b
+set_info(a["string"])
+`,
+		[]code.Instr{
+			{code.Str, 0, 2},
+			{code.Mload, 0, 2},
+			{code.Setinfo, 1, 2}},
+	},
+	{"reset", `
+counter a by b
+reset(a)
+`,
+		[]code.Instr{
+			{code.Mload, 0, 2},
+			{code.Reset, 1, 2}},
+	},
+	{"ratio", `
+gauge r
+counter a
+counter b
+ratio(r, a, b)
+`,
+		[]code.Instr{
+			{code.Mload, 0, 4},
+			{code.Mload, 1, 4},
+			{code.Mload, 2, 4},
+			{code.Ratio, 3, 4}},
+	},
+	{"top_k", `
+gauge a by b
+top_k(a, "x", 3)
+`,
+		[]code.Instr{
+			{code.Mload, 0, 2},
+			{code.Str, 0, 2},
+			{code.Push, int64(3), 2},
+			{code.Topk, 3, 2}},
+	},
+	{"kv_gauges", `
+gauge a by b
+kv_gauges(a, "x=1", 10)
+`,
+		[]code.Instr{
+			{code.Mload, 0, 2},
+			{code.Str, 0, 2},
+			{code.Push, int64(10), 2},
+			{code.Kvgauges, 3, 2}},
+	},
+	{"rate", `
+counter a
+rate(a, 60)
+`,
+		[]code.Instr{
+			{code.Mload, 0, 2},
+			{code.Dload, 0, 2},
+			{code.Push, int64(60), 2},
+			{code.Rate, 2, 2}},
+	},
+	{"exemplar_inc", `
+counter a
+exemplar_inc(a, "abc")
+`,
+		[]code.Instr{
+			{code.Mload, 0, 2},
+			{code.Dload, 0, 2},
+			{code.Str, 0, 2},
+			{code.Exemplar, 2, 2}},
+	},
+	{"merge_buckets", `
+histogram h buckets 1, 10
+merge_buckets(h, "1:2,10:1", 12)
+`,
+		[]code.Instr{
+			{code.Mload, 0, 2},
+			{code.Dload, 0, 2},
+			{code.Str, 0, 2},
+			{code.Push, int64(12), 2},
+			{code.Mergebkts, 3, 2}},
+	},
 	{"types", `
 gauge i
 gauge f
@@ -459,6 +657,21 @@ gauge f
 		},
 	},
 
+	{"program_version", `
+program_version()
+`,
+		[]code.Instr{
+			{code.Progver, 0, 1}}},
+	{"linelen", `
+linelen()
+`,
+		[]code.Instr{
+			{code.Linelen, 0, 1}}},
+	{"source_host", `
+source_host()
+`,
+		[]code.Instr{
+			{code.Getsourcehost, 0, 1}}},
 	{"getfilename", `
 getfilename()
 `,
@@ -4,6 +4,8 @@
 package vm
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"path/filepath"
 	"time"
@@ -20,7 +22,8 @@ import (
 func Compile(name string, input io.Reader, emitAst bool, emitAstTypes bool, syslogUseCurrentYear bool, loc *time.Location) (*VM, error) {
 	name = filepath.Base(name)
 
-	ast, err := parser.Parse(name, input)
+	h := sha256.New()
+	ast, err := parser.Parse(name, io.TeeReader(input, h))
 	if err != nil {
 		return nil, err
 	}
@@ -42,6 +45,7 @@ func Compile(name string, input io.Reader, emitAst bool, emitAstTypes bool, sysl
 	if err != nil {
 		return nil, err
 	}
+	obj.Version = hex.EncodeToString(h.Sum(nil)[:8])
 
 	vm := New(name, obj, syslogUseCurrentYear, loc)
 	return vm, nil
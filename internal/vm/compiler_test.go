@@ -28,6 +28,17 @@ i++
 	}
 }
 
+func TestCompileObserveNotHistogram(t *testing.T) {
+	r := strings.NewReader(`counter i
+/(?P<x>\d+)/ {
+  observe(i, $x)
+}`)
+	_, err := vm.Compile("test", r, true, true, true, nil)
+	if err == nil || !strings.Contains(err.Error(), "Expecting a histogram for argument 1 of observe().") {
+		t.Errorf("expected observe of a counter to fail, got %v", err)
+	}
+}
+
 func TestCompileCodegen(t *testing.T) {
 	r := strings.NewReader(`counter i
 // {
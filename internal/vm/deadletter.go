@@ -0,0 +1,146 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"expvar"
+	"io"
+	"sync"
+
+	"github.com/golang/glog"
+
+	"github.com/google/mtail/internal/logline"
+)
+
+var (
+	// linesUnmatched counts the lines that matched no pattern in any program.
+	linesUnmatched = expvar.NewInt("lines_unmatched_total")
+	// unmatchedSample holds the most recent lines that matched no pattern in
+	// any program.
+	unmatchedSample = &lineRing{}
+)
+
+func init() {
+	expvar.Publish("lines_unmatched_sample", expvar.Func(unmatchedSample.Lines))
+}
+
+// lineRing keeps the last few lines added to it.
+type lineRing struct {
+	mu    sync.Mutex
+	lines []string
+	next  int // Index of the oldest line once lines is full.
+	size  int // Number of lines to keep.
+}
+
+// SetSize discards the lines kept and keeps up to n lines from now on.
+func (r *lineRing) SetSize(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines = nil
+	r.next = 0
+	r.size = n
+}
+
+// Add keeps line, discarding the oldest line kept if the ring is full.
+func (r *lineRing) Add(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size == 0 {
+		return
+	}
+	if len(r.lines) < r.size {
+		r.lines = append(r.lines, line)
+		return
+	}
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % r.size
+}
+
+// Lines returns the lines kept, oldest first.
+func (r *lineRing) Lines() interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lines := make([]string, 0, len(r.lines))
+	lines = append(lines, r.lines[r.next:]...)
+	return append(lines, r.lines[:r.next]...)
+}
+
+// lineTally counts the programs yet to finish with a line, and whether any of
+// them matched it.
+type lineTally struct {
+	remaining int
+	matched   bool
+}
+
+// deadLetters collects the lines that matched no pattern in any program.  As
+// the programs process each line concurrently, the line is only a dead letter
+// once the last program has finished with it.
+type deadLetters struct {
+	mu      sync.Mutex
+	pending map[*logline.LogLine]*lineTally // Lines still being processed.
+	w       io.WriteCloser                  // If not nil, dead letters are written here.
+	sample  bool                            // If set, dead letters are kept in unmatchedSample.
+}
+
+func newDeadLetters() *deadLetters {
+	return &deadLetters{pending: make(map[*logline.LogLine]*lineTally)}
+}
+
+// Expect records that line has been sent to n programs.
+func (d *deadLetters) Expect(line *logline.LogLine, n int) {
+	if n == 0 {
+		d.unmatched(line)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pending[line] = &lineTally{remaining: n}
+}
+
+// Done records that a program has finished with line, and whether it matched
+// any pattern.
+func (d *deadLetters) Done(line *logline.LogLine, matched bool) {
+	d.mu.Lock()
+	t, ok := d.pending[line]
+	if !ok {
+		d.mu.Unlock()
+		return
+	}
+	t.matched = t.matched || matched
+	t.remaining--
+	if t.remaining > 0 {
+		d.mu.Unlock()
+		return
+	}
+	delete(d.pending, line)
+	d.mu.Unlock()
+	if !t.matched {
+		d.unmatched(line)
+	}
+}
+
+func (d *deadLetters) unmatched(line *logline.LogLine) {
+	linesUnmatched.Add(1)
+	if d.sample {
+		unmatchedSample.Add(line.Line)
+	}
+	if d.w == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, err := io.WriteString(d.w, line.Line+"\n"); err != nil {
+		glog.Warningf("Failed to write dead letter: %s", err)
+	}
+}
+
+// Close closes the dead letter file, if any.
+func (d *deadLetters) Close() {
+	if d.w == nil {
+		return
+	}
+	if err := d.w.Close(); err != nil {
+		glog.Warning(err)
+	}
+}
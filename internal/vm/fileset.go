@@ -0,0 +1,74 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fileSetCheckInterval is how often the file of a fileSet is checked for
+// changes, so that a set used on every line doesn't stat its file every line.
+const fileSetCheckInterval = 5 * time.Second
+
+// fileSet is a set of strings read from a file, one per line, and reloaded
+// when the file changes.  Blank lines and lines beginning with `#' are
+// ignored.
+type fileSet struct {
+	pathname string
+	checked  time.Time // When the file was last checked for changes.
+	modTime  time.Time
+	size     int64
+	members  map[string]struct{}
+}
+
+// Contains reports whether s is a member of the set, first reloading the set
+// if the file has been modified since it was last read.  The file is checked
+// at most once per fileSetCheckInterval, as of now, even if the check fails,
+// so a missing file is only reported once per interval.  Until it can be read
+// again the set keeps the members last read, or is empty.
+func (f *fileSet) Contains(s string, now time.Time) (bool, error) {
+	if f.checked.IsZero() || now.Sub(f.checked) >= fileSetCheckInterval {
+		f.checked = now
+		fi, err := os.Stat(f.pathname)
+		if err != nil {
+			return false, err
+		}
+		if f.members == nil || !fi.ModTime().Equal(f.modTime) || fi.Size() != f.size {
+			if err := f.load(); err != nil {
+				return false, err
+			}
+			f.modTime = fi.ModTime()
+			f.size = fi.Size()
+		}
+	}
+	_, ok := f.members[s]
+	return ok, nil
+}
+
+func (f *fileSet) load() error {
+	fd, err := os.Open(f.pathname)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	members := make(map[string]struct{})
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		members[line] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrapf(err, "reading set from %q", f.pathname)
+	}
+	f.members = members
+	return nil
+}
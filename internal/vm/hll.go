@@ -0,0 +1,70 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// hllPrecision is the number of hash bits used to pick a register; the
+// standard error of the estimate is about 1.04/sqrt(2^hllPrecision), or 0.8%.
+const hllPrecision = 14
+
+const hllRegisters = 1 << hllPrecision
+
+// hll is a HyperLogLog sketch, which estimates the number of distinct strings
+// added to it in constant space.
+type hll struct {
+	registers [hllRegisters]uint8
+	sum       float64 // Sum of 2^-r over the registers, kept up to date by Add.
+	zeros     int     // Number of registers still zero.
+}
+
+// newHLL returns an empty sketch.
+func newHLL() *hll {
+	return &hll{sum: hllRegisters, zeros: hllRegisters}
+}
+
+// Add records s in the sketch.
+func (h *hll) Add(s string) {
+	f := fnv.New64a()
+	// Writes to a hash never fail.
+	_, _ = f.Write([]byte(s))
+	x := mix64(f.Sum64())
+	i := x >> (64 - hllPrecision)
+	// Rank is the position of the first set bit in the remaining bits.
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if old := h.registers[i]; rank > old {
+		h.sum += math.Ldexp(1, -int(rank)) - math.Ldexp(1, -int(old))
+		if old == 0 {
+			h.zeros--
+		}
+		h.registers[i] = rank
+	}
+}
+
+// Estimate returns the approximate number of distinct strings added.
+func (h *hll) Estimate() int64 {
+	m := float64(hllRegisters)
+	e := 0.7213 / (1 + 1.079/m) * m * m / h.sum
+	// Use linear counting while many registers are empty, as the raw
+	// estimate is biased for small cardinalities.
+	if e <= 2.5*m && h.zeros > 0 {
+		e = m * math.Log(m/float64(h.zeros))
+	}
+	return int64(math.Round(e))
+}
+
+// mix64 is the splitmix64 finalizer, which spreads the FNV hash more evenly
+// across the high bits used for register selection.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -14,6 +14,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"encoding/json"
 	"expvar"
 	"fmt"
 	"html/template"
@@ -23,6 +24,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -44,36 +46,50 @@ var (
 	// ProgLoadErrors counts the number of program load errors.
 	ProgLoadErrors    = expvar.NewMap("prog_load_errors_total")
 	progRuntimeErrors = expvar.NewMap("prog_runtime_errors_total")
+	// linesDropped counts the lines not sent to a program because its queue was full.
+	linesDropped = expvar.NewMap("vm_lines_dropped_total")
+	// linesQueued reports the number of lines waiting to be processed by each program.
+	linesQueued = expvar.NewMap("vm_lines_queued")
 )
 
 const (
 	fileExt = ".mtail"
 )
 
-// LoadAllPrograms loads all programs in a directory and starts watching the
-// directory for filesystem changes.  Any compile errors are stored for later retrieival.
+// LoadAllPrograms loads all programs in each program directory and starts watching the
+// directories for filesystem changes.  Any compile errors are stored for later retrieival.
 // This function returns an error if an internal error occurs.
 func (l *Loader) LoadAllPrograms() error {
-	if l.programPath == "" {
+	if len(l.programRoots) == 0 {
 		glog.V(2).Info("Programpath is empty, loading nothing")
 		return nil
 	}
-	s, err := os.Stat(l.programPath)
+	for _, root := range l.programRoots {
+		if err := l.loadRoot(root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadRoot loads the programs in the directory or file at the path of root.
+func (l *Loader) loadRoot(root programRoot) error {
+	s, err := os.Stat(root.path)
 	if err != nil {
-		return errors.Wrapf(err, "failed to stat %q", l.programPath)
+		return errors.Wrapf(err, "failed to stat %q", root.path)
 	}
 	switch {
 	case s.IsDir():
-		fis, rerr := ioutil.ReadDir(l.programPath)
+		fis, rerr := ioutil.ReadDir(root.path)
 		if rerr != nil {
-			return errors.Wrapf(rerr, "Failed to list programs in %q", l.programPath)
+			return errors.Wrapf(rerr, "Failed to list programs in %q", root.path)
 		}
 
 		for _, fi := range fis {
 			if fi.IsDir() {
 				continue
 			}
-			err = l.LoadProgram(filepath.Join(l.programPath, fi.Name()))
+			err = l.loadProgram(filepath.Join(root.path, fi.Name()), root.namespace)
 			if err != nil {
 				if l.errorsAbort {
 					return err
@@ -82,7 +98,7 @@ func (l *Loader) LoadAllPrograms() error {
 			}
 		}
 	default:
-		err = l.LoadProgram(l.programPath)
+		err = l.loadProgram(root.path, root.namespace)
 		if err != nil {
 			if l.errorsAbort {
 				return err
@@ -94,17 +110,23 @@ func (l *Loader) LoadAllPrograms() error {
 }
 
 // LoadProgram loads or reloads a program from the full pathname programPath.  The name of
-// the program is the basename of the file.
+// the program is the basename of the file, qualified by the namespace of the
+// program directory it was found in, if any.
 func (l *Loader) LoadProgram(programPath string) error {
-	name := filepath.Base(programPath)
-	if strings.HasPrefix(name, ".") {
+	return l.loadProgram(programPath, l.namespaceOf(programPath))
+}
+
+func (l *Loader) loadProgram(programPath, namespace string) error {
+	base := filepath.Base(programPath)
+	if strings.HasPrefix(base, ".") {
 		glog.V(2).Infof("Skipping %s because it is a hidden file.", programPath)
 		return nil
 	}
-	if filepath.Ext(name) != fileExt {
+	if filepath.Ext(base) != fileExt {
 		glog.V(2).Infof("Skipping %s due to file extension.", programPath)
 		return nil
 	}
+	name := programName(base, namespace)
 	f, err := os.OpenFile(programPath, os.O_RDONLY, 0600)
 	if err != nil {
 		ProgLoadErrors.Add(name, 1)
@@ -117,7 +139,8 @@ func (l *Loader) LoadProgram(programPath string) error {
 	}()
 	l.programErrorMu.Lock()
 	defer l.programErrorMu.Unlock()
-	l.programErrors[name] = l.CompileAndRun(name, f)
+	l.programErrors[name] = l.compileAndRun(name, namespace, f)
+	l.programLoadTimes[name] = time.Now()
 	if l.programErrors[name] != nil {
 		if l.errorsAbort {
 			return l.programErrors[name]
@@ -127,6 +150,25 @@ func (l *Loader) LoadProgram(programPath string) error {
 	return nil
 }
 
+// namespaceOf returns the namespace of the program directory containing
+// programPath, or the empty string if it is in none of them.
+func (l *Loader) namespaceOf(programPath string) string {
+	for _, root := range l.programRoots {
+		if filepath.Clean(root.path) == filepath.Clean(programPath) || filepath.Clean(root.path) == filepath.Dir(programPath) {
+			return root.namespace
+		}
+	}
+	return ""
+}
+
+// programName returns the name of the program with basename base loaded in the namespace.
+func programName(base, namespace string) string {
+	if namespace == "" {
+		return base
+	}
+	return namespace + ":" + base
+}
+
 const loaderTemplate = `
 <h2 id="loader">Program Loader</h2>
 <table border=1>
@@ -199,6 +241,12 @@ func (l *Loader) WriteStatusHTML(w io.Writer) error {
 // it.  If the new program fails to compile, any existing virtual machine with
 // the same name remains running.
 func (l *Loader) CompileAndRun(name string, input io.Reader) error {
+	return l.compileAndRun(name, "", input)
+}
+
+// compileAndRun is CompileAndRun, prefixing the names of the metrics declared
+// by the program with namespace if it is not empty.
+func (l *Loader) compileAndRun(name, namespace string, input io.Reader) error {
 	glog.V(2).Infof("CompileAndRun %s", name)
 	var buf bytes.Buffer
 	tee := io.TeeReader(input, &buf)
@@ -229,8 +277,18 @@ func (l *Loader) CompileAndRun(name string, input io.Reader) error {
 		glog.Info("Dumping program objects and bytecode\n", v.DumpByteCode())
 	}
 
+	if l.workers > 1 {
+		if b := v.statefulBuiltin(); b != "" {
+			ProgLoadErrors.Add(name, 1)
+			return errors.Errorf("%s can't run on %d workers, as it uses %s(), which keeps state for each worker", name, l.workers, b)
+		}
+	}
+
 	// Load the metrics from the compilation into the global metric storage for export.
 	for _, m := range v.m {
+		if namespace != "" {
+			m.Name = namespace + "_" + m.Name
+		}
 		if !m.Hidden {
 			if l.omitMetricSource {
 				m.Source = ""
@@ -252,13 +310,29 @@ func (l *Loader) CompileAndRun(name string, input io.Reader) error {
 	l.handleMu.Lock()
 	defer l.handleMu.Unlock()
 	// Terminates the existing vm.
+	var disabled bool
 	if handle, ok := l.handles[name]; ok {
 		close(handle.lines)
+		disabled = handle.disabled
+	}
+	lines := make(chan *logline.LogLine, l.lineQueueSize)
+	if l.deadLetters != nil {
+		v.lineDone = l.deadLetters.Done
+	}
+	v.metadata = l.metadata
+	v.started = l.started
+	l.handles[name] = &vmHandle{contentHash: contentHash, vm: v, lines: lines, disabled: disabled}
+	linesQueued.Set(name, expvar.Func(func() interface{} { return len(lines) }))
+	var clones []*VM
+	for i := 1; i < l.workers; i++ {
+		clones = append(clones, v.clone())
 	}
-	lines := make(chan *logline.LogLine)
-	l.handles[name] = &vmHandle{contentHash: contentHash, vm: v, lines: lines}
 	l.wg.Add(1)
 	go v.Run(lines, &l.wg)
+	for _, c := range clones {
+		l.wg.Add(1)
+		go c.Run(lines, &l.wg)
+	}
 	return nil
 }
 
@@ -266,23 +340,25 @@ type vmHandle struct {
 	contentHash []byte
 	vm          *VM
 	lines       chan *logline.LogLine
+	disabled    bool // If set, no lines are sent to the vm.
 }
 
 // Loader handles the lifecycle of programs and virtual machines, by watching
 // the configured program source directory, compiling changes to programs, and
 // managing the virtual machines.
 type Loader struct {
-	ctx         context.Context       // a cancellable context
-	wg          sync.WaitGroup        // used to await vm shutdown
-	ms          *metrics.Store        // pointer to metrics.Store to pass to compiler
-	reg         prometheus.Registerer // plce to reg metrics
-	programPath string                // Path that contains mtail programs.
+	ctx          context.Context       // a cancellable context
+	wg           sync.WaitGroup        // used to await vm shutdown
+	ms           *metrics.Store        // pointer to metrics.Store to pass to compiler
+	reg          prometheus.Registerer // plce to reg metrics
+	programRoots []programRoot         // Paths that contain mtail programs.
 
 	handleMu sync.RWMutex         // guards accesses to handles
 	handles  map[string]*vmHandle // map of program names to virtual machines
 
-	programErrorMu sync.RWMutex     // guards access to programErrors
-	programErrors  map[string]error // errors from the last compile attempt of the program
+	programErrorMu   sync.RWMutex         // guards access to programErrors and programLoadTimes
+	programErrors    map[string]error     // errors from the last compile attempt of the program
+	programLoadTimes map[string]time.Time // time of the last compile attempt of the program
 
 	overrideLocation     *time.Location // Instructs the vm to override the timezone with the specified zone.
 	compileOnly          bool           // Only compile programs and report errors, do not load VMs.
@@ -292,10 +368,24 @@ type Loader struct {
 	dumpBytecode         bool           // Instructs the loader to dump to stdout the compiled program after compilation.
 	syslogUseCurrentYear bool           // Instructs the VM to overwrite zero years with the current year in a strptime instruction.
 	omitMetricSource     bool
+	lineQueueSize        int // If nonzero, each program has a queue of this many lines, and lines are dropped when it is full.
+	workers              int // If more than one, each program runs this many VMs taking lines from its queue concurrently.
+
+	deadLetters *deadLetters // If not nil, collects the lines that no program matched.
+
+	metadata map[string]string // Host metadata for getmeta() in every program.
+
+	started time.Time // When the Loader was created, which program warmups run from.
 
 	signalQuit chan struct{} // When closed stops the signal handler goroutine.
 }
 
+// programRoot is a directory or file of mtail programs loaded by the Loader.
+type programRoot struct {
+	path      string
+	namespace string // If not empty, qualifies the names of the programs and their metrics.
+}
+
 // Option configures a new program Loader.
 type Option func(*Loader) error
 
@@ -363,6 +453,93 @@ func OmitMetricSource() Option {
 	}
 }
 
+// DropLinesWhenFull gives each program a queue of size lines, and drops lines
+// for a program when its queue is full instead of waiting for it to catch up.
+func DropLinesWhenFull(size int) Option {
+	return func(l *Loader) error {
+		if size < 1 {
+			return errors.Errorf("line queue size must be positive, not %d", size)
+		}
+		l.lineQueueSize = size
+		return nil
+	}
+}
+
+// Workers runs n virtual machines for each program, which take lines from the
+// program's queue concurrently.  Lines are not processed in order, but each
+// update of a datum is made by one VM at a time.  With more than one, programs
+// that use builtins keeping state in the VM, like changed(), fail to load.
+func Workers(n int) Option {
+	return func(l *Loader) error {
+		if n < 1 {
+			return errors.Errorf("number of workers must be positive, not %d", n)
+		}
+		l.workers = n
+		return nil
+	}
+}
+
+// HostMetadata sets the metadata about the host, such as its zone, that
+// programs read with getmeta().
+func HostMetadata(md map[string]string) Option {
+	return func(l *Loader) error {
+		l.metadata = md
+		return nil
+	}
+}
+
+// DeadLetterFile instructs the Loader to append the lines that matched no
+// pattern in any program to the file at pathname, and count them in
+// lines_unmatched_total.
+func DeadLetterFile(pathname string) Option {
+	return func(l *Loader) error {
+		f, err := os.OpenFile(pathname, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return errors.Wrapf(err, "failed to open dead letter file %q", pathname)
+		}
+		if l.deadLetters == nil {
+			l.deadLetters = newDeadLetters()
+		}
+		l.deadLetters.w = f
+		return nil
+	}
+}
+
+// DeadLetterSample instructs the Loader to keep the last size lines that
+// matched no pattern in any program in the lines_unmatched_sample expvar, and
+// count them in lines_unmatched_total.
+func DeadLetterSample(size int) Option {
+	return func(l *Loader) error {
+		if size < 1 {
+			return errors.Errorf("dead letter sample size must be positive, not %d", size)
+		}
+		if l.deadLetters == nil {
+			l.deadLetters = newDeadLetters()
+		}
+		l.deadLetters.sample = true
+		unmatchedSample.SetSize(size)
+		return nil
+	}
+}
+
+// NamespacedProgramPath instructs the Loader to also load the programs in path,
+// prefixing the names of the metrics they declare with namespace so programs
+// in different directories can declare metrics of the same name.
+func NamespacedProgramPath(path, namespace string) Option {
+	return func(l *Loader) error {
+		if namespace == "" {
+			return errors.Errorf("namespace for program path %q must not be empty", path)
+		}
+		for _, root := range l.programRoots {
+			if root.namespace == namespace {
+				return errors.Errorf("namespace %q already used for program path %q", namespace, root.path)
+			}
+		}
+		l.programRoots = append(l.programRoots, programRoot{path, namespace})
+		return nil
+	}
+}
+
 // PrometheusRegisterer passes in a registry for setting up exported metrics.
 func PrometheusRegisterer(reg prometheus.Registerer) Option {
 	return func(l *Loader) error {
@@ -378,11 +555,15 @@ func NewLoader(lines <-chan *logline.LogLine, wg *sync.WaitGroup, programPath st
 		return nil, errors.New("loader needs a store")
 	}
 	l := &Loader{
-		ms:            store,
-		programPath:   programPath,
-		handles:       make(map[string]*vmHandle),
-		programErrors: make(map[string]error),
-		signalQuit:    make(chan struct{}),
+		ms:               store,
+		handles:          make(map[string]*vmHandle),
+		programErrors:    make(map[string]error),
+		programLoadTimes: make(map[string]time.Time),
+		signalQuit:       make(chan struct{}),
+		started:          systemClock{}.Now(),
+	}
+	if programPath != "" {
+		l.programRoots = append(l.programRoots, programRoot{path: programPath})
 	}
 	initDone := make(chan struct{})
 	defer close(initDone)
@@ -396,6 +577,9 @@ func NewLoader(lines <-chan *logline.LogLine, wg *sync.WaitGroup, programPath st
 			defer wg.Done()
 			<-initDone
 			l.wg.Wait()
+			if l.deadLetters != nil {
+				l.deadLetters.Close()
+			}
 		}()
 	}()
 	// This goroutine is the main consumer/producer loop.
@@ -406,8 +590,35 @@ func NewLoader(lines <-chan *logline.LogLine, wg *sync.WaitGroup, programPath st
 		for line := range lines {
 			LineCount.Add(1)
 			l.handleMu.RLock()
-			for prog := range l.handles {
-				l.handles[prog].lines <- line
+			if l.deadLetters != nil {
+				// Expect the line before sending it, as the programs may
+				// finish with it before the last is sent.
+				var enabled int
+				for _, handle := range l.handles {
+					if !handle.disabled {
+						enabled++
+					}
+				}
+				l.deadLetters.Expect(line, enabled)
+			}
+			for prog, handle := range l.handles {
+				if handle.disabled {
+					continue
+				}
+				if l.lineQueueSize == 0 {
+					handle.lines <- line
+					continue
+				}
+				select {
+				case handle.lines <- line:
+				default:
+					linesDropped.Add(prog, 1)
+					if l.deadLetters != nil {
+						// The program never saw the line, so it can't
+						// be said to have matched no pattern.
+						l.deadLetters.Done(line, true)
+					}
+				}
 			}
 			l.handleMu.RUnlock()
 		}
@@ -417,10 +628,11 @@ func NewLoader(lines <-chan *logline.LogLine, wg *sync.WaitGroup, programPath st
 		for prog := range l.handles {
 			close(l.handles[prog].lines)
 			delete(l.handles, prog)
+			linesQueued.Delete(prog)
 		}
 		l.handleMu.Unlock()
 	}()
-	if l.programPath == "" {
+	if len(l.programRoots) == 0 {
 		glog.Info("No program path specified, no programs will be loaded.")
 		return l, nil
 	}
@@ -430,7 +642,7 @@ func NewLoader(lines <-chan *logline.LogLine, wg *sync.WaitGroup, programPath st
 	go func() {
 		defer l.wg.Done()
 		<-initDone
-		if l.programPath == "" {
+		if len(l.programRoots) == 0 {
 			glog.Info("no program reload on SIGHUP without programPath")
 			return
 		}
@@ -467,7 +679,7 @@ func (l *Loader) SetOption(options ...Option) error {
 
 // UnloadProgram removes the named program, any currently running VM goroutine.
 func (l *Loader) UnloadProgram(pathname string) {
-	name := filepath.Base(pathname)
+	name := programName(filepath.Base(pathname), l.namespaceOf(pathname))
 	l.handleMu.Lock()
 	defer l.handleMu.Unlock()
 	if _, ok := l.handles[name]; ok {
@@ -475,6 +687,53 @@ func (l *Loader) UnloadProgram(pathname string) {
 	}
 }
 
+// SetProgramEnabled enables or disables the named program.  A disabled program
+// stays loaded, but is sent no lines, so its metrics stop changing until it is
+// enabled again.  It stays disabled if it is reloaded.
+func (l *Loader) SetProgramEnabled(name string, enabled bool) error {
+	l.handleMu.Lock()
+	defer l.handleMu.Unlock()
+	handle, ok := l.handles[name]
+	if !ok {
+		return errors.Errorf("no program named %q is loaded", name)
+	}
+	if handle.disabled != !enabled {
+		glog.Infof("Setting program %s enabled to %v", name, enabled)
+	}
+	handle.disabled = !enabled
+	return nil
+}
+
+// ProgramEnableHandler enables the program named by the prog parameter of a
+// POST request.
+func (l *Loader) ProgramEnableHandler(w http.ResponseWriter, r *http.Request) {
+	l.setProgramEnabledHandler(w, r, true)
+}
+
+// ProgramDisableHandler disables the program named by the prog parameter of a
+// POST request, so that an expensive program can be stopped during an
+// incident without unloading it.
+func (l *Loader) ProgramDisableHandler(w http.ResponseWriter, r *http.Request) {
+	l.setProgramEnabledHandler(w, r, false)
+}
+
+func (l *Loader) setProgramEnabledHandler(w http.ResponseWriter, r *http.Request, enabled bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	prog := r.FormValue("prog")
+	if prog == "" {
+		http.Error(w, "No program given", http.StatusBadRequest)
+		return
+	}
+	if err := l.SetProgramEnabled(prog, enabled); err != nil {
+		http.Error(w, "No program found", http.StatusNotFound)
+		return
+	}
+}
+
 func (l *Loader) ProgzHandler(w http.ResponseWriter, r *http.Request) {
 	prog := r.URL.Query().Get("prog")
 	if prog != "" {
@@ -498,3 +757,48 @@ func (l *Loader) ProgzHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	fmt.Fprintf(w, "</ul>")
 }
+
+// programStatus is the result of the last attempt to load a program, as
+// exported by ProgramStatusHandler.
+type programStatus struct {
+	Name     string    `json:"name"`
+	Status   string    `json:"status"` // Either "compiled" or "failed".
+	Error    string    `json:"error,omitempty"`
+	LoadTime time.Time `json:"load_time"`
+	Disabled bool      `json:"disabled,omitempty"`
+}
+
+// ProgramStatusHandler exports the load status of each program as JSON, so
+// deployment tools can check that all programs compiled.
+func (l *Loader) ProgramStatusHandler(w http.ResponseWriter, r *http.Request) {
+	l.programErrorMu.RLock()
+	status := make([]programStatus, 0, len(l.programErrors))
+	for name, err := range l.programErrors {
+		s := programStatus{Name: name, Status: "compiled", LoadTime: l.programLoadTimes[name]}
+		if err != nil {
+			s.Status = "failed"
+			s.Error = err.Error()
+		}
+		status = append(status, s)
+	}
+	l.programErrorMu.RUnlock()
+	l.handleMu.RLock()
+	for i := range status {
+		if handle, ok := l.handles[status[i].Name]; ok {
+			status[i].Disabled = handle.disabled
+		}
+	}
+	l.handleMu.RUnlock()
+	sort.Slice(status, func(i, j int) bool { return status[i].Name < status[j].Name })
+	b, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		glog.Info("error marshalling program status into json:", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	if _, err := w.Write(b); err != nil {
+		glog.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -4,14 +4,23 @@
 package vm
 
 import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/google/mtail/internal/logline"
 	"github.com/google/mtail/internal/metrics"
+	"github.com/google/mtail/internal/metrics/datum"
 	"github.com/google/mtail/internal/testutil"
 )
 
@@ -78,3 +87,404 @@ func TestLoadProg(t *testing.T) {
 	close(lines)
 	wg.Wait()
 }
+
+func TestDropLinesWhenFull(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	var wg sync.WaitGroup
+	l, err := NewLoader(lines, &wg, "", store, DropLinesWhenFull(2))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("fast", strings.NewReader("/$/ {}\n")))
+	testutil.FatalIfErr(t, l.CompileAndRun("slow", strings.NewReader("counter slow_lines\n/$/ {\n  slow_lines++\n}\n")))
+
+	l.handleMu.RLock()
+	fast := l.handles["fast"]
+	slow := l.handles["slow"]
+	l.handleMu.RUnlock()
+
+	fastDropped := testutil.ExpectMapExpvarDeltaWithDeadline(t, "vm_lines_dropped_total", "fast", 0)
+	slowDropped := func() int64 {
+		if v, ok := linesDropped.Get("slow").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	slowDroppedBefore := slowDropped()
+
+	// Hold the lock on the slow program's metric so it stalls on its first line.
+	slow.vm.m[0].Lock()
+	for i := 0; i < 10; i++ {
+		lines <- logline.New(context.Background(), "test", "line")
+		// Let the fast program catch up so its queue always has room.
+		for len(fast.lines) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if slowDropped() == slowDroppedBefore {
+		t.Errorf("expecting slow program to drop lines")
+	}
+	slow.vm.m[0].Unlock()
+	close(lines)
+	wg.Wait()
+	fastDropped()
+}
+
+const workersProgram = `counter requests by method, status
+counter bytes_total
+counter kilobytes_total
+gauge method_bytes by method
+
+/^(?P<method>[A-Z]+) \S+ (?P<status>\d{3}) (?P<bytes>\d+)$/ {
+  requests[$method][$status]++
+  bytes_total += $bytes
+  kilobytes_total += $bytes / 1024.0
+  method_bytes[$method] = method_bytes[$method] + $bytes
+}
+`
+
+// workersLine returns the i'th test line for workersProgram.
+func workersLine(i int) *logline.LogLine {
+	methods := []string{"GET", "POST", "PUT"}
+	statuses := []string{"200", "404", "500", "503"}
+	return logline.New(context.Background(), "test", methods[i%len(methods)]+" /path/"+strconv.Itoa(i)+" "+statuses[i%len(statuses)]+" "+strconv.Itoa(i%100))
+}
+
+// runWorkers processes n lines with workersProgram in a loader with the given
+// options, and returns the store of metrics.
+func runWorkers(tb testing.TB, n int, options ...Option) *metrics.Store {
+	tb.Helper()
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	var wg sync.WaitGroup
+	l, err := NewLoader(lines, &wg, "", store, options...)
+	testutil.FatalIfErr(tb, err)
+	testutil.FatalIfErr(tb, l.CompileAndRun("workers", strings.NewReader(workersProgram)))
+	for i := 0; i < n; i++ {
+		lines <- workersLine(i)
+	}
+	close(lines)
+	wg.Wait()
+	return store
+}
+
+// workersTotals returns the value of each label set of each metric in store.
+func workersTotals(t *testing.T, store *metrics.Store) map[string]string {
+	t.Helper()
+	totals := make(map[string]string)
+	testutil.FatalIfErr(t, store.Range(func(m *metrics.Metric) error {
+		for _, lv := range m.LabelValues {
+			totals[m.Name+"{"+strings.Join(lv.Labels, ",")+"}"] = lv.Value.ValueString()
+		}
+		return nil
+	}))
+	return totals
+}
+
+func TestWorkers(t *testing.T) {
+	serial := workersTotals(t, runWorkers(t, 10000))
+	if len(serial) != 17 {
+		t.Fatalf("expected 12 label sets of requests, one of bytes_total and kilobytes_total, and three of method_bytes, got %v", serial)
+	}
+	concurrent := workersTotals(t, runWorkers(t, 10000, Workers(4)))
+	testutil.ExpectNoDiff(t, serial, concurrent)
+}
+
+// TestWorkersBuiltinUpdates checks that no updates are lost when a builtin
+// writing a datum comes before another update in the same action.  Run it
+// with -race.
+func TestWorkersBuiltinUpdates(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	var wg sync.WaitGroup
+	l, err := NewLoader(lines, &wg, "", store, Workers(4))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("builtins", strings.NewReader(`counter traced by method
+counter total
+gauge kilobytes
+
+/^(?P<method>[A-Z]+) (?P<trace_id>\w+) (?P<bytes>\d+)$/ {
+  exemplar_inc(traced[$method], $trace_id)
+  total = total + 1
+  kilobytes = kilobytes + $bytes / 1024.0
+}
+`)))
+	methods := []string{"GET", "POST", "PUT", "DELETE"}
+	const n = 10000
+	for i := 0; i < n; i++ {
+		lines <- logline.New(context.Background(), "test", methods[i%len(methods)]+" t"+strconv.Itoa(i)+" 512")
+	}
+	close(lines)
+	wg.Wait()
+	expected := map[string]string{
+		"traced{GET}":    strconv.Itoa(n / 4),
+		"traced{POST}":   strconv.Itoa(n / 4),
+		"traced{PUT}":    strconv.Itoa(n / 4),
+		"traced{DELETE}": strconv.Itoa(n / 4),
+		"total{}":        strconv.Itoa(n),
+		"kilobytes{}":    strconv.Itoa(n / 2),
+	}
+	testutil.ExpectNoDiff(t, expected, workersTotals(t, store))
+}
+
+func TestWorkersStatefulBuiltin(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	var wg sync.WaitGroup
+	l, err := NewLoader(lines, &wg, "", store, Workers(2))
+	testutil.FatalIfErr(t, err)
+	err = l.CompileAndRun("changed", strings.NewReader(`counter changes
+/(?P<state>\w+)/ {
+  changed("state", $state) {
+    changes++
+  }
+}
+`))
+	if err == nil || !strings.Contains(err.Error(), "changed()") {
+		t.Errorf("expected changed() to be refused on two workers, got %v", err)
+	}
+	close(lines)
+	wg.Wait()
+}
+
+func BenchmarkWorkers(b *testing.B) {
+	for _, n := range []int{1, 2, 4, 8} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			b.ReportAllocs()
+			runWorkers(b, b.N, Workers(n))
+		})
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	var wg sync.WaitGroup
+	deadLetterFile := filepath.Join(testutil.TestTempDir(t), "unmatched.log")
+	l, err := NewLoader(lines, &wg, "", store, DeadLetterFile(deadLetterFile), DeadLetterSample(10))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("get", strings.NewReader("counter gets\n/^GET / {\n  gets++\n}\n")))
+	testutil.FatalIfErr(t, l.CompileAndRun("noop", strings.NewReader("# matches nothing\n")))
+
+	unmatched := testutil.ExpectExpvarDeltaWithDeadline(t, "lines_unmatched_total", 2)
+	for _, line := range []string{"GET /index.html", "POST /form", "GET /about.html", "garbage"} {
+		lines <- logline.New(context.Background(), "test", line)
+	}
+	close(lines)
+	wg.Wait()
+	unmatched()
+
+	want := []string{"POST /form", "garbage"}
+	b, err := ioutil.ReadFile(deadLetterFile)
+	testutil.FatalIfErr(t, err)
+	if diff := testutil.Diff(want, strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")); diff != "" {
+		t.Errorf("dead letter file diff (-want +got):\n%s", diff)
+	}
+	if diff := testutil.Diff(want, unmatchedSample.Lines()); diff != "" {
+		t.Errorf("dead letter sample diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestHostMetadata(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	var wg sync.WaitGroup
+	l, err := NewLoader(lines, &wg, "", store, HostMetadata(map[string]string{"zone": "us-east1-b"}))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("meta", strings.NewReader("counter requests by zone, rack\n/$/ {\n  requests[getmeta(\"zone\"), getmeta(\"rack\")]++\n}\n")))
+	lines <- logline.New(context.Background(), "test", "GET /")
+	close(lines)
+	wg.Wait()
+
+	m := store.FindMetricOrNil("requests", "meta")
+	if m == nil {
+		t.Fatal("requests metric not found")
+	}
+	if lv := m.FindLabelValueOrNil([]string{"us-east1-b", ""}); lv == nil || datum.GetInt(lv.Value) != 1 {
+		t.Errorf("expecting requests with zone us-east1-b and no rack, got %v", m)
+	}
+}
+
+func TestWarmupFromLoaderStart(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	var wg sync.WaitGroup
+	l, err := NewLoader(lines, &wg, "", store)
+	testutil.FatalIfErr(t, err)
+	// The process has been running for longer than the warmup.
+	l.started = time.Now().Add(-time.Minute)
+	prog := "pragma warmup \"30s\"\ncounter requests\n/GET/ {\n  requests++\n}\n"
+	testutil.FatalIfErr(t, l.CompileAndRun("warmup_reload", strings.NewReader(prog)))
+	// A reload doesn't warm the program up again.
+	testutil.FatalIfErr(t, l.CompileAndRun("warmup_reload", strings.NewReader(prog+"# changed\n")))
+
+	skipped := testutil.ExpectMapExpvarDeltaWithDeadline(t, "vm_warmup_skipped_total", "warmup_reload", 0)
+	lines <- logline.New(context.Background(), "test", "GET /")
+	close(lines)
+	wg.Wait()
+	skipped()
+
+	m := store.FindMetricOrNil("requests", "warmup_reload")
+	if m == nil {
+		t.Fatal("requests metric not found")
+	}
+	d, err := m.GetDatum()
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, int64(1), datum.GetInt(d))
+}
+
+func TestLineRing(t *testing.T) {
+	r := &lineRing{}
+	r.SetSize(2)
+	for _, line := range []string{"a", "b", "c"} {
+		r.Add(line)
+	}
+	if diff := testutil.Diff([]string{"b", "c"}, r.Lines()); diff != "" {
+		t.Errorf("line ring diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestNamespacedProgramPath(t *testing.T) {
+	store := metrics.NewStore()
+	tmpDir := testutil.TestTempDir(t)
+	namespaces := []string{"frontend", "backend"}
+	var opts []Option
+	for _, ns := range namespaces {
+		dir := filepath.Join(tmpDir, ns)
+		testutil.FatalIfErr(t, os.Mkdir(dir, 0700))
+		testutil.WriteString(t, testutil.TestOpenFile(t, filepath.Join(dir, "requests.mtail")), "counter requests\n/$/ {\n  requests++\n}\n")
+		opts = append(opts, NamespacedProgramPath(dir, ns))
+	}
+
+	lines := make(chan *logline.LogLine)
+	var wg sync.WaitGroup
+	_, err := NewLoader(lines, &wg, "", store, opts...)
+	testutil.FatalIfErr(t, err)
+	lines <- logline.New(context.Background(), "test", "line")
+	close(lines)
+	wg.Wait()
+
+	for _, ns := range namespaces {
+		name := ns + "_requests"
+		m := store.FindMetricOrNil(name, ns+":requests.mtail")
+		if m == nil {
+			t.Fatalf("metric %q not found in store: %v", name, store)
+		}
+		d, err := m.GetDatum()
+		testutil.FatalIfErr(t, err)
+		if v := datum.GetInt(d); v != 1 {
+			t.Errorf("%s: expecting 1, got %d", name, v)
+		}
+	}
+}
+
+func TestNamespacedProgramPathDuplicate(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	var wg sync.WaitGroup
+	_, err := NewLoader(lines, &wg, "", store, NamespacedProgramPath("a", "ns"), NamespacedProgramPath("b", "ns"))
+	if err == nil {
+		t.Error("expecting error for duplicate namespace")
+	}
+}
+
+func TestProgramStatusHandler(t *testing.T) {
+	store := metrics.NewStore()
+	tmpDir := testutil.TestTempDir(t)
+	testutil.WriteString(t, testutil.TestOpenFile(t, filepath.Join(tmpDir, "good.mtail")), "counter lines\n/$/ {\n  lines++\n}\n")
+	testutil.WriteString(t, testutil.TestOpenFile(t, filepath.Join(tmpDir, "bad.mtail")), "/$/ {\n  lines++\n}\n")
+
+	lines := make(chan *logline.LogLine)
+	var wg sync.WaitGroup
+	l, err := NewLoader(lines, &wg, tmpDir, store)
+	testutil.FatalIfErr(t, err)
+
+	w := httptest.NewRecorder()
+	l.ProgramStatusHandler(w, httptest.NewRequest("GET", "/progz/status", nil))
+	close(lines)
+	wg.Wait()
+
+	if ct := w.Result().Header.Get("content-type"); ct != "application/json" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	var status []programStatus
+	testutil.FatalIfErr(t, json.Unmarshal(w.Body.Bytes(), &status))
+	if len(status) != 2 {
+		t.Fatalf("expecting status of 2 programs, got %v", status)
+	}
+	bad, good := status[0], status[1]
+	if good.Name != "good.mtail" || good.Status != "compiled" || good.Error != "" || good.LoadTime.IsZero() {
+		t.Errorf("unexpected status for good program: %+v", good)
+	}
+	if bad.Name != "bad.mtail" || bad.Status != "failed" || !strings.Contains(bad.Error, "Identifier `lines' not declared.") || bad.LoadTime.IsZero() {
+		t.Errorf("unexpected status for bad program: %+v", bad)
+	}
+}
+
+func TestProgramDisable(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	var wg sync.WaitGroup
+	l, err := NewLoader(lines, &wg, "", store)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, l.CompileAndRun("expensive", strings.NewReader("counter expensive_lines\n/$/ {\n  expensive_lines++\n}\n")))
+	// The other program shows when the lines have been processed.
+	testutil.FatalIfErr(t, l.CompileAndRun("other", strings.NewReader("counter other_lines\n/$/ {\n  other_lines++\n}\n")))
+
+	count := func(name, prog string) int64 {
+		d, err := store.FindMetricOrNil(name, prog).GetDatum()
+		testutil.FatalIfErr(t, err)
+		return datum.GetInt(d)
+	}
+	// send sends a line and waits for the other program to process it.
+	sent := int64(0)
+	send := func() {
+		lines <- logline.New(context.Background(), "test", "GET /")
+		sent++
+		ok, err := testutil.DoOrTimeout(func() (bool, error) {
+			return count("other_lines", "other") == sent, nil
+		}, time.Second, 10*time.Millisecond)
+		testutil.FatalIfErr(t, err)
+		if !ok {
+			t.Fatal("line not processed")
+		}
+	}
+
+	send()
+	w := httptest.NewRecorder()
+	l.ProgramDisableHandler(w, httptest.NewRequest("POST", "/progz/disable?prog=expensive", nil))
+	if w.Code != 200 {
+		t.Fatalf("disable failed: %d %s", w.Code, w.Body)
+	}
+	send()
+	send()
+	if got := count("expensive_lines", "expensive"); got != 1 {
+		t.Errorf("disabled program processed lines: got %d, want 1", got)
+	}
+
+	w = httptest.NewRecorder()
+	l.ProgramEnableHandler(w, httptest.NewRequest("POST", "/progz/enable?prog=expensive", nil))
+	if w.Code != 200 {
+		t.Fatalf("enable failed: %d %s", w.Code, w.Body)
+	}
+	send()
+	ok, err := testutil.DoOrTimeout(func() (bool, error) {
+		return count("expensive_lines", "expensive") == 2, nil
+	}, time.Second, 10*time.Millisecond)
+	testutil.FatalIfErr(t, err)
+	if !ok {
+		t.Errorf("enabled program did not resume: got %d, want 2", count("expensive_lines", "expensive"))
+	}
+
+	w = httptest.NewRecorder()
+	l.ProgramDisableHandler(w, httptest.NewRequest("POST", "/progz/disable?prog=missing", nil))
+	if w.Code != 404 {
+		t.Errorf("expecting not found for missing program, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	l.ProgramDisableHandler(w, httptest.NewRequest("GET", "/progz/disable?prog=expensive", nil))
+	if w.Code != 405 {
+		t.Errorf("expecting method not allowed for GET, got %d", w.Code)
+	}
+	close(lines)
+	wg.Wait()
+}
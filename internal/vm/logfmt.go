@@ -0,0 +1,61 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"strings"
+)
+
+// logfmtPair is a key and its value from a logfmt style line.
+type logfmtPair struct {
+	key, value string
+}
+
+// logfmtPairs returns the key=value pairs in s, in order.  Pairs are separated
+// by whitespace, and a value may be double quoted to contain spaces, with
+// backslash escaping quotes within it.  Words without an `=' are skipped.
+func logfmtPairs(s string) []logfmtPair {
+	var pairs []logfmtPair
+	i := 0
+	for i < len(s) {
+		for i < len(s) && isLogfmtSpace(s[i]) {
+			i++
+		}
+		start := i
+		for i < len(s) && s[i] != '=' && !isLogfmtSpace(s[i]) {
+			i++
+		}
+		key := s[start:i]
+		if i >= len(s) || s[i] != '=' {
+			continue
+		}
+		i++ // the '='
+		var value string
+		if i < len(s) && s[i] == '"' {
+			var b strings.Builder
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			i++ // the closing quote
+			value = b.String()
+		} else {
+			start = i
+			for i < len(s) && !isLogfmtSpace(s[i]) {
+				i++
+			}
+			value = s[start:i]
+		}
+		if key != "" {
+			pairs = append(pairs, logfmtPair{key, value})
+		}
+	}
+	return pairs
+}
+
+func isLogfmtSpace(c byte) bool {
+	return c == ' ' || c == '\t'
+}
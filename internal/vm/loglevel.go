@@ -0,0 +1,72 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"regexp"
+	"strings"
+)
+
+// logLevels maps the level names found in logs to the levels returned by
+// loglevel().
+var logLevels = map[string]string{
+	"fatal":       "fatal",
+	"critical":    "fatal",
+	"crit":        "fatal",
+	"emerg":       "fatal",
+	"emergency":   "fatal",
+	"alert":       "fatal",
+	"panic":       "fatal",
+	"error":       "error",
+	"err":         "error",
+	"warning":     "warning",
+	"warn":        "warning",
+	"info":        "info",
+	"information": "info",
+	"notice":      "info",
+	"debug":       "debug",
+	"dbg":         "debug",
+	"trace":       "trace",
+}
+
+// glogLevels maps the severity letters prefixing glog lines to levels.
+var glogLevels = map[byte]string{'F': "fatal", 'E': "error", 'W': "warning", 'I': "info"}
+
+var (
+	// levelField matches a level given as a field, like level=warn or "severity": "ERROR".
+	levelField = regexp.MustCompile(`(?i)\b(?:level|lvl|severity|loglevel)"?\s*[=:]\s*"?([a-z]+)`)
+	// levelBracketed matches a level in brackets, like [error] or <WARN>.
+	levelBracketed = regexp.MustCompile(`[\[<(]([A-Za-z]+)[\]>)]`)
+	// levelWord matches an upper case word that may be a level, like ERROR.
+	levelWord = regexp.MustCompile(`\b[A-Z]+\b`)
+	// levelGlog matches the severity and date prefix of a glog line, like E0102.
+	levelGlog = regexp.MustCompile(`^[FEWI]\d{4} `)
+)
+
+// logLevel returns the normalized level of the log line, one of "fatal",
+// "error", "warning", "info", "debug", or "trace", or the empty string if none
+// is found.  Levels given as a field or in brackets are matched regardless of
+// case, but bare words only in upper case, so that words in the message
+// aren't mistaken for levels.
+func logLevel(line string) string {
+	if m := levelField.FindStringSubmatch(line); m != nil {
+		if l, ok := logLevels[strings.ToLower(m[1])]; ok {
+			return l
+		}
+	}
+	for _, m := range levelBracketed.FindAllStringSubmatch(line, -1) {
+		if l, ok := logLevels[strings.ToLower(m[1])]; ok {
+			return l
+		}
+	}
+	if levelGlog.MatchString(line) {
+		return glogLevels[line[0]]
+	}
+	for _, w := range levelWord.FindAllString(line, -1) {
+		if l, ok := logLevels[strings.ToLower(w)]; ok {
+			return l
+		}
+	}
+	return ""
+}
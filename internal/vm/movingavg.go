@@ -0,0 +1,36 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"time"
+)
+
+// movingWindow holds the samples given to moving_avg() for one datum within
+// its time window.
+type movingWindow struct {
+	samples []sample // In order of time.
+	sum     float64  // Sum of the values of samples.
+}
+
+type sample struct {
+	t     time.Time
+	value float64
+}
+
+// Add records value at time t, drops the samples older than window before t,
+// and returns the average of the remaining samples.
+func (w *movingWindow) Add(t time.Time, value float64, window time.Duration) float64 {
+	w.samples = append(w.samples, sample{t, value})
+	w.sum += value
+	cutoff := t.Add(-window)
+	i := 0
+	for ; i < len(w.samples)-1 && !w.samples[i].t.After(cutoff); i++ {
+		w.sum -= w.samples[i].value
+	}
+	if i > 0 {
+		w.samples = append(w.samples[:0], w.samples[i:]...)
+	}
+	return w.sum / float64(len(w.samples))
+}
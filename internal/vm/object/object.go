@@ -5,6 +5,7 @@ package object
 
 import (
 	"regexp"
+	"time"
 
 	"github.com/google/mtail/internal/metrics"
 	"github.com/google/mtail/internal/vm/code"
@@ -12,8 +13,31 @@ import (
 
 // Object is the data and bytecode resulting from compiled program source.
 type Object struct {
-	Program []code.Instr      // The program bytecode.
-	Strings []string          // Static strings.
-	Regexps []*regexp.Regexp  // Static regular expressions.
-	Metrics []*metrics.Metric // Metrics accessible to this program.
+	Program []code.Instr        // The program bytecode.
+	Strings []string            // Static strings.
+	Regexps []*regexp.Regexp    // Static regular expressions.
+	Metrics []*metrics.Metric   // Metrics accessible to this program.
+	Tables  []map[string]string // Static lookup tables.
+
+	RegexSets [][]*regexp.Regexp // Static sets of regular expressions.
+
+	TimestampFallback TimestampFallback // What strptime does with timestamps it can't parse.
+	FieldSeparator    string            // Splits the line into the fields of $F, or runs of whitespace if empty.
+	Warmup            time.Duration     // How long after loading to skip lines.
+	Version           string            // Hash of the program source.
 }
+
+// TimestampFallback chooses the timestamp used for a line when strptime fails
+// to parse one.
+type TimestampFallback int
+
+const (
+	// TimestampFallbackSkip stops processing the line, as for other runtime
+	// errors.  It is the default.
+	TimestampFallbackSkip TimestampFallback = iota
+	// TimestampFallbackWallclock uses the current time.
+	TimestampFallbackWallclock
+	// TimestampFallbackPrevious uses the last timestamp parsed successfully, or
+	// the current time if there was none.
+	TimestampFallbackPrevious
+)
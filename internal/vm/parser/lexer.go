@@ -31,24 +31,71 @@ var keywords = map[string]Kind{
 	"histogram": HISTOGRAM,
 	"next":      NEXT,
 	"otherwise": OTHERWISE,
+	"pragma":    PRAGMA,
+	"regexset":  REGEXSET,
 	"stop":      STOP,
+	"table":     TABLE,
 	"text":      TEXT,
 	"timer":     TIMER,
 }
 
 // List of builtin functions.  Keep this list sorted!
 var builtins = []string{
+	"after_gap",
+	"approx_distinct",
+	"base64decode",
 	"bool",
+	"bucket_hash",
+	"bucketize",
+	"changed",
+	"csv_field",
+	"day_of_week",
+	"decay_set",
+	"exemplar_inc",
+	"exp_bucket",
+	"field",
+	"first_seen",
 	"float",
 	"getfilename",
+	"getmeta",
+	"hour_of_day",
+	"in_set",
 	"int",
+	"kv_gauges",
 	"len",
+	"linelen",
+	"loglevel",
+	"lookup",
+	"mark_seen",
+	"matches_any",
+	"merge_buckets",
+	"moving_avg",
+	"normalize_path",
+	"now",
+	"observe",
+	"observe_seconds",
+	"parse_duration",
+	"program_version",
+	"query_param",
+	"rate",
+	"ratio",
+	"reset",
+	"set_info",
 	"settime",
+	"since_seen",
+	"source_host",
+	"status_class",
 	"string",
+	"strip_ansi",
 	"strptime",
 	"strtol",
+	"syslog_pri",
 	"timestamp",
 	"tolower",
+	"top_k",
+	"tumbling_inc",
+	"url_host",
+	"window_max",
 }
 
 // Dictionary returns a list of all keywords and builtins of the language.
@@ -230,6 +277,9 @@ func lexProg(l *Lexer) stateFn {
 	case r == ',':
 		l.accept()
 		l.emit(COMMA)
+	case r == ':':
+		l.accept()
+		l.emit(COLON)
 	case r == '-':
 		l.accept()
 		switch r = l.next(); {
@@ -29,7 +29,7 @@ var lexerTests = []lexerTest{
 		{EOF, "", position.Position{"comment", 0, 9, 9}}}},
 	{"comment not at col 1", "  # comment", []Token{
 		{EOF, "", position.Position{"comment not at col 1", 0, 11, 11}}}},
-	{"punctuation", "{}()[],", []Token{
+	{"punctuation", "{}()[],:", []Token{
 		{LCURLY, "{", position.Position{"punctuation", 0, 0, 0}},
 		{RCURLY, "}", position.Position{"punctuation", 0, 1, 1}},
 		{LPAREN, "(", position.Position{"punctuation", 0, 2, 2}},
@@ -37,7 +37,8 @@ var lexerTests = []lexerTest{
 		{LSQUARE, "[", position.Position{"punctuation", 0, 4, 4}},
 		{RSQUARE, "]", position.Position{"punctuation", 0, 5, 5}},
 		{COMMA, ",", position.Position{"punctuation", 0, 6, 6}},
-		{EOF, "", position.Position{"punctuation", 0, 7, 7}}}},
+		{COLON, ":", position.Position{"punctuation", 0, 7, 7}},
+		{EOF, "", position.Position{"punctuation", 0, 8, 8}}}},
 	{"operators", "- + = ++ += < > <= >= == != * / << >> & | ^ ~ ** % || && =~ !~ --", []Token{
 		{MINUS, "-", position.Position{"operators", 0, 0, 0}},
 		{PLUS, "+", position.Position{"operators", 0, 2, 2}},
@@ -67,7 +68,7 @@ var lexerTests = []lexerTest{
 		{DEC, "--", position.Position{"operators", 0, 63, 64}},
 		{EOF, "", position.Position{"operators", 0, 65, 65}}}},
 	{"keywords",
-		"counter\ngauge\nas\nby\nhidden\ndef\nnext\nconst\ntimer\notherwise\nelse\ndel\ntext\nafter\nstop\nhistogram\nbuckets\n", []Token{
+		"counter\ngauge\nas\nby\nhidden\ndef\nnext\nconst\ntimer\notherwise\nelse\ndel\ntext\nafter\nstop\nhistogram\nbuckets\npragma\n", []Token{
 			{COUNTER, "counter", position.Position{"keywords", 0, 0, 6}},
 			{NL, "\n", position.Position{"keywords", 1, 7, -1}},
 			{GAUGE, "gauge", position.Position{"keywords", 1, 0, 4}},
@@ -102,7 +103,9 @@ var lexerTests = []lexerTest{
 			{NL, "\n", position.Position{"keywords", 16, 9, -1}},
 			{BUCKETS, "buckets", position.Position{"keywords", 16, 0, 6}},
 			{NL, "\n", position.Position{"keywords", 17, 7, -1}},
-			{EOF, "", position.Position{"keywords", 17, 0, 0}}}},
+			{PRAGMA, "pragma", position.Position{"keywords", 17, 0, 5}},
+			{NL, "\n", position.Position{"keywords", 18, 6, -1}},
+			{EOF, "", position.Position{"keywords", 18, 0, 0}}}},
 	{"builtins",
 		"strptime\ntimestamp\ntolower\nlen\nstrtol\nsettime\ngetfilename\nint\nbool\nfloat\nstring\n", []Token{
 			{BUILTIN, "strptime", position.Position{"builtins", 0, 0, 7}},
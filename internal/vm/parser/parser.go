@@ -49,51 +49,56 @@ const OTHERWISE = 57360
 const ELSE = 57361
 const STOP = 57362
 const BUCKETS = 57363
-const BUILTIN = 57364
-const REGEX = 57365
-const STRING = 57366
-const CAPREF = 57367
-const CAPREF_NAMED = 57368
-const ID = 57369
-const DECO = 57370
-const INTLITERAL = 57371
-const FLOATLITERAL = 57372
-const DURATIONLITERAL = 57373
-const INC = 57374
-const DEC = 57375
-const DIV = 57376
-const MOD = 57377
-const MUL = 57378
-const MINUS = 57379
-const PLUS = 57380
-const POW = 57381
-const SHL = 57382
-const SHR = 57383
-const LT = 57384
-const GT = 57385
-const LE = 57386
-const GE = 57387
-const EQ = 57388
-const NE = 57389
-const BITAND = 57390
-const XOR = 57391
-const BITOR = 57392
-const NOT = 57393
-const AND = 57394
-const OR = 57395
-const ADD_ASSIGN = 57396
-const ASSIGN = 57397
-const CONCAT = 57398
-const MATCH = 57399
-const NOT_MATCH = 57400
-const LCURLY = 57401
-const RCURLY = 57402
-const LPAREN = 57403
-const RPAREN = 57404
-const LSQUARE = 57405
-const RSQUARE = 57406
-const COMMA = 57407
-const NL = 57408
+const PRAGMA = 57364
+const TABLE = 57365
+const REGEXSET = 57366
+const BUILTIN = 57367
+const REGEX = 57368
+const STRING = 57369
+const CAPREF = 57370
+const CAPREF_NAMED = 57371
+const ID = 57372
+const DECO = 57373
+const INTLITERAL = 57374
+const FLOATLITERAL = 57375
+const DURATIONLITERAL = 57376
+const INC = 57377
+const DEC = 57378
+const DIV = 57379
+const MOD = 57380
+const MUL = 57381
+const MINUS = 57382
+const PLUS = 57383
+const POW = 57384
+const SHL = 57385
+const SHR = 57386
+const LT = 57387
+const GT = 57388
+const LE = 57389
+const GE = 57390
+const EQ = 57391
+const NE = 57392
+const BITAND = 57393
+const XOR = 57394
+const BITOR = 57395
+const NOT = 57396
+const AND = 57397
+const OR = 57398
+const ADD_ASSIGN = 57399
+const ASSIGN = 57400
+const CONCAT = 57401
+const MATCH = 57402
+const NOT_MATCH = 57403
+const LCURLY = 57404
+const RCURLY = 57405
+const LPAREN = 57406
+const RPAREN = 57407
+const LSQUARE = 57408
+const RSQUARE = 57409
+const COMMA = 57410
+const COLON = 57411
+const NL = 57412
+const NOVALUE = 57413
 
 var mtailToknames = [...]string{
 	"$end",
@@ -117,6 +122,9 @@ var mtailToknames = [...]string{
 	"ELSE",
 	"STOP",
 	"BUCKETS",
+	"PRAGMA",
+	"TABLE",
+	"REGEXSET",
 	"BUILTIN",
 	"REGEX",
 	"STRING",
@@ -161,7 +169,9 @@ var mtailToknames = [...]string{
 	"LSQUARE",
 	"RSQUARE",
 	"COMMA",
+	"COLON",
 	"NL",
+	"NOVALUE",
 }
 
 var mtailStatenames = [...]string{}
@@ -170,9 +180,9 @@ const mtailEofCode = 1
 const mtailErrCode = 2
 const mtailInitialStackSize = 16
 
-//line parser.y:651
+//line parser.y:750
 
-//  tokenpos returns the position of the current token.
+// tokenpos returns the position of the current token.
 func tokenpos(mtaillex mtailLexer) position.Position {
 	return mtaillex.(*parser).t.Pos
 }
@@ -190,150 +200,168 @@ var mtailExca = [...]int{
 	-2, 0,
 	-1, 2,
 	1, 1,
-	15, 116,
-	28, 116,
-	34, 116,
-	-2, 88,
-	-1, 24,
-	66, 21,
-	-2, 66,
-	-1, 107,
-	15, 116,
-	28, 116,
-	34, 116,
-	-2, 88,
+	15, 133,
+	23, 133,
+	24, 133,
+	31, 133,
+	37, 133,
+	-2, 93,
+	-1, 28,
+	70, 25,
+	-2, 70,
+	-1, 117,
+	15, 133,
+	23, 133,
+	24, 133,
+	31, 133,
+	37, 133,
+	-2, 93,
 }
 
 const mtailPrivate = 57344
 
-const mtailLast = 233
+const mtailLast = 265
 
 var mtailAct = [...]int{
-	158, 21, 92, 64, 44, 29, 28, 43, 42, 27,
-	26, 30, 47, 93, 14, 41, 24, 91, 123, 46,
-	19, 154, 152, 153, 153, 88, 106, 53, 52, 168,
-	22, 167, 50, 51, 63, 89, 49, 13, 50, 51,
-	31, 28, 127, 94, 87, 49, 11, 25, 2, 20,
-	10, 15, 90, 12, 165, 33, 13, 36, 34, 35,
-	45, 60, 38, 39, 45, 11, 25, 142, 20, 10,
-	15, 113, 12, 105, 33, 114, 36, 34, 35, 45,
-	140, 38, 39, 161, 40, 80, 81, 103, 83, 82,
-	124, 124, 104, 133, 37, 50, 51, 112, 107, 16,
-	85, 86, 1, 40, 66, 68, 67, 131, 126, 28,
-	29, 28, 162, 37, 100, 101, 99, 130, 16, 102,
-	136, 24, 146, 28, 28, 19, 141, 143, 145, 144,
-	151, 150, 156, 155, 147, 148, 132, 149, 69, 116,
-	73, 74, 75, 76, 77, 78, 117, 97, 96, 70,
-	71, 61, 79, 118, 98, 166, 119, 120, 121, 171,
-	170, 122, 164, 163, 62, 95, 48, 65, 169, 128,
-	60, 33, 129, 36, 34, 35, 45, 84, 38, 39,
-	33, 115, 36, 34, 35, 45, 72, 38, 39, 33,
-	18, 36, 34, 35, 45, 157, 38, 39, 160, 111,
-	40, 159, 110, 70, 71, 138, 137, 134, 135, 40,
-	37, 125, 54, 109, 9, 139, 8, 7, 108, 37,
-	55, 56, 57, 58, 59, 6, 32, 23, 37, 17,
-	5, 4, 3,
+	174, 46, 25, 102, 31, 49, 33, 72, 47, 17,
+	32, 45, 103, 53, 34, 28, 116, 26, 190, 30,
+	135, 59, 51, 115, 199, 191, 196, 189, 197, 16,
+	169, 101, 58, 168, 22, 186, 71, 185, 13, 29,
+	99, 23, 12, 18, 97, 14, 98, 24, 104, 32,
+	37, 100, 40, 38, 48, 50, 156, 42, 43, 75,
+	77, 76, 35, 187, 37, 155, 40, 38, 48, 50,
+	188, 42, 43, 167, 168, 170, 56, 57, 55, 44,
+	89, 90, 124, 56, 57, 96, 140, 181, 146, 41,
+	55, 92, 91, 44, 2, 19, 56, 57, 128, 66,
+	136, 136, 139, 41, 137, 129, 75, 77, 76, 94,
+	95, 157, 130, 50, 113, 131, 132, 133, 144, 138,
+	134, 33, 126, 32, 125, 32, 107, 106, 143, 141,
+	28, 176, 142, 145, 175, 160, 165, 154, 161, 32,
+	32, 162, 163, 166, 159, 164, 172, 171, 158, 22,
+	117, 16, 82, 83, 84, 85, 86, 87, 127, 121,
+	13, 29, 120, 23, 12, 18, 123, 14, 73, 24,
+	198, 184, 37, 114, 40, 38, 48, 50, 177, 42,
+	43, 79, 80, 79, 80, 192, 193, 37, 52, 40,
+	38, 48, 50, 153, 42, 43, 195, 194, 180, 179,
+	37, 44, 40, 38, 48, 50, 122, 42, 43, 151,
+	150, 41, 67, 110, 111, 109, 44, 19, 112, 152,
+	69, 70, 1, 178, 149, 78, 41, 88, 68, 61,
+	62, 63, 64, 65, 66, 108, 105, 54, 74, 41,
+	93, 81, 21, 173, 147, 148, 60, 15, 39, 183,
+	11, 182, 10, 119, 9, 8, 7, 118, 6, 36,
+	27, 20, 5, 4, 3,
 }
 
 var mtailPact = [...]int{
-	-1000, -1000, 52, -1000, -1000, -1000, -1000, -1000, -1000, -1000,
-	-1000, 37, -1000, -1000, -14, -23, -1000, -39, 215, 136,
-	167, 56, -1000, -1000, 117, -1000, 98, -1000, 28, 34,
-	60, 6, -38, -26, -1000, -1000, -1000, 158, -1000, -1000,
-	158, 110, -1000, -1000, 80, -1000, -1000, 73, -40, -1000,
-	-1000, -1000, -1000, -1000, 175, -1000, -1000, -1000, -1000, -1000,
-	-1000, 44, -23, 171, -1000, -40, -1000, -1000, -1000, -1000,
-	-1000, -1000, -40, -1000, -1000, -1000, -1000, -1000, -1000, -40,
-	-1000, -1000, -40, -40, -40, -1000, -1000, -40, 158, 149,
-	-20, 27, -1000, 117, -1000, -40, -1000, -1000, -40, -1000,
-	-1000, -1000, -1000, 6, -23, 158, -1000, 33, 194, -1000,
-	-1000, -1000, 57, -23, -1000, 36, 158, 158, 167, 158,
-	158, 158, 37, -42, 56, -1000, -41, -1000, 158, 158,
-	-1000, 56, -1000, -1000, -1000, -1000, -1000, 174, 59, 133,
-	20, -1000, -1000, 98, 60, -1000, -1000, 43, 43, 110,
-	-1000, -1000, -1000, 158, -1000, 80, -1000, -34, -1000, -1000,
-	-1000, -1000, -36, -1000, -1000, -1000, 56, 174, 130, -1000,
-	-1000, -1000,
+	-1000, -1000, 147, -1000, -1000, -1000, -1000, -1000, -1000, -1000,
+	-1000, -1000, -1000, 83, -1000, 161, -1000, 28, 16, -1000,
+	-49, 224, 197, 175, 138, 55, -1000, -1000, 146, -1000,
+	107, -1000, 20, 34, 66, 44, -22, -18, -1000, -26,
+	-1000, 162, -1000, -1000, 162, 86, -1000, -1000, -1000, 176,
+	-1000, -1000, -1000, 154, -54, -1000, -1000, -1000, -1000, -1000,
+	132, -1000, -1000, -1000, -1000, -1000, -1000, 136, 16, 94,
+	92, 148, -1000, -1000, -54, -1000, -1000, -1000, -1000, -1000,
+	-1000, -54, -1000, -1000, -1000, -1000, -1000, -1000, -54, -1000,
+	-1000, -54, -54, -54, -1000, -1000, -54, 162, 39, 162,
+	21, 62, -1000, 146, -1000, -54, -1000, -1000, -54, -1000,
+	-1000, -1000, -1000, 44, 16, 162, -1000, 25, 198, -1000,
+	-1000, -1000, 167, 16, -1000, 3, -6, 77, 162, 162,
+	175, 162, 162, 162, 83, 6, 55, -1000, -35, 8,
+	-1000, 162, 162, -1000, 55, -1000, -1000, -1000, -1000, -1000,
+	104, 151, 166, 50, -1000, -1000, -1000, -1000, 107, 66,
+	-1000, -1000, 41, 41, 86, -1000, -1000, -1000, 162, -1000,
+	-1000, 176, -1000, -31, -1000, -1000, -1000, -1000, -33, -1000,
+	-1000, -1000, 0, -45, 55, 104, 164, -1000, -1000, -43,
+	-1000, -1000, -40, -1000, -1000, -1000, 143, -1000, -44, -1000,
 }
 
 var mtailPgo = [...]int{
-	0, 48, 232, 18, 12, 231, 230, 229, 3, 4,
-	15, 13, 2, 227, 10, 11, 1, 14, 226, 7,
-	40, 9, 225, 218, 217, 216, 8, 30, 214, 213,
-	212, 208, 0, 207, 195, 190, 186, 177, 167, 166,
-	165, 154, 152, 138, 120, 112, 102, 73, 17, 97,
+	0, 94, 264, 20, 13, 263, 262, 261, 7, 5,
+	11, 12, 3, 260, 19, 14, 2, 9, 259, 8,
+	62, 4, 258, 257, 256, 255, 1, 17, 254, 253,
+	252, 251, 250, 249, 248, 247, 246, 245, 0, 244,
+	243, 242, 241, 240, 238, 237, 236, 235, 227, 225,
+	224, 223, 222, 23, 31, 206,
 }
 
 var mtailR1 = [...]int{
-	0, 46, 1, 1, 2, 2, 2, 2, 2, 2,
-	2, 2, 2, 2, 5, 5, 5, 6, 6, 4,
-	7, 7, 13, 13, 17, 17, 17, 17, 39, 39,
-	16, 16, 38, 38, 38, 14, 14, 36, 36, 36,
-	36, 36, 36, 15, 15, 37, 37, 10, 10, 27,
-	27, 27, 42, 42, 21, 20, 20, 20, 40, 40,
-	9, 9, 41, 41, 41, 41, 12, 12, 11, 11,
-	43, 43, 8, 8, 8, 8, 8, 8, 8, 8,
-	8, 18, 18, 19, 3, 3, 26, 22, 35, 35,
-	23, 23, 23, 23, 29, 29, 30, 30, 30, 30,
-	30, 33, 34, 34, 31, 44, 45, 45, 45, 45,
-	24, 25, 28, 28, 32, 32, 48, 49, 47, 47,
+	0, 52, 1, 1, 2, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 2, 2, 5, 5,
+	5, 6, 6, 4, 7, 7, 13, 13, 17, 17,
+	17, 17, 45, 45, 16, 16, 44, 44, 44, 14,
+	14, 42, 42, 42, 42, 42, 42, 15, 15, 43,
+	43, 10, 10, 27, 27, 27, 48, 48, 21, 20,
+	20, 20, 46, 46, 9, 9, 47, 47, 47, 47,
+	12, 12, 11, 11, 49, 49, 8, 8, 8, 8,
+	8, 8, 8, 8, 8, 8, 18, 18, 19, 3,
+	3, 26, 22, 41, 41, 23, 23, 23, 23, 29,
+	29, 36, 36, 36, 36, 36, 39, 40, 40, 37,
+	50, 51, 51, 51, 51, 24, 25, 28, 28, 30,
+	31, 31, 31, 31, 32, 33, 33, 33, 33, 38,
+	38, 34, 35, 54, 55, 53, 53,
 }
 
 var mtailR2 = [...]int{
 	0, 1, 0, 2, 1, 1, 1, 1, 1, 1,
-	1, 3, 1, 1, 4, 2, 2, 1, 2, 3,
-	1, 1, 4, 4, 1, 1, 4, 4, 1, 1,
-	1, 4, 1, 1, 1, 1, 4, 1, 1, 1,
-	1, 1, 1, 1, 4, 1, 1, 1, 4, 1,
-	4, 4, 1, 1, 1, 1, 4, 4, 1, 1,
-	1, 4, 1, 1, 1, 1, 1, 2, 1, 2,
-	1, 1, 1, 3, 4, 1, 1, 1, 3, 1,
-	1, 1, 4, 1, 1, 3, 5, 3, 0, 1,
-	2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
-	1, 2, 1, 3, 2, 2, 1, 1, 3, 3,
-	4, 3, 4, 2, 1, 1, 0, 0, 0, 1,
+	1, 1, 1, 3, 1, 1, 2, 1, 4, 2,
+	2, 1, 2, 3, 1, 1, 4, 4, 1, 1,
+	4, 4, 1, 1, 1, 4, 1, 1, 1, 1,
+	4, 1, 1, 1, 1, 1, 1, 1, 4, 1,
+	1, 1, 4, 1, 4, 4, 1, 1, 1, 1,
+	4, 4, 1, 1, 1, 4, 1, 1, 1, 1,
+	1, 2, 1, 2, 1, 1, 1, 3, 4, 1,
+	1, 4, 1, 3, 1, 1, 1, 4, 1, 1,
+	3, 5, 3, 0, 1, 2, 2, 2, 1, 1,
+	1, 1, 1, 1, 1, 1, 2, 1, 3, 2,
+	2, 1, 1, 3, 3, 4, 3, 4, 2, 6,
+	0, 2, 4, 5, 6, 0, 2, 2, 3, 1,
+	1, 1, 2, 0, 0, 0, 1,
 }
 
 var mtailChk = [...]int{
-	-1000, -46, -1, -2, -5, -6, -22, -24, -25, -28,
-	17, 13, 20, 4, -17, 18, 66, -7, -35, -48,
-	16, -16, -27, -13, -11, 14, -14, -21, -8, -12,
-	-15, -20, -18, 22, 25, 26, 24, 61, 29, 30,
-	51, -10, -26, -19, -9, 27, -19, -4, -39, 59,
-	52, 53, -4, 66, -30, 5, 6, 7, 8, 9,
-	34, 15, 28, -11, -8, -38, 48, 50, 49, -43,
-	32, 33, -36, 42, 43, 44, 45, 46, 47, -42,
-	57, 58, 55, 54, -37, 40, 41, 38, 63, 61,
-	-17, -48, -12, -11, -12, -40, 38, 37, -41, 36,
-	34, 35, 39, -20, 19, -47, 66, -1, -23, -29,
-	27, 24, -49, 27, -4, 10, -47, -47, -47, -47,
-	-47, -47, -47, -3, -16, 62, -3, 62, -47, -47,
-	-4, -16, -27, 60, -33, -31, -44, 12, 11, 21,
-	23, -4, 31, -14, -15, -21, -8, -17, -17, -10,
-	-26, -19, 64, 65, 62, -9, -12, -34, -32, 27,
-	24, 24, -45, 30, 29, 34, -16, 65, 65, -32,
-	30, 29,
+	-1000, -52, -1, -2, -5, -6, -22, -24, -25, -28,
+	-30, -32, 17, 13, 20, -35, 4, -17, 18, 70,
+	-7, -41, -54, 16, 22, -16, -27, -13, -11, 14,
+	-14, -21, -8, -12, -15, -20, -18, 25, 28, -34,
+	27, 64, 32, 33, 54, -10, -26, -19, 29, -9,
+	30, -19, 27, -4, -45, 62, 55, 56, -4, 70,
+	-36, 5, 6, 7, 8, 9, 37, 15, 31, 23,
+	24, -11, -8, 30, -44, 51, 53, 52, -49, 35,
+	36, -42, 45, 46, 47, 48, 49, 50, -48, 60,
+	61, 58, 57, -43, 43, 44, 41, 66, 64, 66,
+	-17, -54, -12, -11, -12, -46, 41, 40, -47, 39,
+	37, 38, 42, -20, 19, -53, 70, -1, -23, -29,
+	30, 27, -55, 30, -4, 30, 30, 10, -53, -53,
+	-53, -53, -53, -53, -53, -3, -16, 65, -3, -16,
+	65, -53, -53, -4, -16, -27, 63, -39, -37, -50,
+	12, 11, 21, 26, -4, 62, 62, 34, -14, -15,
+	-21, -8, -17, -17, -10, -26, -19, 67, 68, 65,
+	67, -9, -12, -40, -38, 30, 27, 27, -51, 33,
+	32, 37, -31, -33, -16, 68, 68, 63, 70, 27,
+	63, 70, -26, -38, 33, 32, 69, 68, 27, 68,
 }
 
 var mtailDef = [...]int{
 	2, -2, -2, 3, 4, 5, 6, 7, 8, 9,
-	10, 0, 12, 13, 0, 0, 17, 0, 0, 0,
-	0, 24, 25, 20, -2, 89, 30, 49, 68, 60,
-	35, 54, 72, 0, 75, 76, 77, 116, 79, 80,
-	0, 43, 55, 81, 47, 83, 116, 15, 118, 2,
-	28, 29, 16, 18, 0, 96, 97, 98, 99, 100,
-	117, 0, 0, 113, 68, 118, 32, 33, 34, 69,
-	70, 71, 118, 37, 38, 39, 40, 41, 42, 118,
-	52, 53, 118, 118, 118, 45, 46, 118, 0, 0,
-	0, 0, 60, 66, 67, 118, 58, 59, 118, 62,
-	63, 64, 65, 11, 0, 116, 119, -2, 87, 93,
-	94, 95, 0, 0, 111, 0, 0, 0, 116, 116,
-	116, 0, 116, 0, 84, 73, 0, 78, 0, 0,
-	14, 26, 27, 19, 90, 91, 92, 0, 0, 0,
-	0, 110, 112, 31, 36, 50, 51, 22, 23, 44,
-	56, 57, 82, 0, 74, 48, 61, 101, 102, 114,
-	115, 104, 105, 106, 107, 86, 85, 0, 0, 103,
-	108, 109,
+	10, 11, 12, 0, 14, 15, 17, 0, 0, 21,
+	0, 0, 0, 0, 0, 28, 29, 24, -2, 94,
+	34, 53, 72, 64, 39, 58, 76, 0, 79, 80,
+	82, 133, 84, 85, 0, 47, 59, 86, 131, 51,
+	88, 133, 16, 19, 135, 2, 32, 33, 20, 22,
+	0, 101, 102, 103, 104, 105, 134, 0, 0, 0,
+	0, 118, 72, 132, 135, 36, 37, 38, 73, 74,
+	75, 135, 41, 42, 43, 44, 45, 46, 135, 56,
+	57, 135, 135, 135, 49, 50, 135, 0, 0, 0,
+	0, 0, 64, 70, 71, 135, 62, 63, 135, 66,
+	67, 68, 69, 13, 0, 133, 136, -2, 92, 98,
+	99, 100, 0, 0, 116, 0, 0, 0, 0, 0,
+	133, 133, 133, 0, 133, 0, 89, 77, 0, 0,
+	83, 0, 0, 18, 30, 31, 23, 95, 96, 97,
+	0, 0, 0, 0, 115, 120, 125, 117, 35, 40,
+	54, 55, 26, 27, 48, 60, 61, 87, 0, 78,
+	81, 52, 65, 106, 107, 129, 130, 109, 110, 111,
+	112, 91, 0, 133, 90, 0, 0, 119, 121, 0,
+	124, 126, 127, 108, 113, 114, 0, 128, 122, 123,
 }
 
 var mtailTok1 = [...]int{
@@ -347,7 +375,7 @@ var mtailTok2 = [...]int{
 	32, 33, 34, 35, 36, 37, 38, 39, 40, 41,
 	42, 43, 44, 45, 46, 47, 48, 49, 50, 51,
 	52, 53, 54, 55, 56, 57, 58, 59, 60, 61,
-	62, 63, 64, 65, 66,
+	62, 63, 64, 65, 66, 67, 68, 69, 70, 71,
 }
 
 var mtailTok3 = [...]int{
@@ -359,12 +387,12 @@ var mtailErrorMessages = [...]struct {
 	token int
 	msg   string
 }{
-	{112, 4, "unexpected end of file, expecting '/' to end regex"},
-	{18, 1, "unexpected end of file, expecting '}' to end block"},
-	{18, 1, "unexpected end of file, expecting '}' to end block"},
-	{18, 1, "unexpected end of file, expecting '}' to end block"},
-	{14, 63, "unexpected indexing of an expression"},
-	{14, 66, "statement with no effect, missing an assignment, `+' concatenation, or `{}' block?"},
+	{122, 4, "unexpected end of file, expecting '/' to end regex"},
+	{21, 1, "unexpected end of file, expecting '}' to end block"},
+	{21, 1, "unexpected end of file, expecting '}' to end block"},
+	{21, 1, "unexpected end of file, expecting '}' to end block"},
+	{17, 66, "unexpected indexing of an expression"},
+	{17, 70, "statement with no effect, missing an assignment, `+' concatenation, or `{}' block?"},
 }
 
 //line yaccpar:1
@@ -700,19 +728,19 @@ mtaildefault:
 
 	case 1:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:91
+//line parser.y:97
 		{
 			mtaillex.(*parser).root = mtailDollar[1].n
 		}
 	case 2:
 		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
-//line parser.y:98
+//line parser.y:104
 		{
 			mtailVAL.n = &ast.StmtList{}
 		}
 	case 3:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:102
+//line parser.y:108
 		{
 			mtailVAL.n = mtailDollar[1].n
 			if mtailDollar[2].n != nil {
@@ -721,73 +749,98 @@ mtaildefault:
 		}
 	case 4:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:112
+//line parser.y:118
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 5:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:114
+//line parser.y:120
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 6:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:116
+//line parser.y:122
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 7:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:118
+//line parser.y:124
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 8:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:120
+//line parser.y:126
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 9:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:122
+//line parser.y:128
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
 	case 10:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:124
+//line parser.y:130
 		{
-			mtailVAL.n = &ast.NextStmt{tokenpos(mtaillex)}
+			mtailVAL.n = mtailDollar[1].n
 		}
 	case 11:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:132
+		{
+			mtailVAL.n = mtailDollar[1].n
+		}
+	case 12:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:134
+		{
+			mtailVAL.n = &ast.NextStmt{tokenpos(mtaillex)}
+		}
+	case 13:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:128
+//line parser.y:138
 		{
 			mtailVAL.n = &ast.PatternFragment{Id: mtailDollar[2].n, Expr: mtailDollar[3].n}
 		}
-	case 12:
+	case 14:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:132
+//line parser.y:142
 		{
 			mtailVAL.n = &ast.StopStmt{tokenpos(mtaillex)}
 		}
-	case 13:
+	case 15:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:136
+//line parser.y:146
+		{
+			mtailVAL.n = mtailDollar[1].n
+		}
+	case 16:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:148
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.Pragma).Value = mtailDollar[2].text
+		}
+	case 17:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:153
 		{
 			mtailVAL.n = &ast.Error{tokenpos(mtaillex), mtailDollar[1].text}
 		}
-	case 14:
+	case 18:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:143
+//line parser.y:160
 		{
 			mtailVAL.n = &ast.CondStmt{mtailDollar[1].n, mtailDollar[2].n, mtailDollar[4].n, nil}
 		}
-	case 15:
+	case 19:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:147
+//line parser.y:164
 		{
 			if mtailDollar[1].n != nil {
 				mtailVAL.n = &ast.CondStmt{mtailDollar[1].n, mtailDollar[2].n, nil, nil}
@@ -795,637 +848,727 @@ mtaildefault:
 				mtailVAL.n = mtailDollar[2].n
 			}
 		}
-	case 16:
+	case 20:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:155
+//line parser.y:172
 		{
 			o := &ast.OtherwiseStmt{tokenpos(mtaillex)}
 			mtailVAL.n = &ast.CondStmt{o, mtailDollar[2].n, nil, nil}
 		}
-	case 17:
+	case 21:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:163
+//line parser.y:180
 		{
 			mtailVAL.n = nil
 		}
-	case 18:
+	case 22:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:165
+//line parser.y:182
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 19:
+	case 23:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:170
+//line parser.y:187
 		{
 			mtailVAL.n = mtailDollar[2].n
 		}
-	case 20:
+	case 24:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:177
+//line parser.y:194
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 21:
+	case 25:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:179
+//line parser.y:196
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 22:
+	case 26:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:184
+//line parser.y:201
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 23:
+	case 27:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:188
+//line parser.y:205
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 24:
+	case 28:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:195
+//line parser.y:212
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 25:
+	case 29:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:197
+//line parser.y:214
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 26:
+	case 30:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:199
+//line parser.y:216
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 27:
+	case 31:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:203
+//line parser.y:220
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 28:
+	case 32:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:210
+//line parser.y:227
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 29:
+	case 33:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:212
+//line parser.y:229
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 30:
+	case 34:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:217
+//line parser.y:234
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 31:
+	case 35:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:219
+//line parser.y:236
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 32:
+	case 36:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:226
+//line parser.y:243
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 33:
+	case 37:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:228
+//line parser.y:245
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 34:
+	case 38:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:230
+//line parser.y:247
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 35:
+	case 39:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:235
+//line parser.y:252
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 36:
+	case 40:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:237
+//line parser.y:254
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 37:
+	case 41:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:244
+//line parser.y:261
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 38:
+	case 42:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:246
+//line parser.y:263
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 39:
+	case 43:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:248
+//line parser.y:265
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 40:
+	case 44:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:250
+//line parser.y:267
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 41:
+	case 45:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:252
+//line parser.y:269
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 42:
+	case 46:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:254
+//line parser.y:271
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 43:
+	case 47:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:259
+//line parser.y:276
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 44:
+	case 48:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:261
+//line parser.y:278
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 45:
+	case 49:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:268
+//line parser.y:285
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 46:
+	case 50:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:270
+//line parser.y:287
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 47:
+	case 51:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:275
+//line parser.y:292
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 48:
+	case 52:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:277
+//line parser.y:294
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 49:
+	case 53:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:284
+//line parser.y:301
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 50:
+	case 54:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:286
+//line parser.y:303
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 51:
+	case 55:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:290
+//line parser.y:307
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 52:
+	case 56:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:297
+//line parser.y:314
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 53:
+	case 57:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:299
+//line parser.y:316
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 54:
+	case 58:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:304
+//line parser.y:321
 		{
 			mtailVAL.n = &ast.PatternExpr{Expr: mtailDollar[1].n}
 		}
-	case 55:
+	case 59:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:311
+//line parser.y:328
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 56:
+	case 60:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:313
+//line parser.y:330
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: CONCAT}
 		}
-	case 57:
+	case 61:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:317
+//line parser.y:334
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: CONCAT}
 		}
-	case 58:
+	case 62:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:324
+//line parser.y:341
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 59:
+	case 63:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:326
+//line parser.y:343
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 60:
+	case 64:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:331
+//line parser.y:348
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 61:
+	case 65:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:333
+//line parser.y:350
 		{
 			mtailVAL.n = &ast.BinaryExpr{Lhs: mtailDollar[1].n, Rhs: mtailDollar[4].n, Op: mtailDollar[2].op}
 		}
-	case 62:
+	case 66:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:340
+//line parser.y:357
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 63:
+	case 67:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:342
+//line parser.y:359
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 64:
+	case 68:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:344
+//line parser.y:361
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 65:
+	case 69:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:346
+//line parser.y:363
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 66:
+	case 70:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:351
+//line parser.y:368
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 67:
+	case 71:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:353
+//line parser.y:370
 		{
 			mtailVAL.n = &ast.UnaryExpr{P: tokenpos(mtaillex), Expr: mtailDollar[2].n, Op: mtailDollar[1].op}
 		}
-	case 68:
+	case 72:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:360
+//line parser.y:377
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 69:
+	case 73:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:362
+//line parser.y:379
 		{
 			mtailVAL.n = &ast.UnaryExpr{P: tokenpos(mtaillex), Expr: mtailDollar[1].n, Op: mtailDollar[2].op}
 		}
-	case 70:
+	case 74:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:369
+//line parser.y:386
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 71:
+	case 75:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:371
+//line parser.y:388
 		{
 			mtailVAL.op = mtailDollar[1].op
 		}
-	case 72:
+	case 76:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:376
+//line parser.y:393
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 73:
+	case 77:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:378
+//line parser.y:395
 		{
 			mtailVAL.n = &ast.BuiltinExpr{P: tokenpos(mtaillex), Name: mtailDollar[1].text, Args: nil}
 		}
-	case 74:
+	case 78:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:382
+//line parser.y:399
 		{
 			mtailVAL.n = &ast.BuiltinExpr{P: tokenpos(mtaillex), Name: mtailDollar[1].text, Args: mtailDollar[3].n}
 		}
-	case 75:
+	case 79:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:386
+//line parser.y:403
 		{
 			mtailVAL.n = &ast.CaprefTerm{tokenpos(mtaillex), mtailDollar[1].text, false, nil}
 		}
-	case 76:
+	case 80:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:390
+//line parser.y:407
 		{
-			mtailVAL.n = &ast.CaprefTerm{tokenpos(mtaillex), mtailDollar[1].text, true, nil}
+			mtailVAL.n = mtailDollar[1].n
 		}
-	case 77:
+	case 81:
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:409
+		{
+			c := mtailDollar[1].n.(*ast.CaprefTerm)
+			mtailVAL.n = &ast.FieldTerm{c.P, c.Name, mtailDollar[3].n}
+		}
+	case 82:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:394
+//line parser.y:414
 		{
 			mtailVAL.n = &ast.StringLit{tokenpos(mtaillex), mtailDollar[1].text}
 		}
-	case 78:
+	case 83:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:398
+//line parser.y:418
 		{
 			mtailVAL.n = mtailDollar[2].n
 		}
-	case 79:
+	case 84:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:402
+//line parser.y:422
 		{
 			mtailVAL.n = &ast.IntLit{tokenpos(mtaillex), mtailDollar[1].intVal}
 		}
-	case 80:
+	case 85:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:406
+//line parser.y:426
 		{
 			mtailVAL.n = &ast.FloatLit{tokenpos(mtaillex), mtailDollar[1].floatVal}
 		}
-	case 81:
+	case 86:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:413
+//line parser.y:433
 		{
 			mtailVAL.n = &ast.IndexedExpr{Lhs: mtailDollar[1].n, Index: &ast.ExprList{}}
 		}
-	case 82:
+	case 87:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:417
+//line parser.y:437
 		{
 			mtailVAL.n = mtailDollar[1].n
 			mtailVAL.n.(*ast.IndexedExpr).Index.(*ast.ExprList).Children = append(
 				mtailVAL.n.(*ast.IndexedExpr).Index.(*ast.ExprList).Children,
 				mtailDollar[3].n.(*ast.ExprList).Children...)
 		}
-	case 83:
+	case 88:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:427
+//line parser.y:447
 		{
 			mtailVAL.n = &ast.IdTerm{tokenpos(mtaillex), mtailDollar[1].text, nil, false}
 		}
-	case 84:
+	case 89:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:434
+//line parser.y:454
 		{
 			mtailVAL.n = &ast.ExprList{}
 			mtailVAL.n.(*ast.ExprList).Children = append(mtailVAL.n.(*ast.ExprList).Children, mtailDollar[1].n)
 		}
-	case 85:
+	case 90:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:439
+//line parser.y:459
 		{
 			mtailVAL.n = mtailDollar[1].n
 			mtailVAL.n.(*ast.ExprList).Children = append(mtailVAL.n.(*ast.ExprList).Children, mtailDollar[3].n)
 		}
-	case 86:
+	case 91:
 		mtailDollar = mtailS[mtailpt-5 : mtailpt+1]
-//line parser.y:447
+//line parser.y:467
 		{
 			mp := markedpos(mtaillex)
 			tp := tokenpos(mtaillex)
 			pos := ast.MergePosition(&mp, &tp)
 			mtailVAL.n = &ast.PatternLit{P: *pos, Pattern: mtailDollar[4].text}
 		}
-	case 87:
+	case 92:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:457
+//line parser.y:477
 		{
 			mtailVAL.n = mtailDollar[3].n
 			d := mtailVAL.n.(*ast.VarDecl)
 			d.Kind = mtailDollar[2].kind
 			d.Hidden = mtailDollar[1].flag
 		}
-	case 88:
+	case 93:
 		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
-//line parser.y:467
+//line parser.y:487
 		{
 			mtailVAL.flag = false
 		}
-	case 89:
+	case 94:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:471
+//line parser.y:491
 		{
 			mtailVAL.flag = true
 		}
-	case 90:
+	case 95:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:478
+//line parser.y:498
 		{
 			mtailVAL.n = mtailDollar[1].n
 			mtailVAL.n.(*ast.VarDecl).Keys = mtailDollar[2].texts
 		}
-	case 91:
+	case 96:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:483
+//line parser.y:503
 		{
 			mtailVAL.n = mtailDollar[1].n
 			mtailVAL.n.(*ast.VarDecl).ExportedName = mtailDollar[2].text
 		}
-	case 92:
+	case 97:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:488
+//line parser.y:508
 		{
 			mtailVAL.n = mtailDollar[1].n
 			mtailVAL.n.(*ast.VarDecl).Buckets = mtailDollar[2].floats
 		}
-	case 93:
+	case 98:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:493
+//line parser.y:513
 		{
 			mtailVAL.n = mtailDollar[1].n
 		}
-	case 94:
+	case 99:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:500
+//line parser.y:520
 		{
 			mtailVAL.n = &ast.VarDecl{P: tokenpos(mtaillex), Name: mtailDollar[1].text}
 		}
-	case 95:
+	case 100:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:504
+//line parser.y:524
 		{
 			mtailVAL.n = &ast.VarDecl{P: tokenpos(mtaillex), Name: mtailDollar[1].text}
 		}
-	case 96:
+	case 101:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:511
+//line parser.y:531
 		{
 			mtailVAL.kind = metrics.Counter
 		}
-	case 97:
+	case 102:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:515
+//line parser.y:535
 		{
 			mtailVAL.kind = metrics.Gauge
 		}
-	case 98:
+	case 103:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:519
+//line parser.y:539
 		{
 			mtailVAL.kind = metrics.Timer
 		}
-	case 99:
+	case 104:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:523
+//line parser.y:543
 		{
 			mtailVAL.kind = metrics.Text
 		}
-	case 100:
+	case 105:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:527
+//line parser.y:547
 		{
 			mtailVAL.kind = metrics.Histogram
 		}
-	case 101:
+	case 106:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:534
+//line parser.y:554
 		{
 			mtailVAL.texts = mtailDollar[2].texts
 		}
-	case 102:
+	case 107:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:541
+//line parser.y:561
 		{
 			mtailVAL.texts = make([]string, 0)
 			mtailVAL.texts = append(mtailVAL.texts, mtailDollar[1].text)
 		}
-	case 103:
+	case 108:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:546
+//line parser.y:566
 		{
 			mtailVAL.texts = mtailDollar[1].texts
 			mtailVAL.texts = append(mtailVAL.texts, mtailDollar[3].text)
 		}
-	case 104:
+	case 109:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:554
+//line parser.y:574
 		{
 			mtailVAL.text = mtailDollar[2].text
 		}
-	case 105:
+	case 110:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:561
+//line parser.y:581
 		{
 			mtailVAL.floats = mtailDollar[2].floats
 		}
-	case 106:
+	case 111:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:567
+//line parser.y:587
 		{
 			mtailVAL.floats = make([]float64, 0)
 			mtailVAL.floats = append(mtailVAL.floats, mtailDollar[1].floatVal)
 		}
-	case 107:
+	case 112:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:572
+//line parser.y:592
 		{
 			mtailVAL.floats = make([]float64, 0)
 			mtailVAL.floats = append(mtailVAL.floats, float64(mtailDollar[1].intVal))
 		}
-	case 108:
+	case 113:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:577
+//line parser.y:597
 		{
 			mtailVAL.floats = mtailDollar[1].floats
 			mtailVAL.floats = append(mtailVAL.floats, mtailDollar[3].floatVal)
 		}
-	case 109:
+	case 114:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:582
+//line parser.y:602
 		{
 			mtailVAL.floats = mtailDollar[1].floats
 			mtailVAL.floats = append(mtailVAL.floats, float64(mtailDollar[3].intVal))
 		}
-	case 110:
+	case 115:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:589
+//line parser.y:609
 		{
 			mtailVAL.n = &ast.DecoDecl{P: markedpos(mtaillex), Name: mtailDollar[3].text, Block: mtailDollar[4].n}
 		}
-	case 111:
+	case 116:
 		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
-//line parser.y:596
+//line parser.y:616
 		{
 			mtailVAL.n = &ast.DecoStmt{markedpos(mtaillex), mtailDollar[2].text, mtailDollar[3].n, nil, nil}
 		}
-	case 112:
+	case 117:
 		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
-//line parser.y:603
+//line parser.y:623
 		{
 			mtailVAL.n = &ast.DelStmt{P: tokenpos(mtaillex), N: mtailDollar[2].n, Expiry: mtailDollar[4].duration}
 		}
-	case 113:
+	case 118:
 		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
-//line parser.y:607
+//line parser.y:627
 		{
 			mtailVAL.n = &ast.DelStmt{P: tokenpos(mtaillex), N: mtailDollar[2].n}
 		}
-	case 114:
+	case 119:
+		mtailDollar = mtailS[mtailpt-6 : mtailpt+1]
+//line parser.y:633
+		{
+			mtailVAL.n = mtailDollar[5].n
+			mtailVAL.n.(*ast.TableDecl).P = markedpos(mtaillex)
+			mtailVAL.n.(*ast.TableDecl).Name = mtailDollar[3].text
+		}
+	case 120:
+		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
+//line parser.y:642
+		{
+			mtailVAL.n = &ast.TableDecl{}
+		}
+	case 121:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:646
+		{
+			mtailVAL.n = mtailDollar[1].n
+		}
+	case 122:
+		mtailDollar = mtailS[mtailpt-4 : mtailpt+1]
+//line parser.y:650
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.TableDecl).Keys = append(mtailVAL.n.(*ast.TableDecl).Keys, mtailDollar[2].text)
+			mtailVAL.n.(*ast.TableDecl).Values = append(mtailVAL.n.(*ast.TableDecl).Values, mtailDollar[4].text)
+		}
+	case 123:
+		mtailDollar = mtailS[mtailpt-5 : mtailpt+1]
+//line parser.y:656
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.TableDecl).Keys = append(mtailVAL.n.(*ast.TableDecl).Keys, mtailDollar[2].text)
+			mtailVAL.n.(*ast.TableDecl).Values = append(mtailVAL.n.(*ast.TableDecl).Values, mtailDollar[4].text)
+		}
+	case 124:
+		mtailDollar = mtailS[mtailpt-6 : mtailpt+1]
+//line parser.y:665
+		{
+			mtailVAL.n = mtailDollar[5].n
+			mtailVAL.n.(*ast.RegexSetDecl).Name = mtailDollar[3].text
+		}
+	case 125:
+		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
+//line parser.y:673
+		{
+			// Take the position marked at the start of the declaration now, before
+			// the patterns mark their own.
+			mtailVAL.n = &ast.RegexSetDecl{P: markedpos(mtaillex)}
+		}
+	case 126:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:679
+		{
+			mtailVAL.n = mtailDollar[1].n
+		}
+	case 127:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:683
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.RegexSetDecl).Patterns = append(mtailVAL.n.(*ast.RegexSetDecl).Patterns, mtailDollar[2].n.(*ast.PatternLit).Pattern)
+		}
+	case 128:
+		mtailDollar = mtailS[mtailpt-3 : mtailpt+1]
+//line parser.y:688
+		{
+			mtailVAL.n = mtailDollar[1].n
+			mtailVAL.n.(*ast.RegexSetDecl).Patterns = append(mtailVAL.n.(*ast.RegexSetDecl).Patterns, mtailDollar[2].n.(*ast.PatternLit).Pattern)
+		}
+	case 129:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:613
+//line parser.y:696
 		{
 			mtailVAL.text = mtailDollar[1].text
 		}
-	case 115:
+	case 130:
 		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
-//line parser.y:617
+//line parser.y:700
 		{
 			mtailVAL.text = mtailDollar[1].text
 		}
-	case 116:
+	case 131:
+		mtailDollar = mtailS[mtailpt-1 : mtailpt+1]
+//line parser.y:709
+		{
+			mtailVAL.n = &ast.CaprefTerm{tokenpos(mtaillex), mtailDollar[1].text, true, nil}
+		}
+	case 132:
+		mtailDollar = mtailS[mtailpt-2 : mtailpt+1]
+//line parser.y:716
+		{
+			mtailVAL.n = &ast.Pragma{tokenpos(mtaillex), mtailDollar[2].text, ""}
+		}
+	case 133:
 		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
-//line parser.y:627
+//line parser.y:726
 		{
 			glog.V(2).Infof("position marked at %v", tokenpos(mtaillex))
 			mtaillex.(*parser).pos = tokenpos(mtaillex)
 		}
-	case 117:
+	case 134:
 		mtailDollar = mtailS[mtailpt-0 : mtailpt+1]
-//line parser.y:637
+//line parser.y:736
 		{
 			mtaillex.(*parser).inRegex()
 		}
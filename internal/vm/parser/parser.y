@@ -33,7 +33,8 @@ import (
 %type <n> expr primary_expr multiplicative_expr additive_expr postfix_expr unary_expr assign_expr
 %type <n> rel_expr shift_expr bitwise_expr logical_expr indexed_expr id_expr concat_expr pattern_expr
 %type <n> declaration decl_attribute_spec decorator_declaration decoration_statement regex_pattern match_expr
-%type <n> delete_statement var_name_spec
+%type <n> delete_statement var_name_spec table_declaration table_entry_list
+%type <n> regexset_declaration regexset_entry_list named_capref pragma_name
 %type <kind> type_spec
 %type <text> as_spec id_or_string
 %type <texts> by_spec by_expr_list
@@ -46,7 +47,7 @@ import (
 // Types
 %token COUNTER GAUGE TIMER TEXT HISTOGRAM
 // Reserved words
-%token AFTER AS BY CONST HIDDEN DEF DEL NEXT OTHERWISE ELSE STOP BUCKETS
+%token AFTER AS BY CONST HIDDEN DEF DEL NEXT OTHERWISE ELSE STOP BUCKETS PRAGMA TABLE REGEXSET
 // Builtins
 %token <text> BUILTIN
 // Literals: re2 syntax regular expression, quoted strings, regex capture group
@@ -70,9 +71,14 @@ import (
 %token <op> MATCH NOT_MATCH
 // Punctuation
 %token LCURLY RCURLY LPAREN RPAREN LSQUARE RSQUARE
-%token COMMA
+%token COMMA COLON
 %token NL
 
+// A string following a pragma is its value, so a pragma without one has lower
+// precedence than a string.
+%nonassoc NOVALUE
+%nonassoc STRING
+
 %start start
 
 // The %error directive takes a list of tokens describing a parser state in error, and an error message.
@@ -120,6 +126,10 @@ stmt
   { $$ = $1 }
   | delete_statement
   { $$ = $1 }
+  | table_declaration
+  { $$ = $1 }
+  | regexset_declaration
+  { $$ = $1 }
   | NEXT
   {
     $$ = &ast.NextStmt{tokenpos(mtaillex)}
@@ -132,6 +142,13 @@ stmt
   {
     $$ = &ast.StopStmt{tokenpos(mtaillex)}
   }
+  | pragma_name %prec NOVALUE
+  { $$ = $1 }
+  | pragma_name STRING
+  {
+    $$ = $1
+    $$.(*ast.Pragma).Value = $2
+  }
   | INVALID
   {
     $$ = &ast.Error{tokenpos(mtaillex), $1}
@@ -386,9 +403,12 @@ primary_expr
   {
     $$ = &ast.CaprefTerm{tokenpos(mtaillex), $1, false, nil}
   }
-  | CAPREF_NAMED
+  | named_capref
+  { $$ = $1 }
+  | named_capref LSQUARE bitwise_expr RSQUARE
   {
-    $$ = &ast.CaprefTerm{tokenpos(mtaillex), $1, true, nil}
+    c := $1.(*ast.CaprefTerm)
+    $$ = &ast.FieldTerm{c.P, c.Name, $3}
   }
   | STRING
   {
@@ -608,6 +628,69 @@ delete_statement
     $$ = &ast.DelStmt{P: tokenpos(mtaillex), N: $2}
   }
 
+table_declaration
+  : mark_pos TABLE ID LCURLY table_entry_list RCURLY
+  {
+    $$ = $5
+    $$.(*ast.TableDecl).P = markedpos(mtaillex)
+    $$.(*ast.TableDecl).Name = $3
+  }
+  ;
+
+table_entry_list
+  : /* empty */
+  {
+    $$ = &ast.TableDecl{}
+  }
+  | table_entry_list NL
+  {
+    $$ = $1
+  }
+  | table_entry_list STRING COLON STRING
+  {
+    $$ = $1
+    $$.(*ast.TableDecl).Keys = append($$.(*ast.TableDecl).Keys, $2)
+    $$.(*ast.TableDecl).Values = append($$.(*ast.TableDecl).Values, $4)
+  }
+  | table_entry_list STRING COLON STRING COMMA
+  {
+    $$ = $1
+    $$.(*ast.TableDecl).Keys = append($$.(*ast.TableDecl).Keys, $2)
+    $$.(*ast.TableDecl).Values = append($$.(*ast.TableDecl).Values, $4)
+  }
+  ;
+
+regexset_declaration
+  : mark_pos REGEXSET ID LCURLY regexset_entry_list RCURLY
+  {
+    $$ = $5
+    $$.(*ast.RegexSetDecl).Name = $3
+  }
+  ;
+
+regexset_entry_list
+  : /* empty */
+  {
+    // Take the position marked at the start of the declaration now, before
+    // the patterns mark their own.
+    $$ = &ast.RegexSetDecl{P: markedpos(mtaillex)}
+  }
+  | regexset_entry_list NL
+  {
+    $$ = $1
+  }
+  | regexset_entry_list regex_pattern
+  {
+    $$ = $1
+    $$.(*ast.RegexSetDecl).Patterns = append($$.(*ast.RegexSetDecl).Patterns, $2.(*ast.PatternLit).Pattern)
+  }
+  | regexset_entry_list regex_pattern COMMA
+  {
+    $$ = $1
+    $$.(*ast.RegexSetDecl).Patterns = append($$.(*ast.RegexSetDecl).Patterns, $2.(*ast.PatternLit).Pattern)
+  }
+  ;
+
 id_or_string
   : ID
   {
@@ -619,6 +702,22 @@ id_or_string
   }
   ;
 
+// named_capref and pragma_name are reduced before the parser looks ahead to
+// the next token, which would move tokenpos past them.
+named_capref
+  : CAPREF_NAMED
+  {
+    $$ = &ast.CaprefTerm{tokenpos(mtaillex), $1, true, nil}
+  }
+  ;
+
+pragma_name
+  : PRAGMA ID
+  {
+    $$ = &ast.Pragma{tokenpos(mtaillex), $2, ""}
+  }
+  ;
+
 // mark_pos is an epsilon (marker nonterminal) that records the current token
 // position as the parser position.  Use markedpos() to fetch the position and
 // merge with tokenpos for exotic productions.
@@ -28,6 +28,50 @@ var parserTests = []struct {
 	{"declare counter",
 		"counter lines_total\n"},
 
+	{"pragma",
+		"pragma case_insensitive\ncounter lines_total\n"},
+
+	{"pragma with value",
+		"pragma field_separator \"|\"\ncounter lines_total\n"},
+	{"pragma with quoted value",
+		"pragma field_separator \"\\\"\"\ncounter lines_total\n"},
+	{"pragma with escaped value",
+		"pragma field_separator \"\\t\"\ncounter lines_total\n"},
+
+	{"field of line",
+		"/$/ {\n  $F[2]\n}\n"},
+
+	{"table",
+		`table status_names {
+  "200": "success",
+  "404": "client_error"
+}
+`},
+
+	{"table with quotes and backslashes",
+		`table paths {
+  "a\\b": "\"quoted\"",
+  "\t": "c:\\dir\\"
+}
+`},
+
+	{"lookup",
+		`table t {}
+lookup(t, "a", "b")
+`},
+
+	{"regexset",
+		`regexset errors {
+  /timeout/,
+  /status=5\d\d/
+}
+`},
+
+	{"matches_any",
+		`regexset s { /a/ }
+matches_any("a", s)
+`},
+
 	{"declare counter string name",
 		"counter lines_total as \"line-count\"\n"},
 
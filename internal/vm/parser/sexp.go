@@ -134,6 +134,10 @@ func (s *Sexp) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.CaprefTerm:
 		s.emit("\"" + v.Name + "\"")
 
+	case *ast.FieldTerm:
+		s.emit("\"" + v.Name + "\"")
+		s.newline()
+
 	case *ast.BuiltinExpr:
 		s.emit("\"" + v.Name + "\"")
 		s.newline()
@@ -198,6 +202,26 @@ func (s *Sexp) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.StopStmt:
 		s.emit("stop")
 
+	case *ast.Pragma:
+		s.emit(fmt.Sprintf("pragma %q", v.Name))
+		if v.Value != "" {
+			s.emit(fmt.Sprintf(" %q", v.Value))
+		}
+
+	case *ast.TableDecl:
+		s.emit(fmt.Sprintf("table %q", v.Name))
+		for i, k := range v.Keys {
+			s.newline()
+			s.emit(fmt.Sprintf("%q: %q", k, v.Values[i]))
+		}
+
+	case *ast.RegexSetDecl:
+		s.emit(fmt.Sprintf("regexset %q", v.Name))
+		for _, p := range v.Patterns {
+			s.newline()
+			s.emit(fmt.Sprintf("/%s/", p))
+		}
+
 	case *ast.DecoDecl:
 		s.emit(fmt.Sprintf("%q", v.Name))
 		s.newline()
@@ -158,6 +158,11 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.CaprefTerm:
 		u.emit("$" + v.Name)
 
+	case *ast.FieldTerm:
+		u.emit("$" + v.Name + "[")
+		ast.Walk(u, v.Index)
+		u.emit("]")
+
 	case *ast.BuiltinExpr:
 		u.emit(v.Name + "(")
 		if v.Args != nil {
@@ -267,6 +272,34 @@ func (u *Unparser) VisitBefore(n ast.Node) (ast.Visitor, ast.Node) {
 	case *ast.StopStmt:
 		u.emit("stop")
 
+	case *ast.Pragma:
+		u.emit("pragma " + v.Name)
+		if v.Value != "" {
+			u.emit(" " + quoteString(v.Value))
+		}
+
+	case *ast.TableDecl:
+		u.emit(fmt.Sprintf("table %s {", v.Name))
+		u.newline()
+		u.indent()
+		for i, k := range v.Keys {
+			u.emit(quoteString(k) + ": " + quoteString(v.Values[i]) + ",")
+			u.newline()
+		}
+		u.outdent()
+		u.emit("}")
+
+	case *ast.RegexSetDecl:
+		u.emit(fmt.Sprintf("regexset %s {", v.Name))
+		u.newline()
+		u.indent()
+		for _, p := range v.Patterns {
+			u.emit(fmt.Sprintf("/%s/,", p))
+			u.newline()
+		}
+		u.outdent()
+		u.emit("}")
+
 	default:
 		panic(fmt.Sprintf("unfound undefined type %T", n))
 	}
@@ -286,3 +319,10 @@ func (u *Unparser) Unparse(n ast.Node) string {
 	ast.Walk(u, n)
 	return u.output.String()
 }
+
+// quoteString returns s as a quoted string that lexes back to s.  The lexer
+// keeps escapes other than \" as written, so only the quotes need escaping
+// again; strconv.Quote would double the backslashes already in s.
+func quoteString(s string) string {
+	return "\"" + strings.Replace(s, `"`, `\"`, -1) + "\""
+}
@@ -0,0 +1,40 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"time"
+)
+
+// rateWindow holds the samples of one datum given to rate() within its time
+// window.
+type rateWindow struct {
+	samples []sample // In order of time.
+}
+
+// Add records value at time t, drops the samples older than window before t,
+// and returns the per second rate of increase over the remaining samples.  A
+// decrease between two samples is a reset of the counter, and is ignored.
+func (w *rateWindow) Add(t time.Time, value float64, window time.Duration) float64 {
+	w.samples = append(w.samples, sample{t, value})
+	cutoff := t.Add(-window)
+	i := 0
+	for i < len(w.samples)-1 && w.samples[i].t.Before(cutoff) {
+		i++
+	}
+	if i > 0 {
+		w.samples = append(w.samples[:0], w.samples[i:]...)
+	}
+	var increase float64
+	for i := 1; i < len(w.samples); i++ {
+		if delta := w.samples[i].value - w.samples[i-1].value; delta > 0 {
+			increase += delta
+		}
+	}
+	elapsed := w.samples[len(w.samples)-1].t.Sub(w.samples[0].t).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return increase / elapsed
+}
@@ -0,0 +1,279 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/mtail/internal/vm/types"
+)
+
+// maxRegexSetStates bounds the number of DFA states cached by a regexSet; the
+// cache is discarded and rebuilt when it grows past this.
+const maxRegexSetStates = 10000
+
+// regexSet matches a string against many regular expressions in a single
+// pass, like RE2's RE2::Set, reporting which of them match anywhere in the
+// string.  The patterns' programs are run in lockstep as a DFA built lazily
+// from the sets of threads of all the programs.  A regexSet is not safe for
+// concurrent use.
+type regexSet struct {
+	progs  []*syntax.Prog
+	states map[string]*setState // Cached DFA states by key.
+	start  *setState
+	cached int // Number of states cached since the last reset.
+}
+
+// setThread is a thread of one of the programs in a regexSet.
+type setThread struct {
+	prog, pc uint32
+}
+
+// Classes of runes that decide the result of empty-width assertions, like
+// `^' and `\b'.  The null class is the beginning or end of the string.
+const (
+	classNull = iota
+	classNewline
+	classWord
+	classOther
+)
+
+// setState is a DFA state of a regexSet: the threads waiting to consume the
+// next rune, and the class of the previous rune.
+type setState struct {
+	key     string
+	threads []setThread
+	prev    int
+
+	ascii [utf8.RuneSelf]*setEdge // Transitions on ASCII runes.
+	other map[rune]*setEdge       // Transitions on all other runes.
+	end   []int                   // Patterns matching at the end of the string.
+	ended bool                    // True once end has been computed.
+}
+
+// setEdge is a transition between DFA states, recording the patterns found to
+// match before the rune consumed.
+type setEdge struct {
+	next    *setState
+	matched []int
+}
+
+// newRegexSet returns a regexSet matching the patterns of res.
+func newRegexSet(res []*regexp.Regexp) (*regexSet, error) {
+	rs := &regexSet{}
+	for _, re := range res {
+		r, err := types.ParseRegexp(re.String())
+		if err != nil {
+			return nil, err
+		}
+		p, err := syntax.Compile(r)
+		if err != nil {
+			return nil, err
+		}
+		rs.progs = append(rs.progs, p)
+	}
+	rs.reset()
+	return rs, nil
+}
+
+// reset discards the cached states.
+func (rs *regexSet) reset() {
+	rs.states = make(map[string]*setState)
+	rs.cached = 0
+	rs.start = rs.state(nil, classNull)
+}
+
+// state returns the cached state for threads after a rune of class prev,
+// creating it if necessary.  threads must be sorted.
+func (rs *regexSet) state(threads []setThread, prev int) *setState {
+	var b strings.Builder
+	b.WriteByte(byte(prev))
+	for _, t := range threads {
+		for _, x := range [2]uint32{t.prog, t.pc} {
+			b.WriteByte(byte(x))
+			b.WriteByte(byte(x >> 8))
+			b.WriteByte(byte(x >> 16))
+			b.WriteByte(byte(x >> 24))
+		}
+	}
+	key := b.String()
+	if s, ok := rs.states[key]; ok {
+		return s
+	}
+	s := &setState{key: key, threads: threads, prev: prev}
+	rs.states[key] = s
+	rs.cached++
+	return s
+}
+
+// runeClass returns the class of r, or classNull if r is negative.
+func runeClass(r rune) int {
+	switch {
+	case r < 0:
+		return classNull
+	case r == '\n':
+		return classNewline
+	case syntax.IsWordChar(r):
+		return classWord
+	default:
+		return classOther
+	}
+}
+
+// classRunes are representatives of each rune class.
+var classRunes = [...]rune{classNull: -1, classNewline: '\n', classWord: 'a', classOther: ' '}
+
+// closure follows the empty transitions from the threads of s, and from the
+// start of every program as a match may begin anywhere, given that the next
+// rune is of class next.  It returns the threads ready to consume a rune, and
+// the patterns that matched.
+func (rs *regexSet) closure(s *setState, next int) (ready []setThread, matched []int) {
+	flag := syntax.EmptyOpContext(classRunes[s.prev], classRunes[next])
+	seen := make(map[setThread]bool)
+	found := make(map[uint32]bool)
+	var add func(t setThread)
+	add = func(t setThread) {
+		if seen[t] {
+			return
+		}
+		seen[t] = true
+		inst := &rs.progs[t.prog].Inst[t.pc]
+		switch inst.Op {
+		case syntax.InstAlt, syntax.InstAltMatch:
+			add(setThread{t.prog, inst.Out})
+			add(setThread{t.prog, inst.Arg})
+		case syntax.InstCapture, syntax.InstNop:
+			add(setThread{t.prog, inst.Out})
+		case syntax.InstEmptyWidth:
+			if syntax.EmptyOp(inst.Arg)&^flag == 0 {
+				add(setThread{t.prog, inst.Out})
+			}
+		case syntax.InstMatch:
+			if !found[t.prog] {
+				found[t.prog] = true
+				matched = append(matched, int(t.prog))
+			}
+		case syntax.InstFail:
+		default:
+			ready = append(ready, t)
+		}
+	}
+	for _, t := range s.threads {
+		add(t)
+	}
+	for i, p := range rs.progs {
+		add(setThread{uint32(i), uint32(p.Start)})
+	}
+	return ready, matched
+}
+
+// edge returns the transition from s on r.
+func (rs *regexSet) edge(s *setState, r rune) *setEdge {
+	if r < utf8.RuneSelf {
+		if e := s.ascii[r]; e != nil {
+			return e
+		}
+	} else if e, ok := s.other[r]; ok {
+		return e
+	}
+	cls := runeClass(r)
+	ready, matched := rs.closure(s, cls)
+	var threads []setThread
+	seen := make(map[setThread]bool)
+	for _, t := range ready {
+		inst := &rs.progs[t.prog].Inst[t.pc]
+		var ok bool
+		switch inst.Op {
+		case syntax.InstRuneAny:
+			ok = true
+		case syntax.InstRuneAnyNotNL:
+			ok = r != '\n'
+		default:
+			ok = inst.MatchRune(r)
+		}
+		next := setThread{t.prog, inst.Out}
+		if ok && !seen[next] {
+			seen[next] = true
+			threads = append(threads, next)
+		}
+	}
+	sort.Slice(threads, func(i, j int) bool {
+		if threads[i].prog != threads[j].prog {
+			return threads[i].prog < threads[j].prog
+		}
+		return threads[i].pc < threads[j].pc
+	})
+	e := &setEdge{next: rs.state(threads, cls), matched: matched}
+	if r < utf8.RuneSelf {
+		s.ascii[r] = e
+	} else {
+		if s.other == nil {
+			s.other = make(map[rune]*setEdge)
+		}
+		s.other[r] = e
+	}
+	return e
+}
+
+// ends returns the patterns found to match at the end of the string in s.
+func (rs *regexSet) ends(s *setState) []int {
+	if !s.ended {
+		_, s.end = rs.closure(s, classNull)
+		s.ended = true
+	}
+	return s.end
+}
+
+// run steps through s, calling f with the patterns found to match so far;
+// run stops early if f returns false.
+func (rs *regexSet) run(s string, f func([]int) bool) {
+	st := rs.start
+	for _, r := range s {
+		if rs.cached > maxRegexSetStates {
+			threads, prev := st.threads, st.prev
+			rs.reset()
+			st = rs.state(threads, prev)
+		}
+		e := rs.edge(st, r)
+		if len(e.matched) > 0 && !f(e.matched) {
+			return
+		}
+		st = e.next
+	}
+	if m := rs.ends(st); len(m) > 0 {
+		f(m)
+	}
+}
+
+// MatchString reports whether s matches any of the patterns.
+func (rs *regexSet) MatchString(s string) bool {
+	var ok bool
+	rs.run(s, func([]int) bool {
+		ok = true
+		return false
+	})
+	return ok
+}
+
+// Matches returns the indices of the patterns that match s, in increasing order.
+func (rs *regexSet) Matches(s string) []int {
+	found := make([]bool, len(rs.progs))
+	rs.run(s, func(matched []int) bool {
+		for _, i := range matched {
+			found[i] = true
+		}
+		return true
+	})
+	var r []int
+	for i, ok := range found {
+		if ok {
+			r = append(r, i)
+		}
+	}
+	return r
+}
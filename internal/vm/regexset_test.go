@@ -0,0 +1,107 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/google/mtail/internal/testutil"
+)
+
+var regexSetPatterns = []string{
+	`^GET `,
+	`^POST `,
+	`status=5\d\d`,
+	`\btimeout\b`,
+	`(?i)error`,
+	`ms$`,
+	`^$`,
+	`(?m)^second`,
+	`ü+`,
+	`a|b`,
+}
+
+var regexSetTests = []string{
+	"",
+	"GET /index.html status=200 12ms",
+	"POST /api status=503 timeout",
+	"GETTING timeouts",
+	"an ERROR occurred",
+	"first line\nsecond line",
+	"grüüß",
+	"xyz",
+	"\xff\xfe invalid utf-8 ms",
+}
+
+func TestRegexSetMatches(t *testing.T) {
+	var res []*regexp.Regexp
+	for _, p := range regexSetPatterns {
+		res = append(res, regexp.MustCompile(p))
+	}
+	rs, err := newRegexSet(res)
+	testutil.FatalIfErr(t, err)
+	for _, s := range regexSetTests {
+		s := s
+		t.Run(fmt.Sprintf("%q", s), func(t *testing.T) {
+			var expected []int
+			for i, re := range res {
+				if re.MatchString(s) {
+					expected = append(expected, i)
+				}
+			}
+			testutil.ExpectNoDiff(t, expected, rs.Matches(s))
+			if got := rs.MatchString(s); got != (len(expected) > 0) {
+				t.Errorf("MatchString(%q) = %v, expected %v", s, got, len(expected) > 0)
+			}
+		})
+	}
+}
+
+func TestRegexSetReset(t *testing.T) {
+	rs, err := newRegexSet([]*regexp.Regexp{regexp.MustCompile(`a.{20}b`), regexp.MustCompile(`z$`)})
+	testutil.FatalIfErr(t, err)
+	// Enough distinct inputs to overflow the cache of states several times.
+	for i := 0; i < 5*maxRegexSetStates; i++ {
+		s := fmt.Sprintf("%x%s", i*7919, "a01234567890123456789bz")
+		testutil.ExpectNoDiff(t, []int{0, 1}, rs.Matches(s))
+	}
+}
+
+// benchmarkPatterns returns n patterns in the style of a program dispatching
+// on the request path and status of each line.
+func benchmarkPatterns(n int) []*regexp.Regexp {
+	var res []*regexp.Regexp
+	for i := 0; i < n; i++ {
+		res = append(res, regexp.MustCompile(fmt.Sprintf(`^\S+ /api/v\d/service%d/\S+ status=(4|5)\d\d`, i)))
+	}
+	return res
+}
+
+const benchmarkLine = "GET /api/v1/service99999/users/12345 status=200 size=5120 duration=12ms"
+
+func BenchmarkRegexSet(b *testing.B) {
+	for _, n := range []int{1, 10, 50} {
+		res := benchmarkPatterns(n)
+		b.Run(fmt.Sprintf("sequential-%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, re := range res {
+					if re.MatchString(benchmarkLine) {
+						b.Fatal("unexpected match")
+					}
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("set-%d", n), func(b *testing.B) {
+			rs, err := newRegexSet(res)
+			testutil.FatalIfErr(b, err)
+			for i := 0; i < b.N; i++ {
+				if rs.MatchString(benchmarkLine) {
+					b.Fatal("unexpected match")
+				}
+			}
+		})
+	}
+}
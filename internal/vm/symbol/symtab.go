@@ -16,11 +16,13 @@ type SymbolKind int
 
 // SymbolKind enumerates the kinds of symbols found in the program text.
 const (
-	VarSymbol     SymbolKind = iota // Variables
-	CaprefSymbol                    // Capture group references
-	DecoSymbol                      // Decorators
-	PatternSymbol                   // Named pattern constants
-	endSymbol                       // for testing
+	VarSymbol      SymbolKind = iota // Variables
+	CaprefSymbol                     // Capture group references
+	DecoSymbol                       // Decorators
+	PatternSymbol                    // Named pattern constants
+	TableSymbol                      // Static lookup tables
+	RegexSetSymbol                   // Static sets of regular expressions
+	endSymbol                        // for testing
 )
 
 func (k SymbolKind) String() string {
@@ -33,6 +35,10 @@ func (k SymbolKind) String() string {
 		return "decorator"
 	case PatternSymbol:
 		return "named pattern constant"
+	case TableSymbol:
+		return "table"
+	case RegexSetSymbol:
+		return "regexset"
 	default:
 		panic("unexpected symbolkind")
 	}
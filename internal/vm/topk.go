@@ -0,0 +1,88 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"sort"
+)
+
+// topKOther is the label of the datum that top_k() sets to the count of the
+// keys not in the top k.
+const topKOther = "(other)"
+
+// topKCounters is the number of keys counted by top_k() for every key
+// exported, so that keys newly seen replace each other rather than frequent
+// keys.
+const topKCounters = 2
+
+// topKSummary is a Space-Saving summary of the keys given to top_k() for one
+// metric, which counts at most a fixed number of keys.  When a key that is
+// not counted arrives and the summary is full, it replaces the key with the
+// lowest count, and takes that count plus one, so counts may overestimate,
+// but the frequent keys are kept.
+type topKSummary struct {
+	counts map[string]int64 // Estimated counts by key.
+	total  int64            // Number of keys added.
+}
+
+func newTopKSummary() *topKSummary {
+	return &topKSummary{counts: make(map[string]int64)}
+}
+
+// Add counts key, counting at most capacity keys.
+func (s *topKSummary) Add(key string, capacity int) {
+	s.total++
+	if _, ok := s.counts[key]; ok {
+		s.counts[key]++
+		return
+	}
+	// The new key may have been seen up to as many times as the key it
+	// replaces.
+	var floor int64
+	for len(s.counts) >= capacity {
+		var (
+			min   string
+			found bool
+		)
+		for k, c := range s.counts {
+			if !found || c < s.counts[min] || (c == s.counts[min] && k < min) {
+				min, found = k, true
+			}
+		}
+		if s.counts[min] > floor {
+			floor = s.counts[min]
+		}
+		delete(s.counts, min)
+	}
+	s.counts[key] = floor + 1
+}
+
+// topKCount is the estimated count of a key.
+type topKCount struct {
+	key   string
+	count int64
+}
+
+// Top returns the k keys with the highest counts, in order, and the count of
+// all the other keys.
+func (s *topKSummary) Top(k int) ([]topKCount, int64) {
+	top := make([]topKCount, 0, len(s.counts))
+	for key, count := range s.counts {
+		top = append(top, topKCount{key, count})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].count != top[j].count {
+			return top[i].count > top[j].count
+		}
+		return top[i].key < top[j].key
+	})
+	if len(top) > k {
+		top = top[:k]
+	}
+	other := s.total
+	for _, c := range top {
+		other -= c.count
+	}
+	return top, other
+}
@@ -184,31 +184,77 @@ func IsComplete(t Type) bool {
 
 // Builtin types
 var (
-	Undef   = &Operator{"Undef", []Type{}}
-	Error   = &Operator{"Error", []Type{}}
-	None    = &Operator{"None", []Type{}}
-	Bool    = &Operator{"Bool", []Type{}}
-	Int     = &Operator{"Int", []Type{}}
-	Float   = &Operator{"Float", []Type{}}
-	String  = &Operator{"String", []Type{}}
-	Pattern = &Operator{"Pattern", []Type{}}
+	Undef    = &Operator{"Undef", []Type{}}
+	Error    = &Operator{"Error", []Type{}}
+	None     = &Operator{"None", []Type{}}
+	Bool     = &Operator{"Bool", []Type{}}
+	Int      = &Operator{"Int", []Type{}}
+	Float    = &Operator{"Float", []Type{}}
+	String   = &Operator{"String", []Type{}}
+	Pattern  = &Operator{"Pattern", []Type{}}
+	Table    = &Operator{"Table", []Type{}}
+	RegexSet = &Operator{"RegexSet", []Type{}}
 	// TODO(jaq): use composite type so we can typecheck the bucket directly, e.g. hist[j] = i
 	Buckets = &Operator{"Buckets", []Type{}}
 )
 
 // Builtins is a mapping of the builtin language functions to their type definitions.
 var Builtins = map[string]Type{
-	"int":         Function(NewVariable(), Int),
-	"bool":        Function(NewVariable(), Bool),
-	"float":       Function(NewVariable(), Float),
-	"string":      Function(NewVariable(), String),
-	"timestamp":   Function(Int),
-	"len":         Function(String, Int),
-	"settime":     Function(Int, None),
-	"strptime":    Function(String, String, None),
-	"strtol":      Function(String, Int, Int),
-	"tolower":     Function(String, String),
-	"getfilename": Function(String),
+	"int":             Function(NewVariable(), Int),
+	"bool":            Function(NewVariable(), Bool),
+	"float":           Function(NewVariable(), Float),
+	"string":          Function(NewVariable(), String),
+	"timestamp":       Function(Int),
+	"now":             Function(Int),
+	"len":             Function(String, Int),
+	"settime":         Function(Int, None),
+	"strptime":        Function(String, String, None),
+	"strtol":          Function(String, Int, Int),
+	"tolower":         Function(String, String),
+	"base64decode":    Function(String, String),
+	"approx_distinct": Function(Int, String, None),
+	"changed":         Function(String, String, Bool),
+	"first_seen":      Function(String, Bool),
+	"after_gap":       Function(String, Int, Bool),
+	"decay_set":       Function(Float, Float, Float, None),
+	"moving_avg":      Function(Float, Float, Float, None),
+	"tumbling_inc":    Function(Int, Int, None),
+	"exemplar_inc":    Function(Int, String, None),
+	"window_max":      Function(Float, Float, Int, None),
+	"reset":           Function(NewVariable(), None),
+	"ratio":           Function(NewVariable(), NewVariable(), NewVariable(), None),
+	"top_k":           Function(NewVariable(), String, Int, None),
+	"kv_gauges":       Function(NewVariable(), String, Int, None),
+	"observe":         Function(Float, Float, None),
+	"observe_seconds": Function(Float, String, None),
+	"merge_buckets":   Function(Float, String, None),
+	"mark_seen":       Function(NewVariable(), None),
+	"set_info":        Function(NewVariable(), None),
+	"since_seen":      Function(NewVariable(), Float),
+	"rate":            Function(NewVariable(), Float, Float),
+	"field":           Function(String, Int, String),
+	"csv_field":       Function(String, Int, String),
+	"normalize_path":  Function(String, String),
+	"bucketize":       Function(Float, String, String, String),
+	"bucket_hash":     Function(String, Int, Int),
+	"exp_bucket":      Function(Float, Float, Int),
+	"strip_ansi":      Function(String, String),
+	"loglevel":        Function(String, String),
+	"parse_duration":  Function(String, Float),
+	"query_param":     Function(String, String, String),
+	"url_host":        Function(String, String),
+	"status_class":    Function(Int, String),
+	"syslog_pri":      Function(String, String, String),
+	"hour_of_day":     Function(Int, Int),
+	"day_of_week":     Function(Int, Int),
+	"getfilename":     Function(String),
+	"source_host":     Function(String),
+	"linelen":         Function(Int),
+	"program_version": Function(String),
+	"getmeta":         Function(String, String),
+	"in_set":          Function(String, String, Bool),
+	"lookup":          Function(Table, String, String, String),
+	"matches_any":     Function(String, RegexSet, Bool),
 }
 
 // FreshType returns a new type from the provided type scheme, replacing any
@@ -8,9 +8,14 @@ package vm
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"expvar"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"math"
+	"net/url"
 	"regexp"
 	"runtime/debug"
 	"strconv"
@@ -18,6 +23,7 @@ import (
 	"sync"
 	"text/tabwriter"
 	"time"
+	"unicode"
 
 	"github.com/golang/glog"
 	"github.com/golang/groupcache/lru"
@@ -40,14 +46,239 @@ var (
 	}, []string{"prog"})
 
 	runtimeLogError = flag.Bool("vm_logs_runtime_errors", true, "Enables logging of runtime errors to the standard log.  Set to false to only have the errors printed to the HTTP console.")
+
+	runtimeErrorLogInterval = flag.Duration("vm_runtime_error_log_interval", time.Minute, "Log each distinct runtime error of a program at most once in this interval, followed by a count of the identical errors not logged.  Set to zero to log every runtime error.")
+
+	// timestampParseErrors counts the timestamps that strptime could not parse, by program.
+	timestampParseErrors = expvar.NewMap("timestamp_parse_errors_total")
+
+	// warmupSkipped counts the lines skipped during the warmup of a program, by program.
+	warmupSkipped = expvar.NewMap("vm_warmup_skipped_total")
+	// kvGaugesDropped counts the keys not set by kv_gauges() because the gauge
+	// already had as many as allowed, by program.
+	kvGaugesDropped = expvar.NewMap("vm_kv_gauges_dropped_total")
+	// bytesProcessed counts the bytes of the lines given to each program, not
+	// counting their line terminators, by program.
+	bytesProcessed = expvar.NewMap("bytes_processed_total")
+)
+
+var (
+	numericSegment = regexp.MustCompile(`^[0-9]+$`)
+	uuidSegment    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+	// ansiEscape matches ANSI escape sequences: control sequences like the
+	// colour code `ESC[31m', operating system commands terminated by BEL or
+	// `ESC\', and the other escapes like the character set selection `ESC(B'.
+	ansiEscape = regexp.MustCompile(`\x1b(?:\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(?:\x07|\x1b\\)|[ -/]*[0-~])`)
+)
+
+// base64Decode decodes s as standard or URL-safe base64, with or without
+// padding.  It returns the empty string if s is not valid in any of them.
+func base64Decode(s string) string {
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		if b, err := enc.DecodeString(s); err == nil {
+			return string(b)
+		}
+	}
+	return ""
+}
+
+// queryParam returns the first value of the parameter name in the query string
+// of rawurl, or the empty string if it has none.
+func queryParam(rawurl, name string) string {
+	i := strings.IndexByte(rawurl, '?')
+	if i < 0 {
+		return ""
+	}
+	query := rawurl[i+1:]
+	if j := strings.IndexByte(query, '#'); j >= 0 {
+		query = query[:j]
+	}
+	// Parameters that can't be decoded are skipped, but the others are still
+	// returned.
+	values, _ := url.ParseQuery(query)
+	return values.Get(name)
+}
+
+// urlHost returns the host of rawurl, with its port if withPort is true, or
+// the empty string if it can't be parsed.  A rawurl without a scheme is taken
+// to start with an authority, as in host:port/path.
+func urlHost(rawurl string, withPort bool) string {
+	if !strings.Contains(rawurl, "://") {
+		rawurl = "//" + rawurl
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	if withPort {
+		return u.Host
+	}
+	return u.Hostname()
+}
+
+// parseBucketCounts parses s, a list of bound:count pairs separated by commas
+// or whitespace, like "10:3,100:5,+Inf:1", into a map of bucket upper bounds
+// to counts.
+func parseBucketCounts(s string) (map[float64]uint64, error) {
+	counts := make(map[float64]uint64)
+	for _, pair := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		i := strings.LastIndexByte(pair, ':')
+		if i < 0 {
+			return nil, errors.Errorf("bucket count %q is not of the form bound:count", pair)
+		}
+		bound, err := strconv.ParseFloat(pair[:i], 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad bucket bound in %q", pair)
+		}
+		count, err := strconv.ParseUint(pair[i+1:], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad bucket count in %q", pair)
+		}
+		counts[bound] += count
+	}
+	return counts, nil
+}
+
+// statusClass returns the class of the HTTP status code, like "2xx" for 200, or
+// "unknown" if it isn't in the range of status codes.
+func statusClass(code int64) string {
+	if code < 100 || code > 599 {
+		return "unknown"
+	}
+	return strconv.FormatInt(code/100, 10) + "xx"
+}
+
+// syslogFacilities and syslogSeverities name the facility and severity
+// codes of a syslog priority.
+var (
+	syslogFacilities = []string{
+		"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+		"uucp", "cron", "authpriv", "ftp", "ntp", "audit", "alert", "clock",
+		"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+	}
+	syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
 )
 
+// syslogPri returns the names of the facility and severity of the priority
+// that starts a raw syslog line, like <134>, or empty strings if it doesn't
+// start with one.
+func syslogPri(line string) (facility, severity string) {
+	end := strings.IndexByte(line, '>')
+	if !strings.HasPrefix(line, "<") || end < 2 || end > 4 || line[1] < '0' || line[1] > '9' {
+		return "", ""
+	}
+	pri, err := strconv.Atoi(line[1:end])
+	if err != nil || pri >= len(syslogFacilities)*8 {
+		return "", ""
+	}
+	return syslogFacilities[pri/8], syslogSeverities[pri%8]
+}
+
+// bucketHash returns the bucket from 0 to n-1 that s hashes to.  The hash is
+// stable, so a string has the same bucket in every mtail and across restarts.
+func bucketHash(s string, n int64) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return int64(h.Sum64() % uint64(n))
+}
+
+// expBucket returns the index of the exponential histogram bucket of base that
+// x falls in, where bucket i holds the values greater than base^(i-1) and at
+// most base^i.  x must be positive and base greater than one.
+func expBucket(x, base float64) int64 {
+	i := math.Ceil(math.Log(x) / math.Log(base))
+	// Correct for rounding in the logarithms near the bucket boundaries.
+	if math.Pow(base, i-1) >= x {
+		i--
+	} else if math.Pow(base, i) < x {
+		i++
+	}
+	return int64(i)
+}
+
+// csvField returns the nth field, counting from 1, of the CSV record s, or the
+// empty string if s has no nth field or isn't a valid record.
+func csvField(s string, n int64) string {
+	r := csv.NewReader(strings.NewReader(s))
+	r.FieldsPerRecord = -1
+	fields, err := r.Read()
+	if err != nil || n < 1 || n > int64(len(fields)) {
+		return ""
+	}
+	return fields[n-1]
+}
+
+// floorDiv returns x divided by y, rounded down.
+func floorDiv(x, y int64) int64 {
+	q := x / y
+	if (x%y != 0) && ((x < 0) != (y < 0)) {
+		q--
+	}
+	return q
+}
+
+// normalizePath replaces the numeric and UUID-like segments of a URL path with
+// the placeholders `:id` and `:uuid`, so that the result can be used as a
+// label value without unbounded cardinality.
+func normalizePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		switch {
+		case numericSegment.MatchString(s):
+			segments[i] = ":id"
+		case uuidSegment.MatchString(s):
+			segments[i] = ":uuid"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
 type thread struct {
 	pc      int              // Program counter.
 	matched bool             // Flag set if any match has been found.
+	hit     bool             // Flag set if any regular expression has matched.
 	matches map[int][]string // Match result variables.
 	time    time.Time        // Time register.
 	stack   []interface{}    // Data stack.
+	locked  *sync.Mutex      // Lock held on the datums being updated, if any.
+}
+
+// unlock releases the lock held by t on the datums, if any.
+func (t *thread) unlock() {
+	if t.locked != nil {
+		t.locked.Unlock()
+		t.locked = nil
+	}
+}
+
+// releasesDatum returns true if the instruction with opcode op finishes an
+// update of the datums.  It either writes a datum or removes it, or is a jump
+// following an expression that only read them.
+func releasesDatum(op code.Opcode) bool {
+	switch op {
+	case code.Iset, code.Fset, code.Sset, code.Inc, code.Dec,
+		code.Decayset, code.Movingavg, code.Observe, code.Observesec, code.Mergebkts,
+		code.Tumbleinc, code.Exemplar, code.Windowmax, code.Approxdist, code.Topk,
+		code.Reset, code.Setinfo, code.Kvgauges, code.Del, code.Expire,
+		code.Jnm, code.Jm, code.Jmp:
+		return true
+	}
+	return false
+}
+
+// lockDatums makes t hold the lock on the datums shared with the other VMs
+// running this program, if there are any, until the instruction finishing the
+// update.  Reading a datum and writing its new value are separate
+// instructions, so that the VMs would otherwise lose each other's updates.
+// There is one lock for all the datums, so that every datum read or written
+// by an update is locked, and a VM never waits for a lock while holding
+// another.
+func (v *VM) lockDatums(t *thread) {
+	if v.datumLock != nil && t.locked == nil {
+		v.datumLock.Lock()
+		t.locked = v.datumLock
+	}
 }
 
 // VM describes the virtual machine for each program.  It contains virtual
@@ -62,21 +293,166 @@ type VM struct {
 	str []string          // String constants
 	m   []*metrics.Metric // Metrics accessible to this program.
 
+	tables    []map[string]string // Static lookup tables
+	regexSets []*regexSet         // Static sets of regular expressions
+
 	timeMemos *lru.Cache // memo of time string parse results
 
+	lastValues map[string]string // Last value seen by changed(), by key.
+
+	firstSeen      map[string]time.Time // Expiry of the keys seen by first_seen(), or zero if they don't expire.
+	firstSeenSwept time.Time            // When expired keys were last removed from firstSeen.
+
+	lastMatched map[string]time.Time // When each key was last seen by after_gap().
+
+	fileSets map[string]*fileSet // Sets loaded by in_set(), by pathname.
+
+	bucketLists map[string]*bucketList // Buckets parsed by bucketize(), by boundaries and labels.
+
+	sketches map[datum.Datum]*hll // Distinct value sketches by approx_distinct(), by datum.
+
+	windows map[datum.Datum]*movingWindow // Samples by moving_avg(), by datum.
+
+	rates map[datum.Datum]*rateWindow // Samples by rate(), by datum.
+
+	topKs map[*metrics.Metric]*topKSummary // Keys counted by top_k(), by metric.
+
+	seen map[datum.Datum]time.Time // Times marked by mark_seen(), by datum.
+
+	datumLock *sync.Mutex // If not nil, shared with the other VMs running this program.
+
+	datumsSwept time.Time // When the state kept for removed datums was last forgotten.
+
 	t *thread // Current thread of execution
 
 	input *logline.LogLine // Log line input to this round of execution.
 
+	lineDone func(line *logline.LogLine, matched bool) // If set, called with whether any pattern matched each line.
+
+	metadata map[string]string // Host metadata returned by getmeta(), by key.
+
 	terminate bool // Flag to stop the VM on this line of input.
 
 	HardCrash bool // User settable flag to make the VM crash instead of recover on panic.
 
-	runtimeErrorMu sync.RWMutex //protects runtimeError
-	runtimeError   string       // records the last runtime error from errorf()
+	runtimeErrorMu    sync.RWMutex         //protects runtimeError and runtimeErrorLimit
+	runtimeError      string               // records the last runtime error from errorf()
+	runtimeErrorLimit *runtimeErrorLimiter // limits the logging of identical runtime errors
+	logRuntimeError   func(string)         // writes a runtime error to the log
 
 	syslogUseCurrentYear bool           // Overwrite zero years with the current year in a strptime.
 	loc                  *time.Location // Override local timezone with provided, if not empty
+
+	timestampFallback object.TimestampFallback // What strptime does when it can't parse a timestamp.
+	lastTime          time.Time                // Last timestamp parsed by strptime.
+
+	fieldSeparator string // Splits the input line into the fields of $F.
+	version        string // Hash of the program source.
+
+	obj *object.Object // The compiled program, to clone the VM from.
+
+	warmup  time.Duration // How long after started to skip lines.
+	started time.Time     // When the process started, which the warmup runs from.
+
+	clock clock // Tells the wall clock time for now() and runtime error logging.
+}
+
+// splitField returns the 1-indexed field n of s split by sep, or by runs of
+// whitespace if sep is empty, or the empty string if there is no such field.
+func splitField(s, sep string, n int64) string {
+	var fields []string
+	if sep == "" {
+		fields = strings.Fields(s)
+	} else {
+		fields = strings.Split(s, sep)
+	}
+	if n < 1 || n > int64(len(fields)) {
+		return ""
+	}
+	return fields[n-1]
+}
+
+// datumFloat returns the value of the numeric datum d.
+func datumFloat(d datum.Datum) float64 {
+	switch d := d.(type) {
+	case *datum.Int:
+		return float64(d.Get())
+	case *datum.Float:
+		return d.Get()
+	default:
+		return 0
+	}
+}
+
+// firstSeenSweepInterval is how often the keys of first_seen() that have
+// expired are removed, so that keys which are never seen again don't take up
+// memory forever.
+const firstSeenSweepInterval = time.Minute
+
+// datumSweepInterval is how often the state kept by builtins for each datum is
+// checked for datums removed by expiry, so that it doesn't take up memory
+// forever.
+const datumSweepInterval = time.Minute
+
+// maxLimitedErrors bounds the number of distinct runtime errors remembered by
+// a runtimeErrorLimiter.
+const maxLimitedErrors = 1000
+
+// runtimeErrorLimiter limits the logging of each distinct runtime error to once
+// per interval, counting the occurrences not logged.
+type runtimeErrorLimiter struct {
+	interval time.Duration
+	errors   map[string]*limitedError
+}
+
+type limitedError struct {
+	logged     time.Time // When the error was last logged.
+	suppressed int       // Occurrences of the error not logged since.
+}
+
+func newRuntimeErrorLimiter(interval time.Duration) *runtimeErrorLimiter {
+	return &runtimeErrorLimiter{interval: interval, errors: make(map[string]*limitedError)}
+}
+
+// allow reports whether the error identified by key, occurring at now, should
+// be logged, and if so the number of its occurrences not logged before it.
+func (l *runtimeErrorLimiter) allow(key string, now time.Time) (bool, int) {
+	if l.interval <= 0 {
+		return true, 0
+	}
+	e, ok := l.errors[key]
+	if !ok {
+		if len(l.errors) >= maxLimitedErrors {
+			for k, e := range l.errors {
+				if now.Sub(e.logged) >= l.interval {
+					delete(l.errors, k)
+				}
+			}
+			if len(l.errors) >= maxLimitedErrors {
+				l.errors = make(map[string]*limitedError)
+			}
+		}
+		l.errors[key] = &limitedError{logged: now}
+		return true, 0
+	}
+	if now.Sub(e.logged) < l.interval {
+		e.suppressed++
+		return false, 0
+	}
+	suppressed := e.suppressed
+	e.logged, e.suppressed = now, 0
+	return true, suppressed
+}
+
+// clock tells the wall clock time, so that tests can fake it.
+type clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
 }
 
 // Push a value onto the stack
@@ -94,18 +470,30 @@ func (t *thread) Pop() (value interface{}) {
 
 // Log a runtime error and terminate the program
 func (v *VM) errorf(format string, args ...interface{}) {
+	v.warnf(format, args...)
+	v.terminate = true
+}
+
+// Log a runtime error, but continue running the program on the current line.
+func (v *VM) warnf(format string, args ...interface{}) {
 	i := v.prog[v.t.pc-1]
 	progRuntimeErrors.Add(v.name, 1)
 	v.runtimeErrorMu.Lock()
-	v.runtimeError = fmt.Sprintf(format+"\n", args...)
-	v.runtimeError += fmt.Sprintf(
+	msg := fmt.Sprintf(format+"\n", args...)
+	loc := fmt.Sprintf(
 		"Error occurred at instruction %d {%s, %v}, originating in %s at line %d\n",
 		v.t.pc-1, i.Opcode, i.Operand, v.name, i.SourceLine+1)
+	v.runtimeError = msg + loc
 	v.runtimeError += fmt.Sprintf("Full input text from %q was %q", v.input.Filename, v.input.Line)
 	if *runtimeLogError || bool(glog.V(1)) {
-		glog.Info(v.name + ": Runtime error: " + v.runtimeError)
-
-		glog.Infof("Set logging verbosity higher (-v1 or more) to see full VM state dump.")
+		// Identical errors differ only in their input text.
+		if ok, suppressed := v.runtimeErrorLimit.allow(msg+loc, v.clock.Now()); ok {
+			if suppressed > 0 {
+				v.logRuntimeError(fmt.Sprintf("%s: %d identical runtime errors not logged since the last:\n%s", v.name, suppressed, msg+loc))
+			}
+			v.logRuntimeError(v.name + ": Runtime error: " + v.runtimeError)
+			glog.Infof("Set logging verbosity higher (-v1 or more) to see full VM state dump.")
+		}
 	}
 	if glog.V(1) {
 		glog.Infof("VM stack:\n%s", debug.Stack())
@@ -121,7 +509,6 @@ func (v *VM) errorf(format string, args ...interface{}) {
 		glog.Infof(v.DumpByteCode())
 	}
 	v.runtimeErrorMu.Unlock()
-	v.terminate = true
 }
 
 func (t *thread) PopInt() (int64, error) {
@@ -152,6 +539,8 @@ func (t *thread) PopFloat() (float64, error) {
 		return n, nil
 	case int:
 		return float64(n), nil
+	case int64:
+		return float64(n), nil
 	case string:
 		r, err := strconv.ParseFloat(n, 64)
 		if err != nil {
@@ -302,16 +691,24 @@ func compare(a, b interface{}, opnd int) (bool, error) {
 	return false, errors.Errorf("cannot compare %T %q with %T %q", a, a, b, b)
 }
 
+// localTime returns the time of the timestamp ts in the timezone given to the
+// VM, or the local timezone if none was.
+func (v *VM) localTime(ts int64) time.Time {
+	if v.loc != nil {
+		return time.Unix(ts, 0).In(v.loc)
+	}
+	return time.Unix(ts, 0).Local()
+}
+
 // ParseTime performs location and syslog-year aware timestamp parsing.
-func (v *VM) ParseTime(layout, value string) (tm time.Time) {
-	var err error
+func (v *VM) ParseTime(layout, value string) (tm time.Time, err error) {
 	if v.loc != nil {
 		tm, err = time.ParseInLocation(layout, value, v.loc)
 	} else {
 		tm, err = time.Parse(layout, value)
 	}
 	if err != nil {
-		v.errorf("strptime (%v, %v, %v) failed: %s", layout, value, v.loc, err)
+		err = errors.Wrapf(err, "strptime (%v, %v, %v) failed", layout, value, v.loc)
 		return
 	}
 	// Hack for yearless syslog.
@@ -355,6 +752,7 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		// where i.opnd == the matched re index
 		index := i.Operand.(int)
 		t.matches[index] = v.re[index].FindStringSubmatch(v.input.Line)
+		t.hit = t.hit || t.matches[index] != nil
 		t.Push(t.matches[index] != nil)
 
 	case code.Smatch:
@@ -366,6 +764,7 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			return
 		}
 		t.matches[index] = v.re[index].FindStringSubmatch(line)
+		t.hit = t.hit || t.matches[index] != nil
 		t.Push(t.matches[index] != nil)
 
 	case code.Cmp:
@@ -567,13 +966,29 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			// Store the result from the re'th index at the s'th index
 			ts = t.matches[re][s]
 		}
-		if cached, ok := v.timeMemos.Get(ts); !ok {
-			tm := v.ParseTime(layout, ts)
-			v.timeMemos.Add(ts, tm)
-			t.time = tm
-		} else {
+		if cached, ok := v.timeMemos.Get(ts); ok {
 			t.time = cached.(time.Time)
+			v.lastTime = t.time
+			return
+		}
+		tm, err := v.ParseTime(layout, ts)
+		if err != nil {
+			timestampParseErrors.Add(v.name, 1)
+			switch v.timestampFallback {
+			case object.TimestampFallbackWallclock:
+				glog.V(1).Infof("%s: %s; using current time", v.name, err)
+				t.time = time.Time{}
+			case object.TimestampFallbackPrevious:
+				glog.V(1).Infof("%s: %s; using previous timestamp %v", v.name, err, v.lastTime)
+				t.time = v.lastTime
+			default:
+				v.errorf("%+v", err)
+			}
+			return
 		}
+		v.timeMemos.Add(ts, tm)
+		t.time = tm
+		v.lastTime = tm
 
 	case code.Timestamp:
 		// Put the time register onto the stack, unless it's zero in which case use system time.
@@ -584,6 +999,10 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			t.Push(t.time.Unix())
 		}
 
+	case code.Now:
+		// Push the wall clock time, regardless of the time register.
+		t.Push(v.clock.Now().Unix())
+
 	case code.Settime:
 		// Pop TOS and store in time register
 		val := t.Pop()
@@ -737,6 +1156,7 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			return
 		}
 		//fmt.Printf("Found %v\n", d)
+		v.lockDatums(t)
 		t.Push(d)
 
 	case code.Iget, code.Fget, code.Sget:
@@ -755,6 +1175,7 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		}
 
 	case code.Del:
+		v.lockDatums(t)
 		m := t.Pop().(*metrics.Metric)
 		index := i.Operand.(int)
 		keys := make([]string, index)
@@ -766,6 +1187,14 @@ func (v *VM) execute(t *thread, i code.Instr) {
 			}
 			keys[j] = s
 		}
+		if len(keys) == len(m.Keys) {
+			m.RLock()
+			lv := m.FindLabelValueOrNil(keys)
+			m.RUnlock()
+			if lv != nil {
+				v.forgetDatum(lv.Value)
+			}
+		}
 		err := m.RemoveDatum(keys...)
 		if err != nil {
 			v.errorf("del (RemoveDatum) failed: %s", err)
@@ -773,6 +1202,7 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		}
 
 	case code.Expire:
+		v.lockDatums(t)
 		m := t.Pop().(*metrics.Metric)
 		index := i.Operand.(int)
 		keys := make([]string, index)
@@ -799,144 +1229,1159 @@ func (v *VM) execute(t *thread, i code.Instr) {
 		}
 		t.Push(strings.ToLower(s))
 
-	case code.Length:
-		// Compute the length of a string from TOS, and push result back.
+	case code.Normpath:
+		// Normalize the path from TOS, and push result back.
 		s, err := t.PopString()
 		if err != nil {
 			v.errorf("%+v", err)
 			return
 		}
-		t.Push(len(s))
+		t.Push(normalizePath(s))
 
-	case code.S2i:
-		base := int64(10)
-		var err error
-		if i.Operand != nil {
-			// strtol is emitted with an arglen, int is not
-			base, err = t.PopInt()
-			if err != nil {
-				v.errorf("%s", err)
-				return
-			}
-		}
-		str, err := t.PopString()
+	case code.Stripansi:
+		// Remove ANSI escape sequences from the string at TOS, and push result back.
+		s, err := t.PopString()
 		if err != nil {
 			v.errorf("%+v", err)
 			return
 		}
-		i, err := strconv.ParseInt(str, int(base), 64)
+		t.Push(ansiEscape.ReplaceAllString(s, ""))
+
+	case code.Loglevel:
+		// Replace the log line at TOS with its normalized level.
+		line, err := t.PopString()
 		if err != nil {
-			v.errorf("%s", err)
+			v.errorf("%+v", err)
 			return
 		}
-		t.Push(i)
+		t.Push(logLevel(line))
 
-	case code.S2f:
-		str, err := t.PopString()
+	case code.Queryparam:
+		// Look up the parameter named at TOS in the query string of the URL
+		// below it, and push its first value.
+		name, err := t.PopString()
 		if err != nil {
 			v.errorf("%+v", err)
 			return
 		}
-		f, err := strconv.ParseFloat(str, 64)
+		rawurl, err := t.PopString()
 		if err != nil {
-			v.errorf("%s", err)
+			v.errorf("%+v", err)
 			return
 		}
-		t.Push(f)
+		t.Push(queryParam(rawurl, name))
 
-	case code.I2f:
-		i, err := t.PopInt()
+	case code.Urlhost:
+		// Replace the URL or authority below TOS with its host, including
+		// its port if the flag at TOS is nonzero.
+		var withPort int64
+		if i.Operand == 2 {
+			var err error
+			withPort, err = t.PopInt()
+			if err != nil {
+				v.errorf("%+v", err)
+				return
+			}
+		}
+		s, err := t.PopString()
 		if err != nil {
-			v.errorf("%s", err)
+			v.errorf("%+v", err)
 			return
 		}
-		t.Push(float64(i))
+		t.Push(urlHost(s, withPort != 0))
 
-	case code.I2s:
-		i, err := t.PopInt()
+	case code.Buckethash:
+		// Push the bucket that the string below TOS hashes to, of the
+		// number of buckets at TOS.
+		n, err := t.PopInt()
 		if err != nil {
-			v.errorf("%s", err)
+			v.errorf("%+v", err)
 			return
 		}
-		t.Push(fmt.Sprintf("%d", i))
-
-	case code.F2s:
-		f, err := t.PopFloat()
+		s, err := t.PopString()
 		if err != nil {
-			v.errorf("%s", err)
+			v.errorf("%+v", err)
 			return
 		}
-		t.Push(fmt.Sprintf("%g", f))
-
-	case code.Setmatched:
-		t.matched = i.Operand.(bool)
-
-	case code.Otherwise:
-		// Only match if the matched flag is false.
-		t.Push(!t.matched)
+		if n <= 0 {
+			v.errorf("bucket_hash number of buckets must be positive, not %d", n)
+			return
+		}
+		t.Push(bucketHash(s, n))
 
-	case code.Getfilename:
-		t.Push(v.input.Filename)
+	case code.Statclass:
+		// Replace the HTTP status code at TOS with its class.
+		status, err := t.PopInt()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		t.Push(statusClass(status))
 
-	case code.Cat:
-		b, berr := t.PopString()
-		if berr != nil {
-			v.errorf("%+v", berr)
+	case code.Syslogpri:
+		// Replace the line below TOS with the part named at TOS, facility or
+		// severity, of its syslog priority.
+		part, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
 			return
 		}
-		a, aerr := t.PopString()
-		if aerr != nil {
-			v.errorf("%+v", aerr)
+		line, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		facility, severity := syslogPri(line)
+		switch part {
+		case "facility":
+			t.Push(facility)
+		case "severity":
+			t.Push(severity)
+		default:
+			v.errorf("syslog_pri part must be facility or severity, not %q", part)
 			return
 		}
-		t.Push(a + b)
-
-	default:
-		v.errorf("illegal instruction: %d", i.Opcode)
-	}
-}
 
-// ProcessLogLine handles the incoming lines by running a fetch-execute cycle
-// on the VM bytecode with the line as input to the program, until termination.
-func (v *VM) ProcessLogLine(ctx context.Context, line *logline.LogLine) {
-	start := time.Now()
-	defer func() {
-		lineProcessingDurations.WithLabelValues(v.name).Observe(time.Since(start).Seconds())
-	}()
-	t := new(thread)
-	t.matched = false
-	v.t = t
-	v.input = line
-	t.stack = make([]interface{}, 0)
-	t.matches = make(map[int][]string, len(v.re))
-	for {
-		if t.pc >= len(v.prog) {
+	case code.Hourofday, code.Dayofweek:
+		// Replace the timestamp at TOS with its hour of the day or day of the
+		// week, in the VM's timezone.
+		ts, err := t.PopInt()
+		if err != nil {
+			v.errorf("%+v", err)
 			return
 		}
-		i := v.prog[t.pc]
-		t.pc++
-		v.execute(t, i)
-		if v.terminate {
-			// Terminate only stops this invocation on this line of input; reset the terminate flag.
-			v.terminate = false
+		tm := v.localTime(ts)
+		if i.Opcode == code.Hourofday {
+			t.Push(int64(tm.Hour()))
+		} else {
+			t.Push(int64(tm.Weekday()))
+		}
+
+	case code.B64decode:
+		// Decode a base64 string from TOS, and push result back.  Invalid
+		// input decodes to the empty string rather than a runtime error.
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
 			return
 		}
-	}
-}
+		t.Push(base64Decode(s))
 
-// New creates a new virtual machine with the given name, and compiler
-// artifacts for executable and data segments.
-func New(name string, obj *object.Object, syslogUseCurrentYear bool, loc *time.Location) *VM {
-	return &VM{
-		name:                 name,
+	case code.Changed:
+		// Compare the value at TOS with the last one seen for the key below
+		// it, and push whether it differs.  The first value seen for a key
+		// is not a change.
+		val, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		key, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		last, ok := v.lastValues[key]
+		v.lastValues[key] = val
+		t.Push(ok && last != val)
+
+	case code.Firstseen:
+		// Push whether the key at TOS, or below the TTL in seconds at TOS,
+		// has not been seen before.  With a TTL, a key is forgotten once it
+		// has not been seen for that long.
+		var ttl int64
+		if i.Operand == 2 {
+			var err error
+			ttl, err = t.PopInt()
+			if err != nil {
+				v.errorf("%+v", err)
+				return
+			}
+			if ttl <= 0 {
+				v.errorf("first_seen TTL must be positive, not %d", ttl)
+				return
+			}
+		}
+		key, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		ts := t.time
+		if ts.IsZero() {
+			ts = v.clock.Now()
+		}
+		if ts.Sub(v.firstSeenSwept) >= firstSeenSweepInterval {
+			for k, expiry := range v.firstSeen {
+				if !expiry.IsZero() && !ts.Before(expiry) {
+					delete(v.firstSeen, k)
+				}
+			}
+			v.firstSeenSwept = ts
+		}
+		expiry, ok := v.firstSeen[key]
+		seen := ok && (expiry.IsZero() || ts.Before(expiry))
+		if ttl > 0 {
+			v.firstSeen[key] = ts.Add(time.Duration(ttl) * time.Second)
+		} else {
+			v.firstSeen[key] = time.Time{}
+		}
+		t.Push(!seen)
+
+	case code.Aftergap:
+		// Push whether the key below TOS was last seen longer ago than the
+		// gap in seconds at TOS, and record it as seen now.  A key not seen
+		// before has no gap.
+		gap, err := t.PopInt()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		if gap <= 0 {
+			v.errorf("after_gap gap must be positive, not %d", gap)
+			return
+		}
+		key, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		ts := t.time
+		if ts.IsZero() {
+			ts = v.clock.Now()
+		}
+		last, ok := v.lastMatched[key]
+		v.lastMatched[key] = ts
+		t.Push(ok && ts.Sub(last) > time.Duration(gap)*time.Second)
+
+	case code.Lookup:
+		// Look up the key below TOS in the table at operand, and push the
+		// value found, or the default at TOS if there is none.
+		def, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		key, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		if val, ok := v.tables[i.Operand.(int)][key]; ok {
+			t.Push(val)
+		} else {
+			t.Push(def)
+		}
+
+	case code.Matchany:
+		// Test whether the string at TOS matches any pattern of the regexset at operand.
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		m := v.regexSets[i.Operand.(int)].MatchString(s)
+		t.hit = t.hit || m
+		t.Push(m)
+
+	case code.Inset:
+		// Test whether the string below TOS is a member of the set listed in
+		// the file named at TOS.  The file is reread when it changes, checked
+		// at most every fileSetCheckInterval of wall clock time.
+		pathname, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		fs, ok := v.fileSets[pathname]
+		if !ok {
+			fs = &fileSet{pathname: pathname}
+			v.fileSets[pathname] = fs
+		}
+		member, err := fs.Contains(s, v.clock.Now())
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		t.Push(member)
+
+	case code.Bucketize:
+		// Push the label at TOS of the bucket of the value below the
+		// boundaries below it.
+		labels, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		boundaries, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		x, err := t.PopFloat()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		key := boundaries + "\x00" + labels
+		b, ok := v.bucketLists[key]
+		if !ok {
+			b, err = parseBucketList(boundaries, labels)
+			if err != nil {
+				v.errorf("%+v", err)
+				return
+			}
+			v.bucketLists[key] = b
+		}
+		t.Push(b.Label(x))
+
+	case code.Decayset:
+		// Decay the datum by the time elapsed since it was last set, using
+		// the half life in seconds at TOS, then add the value below it.
+		halflife, err := t.PopFloat()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		if halflife <= 0 {
+			v.errorf("decay_set half life must be positive, not %g", halflife)
+			return
+		}
+		value, err := t.PopFloat()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		d, ok := t.Pop().(*datum.Float)
+		if !ok {
+			v.errorf("Unexpected type to decay_set: %T %q", d, d)
+			return
+		}
+		// The half life is kept with the datum, so that it goes on decaying
+		// when read after the last update.
+		ts := t.time
+		if ts.IsZero() {
+			ts = v.clock.Now()
+		}
+		d.SetDecaying(d.GetAt(ts)+value, time.Duration(halflife*float64(time.Second)), ts)
+
+	case code.Movingavg:
+		// Add the value below TOS to the samples kept for the datum below it,
+		// and set the datum to the average of the samples within the window
+		// of seconds at TOS.
+		window, err := t.PopFloat()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		if window <= 0 {
+			v.errorf("moving_avg window must be positive, not %g", window)
+			return
+		}
+		value, err := t.PopFloat()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		d, ok := t.Pop().(datum.Datum)
+		if !ok {
+			v.errorf("Unexpected type to moving_avg: %T %q", d, d)
+			return
+		}
+		w, ok := v.windows[d]
+		if !ok {
+			w = &movingWindow{}
+			v.windows[d] = w
+		}
+		datum.SetFloat(d, w.Add(t.time, value, time.Duration(window*float64(time.Second))), t.time)
+
+	case code.Observe:
+		// Observe the value at TOS in the histogram datum below it.
+		value, err := t.PopFloat()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		d, ok := t.Pop().(*datum.Buckets)
+		if !ok {
+			v.errorf("Unexpected type to observe: %T %q", d, d)
+			return
+		}
+		d.Observe(value, t.time)
+
+	case code.Observesec:
+		// Observe the seconds in the string at TOS in the histogram datum
+		// below it.  Nginx and others log "-" for a missing time, which is
+		// skipped rather than being a runtime error.
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		d, ok := t.Pop().(*datum.Buckets)
+		if !ok {
+			v.errorf("Unexpected type to observe: %T %q", d, d)
+			return
+		}
+		if s == "-" || s == "" {
+			return
+		}
+		value, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		d.Observe(value, t.time)
+
+	case code.Mergebkts:
+		// Add the bound:count pairs in the string below TOS, or at TOS if
+		// there is no sum, to the buckets of the histogram datum below it, and
+		// the sum at TOS to its sum.
+		var sum float64
+		if i.Operand == 3 {
+			var err error
+			sum, err = t.PopFloat()
+			if err != nil {
+				v.errorf("%+v", err)
+				return
+			}
+		}
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		d, ok := t.Pop().(*datum.Buckets)
+		if !ok {
+			v.errorf("Unexpected type to merge_buckets: %T %q", d, d)
+			return
+		}
+		counts, err := parseBucketCounts(s)
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		if err := d.Merge(counts, sum, t.time); err != nil {
+			v.errorf("merge_buckets of %q: %s", s, err)
+			return
+		}
+
+	case code.Tumbleinc:
+		// Increment the datum below TOS, first resetting it to zero if it
+		// was last set in an earlier window of the seconds at TOS.  Windows
+		// start at multiples of their length since the epoch.
+		window, err := t.PopInt()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		if window <= 0 {
+			v.errorf("tumbling_inc window must be positive, not %d", window)
+			return
+		}
+		d, ok := t.Pop().(datum.Datum)
+		if !ok {
+			v.errorf("Unexpected type to tumbling_inc: %T %q", d, d)
+			return
+		}
+		ts := t.time
+		if ts.IsZero() {
+			ts = v.clock.Now()
+		}
+		var count int64
+		if floorDiv(d.TimeUTC().Unix(), window) == floorDiv(ts.Unix(), window) {
+			count = datum.GetInt(d)
+		}
+		datum.SetInt(d, count+1, ts)
+
+	case code.Exemplar:
+		// Increment the datum below TOS, and attach the trace ID at TOS to the
+		// increment as its exemplar, unless the trace ID is empty.
+		traceID, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		d, ok := t.Pop().(datum.Datum)
+		if !ok {
+			v.errorf("Unexpected type to exemplar_inc: %T %q", d, d)
+			return
+		}
+		ts := t.time
+		if ts.IsZero() {
+			ts = v.clock.Now()
+		}
+		datum.IncIntBy(d, 1, ts)
+		if traceID != "" {
+			datum.SetExemplar(d, &datum.Exemplar{TraceID: traceID, Value: 1, Time: ts})
+		}
+
+	case code.Reset:
+		// Set every datum of the metric at TOS to zero, at the timestamp
+		// register or the wall clock time if it is zero.
+		v.lockDatums(t)
+		m := t.Pop().(*metrics.Metric)
+		ts := t.time
+		if ts.IsZero() {
+			ts = v.clock.Now()
+		}
+		m.RLock()
+		for _, lv := range m.LabelValues {
+			datum.Reset(lv.Value, ts)
+		}
+		m.RUnlock()
+
+	case code.Ratio:
+		// Make the gauge third from TOS hold the ratio of the metric below TOS
+		// to the metric at TOS, which is computed when they are exported.
+		den := t.Pop().(*metrics.Metric)
+		num := t.Pop().(*metrics.Metric)
+		g := t.Pop().(*metrics.Metric)
+		g.SetRatio(num, den)
+
+	case code.Topk:
+		// Count the string below TOS for the metric below it, then set the
+		// metric to the counts of the number at TOS of most frequent strings,
+		// and of all the others, removing the strings no longer among them.
+		k, err := t.PopInt()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		if k <= 0 {
+			v.errorf("top_k k must be positive, not %d", k)
+			return
+		}
+		key, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		m := t.Pop().(*metrics.Metric)
+		ts := t.time
+		if ts.IsZero() {
+			ts = v.clock.Now()
+		}
+		s, ok := v.topKs[m]
+		if !ok {
+			s = newTopKSummary()
+			v.topKs[m] = s
+		}
+		s.Add(key, int(k)*topKCounters)
+		top, other := s.Top(int(k))
+		keep := map[string]bool{topKOther: true}
+		for _, c := range top {
+			keep[c.key] = true
+			d, err := m.GetDatum(c.key)
+			if err != nil {
+				v.errorf("%+v", err)
+				return
+			}
+			datum.SetInt(d, c.count, ts)
+		}
+		d, err := m.GetDatum(topKOther)
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		datum.SetInt(d, other, ts)
+		var removed []string
+		m.RLock()
+		for _, lv := range m.LabelValues {
+			if !keep[lv.Labels[0]] {
+				removed = append(removed, lv.Labels[0])
+			}
+		}
+		m.RUnlock()
+		for _, l := range removed {
+			if err := m.RemoveDatum(l); err != nil {
+				v.errorf("%+v", err)
+				return
+			}
+		}
+
+	case code.Windowmax:
+		// Set the datum below TOS to the value below it if that is greater,
+		// or if the datum was last set in an earlier window of the seconds
+		// at TOS.  Windows start at multiples of their length since the
+		// epoch.
+		window, err := t.PopInt()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		if window <= 0 {
+			v.errorf("window_max window must be positive, not %d", window)
+			return
+		}
+		value, err := t.PopFloat()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		d, ok := t.Pop().(datum.Datum)
+		if !ok {
+			v.errorf("Unexpected type to window_max: %T %q", d, d)
+			return
+		}
+		ts := t.time
+		if ts.IsZero() {
+			ts = v.clock.Now()
+		}
+		if datum.GetObservations(d) == 0 || floorDiv(d.TimeUTC().Unix(), window) != floorDiv(ts.Unix(), window) || value > datum.GetFloat(d) {
+			datum.SetFloat(d, value, ts)
+		}
+
+	case code.Markseen:
+		// Record the timestamp register as the time the datum at TOS was last
+		// seen, or the wall clock time if it is zero.
+		d, ok := t.Pop().(datum.Datum)
+		if !ok {
+			v.errorf("Unexpected type to mark_seen: %T %q", d, d)
+			return
+		}
+		ts := t.time
+		if ts.IsZero() {
+			ts = v.clock.Now()
+		}
+		v.seen[d] = ts
+
+	case code.Setinfo:
+		// Set the datum of the metric at TOS named by the keys below it to 1,
+		// at the timestamp register or the wall clock time if it is zero, and
+		// remove every other datum of the metric.
+		v.lockDatums(t)
+		m := t.Pop().(*metrics.Metric)
+		index := i.Operand.(int)
+		keys := make([]string, index)
+		for j := index - 1; j >= 0; j-- {
+			s, err := t.PopString()
+			if err != nil {
+				v.errorf("%+v", err)
+				return
+			}
+			keys[j] = s
+		}
+		d, err := m.GetDatum(keys...)
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		ts := t.time
+		if ts.IsZero() {
+			ts = v.clock.Now()
+		}
+		switch d.(type) {
+		case *datum.Int:
+			datum.SetInt(d, 1, ts)
+		case *datum.Float:
+			datum.SetFloat(d, 1, ts)
+		default:
+			v.errorf("Unexpected type to set_info: %T %q", d, d)
+			return
+		}
+		m.Lock()
+		for _, lv := range m.LabelValues {
+			if lv.Value == d {
+				m.LabelValues = []*metrics.LabelValue{lv}
+				break
+			}
+		}
+		m.Unlock()
+
+	case code.Sinceseen:
+		// Push the seconds from when the datum at TOS was last seen to the
+		// wall clock time, or -1 if it has not been seen.
+		d, ok := t.Pop().(datum.Datum)
+		if !ok {
+			v.errorf("Unexpected type to since_seen: %T %q", d, d)
+			return
+		}
+		elapsed := -1.
+		if ts, ok := v.seen[d]; ok {
+			elapsed = math.Max(v.clock.Now().Sub(ts).Seconds(), 0)
+		}
+		t.Push(elapsed)
+
+	case code.Rate:
+		// Push the per second rate of increase of the datum below TOS over
+		// the window of seconds at TOS.
+		window, err := t.PopFloat()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		if window <= 0 {
+			v.errorf("rate window must be positive, not %g", window)
+			return
+		}
+		d, ok := t.Pop().(datum.Datum)
+		if !ok {
+			v.errorf("Unexpected type to rate: %T %q", d, d)
+			return
+		}
+		ts := t.time
+		if ts.IsZero() {
+			ts = v.clock.Now()
+		}
+		w, ok := v.rates[d]
+		if !ok {
+			w = &rateWindow{}
+			v.rates[d] = w
+		}
+		t.Push(w.Add(ts, datumFloat(d), time.Duration(window*float64(time.Second))))
+
+	case code.Approxdist:
+		// Add the string at TOS to the sketch kept for the datum below it,
+		// and set the datum to the estimated number of distinct strings.
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		d, ok := t.Pop().(datum.Datum)
+		if !ok {
+			v.errorf("Unexpected type to approx_distinct: %T %q", d, d)
+			return
+		}
+		sketch, ok := v.sketches[d]
+		if !ok {
+			sketch = newHLL()
+			v.sketches[d] = sketch
+		}
+		sketch.Add(s)
+		datum.SetInt(d, sketch.Estimate(), t.time)
+
+	case code.Field:
+		// Split the string by the separator if one is given, or else by
+		// runs of whitespace, and push the 1-indexed field numbered by TOS.
+		var sep string
+		if i.Operand == 3 {
+			var err error
+			sep, err = t.PopString()
+			if err != nil {
+				v.errorf("%+v", err)
+				return
+			}
+		}
+		n, err := t.PopInt()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		t.Push(splitField(s, sep, n))
+
+	case code.Linefield:
+		// Push the 1-indexed field numbered by TOS of the input line, split
+		// by the program's field separator.
+		n, err := t.PopInt()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		t.Push(splitField(v.input.Line, v.fieldSeparator, n))
+
+	case code.Csvfield:
+		// Parse the string below TOS as a CSV record, and push the 1-indexed
+		// field numbered by TOS.
+		n, err := t.PopInt()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		t.Push(csvField(s, n))
+
+	case code.Length:
+		// Compute the length of a string from TOS, and push result back.
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		t.Push(len(s))
+
+	case code.S2i:
+		base := int64(10)
+		var err error
+		if i.Operand != nil {
+			// strtol is emitted with an arglen, int is not
+			base, err = t.PopInt()
+			if err != nil {
+				v.errorf("%s", err)
+				return
+			}
+		}
+		str, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		i, err := strconv.ParseInt(str, int(base), 64)
+		if err != nil {
+			v.errorf("%s", err)
+			return
+		}
+		t.Push(i)
+
+	case code.S2f:
+		str, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		f, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			v.errorf("%s", err)
+			return
+		}
+		t.Push(f)
+
+	case code.I2f:
+		i, err := t.PopInt()
+		if err != nil {
+			v.errorf("%s", err)
+			return
+		}
+		t.Push(float64(i))
+
+	case code.I2s:
+		i, err := t.PopInt()
+		if err != nil {
+			v.errorf("%s", err)
+			return
+		}
+		t.Push(fmt.Sprintf("%d", i))
+
+	case code.F2s:
+		f, err := t.PopFloat()
+		if err != nil {
+			v.errorf("%s", err)
+			return
+		}
+		t.Push(fmt.Sprintf("%g", f))
+
+	case code.Setmatched:
+		t.matched = i.Operand.(bool)
+
+	case code.Otherwise:
+		// Only match if the matched flag is false.
+		t.Push(!t.matched)
+
+	case code.Getfilename:
+		t.Push(v.input.Filename)
+
+	case code.Getsourcehost:
+		t.Push(v.input.SourceHost)
+
+	case code.Linelen:
+		t.Push(int64(len(v.input.Line)))
+
+	case code.Kvgauges:
+		// Set the gauge below the line below TOS to the value of each
+		// key=value pair in the line with a numeric value, by key.  Keys not
+		// already in the gauge are dropped once it has the number of keys at
+		// TOS.
+		v.lockDatums(t)
+		max, err := t.PopInt()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		if max <= 0 {
+			v.errorf("kv_gauges max keys must be positive, not %d", max)
+			return
+		}
+		line, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		m := t.Pop().(*metrics.Metric)
+		ts := t.time
+		if ts.IsZero() {
+			ts = v.clock.Now()
+		}
+		for _, p := range logfmtPairs(line) {
+			f, err := strconv.ParseFloat(p.value, 64)
+			if err != nil {
+				continue
+			}
+			m.RLock()
+			full := m.FindLabelValueOrNil([]string{p.key}) == nil && int64(len(m.LabelValues)) >= max
+			m.RUnlock()
+			if full {
+				kvGaugesDropped.Add(v.name, 1)
+				continue
+			}
+			d, err := m.GetDatum(p.key)
+			if err != nil {
+				v.errorf("%+v", err)
+				return
+			}
+			datum.SetFloat(d, f, ts)
+		}
+
+	case code.Expbucket:
+		// Replace the value below the base at TOS with the index of its
+		// exponential bucket.
+		base, err := t.PopFloat()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		x, err := t.PopFloat()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		if !(base > 1) || math.IsInf(base, 0) {
+			v.errorf("exp_bucket base must be greater than 1, not %g", base)
+			return
+		}
+		if !(x > 0) || math.IsInf(x, 0) {
+			v.errorf("exp_bucket value must be positive, not %g", x)
+			return
+		}
+		t.Push(expBucket(x, base))
+
+	case code.Progver:
+		t.Push(v.version)
+
+	case code.Getmeta:
+		// Replace the key at TOS with its value in the host metadata, or
+		// the empty string if it has none.
+		key, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		t.Push(v.metadata[key])
+
+	case code.Parsedur:
+		// Parse a Go duration string from TOS, and push the seconds back as a float.
+		s, err := t.PopString()
+		if err != nil {
+			v.errorf("%+v", err)
+			return
+		}
+		// A bad duration is counted as an error, but is taken as zero so the
+		// rest of the line is still processed.
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			v.warnf("%s", err)
+		}
+		t.Push(d.Seconds())
+
+	case code.Cat:
+		b, berr := t.PopString()
+		if berr != nil {
+			v.errorf("%+v", berr)
+			return
+		}
+		a, aerr := t.PopString()
+		if aerr != nil {
+			v.errorf("%+v", aerr)
+			return
+		}
+		t.Push(a + b)
+
+	default:
+		v.errorf("illegal instruction: %d", i.Opcode)
+	}
+}
+
+// ProcessLogLine handles the incoming lines by running a fetch-execute cycle
+// on the VM bytecode with the line as input to the program, until termination.
+func (v *VM) ProcessLogLine(ctx context.Context, line *logline.LogLine) {
+	bytesProcessed.Add(v.name, int64(len(line.Line)))
+	if v.warmup > 0 && v.clock.Now().Sub(v.started) < v.warmup {
+		warmupSkipped.Add(v.name, 1)
+		// The line was deliberately skipped, so it isn't a dead letter.
+		if v.lineDone != nil {
+			v.lineDone(line, true)
+		}
+		return
+	}
+	v.sweepRemovedDatums(v.clock.Now())
+	start := time.Now()
+	t := new(thread)
+	defer func() {
+		t.unlock()
+		lineProcessingDurations.WithLabelValues(v.name).Observe(time.Since(start).Seconds())
+		if v.lineDone != nil {
+			v.lineDone(line, t.hit)
+		}
+	}()
+	t.matched = false
+	v.t = t
+	v.input = line
+	t.stack = make([]interface{}, 0)
+	t.matches = make(map[int][]string, len(v.re))
+	for {
+		if t.pc >= len(v.prog) {
+			return
+		}
+		i := v.prog[t.pc]
+		t.pc++
+		v.execute(t, i)
+		if t.locked != nil && releasesDatum(i.Opcode) {
+			t.unlock()
+		}
+		if v.terminate {
+			// Terminate only stops this invocation on this line of input; reset the terminate flag.
+			v.terminate = false
+			return
+		}
+	}
+}
+
+// forgetDatum removes the state kept by builtins for d.
+func (v *VM) forgetDatum(d datum.Datum) {
+	delete(v.sketches, d)
+	delete(v.windows, d)
+	delete(v.rates, d)
+	delete(v.seen, d)
+}
+
+// sweepRemovedDatums forgets the state kept by builtins for datums no longer in
+// any of the program's metrics, such as those removed by expiry, if it hasn't
+// done so in the last datumSweepInterval.
+func (v *VM) sweepRemovedDatums(now time.Time) {
+	if now.Sub(v.datumsSwept) < datumSweepInterval || len(v.sketches)+len(v.windows)+len(v.rates)+len(v.seen) == 0 {
+		return
+	}
+	v.datumsSwept = now
+	live := make(map[datum.Datum]bool)
+	for _, m := range v.m {
+		m.RLock()
+		for _, lv := range m.LabelValues {
+			live[lv.Value] = true
+		}
+		m.RUnlock()
+	}
+	for d := range v.sketches {
+		if !live[d] {
+			v.forgetDatum(d)
+		}
+	}
+	for d := range v.windows {
+		if !live[d] {
+			v.forgetDatum(d)
+		}
+	}
+	for d := range v.rates {
+		if !live[d] {
+			v.forgetDatum(d)
+		}
+	}
+	for d := range v.seen {
+		if !live[d] {
+			v.forgetDatum(d)
+		}
+	}
+}
+
+// New creates a new virtual machine with the given name, and compiler
+// artifacts for executable and data segments.
+func New(name string, obj *object.Object, syslogUseCurrentYear bool, loc *time.Location) *VM {
+	var regexSets []*regexSet
+	for _, res := range obj.RegexSets {
+		rs, err := newRegexSet(res)
+		if err != nil {
+			// The patterns have already been compiled by codegen.
+			panic(fmt.Sprintf("internal error: can't build regexset: %s", err))
+		}
+		regexSets = append(regexSets, rs)
+	}
+	v := &VM{
+		name:                 name,
 		re:                   obj.Regexps,
 		str:                  obj.Strings,
 		m:                    obj.Metrics,
+		tables:               obj.Tables,
+		regexSets:            regexSets,
 		prog:                 obj.Program,
 		timeMemos:            lru.New(64),
+		lastValues:           make(map[string]string),
+		firstSeen:            make(map[string]time.Time),
+		lastMatched:          make(map[string]time.Time),
+		fileSets:             make(map[string]*fileSet),
+		sketches:             make(map[datum.Datum]*hll),
+		windows:              make(map[datum.Datum]*movingWindow),
+		rates:                make(map[datum.Datum]*rateWindow),
+		topKs:                make(map[*metrics.Metric]*topKSummary),
+		bucketLists:          make(map[string]*bucketList),
+		seen:                 make(map[datum.Datum]time.Time),
 		syslogUseCurrentYear: syslogUseCurrentYear,
 		loc:                  loc,
+		timestampFallback:    obj.TimestampFallback,
+		fieldSeparator:       obj.FieldSeparator,
+		warmup:               obj.Warmup,
+		version:              obj.Version,
+		obj:                  obj,
+		clock:                systemClock{},
+		runtimeErrorLimit:    newRuntimeErrorLimiter(*runtimeErrorLogInterval),
+		logRuntimeError:      func(s string) { glog.Info(s) },
+	}
+	// The Loader replaces this with its own start time, so that reloading a
+	// program doesn't warm it up again.
+	v.started = v.clock.Now()
+	return v
+}
+
+// clone returns a new virtual machine running the same program as v, which
+// shares its metrics and the locks on their datums, but none of the state kept
+// by its builtins.  v must not be running yet.
+func (v *VM) clone() *VM {
+	if v.datumLock == nil {
+		v.datumLock = new(sync.Mutex)
+	}
+	c := New(v.name, v.obj, v.syslogUseCurrentYear, v.loc)
+	c.lineDone = v.lineDone
+	c.metadata = v.metadata
+	c.started = v.started
+	c.datumLock = v.datumLock
+	return c
+}
+
+// statefulBuiltins are the builtins that keep state in the VM, by the opcode
+// they compile to, which would be wrong if split across several VMs.
+var statefulBuiltins = map[code.Opcode]string{
+	code.Aftergap:   "after_gap",
+	code.Approxdist: "approx_distinct",
+	code.Changed:    "changed",
+	code.Firstseen:  "first_seen",
+	code.Markseen:   "mark_seen",
+	code.Movingavg:  "moving_avg",
+	code.Rate:       "rate",
+	code.Sinceseen:  "since_seen",
+	code.Topk:       "top_k",
+}
+
+// statefulBuiltin returns the name of a builtin used by the program of v that
+// keeps state in the VM, or the empty string if there is none.
+func (v *VM) statefulBuiltin() string {
+	for _, i := range v.prog {
+		if name, ok := statefulBuiltins[i.Opcode]; ok {
+			return name
+		}
 	}
+	return ""
 }
 
 // DumpByteCode emits the program disassembly and program objects to a string.
@@ -10,6 +10,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/mtail/internal/logline"
 	"github.com/google/mtail/internal/metrics"
@@ -936,6 +937,1281 @@ a
 			},
 		},
 	},
+	{"parse-duration",
+		`gauge latency
+
+/latency=(\S+)/ {
+    latency = parse_duration($1)
+}
+`, `latency=1.5s
+latency=bogus
+`, 1,
+		metrics.MetricSlice{
+			{
+				Name:    "latency",
+				Program: "parse-duration",
+				Kind:    metrics.Gauge,
+				Type:    metrics.Float,
+				Keys:    []string{},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{},
+						Value:  &datum.Float{Valuebits: math.Float64bits(0)},
+					},
+				},
+			},
+		},
+	},
+	{"base64decode",
+		`counter status by code
+
+/payload=(\S+)/ {
+    status[base64decode($1)]++
+}
+`, `payload=NTAz
+payload=!!!
+payload=NTAz
+`, 0,
+		metrics.MetricSlice{
+			{
+				Name:    "status",
+				Program: "base64decode",
+				Kind:    metrics.Counter,
+				Type:    metrics.Int,
+				Keys:    []string{"code"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"503"},
+						Value:  &datum.Int{Value: 2},
+					},
+					{
+						Labels: []string{""},
+						Value:  &datum.Int{Value: 1},
+					},
+				},
+			},
+		},
+	},
+	{"changed",
+		`counter transitions by breaker
+
+/breaker=(?P<name>\w+) state=(?P<state>\w+)/ {
+    changed($name, $state) {
+        transitions[$name]++
+    }
+}
+`, `breaker=db state=open
+breaker=db state=open
+breaker=db state=closed
+breaker=db state=closed
+breaker=db state=open
+`, 0,
+		metrics.MetricSlice{
+			{
+				Name:    "transitions",
+				Program: "changed",
+				Kind:    metrics.Counter,
+				Type:    metrics.Int,
+				Keys:    []string{"breaker"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"db"},
+						Value:  &datum.Int{Value: 2},
+					},
+				},
+			},
+		},
+	},
+	{"lookup",
+		`counter requests by class
+
+table status_names {
+    "200": "success",
+    "301": "redirect",
+    "404": "client_error",
+}
+
+/status=(?P<code>\S+)/ {
+    requests[lookup(status_names, $code, "unknown")]++
+}
+`, `status=200
+status=404
+status=200
+status=999
+`, 0,
+		metrics.MetricSlice{
+			{
+				Name:    "requests",
+				Program: "lookup",
+				Kind:    metrics.Counter,
+				Type:    metrics.Int,
+				Keys:    []string{"class"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"success"},
+						Value:  &datum.Int{Value: 2},
+					},
+					{
+						Labels: []string{"client_error"},
+						Value:  &datum.Int{Value: 1},
+					},
+					{
+						Labels: []string{"unknown"},
+						Value:  &datum.Int{Value: 1},
+					},
+				},
+			},
+		},
+	},
+	{"exemplar_inc",
+		`counter requests_total
+
+/^(?P<t>\d+) trace=(?P<trace>\S*)$/ {
+    settime($t)
+    exemplar_inc(requests_total, $trace)
+}
+`, `1000 trace=4bf92f3577b34da6
+1010 trace=00f067aa0ba902b7
+1020 trace=
+`, 0,
+		metrics.MetricSlice{
+			{
+				Name:    "requests_total",
+				Program: "exemplar_inc",
+				Kind:    metrics.Counter,
+				Type:    metrics.Int,
+				Keys:    []string{},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Value: &datum.Int{
+							BaseDatum: datum.BaseDatum{Exemplar: &datum.Exemplar{TraceID: "00f067aa0ba902b7", Value: 1, Time: time.Unix(1010, 0)}},
+							Value:     3,
+						},
+					},
+				},
+			},
+		},
+	},
+	{"decay_set",
+		`gauge activity
+
+/^(?P<t>\d+) (?P<v>\d+)$/ {
+    settime($t)
+    decay_set(activity, $v, 10)
+}
+`, `1000 100
+1010 0
+1020 25
+`, 0,
+		metrics.MetricSlice{
+			{
+				Name:    "activity",
+				Program: "decay_set",
+				Kind:    metrics.Gauge,
+				Type:    metrics.Float,
+				Keys:    []string{},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{},
+						Value:  &datum.Float{Valuebits: math.Float64bits(50), HalfLife: int64(10 * time.Second)},
+					},
+				},
+			},
+		},
+	},
+	{"moving_avg",
+		`gauge throughput by host
+
+/^(?P<t>\d+) (?P<host>\S+) (?P<bytes>\d+)$/ {
+    settime($t)
+    moving_avg(throughput[$host], $bytes, 60)
+}
+`, `1000 a 100
+1000 b 10
+1030 a 200
+1061 a 600
+1090 b 20
+`, 0,
+		metrics.MetricSlice{
+			{
+				Name:    "throughput",
+				Program: "moving_avg",
+				Kind:    metrics.Gauge,
+				Type:    metrics.Float,
+				Keys:    []string{"host"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"a"},
+						Value:  &datum.Float{Valuebits: math.Float64bits(400)},
+					},
+					{
+						Labels: []string{"b"},
+						Value:  &datum.Float{Valuebits: math.Float64bits(20)},
+					},
+				},
+			},
+		},
+	},
+	{"rate",
+		`counter requests_total by host
+gauge requests_per_second by host
+
+/^(?P<t>\d+) (?P<host>\S+) (?P<count>\d+)$/ {
+    settime($t)
+    requests_total[$host] = $count
+    requests_per_second[$host] = rate(requests_total[$host], 60)
+}
+`, `1000 a 0
+1000 c 100
+1010 a 50
+1010 c 200
+1020 a 100
+1020 c 5
+1030 a 10
+1040 a 60
+1090 b 10
+1100 b 30
+`, 0,
+		metrics.MetricSlice{
+			{
+				Name:    "requests_total",
+				Program: "rate",
+				Kind:    metrics.Counter,
+				Type:    metrics.Int,
+				Keys:    []string{"host"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"a"},
+						Value:  &datum.Int{Value: 60},
+					},
+					{
+						Labels: []string{"c"},
+						Value:  &datum.Int{Value: 5},
+					},
+					{
+						Labels: []string{"b"},
+						Value:  &datum.Int{Value: 30},
+					},
+				},
+			},
+			{
+				Name:    "requests_per_second",
+				Program: "rate",
+				Kind:    metrics.Gauge,
+				Type:    metrics.Float,
+				Keys:    []string{"host"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"a"},
+						Value:  &datum.Float{Valuebits: math.Float64bits(3.75)},
+					},
+					{
+						Labels: []string{"c"},
+						Value:  &datum.Float{Valuebits: math.Float64bits(5)},
+					},
+					{
+						Labels: []string{"b"},
+						Value:  &datum.Float{Valuebits: math.Float64bits(2)},
+					},
+				},
+			},
+		},
+	},
+	{"top_k",
+		`gauge requests by path
+
+/^GET (?P<path>\S+)$/ {
+    top_k(requests, $path, 3)
+}
+`, strings.Repeat("GET /a\nGET /a\nGET /a\nGET /b\nGET /b\nGET /c\n", 10) + "GET /d\nGET /e\nGET /f\nGET /g\nGET /h\nGET /i\nGET /j\nGET /k\n", 0,
+		metrics.MetricSlice{
+			{
+				Name:    "requests",
+				Program: "top_k",
+				Kind:    metrics.Gauge,
+				Type:    metrics.Int,
+				Keys:    []string{"path"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"/a"},
+						Value:  &datum.Int{Value: 30},
+					},
+					{
+						Labels: []string{"(other)"},
+						Value:  &datum.Int{Value: 8},
+					},
+					{
+						Labels: []string{"/b"},
+						Value:  &datum.Int{Value: 20},
+					},
+					{
+						Labels: []string{"/c"},
+						Value:  &datum.Int{Value: 10},
+					},
+				},
+			},
+		},
+	},
+	{"kv_gauges",
+		`gauge stats by key
+
+/^stats (?P<pairs>.*)$/ {
+    kv_gauges(stats, $pairs, 3)
+}
+`, "stats cpu=0.5 mem=128 host=web1\nstats cpu=0.75 msg=\"a b=2\" disk=7 net=9\n", 0,
+		metrics.MetricSlice{
+			{
+				Name:    "stats",
+				Program: "kv_gauges",
+				Kind:    metrics.Gauge,
+				Type:    metrics.Float,
+				Keys:    []string{"key"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"cpu"},
+						Value:  &datum.Float{Valuebits: math.Float64bits(0.75)},
+					},
+					{
+						Labels: []string{"mem"},
+						Value:  &datum.Float{Valuebits: math.Float64bits(128)},
+					},
+					{
+						Labels: []string{"disk"},
+						Value:  &datum.Float{Valuebits: math.Float64bits(7)},
+					},
+				},
+			},
+		},
+	},
+	{"set_info",
+		`gauge build_info by version, commit
+
+/^starting version=(?P<version>\S+) commit=(?P<commit>\w+)$/ {
+    set_info(build_info[$version, $commit])
+}
+`, "starting version=1.0 commit=a1b2c3\nserving\nstarting version=1.1 commit=d4e5f6\n", 0,
+		metrics.MetricSlice{
+			{
+				Name:    "build_info",
+				Program: "set_info",
+				Kind:    metrics.Gauge,
+				Type:    metrics.Int,
+				Keys:    []string{"version", "commit"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"1.1", "d4e5f6"},
+						Value:  &datum.Int{Value: 1},
+					},
+				},
+			},
+		},
+	},
+	{"approx_distinct",
+		`gauge users by minute
+
+/^(?P<minute>\d+:\d+) user=(?P<user>\w+)$/ {
+    approx_distinct(users[$minute], $user)
+}
+`, `00:01 user=alice
+00:01 user=bob
+00:01 user=alice
+00:02 user=alice
+`, 0,
+		metrics.MetricSlice{
+			{
+				Name:    "users",
+				Program: "approx_distinct",
+				Kind:    metrics.Gauge,
+				Type:    metrics.Int,
+				Keys:    []string{"minute"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"00:01"},
+						Value:  &datum.Int{Value: 2},
+					},
+					{
+						Labels: []string{"00:02"},
+						Value:  &datum.Int{Value: 1},
+					},
+				},
+			},
+		},
+	},
+	{"field",
+		`counter requests by method
+counter users by role
+
+/^(?P<request>\S+ \S+ \S+)$/ {
+    requests[field($request, 2)]++
+}
+/^(?P<user>.*,.*)$/ {
+    users[field($user, 2, ",")]++
+}
+`, `10.0.0.1 GET /index.html
+10.0.0.2 POST /api
+10.0.0.1 GET /api
+alice,admin
+bob,user
+carol,admin
+`, 0,
+		metrics.MetricSlice{
+			{
+				Name:    "requests",
+				Program: "field",
+				Kind:    metrics.Counter,
+				Type:    metrics.Int,
+				Keys:    []string{"method"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"GET"},
+						Value:  &datum.Int{Value: 2},
+					},
+					{
+						Labels: []string{"POST"},
+						Value:  &datum.Int{Value: 1},
+					},
+				},
+			},
+			{
+				Name:    "users",
+				Program: "field",
+				Kind:    metrics.Counter,
+				Type:    metrics.Int,
+				Keys:    []string{"role"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"admin"},
+						Value:  &datum.Int{Value: 2},
+					},
+					{
+						Labels: []string{"user"},
+						Value:  &datum.Int{Value: 1},
+					},
+				},
+			},
+		},
+	},
+	{"csv_field",
+		`counter actions by action
+
+/^(?P<record>.*)$/ {
+    actions[csv_field($record, 3)]++
+}
+`, `2021-03-01T10:00:00Z,"Smith, Alice",login
+2021-03-01T10:05:00Z,"Jones, ""Bob""",login
+2021-03-01T10:07:00Z,"Smith, Alice",logout
+`, 0,
+		metrics.MetricSlice{
+			{
+				Name:    "actions",
+				Program: "csv_field",
+				Kind:    metrics.Counter,
+				Type:    metrics.Int,
+				Keys:    []string{"action"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"login"},
+						Value:  &datum.Int{Value: 2},
+					},
+					{
+						Labels: []string{"logout"},
+						Value:  &datum.Int{Value: 1},
+					},
+				},
+			},
+		},
+	},
+	{"url_host",
+		`counter upstream_requests by upstream
+
+/upstream=(?P<upstream>\S+)/ {
+    upstream_requests[url_host($upstream)]++
+}
+`, `upstream=https://api.example.com:443/v1/users
+upstream=api.example.com:8443
+`, 0,
+		metrics.MetricSlice{
+			{
+				Name:    "upstream_requests",
+				Program: "url_host",
+				Kind:    metrics.Counter,
+				Type:    metrics.Int,
+				Keys:    []string{"upstream"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"api.example.com"},
+						Value:  &datum.Int{Value: 2},
+					},
+				},
+			},
+		},
+	},
+	{"ratio updated by other patterns",
+		`counter lookups_total
+counter hits_total
+gauge hit_ratio
+
+/^start$/ {
+    ratio(hit_ratio, hits_total, lookups_total)
+}
+/^hit$/ {
+    lookups_total++
+    hits_total++
+}
+/^miss$/ {
+    lookups_total++
+}
+`, `start
+hit
+miss
+miss
+hit
+`, 0,
+		metrics.MetricSlice{
+			{
+				Name:        "lookups_total",
+				Program:     "ratio updated by other patterns",
+				Kind:        metrics.Counter,
+				Type:        metrics.Int,
+				Keys:        []string{},
+				LabelValues: []*metrics.LabelValue{{Value: &datum.Int{Value: 4}}},
+			},
+			{
+				Name:        "hits_total",
+				Program:     "ratio updated by other patterns",
+				Kind:        metrics.Counter,
+				Type:        metrics.Int,
+				Keys:        []string{},
+				LabelValues: []*metrics.LabelValue{{Value: &datum.Int{Value: 2}}},
+			},
+			{
+				Name:        "hit_ratio",
+				Program:     "ratio updated by other patterns",
+				Kind:        metrics.Gauge,
+				Type:        metrics.Float,
+				Keys:        []string{},
+				LabelValues: []*metrics.LabelValue{{Value: &datum.Float{Valuebits: math.Float64bits(0.5)}}},
+			},
+		},
+	},
+	{"ratio",
+		`counter requests_total by endpoint
+counter errors_total by endpoint
+gauge error_ratio by endpoint
+
+/^(?P<endpoint>\S+) (?P<status>\d+)$/ {
+    requests_total[$endpoint]++
+    $status >= 500 {
+        errors_total[$endpoint]++
+    }
+    ratio(error_ratio, errors_total, requests_total)
+}
+`, `/a 200
+/a 500
+/a 200
+/a 503
+/b 200
+`, 0,
+		metrics.MetricSlice{
+			{
+				Name:    "requests_total",
+				Program: "ratio",
+				Kind:    metrics.Counter,
+				Type:    metrics.Int,
+				Keys:    []string{"endpoint"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"/a"},
+						Value:  &datum.Int{Value: 4},
+					},
+					{
+						Labels: []string{"/b"},
+						Value:  &datum.Int{Value: 1},
+					},
+				},
+			},
+			{
+				Name:    "errors_total",
+				Program: "ratio",
+				Kind:    metrics.Counter,
+				Type:    metrics.Int,
+				Keys:    []string{"endpoint"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"/a"},
+						Value:  &datum.Int{Value: 2},
+					},
+				},
+			},
+			{
+				Name:    "error_ratio",
+				Program: "ratio",
+				Kind:    metrics.Gauge,
+				Type:    metrics.Float,
+				Keys:    []string{"endpoint"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"/a"},
+						Value:  &datum.Float{Valuebits: math.Float64bits(0.5)},
+					},
+					{
+						Labels: []string{"/b"},
+						Value:  &datum.Float{Valuebits: math.Float64bits(0)},
+					},
+				},
+			},
+		},
+	},
+	{"first_seen",
+		`counter new_clients
+
+/client=(?P<client>\w+)/ {
+    first_seen($client) {
+        new_clients++
+    }
+}
+`, `client=a
+client=b
+client=a
+client=c
+`, 0,
+		metrics.MetricSlice{
+			{
+				Name:    "new_clients",
+				Program: "first_seen",
+				Kind:    metrics.Counter,
+				Type:    metrics.Int,
+				Keys:    []string{},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Value: &datum.Int{Value: 3},
+					},
+				},
+			},
+		},
+	},
+	{"strip_ansi",
+		`counter errors by device
+
+/^(?P<line>.*)$/ {
+    strip_ansi($line) =~ /^ERROR disk (?P<device>\S+) full$/ {
+        errors[$device]++
+    }
+}
+`, "\x1b[1;31mERROR\x1b[0m disk \x1b[4msda\x1b[0m full\nERROR disk sda full\nERROR disk sdb full\n", 0,
+		metrics.MetricSlice{
+			{
+				Name:    "errors",
+				Program: "strip_ansi",
+				Kind:    metrics.Counter,
+				Type:    metrics.Int,
+				Keys:    []string{"device"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"sda"},
+						Value:  &datum.Int{Value: 2},
+					},
+					{
+						Labels: []string{"sdb"},
+						Value:  &datum.Int{Value: 1},
+					},
+				},
+			},
+		},
+	},
+	{"observe",
+		`histogram latency_ms
+histogram latency_by_code_ms by code
+
+/^(?P<code>\d{3}) (?P<latency>\d+)ms$/ {
+    observe(latency_ms, $latency)
+    observe(latency_by_code_ms[$code], $latency)
+}
+`, "200 10ms\n200 20ms\n500 60ms\n", 0,
+		metrics.MetricSlice{
+			{
+				Name:    "latency_ms",
+				Program: "observe",
+				Kind:    metrics.Histogram,
+				Type:    metrics.Buckets,
+				Keys:    []string{},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{},
+						Value: &datum.Buckets{
+							Buckets: []datum.BucketCount{{Range: datum.Range{Min: 0, Max: math.Inf(+1)}, Count: 3}},
+							Count:   3,
+							Sum:     90,
+						},
+					},
+				},
+			},
+			{
+				Name:    "latency_by_code_ms",
+				Program: "observe",
+				Kind:    metrics.Histogram,
+				Type:    metrics.Buckets,
+				Keys:    []string{"code"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"200"},
+						Value: &datum.Buckets{
+							Buckets: []datum.BucketCount{{Range: datum.Range{Min: 0, Max: math.Inf(+1)}, Count: 2}},
+							Count:   2,
+							Sum:     30,
+						},
+					},
+					{
+						Labels: []string{"500"},
+						Value: &datum.Buckets{
+							Buckets: []datum.BucketCount{{Range: datum.Range{Min: 0, Max: math.Inf(+1)}, Count: 1}},
+							Count:   1,
+							Sum:     60,
+						},
+					},
+				},
+			},
+		},
+	},
+	{"observe_seconds",
+		`histogram nginx_request_time_seconds buckets 0.1, 1, 10
+
+/ (?P<request_time>\S+)$/ {
+    observe_seconds(nginx_request_time_seconds, $request_time)
+}
+`, "GET /index.html 200 0.123\nGET /report 200 1.500\nGET /health 499 -\n", 0,
+		metrics.MetricSlice{
+			{
+				Name:    "nginx_request_time_seconds",
+				Program: "observe_seconds",
+				Kind:    metrics.Histogram,
+				Type:    metrics.Buckets,
+				Keys:    []string{},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Value: &datum.Buckets{
+							Buckets: []datum.BucketCount{
+								{Range: datum.Range{Min: 0, Max: 0.1}, Count: 0},
+								{Range: datum.Range{Min: 0.1, Max: 1}, Count: 1},
+								{Range: datum.Range{Min: 1, Max: 10}, Count: 1},
+								{Range: datum.Range{Min: 10, Max: math.Inf(+1)}, Count: 0},
+							},
+							Count: 2,
+							Sum:   1.623,
+						},
+					},
+				},
+				Buckets: []datum.Range{{Min: 0, Max: 0.1}, {Min: 0.1, Max: 1}, {Min: 1, Max: 10}, {Min: 10, Max: math.Inf(+1)}},
+			},
+		},
+	},
+	{"merge_buckets",
+		`histogram request_latency_ms buckets 10, 100
+
+/^latency_buckets=(?P<buckets>\S+) sum=(?P<sum>\S+)$/ {
+    merge_buckets(request_latency_ms, $buckets, $sum)
+}
+`, "latency_buckets=10:3,100:1 sum=64\nlatency_buckets=10:1,100:2,+Inf:1 sum=1250.5\n", 0,
+		metrics.MetricSlice{
+			{
+				Name:    "request_latency_ms",
+				Program: "merge_buckets",
+				Kind:    metrics.Histogram,
+				Type:    metrics.Buckets,
+				Keys:    []string{},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Value: &datum.Buckets{
+							Buckets: []datum.BucketCount{
+								{Range: datum.Range{Min: 0, Max: 10}, Count: 4},
+								{Range: datum.Range{Min: 10, Max: 100}, Count: 3},
+								{Range: datum.Range{Min: 100, Max: math.Inf(+1)}, Count: 1},
+							},
+							Count: 8,
+							Sum:   1314.5,
+						},
+					},
+				},
+				Buckets: []datum.Range{{Min: 0, Max: 10}, {Min: 10, Max: 100}, {Min: 100, Max: math.Inf(+1)}},
+			},
+		},
+	},
+	{"bucketize",
+		`counter requests by speed
+
+/^latency=(?P<latency>\S+)$/ {
+    requests[bucketize($latency, "0.1,1", "fast,ok,slow")]++
+}
+`, "latency=0.02\nlatency=0.1\nlatency=0.5\nlatency=3\nlatency=0.099\n", 0,
+		metrics.MetricSlice{
+			{
+				Name:    "requests",
+				Program: "bucketize",
+				Kind:    metrics.Counter,
+				Type:    metrics.Int,
+				Keys:    []string{"speed"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"fast"},
+						Value:  &datum.Int{Value: 2},
+					},
+					{
+						Labels: []string{"ok"},
+						Value:  &datum.Int{Value: 2},
+					},
+					{
+						Labels: []string{"slow"},
+						Value:  &datum.Int{Value: 1},
+					},
+				},
+			},
+		},
+	},
+	{"loglevel",
+		`counter log_lines by level
+
+/^(?P<line>.*)$/ {
+    log_lines[loglevel($line)]++
+}
+`, "[ERROR] disk full\nlevel=warn msg=slow\nWARNING: disk 90% full\nINFO started\nGET /index.html 200\n", 0,
+		metrics.MetricSlice{
+			{
+				Name:    "log_lines",
+				Program: "loglevel",
+				Kind:    metrics.Counter,
+				Type:    metrics.Int,
+				Keys:    []string{"level"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"error"},
+						Value:  &datum.Int{Value: 1},
+					},
+					{
+						Labels: []string{"warning"},
+						Value:  &datum.Int{Value: 2},
+					},
+					{
+						Labels: []string{"info"},
+						Value:  &datum.Int{Value: 1},
+					},
+					{
+						Labels: []string{""},
+						Value:  &datum.Int{Value: 1},
+					},
+				},
+			},
+		},
+	},
+	{"query_param",
+		`counter requests by action
+
+/^GET (?P<url>\S+)$/ {
+    requests[query_param($url, "action")]++
+}
+`, "GET /cart?action=checkout&user=1\nGET /cart?user=2&action=checkout\nGET /cart?action=add%20item\nGET /cart\n", 0,
+		metrics.MetricSlice{
+			{
+				Name:    "requests",
+				Program: "query_param",
+				Kind:    metrics.Counter,
+				Type:    metrics.Int,
+				Keys:    []string{"action"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"checkout"},
+						Value:  &datum.Int{Value: 2},
+					},
+					{
+						Labels: []string{"add item"},
+						Value:  &datum.Int{Value: 1},
+					},
+					{
+						Labels: []string{""},
+						Value:  &datum.Int{Value: 1},
+					},
+				},
+			},
+		},
+	},
+	{"guarded add of string capture",
+		`counter bytes
+counter requests
+
+/^(?P<status>\d{3}) (?P<size>\S+)$/ {
+    requests++
+    $status == 200 {
+        bytes += $size
+    }
+}
+`, "200 1024\n404 -\n200 512\n500 error\n", 0,
+		metrics.MetricSlice{
+			{
+				Name:    "bytes",
+				Program: "guarded add of string capture",
+				Kind:    metrics.Counter,
+				Type:    metrics.Int,
+				Keys:    []string{},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Value: &datum.Int{Value: 1536},
+					},
+				},
+			},
+			{
+				Name:    "requests",
+				Program: "guarded add of string capture",
+				Kind:    metrics.Counter,
+				Type:    metrics.Int,
+				Keys:    []string{},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Value: &datum.Int{Value: 4},
+					},
+				},
+			},
+		},
+	},
+	{"syslog_pri",
+		`counter messages by facility, severity
+
+/^(?P<line>.*)$/ {
+    messages[syslog_pri($line, "facility"), syslog_pri($line, "severity")]++
+}
+`, "<134>Oct 11 22:14:15 web1 app: started\nOct 11 22:14:16 web1 app: no priority\n", 0,
+		metrics.MetricSlice{
+			{
+				Name:    "messages",
+				Program: "syslog_pri",
+				Kind:    metrics.Counter,
+				Type:    metrics.Int,
+				Keys:    []string{"facility", "severity"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"local0", "info"},
+						Value:  &datum.Int{Value: 1},
+					},
+					{
+						Labels: []string{"", ""},
+						Value:  &datum.Int{Value: 1},
+					},
+				},
+			},
+		},
+	},
+	{"status_class",
+		`counter requests by class
+
+/ (?P<status>\d+)$/ {
+    requests[status_class($status)]++
+}
+`, "GET / 200\nGET /missing 404\nGET /index.html 204\nGET /api 503\nGET /odd 999\n", 0,
+		metrics.MetricSlice{
+			{
+				Name:    "requests",
+				Program: "status_class",
+				Kind:    metrics.Counter,
+				Type:    metrics.Int,
+				Keys:    []string{"class"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"2xx"},
+						Value:  &datum.Int{Value: 2},
+					},
+					{
+						Labels: []string{"4xx"},
+						Value:  &datum.Int{Value: 1},
+					},
+					{
+						Labels: []string{"5xx"},
+						Value:  &datum.Int{Value: 1},
+					},
+					{
+						Labels: []string{"unknown"},
+						Value:  &datum.Int{Value: 1},
+					},
+				},
+			},
+		},
+	},
+	{"bucket_hash",
+		`counter requests by shard
+
+/user=(?P<user>\w+)/ {
+    requests[bucket_hash($user, 4)]++
+}
+`, "user=alice\nuser=bob\nuser=carol\nuser=alice\n", 0,
+		metrics.MetricSlice{
+			{
+				Name:    "requests",
+				Program: "bucket_hash",
+				Kind:    metrics.Counter,
+				Type:    metrics.Int,
+				Keys:    []string{"shard"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"3"},
+						Value:  &datum.Int{Value: 2},
+					},
+					{
+						Labels: []string{"0"},
+						Value:  &datum.Int{Value: 1},
+					},
+					{
+						Labels: []string{"2"},
+						Value:  &datum.Int{Value: 1},
+					},
+				},
+			},
+		},
+	},
+	{"reset on restart",
+		`counter requests by code
+counter errors
+counter restarts
+
+/code=(?P<code>\d+)/ {
+    requests[$code]++
+    errors++
+}
+
+/service restarted/ {
+    reset(requests)
+    reset(errors)
+}
+/restart/ {
+    restarts++
+}
+`, "code=200\ncode=500\ncode=200\nservice restarted\ncode=200\n", 0,
+		metrics.MetricSlice{
+			{
+				Name:    "requests",
+				Program: "reset on restart",
+				Kind:    metrics.Counter,
+				Type:    metrics.Int,
+				Keys:    []string{"code"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"200"},
+						Value:  &datum.Int{Value: 1},
+					},
+					{
+						Labels: []string{"500"},
+						Value:  &datum.Int{Value: 0},
+					},
+				},
+			},
+			{
+				Name:    "errors",
+				Program: "reset on restart",
+				Kind:    metrics.Counter,
+				Type:    metrics.Int,
+				Keys:    []string{},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Value: &datum.Int{Value: 1},
+					},
+				},
+			},
+			{
+				Name:    "restarts",
+				Program: "reset on restart",
+				Kind:    metrics.Counter,
+				Type:    metrics.Int,
+				Keys:    []string{},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Value: &datum.Int{Value: 1},
+					},
+				},
+			},
+		},
+	},
+	{"matches_any",
+		`counter errors
+counter ok
+
+regexset failures {
+    /timeout/,
+    /status=5\d\d/,
+    /\bpanic\b/,
+}
+
+/^(?P<line>.*)$/ {
+    matches_any($line, failures) {
+        errors++
+    } else {
+        ok++
+    }
+}
+`, `GET / status=200
+GET /slow status=200 timeout
+GET /broken status=503
+worker panic: nil map
+`, 0,
+		metrics.MetricSlice{
+			{
+				Name:        "errors",
+				Program:     "matches_any",
+				Kind:        metrics.Counter,
+				Type:        metrics.Int,
+				Keys:        []string{},
+				LabelValues: []*metrics.LabelValue{{Value: &datum.Int{Value: 3}}},
+			},
+			{
+				Name:        "ok",
+				Program:     "matches_any",
+				Kind:        metrics.Counter,
+				Type:        metrics.Int,
+				Keys:        []string{},
+				LabelValues: []*metrics.LabelValue{{Value: &datum.Int{Value: 1}}},
+			},
+		},
+	},
+	{"pragma case_insensitive",
+		`pragma case_insensitive
+counter method by verb
+
+/(?P<verb>get|post) / {
+    method[$verb]++
+}
+`, `GET /
+get /
+Post /
+`, 0,
+		metrics.MetricSlice{
+			{
+				Name:    "method",
+				Program: "pragma case_insensitive",
+				Kind:    metrics.Counter,
+				Type:    metrics.Int,
+				Keys:    []string{"verb"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"GET"},
+						Value:  &datum.Int{Value: 1},
+					},
+					{
+						Labels: []string{"get"},
+						Value:  &datum.Int{Value: 1},
+					},
+					{
+						Labels: []string{"Post"},
+						Value:  &datum.Int{Value: 1},
+					},
+				},
+			},
+		},
+	},
+	{"pragma case_insensitive opt out",
+		`pragma case_insensitive
+counter any_get
+counter upper_get
+
+/^get / {
+    any_get++
+}
+/(?-i)^GET / {
+    upper_get++
+}
+`, `GET /
+get /
+Get /
+`, 0,
+		metrics.MetricSlice{
+			{
+				Name:        "any_get",
+				Program:     "pragma case_insensitive opt out",
+				Kind:        metrics.Counter,
+				Type:        metrics.Int,
+				Keys:        []string{},
+				LabelValues: []*metrics.LabelValue{{Value: &datum.Int{Value: 3}}},
+			},
+			{
+				Name:        "upper_get",
+				Program:     "pragma case_insensitive opt out",
+				Kind:        metrics.Counter,
+				Type:        metrics.Int,
+				Keys:        []string{},
+				LabelValues: []*metrics.LabelValue{{Value: &datum.Int{Value: 1}}},
+			},
+		},
+	},
+	{"pragma field_separator",
+		`pragma field_separator "|"
+counter requests_total by method
+
+/$/ {
+    requests_total[$F[2]]++
+}
+`, `a|GET|/
+b|POST|/
+c|GET|/index.html
+`, 0,
+		metrics.MetricSlice{
+			{
+				Name:    "requests_total",
+				Program: "pragma field_separator",
+				Kind:    metrics.Counter,
+				Type:    metrics.Int,
+				Keys:    []string{"method"},
+				LabelValues: []*metrics.LabelValue{
+					{
+						Labels: []string{"GET"},
+						Value:  &datum.Int{Value: 2},
+					},
+					{
+						Labels: []string{"POST"},
+						Value:  &datum.Int{Value: 1},
+					},
+				},
+			},
+		},
+	},
+	{"stop skips the rest of the line",
+		`counter lines
+counter errors
+counter other
+
+/$/ {
+    lines++
+}
+/ERROR/ {
+    errors++
+    stop
+    other++
+}
+other++
+`, `ok
+ERROR disk full
+ok
+`, 0,
+		metrics.MetricSlice{
+			{
+				Name:        "errors",
+				Program:     "stop skips the rest of the line",
+				Kind:        metrics.Counter,
+				Type:        metrics.Int,
+				Keys:        []string{},
+				LabelValues: []*metrics.LabelValue{{Value: &datum.Int{Value: 1}}},
+			},
+			{
+				Name:        "lines",
+				Program:     "stop skips the rest of the line",
+				Kind:        metrics.Counter,
+				Type:        metrics.Int,
+				Keys:        []string{},
+				LabelValues: []*metrics.LabelValue{{Value: &datum.Int{Value: 3}}},
+			},
+			{
+				Name:        "other",
+				Program:     "stop skips the rest of the line",
+				Kind:        metrics.Counter,
+				Type:        metrics.Int,
+				Keys:        []string{},
+				LabelValues: []*metrics.LabelValue{{Value: &datum.Int{Value: 2}}},
+			},
+		},
+	},
 }
 
 func TestVmEndToEnd(t *testing.T) {
@@ -962,6 +2238,8 @@ func TestVmEndToEnd(t *testing.T) {
 			}
 			close(lines)
 			wg.Wait()
+			// Ratios are computed when the metrics are exported.
+			testutil.FatalIfErr(t, store.UpdateRatios())
 
 			progRuntimeErrorsCheck()
 
@@ -972,7 +2250,7 @@ func TestVmEndToEnd(t *testing.T) {
 			})
 
 			// Ignore the datum.Time field as well, as the results will be unstable otherwise.
-			testutil.ExpectNoDiff(t, tc.metrics, ms, testutil.SortSlices(metrics.MetricsLess), testutil.IgnoreUnexported(metrics.Metric{}, sync.RWMutex{}, datum.String{}), testutil.IgnoreFields(datum.BaseDatum{}, "Time"))
+			testutil.ExpectNoDiff(t, tc.metrics, ms, testutil.SortSlices(metrics.MetricsLess), testutil.IgnoreUnexported(metrics.Metric{}, sync.RWMutex{}, datum.String{}), testutil.IgnoreFields(datum.BaseDatum{}, "Time", "Observations"))
 		})
 	}
 }
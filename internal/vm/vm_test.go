@@ -5,7 +5,13 @@ package vm
 
 import (
 	"context"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
@@ -33,7 +39,7 @@ var instructions = []struct {
 		[]string{},
 		[]interface{}{},
 		[]interface{}{true},
-		thread{pc: 0, matches: map[int][]string{0: {"aaaab"}}},
+		thread{pc: 0, hit: true, matches: map[int][]string{0: {"aaaab"}}},
 	},
 	{"cmp lt",
 		code.Instr{code.Cmp, -1, 0},
@@ -211,6 +217,419 @@ var instructions = []struct {
 		[]interface{}{"mIxeDCasE"},
 		[]interface{}{"mixedcase"},
 		thread{pc: 0, matches: map[int][]string{}}},
+	{"field whitespace",
+		code.Instr{code.Field, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"  GET   /index.html 200", int64(2)},
+		[]interface{}{"/index.html"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"field separator",
+		code.Instr{code.Field, 3, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"alice,,admin", int64(3), ","},
+		[]interface{}{"admin"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"field empty",
+		code.Instr{code.Field, 3, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"alice,,admin", int64(2), ","},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"field out of range",
+		code.Instr{code.Field, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"GET /index.html", int64(3)},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"getmeta unknown",
+		code.Instr{code.Getmeta, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"zone"},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"csvfield",
+		code.Instr{code.Csvfield, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{`2021-03-01,alice,login`, int64(2)},
+		[]interface{}{"alice"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"csvfield quoted comma",
+		code.Instr{code.Csvfield, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{`2021-03-01,"Smith, Alice",login`, int64(2)},
+		[]interface{}{"Smith, Alice"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"csvfield escaped quote",
+		code.Instr{code.Csvfield, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{`2021-03-01,"said ""hi"", then left",logout`, int64(2)},
+		[]interface{}{`said "hi", then left`},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"csvfield after quoted comma",
+		code.Instr{code.Csvfield, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{`"Smith, Alice",login`, int64(2)},
+		[]interface{}{"login"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"csvfield out of range",
+		code.Instr{code.Csvfield, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{`"Smith, Alice",login`, int64(3)},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"csvfield zero",
+		code.Instr{code.Csvfield, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{`"Smith, Alice",login`, int64(0)},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"csvfield bad quote",
+		code.Instr{code.Csvfield, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{`"Smith, Alice,login`, int64(1)},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"normpath numeric",
+		code.Instr{code.Normpath, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/user/12345/profile"},
+		[]interface{}{"/user/:id/profile"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"normpath uuid",
+		code.Instr{code.Normpath, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/order/123e4567-e89b-12d3-a456-426614174000/items/7"},
+		[]interface{}{"/order/:uuid/items/:id"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"normpath preserved",
+		code.Instr{code.Normpath, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/v2/users/abc123/"},
+		[]interface{}{"/v2/users/abc123/"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"bucketize below first",
+		code.Instr{code.Bucketize, 3, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{0.05, "0.1,1", "fast,ok,slow"},
+		[]interface{}{"fast"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"bucketize on boundary",
+		code.Instr{code.Bucketize, 3, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{0.1, "0.1,1", "fast,ok,slow"},
+		[]interface{}{"ok"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"bucketize between",
+		code.Instr{code.Bucketize, 3, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{0.5, "0.1,1", "fast,ok,slow"},
+		[]interface{}{"ok"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"bucketize on last boundary",
+		code.Instr{code.Bucketize, 3, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{1.0, "0.1,1", "fast,ok,slow"},
+		[]interface{}{"slow"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"bucketize above last",
+		code.Instr{code.Bucketize, 3, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{12.5, "0.1,1", "fast,ok,slow"},
+		[]interface{}{"slow"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"loglevel bracketed",
+		code.Instr{code.Loglevel, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"[ERROR] disk full"},
+		[]interface{}{"error"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"loglevel field",
+		code.Instr{code.Loglevel, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"ts=2021-06-01T12:00:00Z level=warn msg=\"queue backing up\""},
+		[]interface{}{"warning"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"loglevel json field",
+		code.Instr{code.Loglevel, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"{\"severity\": \"Info\", \"msg\": \"started\"}"},
+		[]interface{}{"info"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"loglevel word",
+		code.Instr{code.Loglevel, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"2021-06-01 12:00:00 WARNING: disk 90% full"},
+		[]interface{}{"warning"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"loglevel glog",
+		code.Instr{code.Loglevel, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"E0601 12:00:00.000000    1 main.go:42] write failed"},
+		[]interface{}{"error"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"loglevel lower case word",
+		code.Instr{code.Loglevel, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"failed to get info for user"},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"loglevel unrecognized",
+		code.Instr{code.Loglevel, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"GET /index.html 200"},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"urlhost",
+		code.Instr{code.Urlhost, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"https://api.example.com:443/x"},
+		[]interface{}{"api.example.com"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"urlhost with port",
+		code.Instr{code.Urlhost, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"https://api.example.com:443/x", int64(1)},
+		[]interface{}{"api.example.com:443"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"urlhost authority",
+		code.Instr{code.Urlhost, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"backend-1.internal:8080/healthz"},
+		[]interface{}{"backend-1.internal"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"urlhost authority with port",
+		code.Instr{code.Urlhost, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"backend-1.internal:8080", int64(1)},
+		[]interface{}{"backend-1.internal:8080"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"urlhost ipv6",
+		code.Instr{code.Urlhost, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"http://[2001:db8::1]:8080/"},
+		[]interface{}{"2001:db8::1"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"urlhost malformed",
+		code.Instr{code.Urlhost, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"http://exa mple.com/"},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"urlhost bad port",
+		code.Instr{code.Urlhost, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"http://example.com:http/"},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"urlhost path only",
+		code.Instr{code.Urlhost, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/index.html"},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"queryparam present",
+		code.Instr{code.Queryparam, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/cart?user=1&action=checkout&action=pay", "action"},
+		[]interface{}{"checkout"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"queryparam absent",
+		code.Instr{code.Queryparam, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/cart?user=1", "action"},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"queryparam encoded",
+		code.Instr{code.Queryparam, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"https://example.com/search?q=caf%C3%A9+au+lait&bad=%zz#results", "q"},
+		[]interface{}{"café au lait"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"queryparam no query",
+		code.Instr{code.Queryparam, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/cart/checkout#action=pay", "action"},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"buckethash",
+		code.Instr{code.Buckethash, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"alice", int64(8)},
+		[]interface{}{int64(7)},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"buckethash fewer buckets",
+		code.Instr{code.Buckethash, 2, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"bob", int64(4)},
+		[]interface{}{int64(0)},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"statclass ok",
+		code.Instr{code.Statclass, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{int64(200)},
+		[]interface{}{"2xx"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"statclass not found",
+		code.Instr{code.Statclass, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{int64(404)},
+		[]interface{}{"4xx"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"statclass unavailable",
+		code.Instr{code.Statclass, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{int64(503)},
+		[]interface{}{"5xx"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"statclass out of range",
+		code.Instr{code.Statclass, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{int64(999)},
+		[]interface{}{"unknown"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"statclass zero",
+		code.Instr{code.Statclass, 1, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{int64(0)},
+		[]interface{}{"unknown"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"stripansi colour",
+		code.Instr{code.Stripansi, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"\x1b[1;31mERROR\x1b[0m disk \x1b[4mfull\x1b[m"},
+		[]interface{}{"ERROR disk full"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"stripansi osc",
+		code.Instr{code.Stripansi, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"\x1b]0;title\x07done \x1b]8;;http://x\x1b\\link\x1b]8;;\x1b\\\x1b7\x1b(B"},
+		[]interface{}{"done link"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"stripansi plain",
+		code.Instr{code.Stripansi, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"[INFO] 50% done ~ [ok]"},
+		[]interface{}{"[INFO] 50% done ~ [ok]"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"parseduration ms",
+		code.Instr{code.Parsedur, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"12ms"},
+		[]interface{}{0.012},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"parseduration s",
+		code.Instr{code.Parsedur, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"1.5s"},
+		[]interface{}{1.5},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"parseduration m",
+		code.Instr{code.Parsedur, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"2m"},
+		[]interface{}{120.},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"b64decode std",
+		code.Instr{code.B64decode, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"c3RhdHVzPTIwMD8+"},
+		[]interface{}{"status=200?>"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"b64decode url",
+		code.Instr{code.B64decode, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"c3RhdHVzPTIwMD8-"},
+		[]interface{}{"status=200?>"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"b64decode padded",
+		code.Instr{code.B64decode, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"NTAz"},
+		[]interface{}{"503"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"b64decode padding",
+		code.Instr{code.B64decode, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"NDA0IQ=="},
+		[]interface{}{"404!"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"changed first value",
+		code.Instr{code.Changed, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"breaker", "open"},
+		[]interface{}{false},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"b64decode unpadded",
+		code.Instr{code.B64decode, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"NDA0IQ"},
+		[]interface{}{"404!"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"b64decode malformed",
+		code.Instr{code.B64decode, 0, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"not base64!"},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
 	{"length",
 		code.Instr{code.Length, 0, 0},
 		[]*regexp.Regexp{},
@@ -414,6 +833,20 @@ var instructions = []struct {
 		[]interface{}{},
 		[]interface{}{testFilename},
 		thread{pc: 0, matches: map[int][]string{}}},
+	{"getsourcehost",
+		code.Instr{code.Getsourcehost, nil, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{},
+		[]interface{}{testSourceHost},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"linelen",
+		code.Instr{code.Linelen, nil, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{},
+		[]interface{}{int64(5)},
+		thread{pc: 0, matches: map[int][]string{}}},
 	{"i2s",
 		code.Instr{code.I2s, nil, 0},
 		[]*regexp.Regexp{},
@@ -458,7 +891,10 @@ var instructions = []struct {
 		thread{pc: 0, matches: map[int][]string{}}},
 }
 
-const testFilename = "test"
+const (
+	testFilename   = "test"
+	testSourceHost = "192.0.2.1"
+)
 
 // Testcode.Instrs tests that each instruction behaves as expected through one
 // instruction cycle.
@@ -479,7 +915,7 @@ func TestInstrs(t *testing.T) {
 				v.t.Push(item)
 			}
 			v.t.matches = make(map[int][]string)
-			v.input = logline.New(context.Background(), testFilename, "aaaab")
+			v.input = logline.NewFromHost(context.Background(), testFilename, testSourceHost, "aaaab")
 			v.execute(v.t, tc.i)
 			if v.terminate {
 				t.Fatalf("Execution failed, see info log.")
@@ -506,6 +942,278 @@ func makeVM(i code.Instr, m []*metrics.Metric) *VM {
 
 }
 
+func TestChangedInstr(t *testing.T) {
+	v := makeVM(code.Instr{code.Changed, 0, 0}, nil)
+	var got []bool
+	for _, state := range []string{"open", "open", "closed", "closed", "open"} {
+		v.t.Push("breaker")
+		v.t.Push(state)
+		v.execute(v.t, v.prog[0])
+		if v.terminate {
+			t.Fatalf("Execution failed, see info log.")
+		}
+		got = append(got, v.t.Pop().(bool))
+	}
+	testutil.ExpectNoDiff(t, []bool{false, false, true, false, true}, got)
+}
+
+func TestDecaysetInstr(t *testing.T) {
+	m := metrics.NewMetric("activity", "test", metrics.Gauge, metrics.Float)
+	d, err := m.GetDatum()
+	testutil.FatalIfErr(t, err)
+
+	v := makeVM(code.Instr{code.Decayset, 3, 0}, nil)
+	decaySet := func(ts time.Time, value float64) {
+		v.t.time = ts
+		v.t.Push(d)
+		v.t.Push(value)
+		v.t.Push(10.)
+		v.execute(v.t, v.prog[0])
+		if v.terminate {
+			t.Fatalf("Execution failed, see info log.")
+		}
+	}
+	// Set one half life ago, so the exported value has already decayed
+	// without another update.
+	start := time.Now().Add(-10 * time.Second)
+	decaySet(start, 100)
+	f := d.(*datum.Float)
+	if got := f.GetAt(start); got != 100 {
+		t.Errorf("initial value: got %g, want 100", got)
+	}
+	if got := datum.GetFloat(d); math.Abs(got-50) > 1 {
+		t.Errorf("exported value: got %g, want 50", got)
+	}
+	if got := d.ValueString(); got == "100" {
+		t.Errorf("exported value string didn't decay: %s", got)
+	}
+	// Adding to it decays the old value first.
+	decaySet(start.Add(20*time.Second), 25)
+	if got := f.GetAt(start.Add(20 * time.Second)); math.Abs(got-50) > 1e-9 {
+		t.Errorf("decayed value: got %g, want 50", got)
+	}
+}
+
+func TestMovingavgInstr(t *testing.T) {
+	m := metrics.NewMetric("throughput", "test", metrics.Gauge, metrics.Float, "host")
+	d, err := m.GetDatum("a")
+	testutil.FatalIfErr(t, err)
+	other, err := m.GetDatum("b")
+	testutil.FatalIfErr(t, err)
+
+	v := makeVM(code.Instr{code.Movingavg, 3, 0}, nil)
+	movingAvg := func(d datum.Datum, ts time.Time, value float64) {
+		v.t.time = ts
+		v.t.Push(d)
+		v.t.Push(value)
+		v.t.Push(60.)
+		v.execute(v.t, v.prog[0])
+		if v.terminate {
+			t.Fatalf("Execution failed, see info log.")
+		}
+	}
+	start := time.Unix(1000, 0)
+	for _, tc := range []struct {
+		offset   time.Duration
+		value    float64
+		expected float64
+	}{
+		{0, 10, 10},
+		{20 * time.Second, 20, 15},
+		{40 * time.Second, 30, 20},
+		// The first sample is now older than the window.
+		{70 * time.Second, 40, 30},
+		// All the earlier samples are older than the window.
+		{200 * time.Second, 5, 5},
+	} {
+		movingAvg(d, start.Add(tc.offset), tc.value)
+		if got := datum.GetFloat(d); got != tc.expected {
+			t.Errorf("at %s: got %g, want %g", tc.offset, got, tc.expected)
+		}
+	}
+	// Each datum has its own window.
+	movingAvg(other, start, 100)
+	if got := datum.GetFloat(other); got != 100 {
+		t.Errorf("other datum average: got %g, want 100", got)
+	}
+}
+
+func TestApproxdistInstr(t *testing.T) {
+	m := metrics.NewMetric("users", "test", metrics.Gauge, metrics.Int, "minute")
+	d, err := m.GetDatum("00:01")
+	testutil.FatalIfErr(t, err)
+	other, err := m.GetDatum("00:02")
+	testutil.FatalIfErr(t, err)
+
+	v := makeVM(code.Instr{code.Approxdist, 2, 0}, nil)
+	approxDistinct := func(d datum.Datum, s string) {
+		v.t.Push(d)
+		v.t.Push(s)
+		v.execute(v.t, v.prog[0])
+		if v.terminate {
+			t.Fatalf("Execution failed, see info log.")
+		}
+	}
+	const n = 10000
+	// Three standard errors either side.
+	bound := 3 * 1.04 / math.Sqrt(hllRegisters) * n
+	for i := 0; i < n; i++ {
+		approxDistinct(d, fmt.Sprintf("user%d", i))
+	}
+	estimate := datum.GetInt(d)
+	if math.Abs(float64(estimate-n)) > bound {
+		t.Errorf("estimate %d not within %g of %d", estimate, bound, n)
+	}
+	// Repeats don't add to the estimate.
+	for i := 0; i < n; i++ {
+		approxDistinct(d, fmt.Sprintf("user%d", i%100))
+	}
+	if got := datum.GetInt(d); got != estimate {
+		t.Errorf("repeats changed estimate from %d to %d", estimate, got)
+	}
+	// Each datum has its own sketch.
+	approxDistinct(other, "user1")
+	if got := datum.GetInt(other); got != 1 {
+		t.Errorf("other datum estimate: got %d, want 1", got)
+	}
+}
+
+func TestSweepRemovedDatums(t *testing.T) {
+	prog := `gauge users by minute
+gauge throughput by minute
+counter logins by minute
+gauge login_rate by minute
+/^user (?P<minute>\S+) (?P<user>\S+)$/ {
+  approx_distinct(users[$minute], $user)
+  moving_avg(throughput[$minute], 1, 60)
+  mark_seen(logins[$minute])
+  login_rate[$minute] = rate(logins[$minute], 60)
+}
+/^del (?P<minute>\S+)$/ {
+  del users[$minute]
+  del throughput[$minute]
+  del logins[$minute]
+}
+`
+	v, err := Compile("sweep", strings.NewReader(prog), false, false, false, nil)
+	testutil.FatalIfErr(t, err)
+	start := time.Unix(1600000000, 0)
+	process := func(offset time.Duration, line string) {
+		v.clock = fakeClock(start.Add(offset))
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+	}
+	state := func() []int {
+		return []int{len(v.sketches), len(v.windows), len(v.rates), len(v.seen)}
+	}
+
+	process(0, "user 00:01 alice")
+	process(0, "user 00:02 bob")
+	testutil.ExpectNoDiff(t, []int{2, 2, 2, 2}, state())
+	// Deleting a datum forgets its state at once.
+	process(0, "del 00:01")
+	testutil.ExpectNoDiff(t, []int{1, 1, 1, 1}, state())
+	// A datum removed from the metric by expiry is forgotten by the next sweep.
+	for _, m := range v.m {
+		testutil.FatalIfErr(t, m.RemoveDatum("00:02"))
+	}
+	process(time.Second, "user 00:03 carol")
+	testutil.ExpectNoDiff(t, []int{2, 2, 2, 2}, state())
+	process(datumSweepInterval, "user 00:03 dave")
+	testutil.ExpectNoDiff(t, []int{1, 1, 1, 1}, state())
+}
+
+func TestParsedurError(t *testing.T) {
+	name := "parsedur_error"
+	v, err := Compile(name, strings.NewReader(`counter lines
+gauge latency
+/latency=(\S+)/ {
+  latency = parse_duration($1)
+  lines++
+}
+`), false, false, false, nil)
+	testutil.FatalIfErr(t, err)
+	runtimeErrorsCheck := testutil.ExpectMapExpvarDeltaWithDeadline(t, "prog_runtime_errors_total", name, 1)
+
+	v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "latency=bogus"))
+
+	runtimeErrorsCheck()
+	// The duration is taken as zero, and the statements after it are run.
+	d, err := v.m[0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, int64(1), datum.GetInt(d))
+	d, err = v.m[1].GetDatum()
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, 0.0, datum.GetFloat(d))
+}
+
+func TestInsetInstr(t *testing.T) {
+	allowlist := filepath.Join(testutil.TestTempDir(t), "allowlist")
+	testutil.FatalIfErr(t, ioutil.WriteFile(allowlist, []byte("/api/users\n/api/orders\n"), 0600))
+
+	v := makeVM(code.Instr{code.Inset, 0, 0}, nil)
+	start := time.Unix(1600000000, 0)
+	v.clock = fakeClock(start)
+	inSet := func(s string) bool {
+		v.t.Push(s)
+		v.t.Push(allowlist)
+		v.execute(v.t, v.prog[0])
+		if v.terminate {
+			t.Fatalf("Execution failed, see info log.")
+		}
+		return v.t.Pop().(bool)
+	}
+	testutil.ExpectNoDiff(t, []bool{true, true, false},
+		[]bool{inSet("/api/users"), inSet("/api/orders"), inSet("/api/admin")})
+
+	testutil.FatalIfErr(t, ioutil.WriteFile(allowlist, []byte("# orders removed\n/api/users\n/api/admin\n"), 0600))
+	// The change isn't seen until the file is checked again.
+	v.clock = fakeClock(start.Add(fileSetCheckInterval - time.Second))
+	testutil.ExpectNoDiff(t, []bool{true, true, false},
+		[]bool{inSet("/api/users"), inSet("/api/orders"), inSet("/api/admin")})
+	v.clock = fakeClock(start.Add(fileSetCheckInterval))
+	testutil.ExpectNoDiff(t, []bool{true, false, true},
+		[]bool{inSet("/api/users"), inSet("/api/orders"), inSet("/api/admin")})
+}
+
+func TestInsetMissingFile(t *testing.T) {
+	allowlist := filepath.Join(testutil.TestTempDir(t), "allowlist")
+
+	v := makeVM(code.Instr{code.Inset, 0, 0}, nil)
+	start := time.Unix(1600000000, 0)
+	inSet := func(s string, ts time.Time) (bool, bool) {
+		v.clock = fakeClock(ts)
+		v.terminate = false
+		v.t.pc = 1 // As if the instruction had been fetched, for the error location.
+		v.t.Push(s)
+		v.t.Push(allowlist)
+		v.execute(v.t, v.prog[0])
+		if v.terminate {
+			return false, false
+		}
+		return v.t.Pop().(bool), true
+	}
+	runtimeErrorsCheck := testutil.ExpectMapExpvarDeltaWithDeadline(t, "prog_runtime_errors_total", "test", 1)
+	// The missing file is an error the first time it is checked, and the set
+	// is empty until it is checked again.
+	if _, ok := inSet("/api/users", start); ok {
+		t.Error("expected error for missing file")
+	}
+	testutil.FatalIfErr(t, ioutil.WriteFile(allowlist, []byte("/api/users\n"), 0600))
+	for _, ts := range []time.Time{start, start.Add(fileSetCheckInterval - time.Second)} {
+		member, ok := inSet("/api/users", ts)
+		if !ok {
+			t.Fatalf("Execution failed at %s, see info log.", ts)
+		}
+		testutil.ExpectNoDiff(t, false, member)
+	}
+	runtimeErrorsCheck()
+	member, ok := inSet("/api/users", start.Add(fileSetCheckInterval))
+	if !ok {
+		t.Fatalf("Execution failed, see info log.")
+	}
+	testutil.ExpectNoDiff(t, true, member)
+}
+
 // code.Instructions with datum store side effects
 func TestDatumSetInstrs(t *testing.T) {
 	var m []*metrics.Metric
@@ -697,6 +1405,513 @@ func TestStrptimeWithoutTimezone(t *testing.T) {
 	}
 }
 
+func TestStrptimeFallback(t *testing.T) {
+	parsed := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, tc := range []struct {
+		name          string
+		pragma        string
+		count         int64
+		runtimeErrors int64
+		wantTime      func(start time.Time, got time.Time) bool
+	}{
+		{"default", "", 1, 1, func(start, got time.Time) bool { return got.Equal(parsed) }},
+		{"wallclock", "pragma timestamp_fallback_wallclock\n", 2, 0, func(start, got time.Time) bool { return !got.Before(start) }},
+		{"skip", "pragma timestamp_fallback_skip\n", 1, 1, func(start, got time.Time) bool { return got.Equal(parsed) }},
+		{"previous", "pragma timestamp_fallback_previous\n", 2, 0, func(start, got time.Time) bool { return got.Equal(parsed) }},
+	} {
+		tc := tc
+		name := "fallback_" + tc.name
+		t.Run(tc.name, func(t *testing.T) {
+			prog := tc.pragma + `counter lines
+/^(?P<date>\S+) / {
+  strptime($date, "2006-01-02T15:04:05Z07:00")
+  lines++
+}
+`
+			v, err := Compile(name, strings.NewReader(prog), false, false, false, nil)
+			testutil.FatalIfErr(t, err)
+			parseErrorsCheck := testutil.ExpectMapExpvarDeltaWithDeadline(t, "timestamp_parse_errors_total", name, 1)
+			runtimeErrorsCheck := testutil.ExpectMapExpvarDeltaWithDeadline(t, "prog_runtime_errors_total", name, tc.runtimeErrors)
+
+			v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "2020-01-02T03:04:05Z ok"))
+			start := time.Now()
+			v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "yesterday malformed"))
+
+			parseErrorsCheck()
+			runtimeErrorsCheck()
+			d, err := v.m[0].GetDatum()
+			testutil.FatalIfErr(t, err)
+			if got := datum.GetInt(d); got != tc.count {
+				t.Errorf("lines is %d, want %d", got, tc.count)
+			}
+			if got := d.TimeUTC(); !tc.wantTime(start, got) {
+				t.Errorf("unexpected datum time %s, started at %s", got, start)
+			}
+		})
+	}
+}
+
+type fakeClock time.Time
+
+func (c fakeClock) Now() time.Time {
+	return time.Time(c)
+}
+
+func TestNow(t *testing.T) {
+	prog := `gauge heartbeat
+gauge record
+/^(?P<date>\S+) / {
+  strptime($date, "2006-01-02T15:04:05Z07:00")
+  heartbeat = now()
+  record = timestamp()
+}
+`
+	v, err := Compile("now", strings.NewReader(prog), false, false, false, nil)
+	testutil.FatalIfErr(t, err)
+	wallclock := time.Unix(1600000000, 0)
+	v.clock = fakeClock(wallclock)
+	v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "2020-01-02T03:04:05Z ok"))
+
+	parsed := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	heartbeat, err := v.m[0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if got := datum.GetInt(heartbeat); got != wallclock.Unix() {
+		t.Errorf("now() is %d, want %d", got, wallclock.Unix())
+	}
+	// The datum is still written at the record time.
+	if got := heartbeat.TimeUTC(); !got.Equal(parsed) {
+		t.Errorf("heartbeat time is %s, want %s", got, parsed)
+	}
+	record, err := v.m[1].GetDatum()
+	testutil.FatalIfErr(t, err)
+	if got := datum.GetInt(record); got != parsed.Unix() {
+		t.Errorf("timestamp() is %d, want %d", got, parsed.Unix())
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	prog := `pragma warmup "30s"
+counter requests
+/GET/ {
+  requests++
+}
+`
+	v, err := Compile("warmup", strings.NewReader(prog), false, false, false, nil)
+	testutil.FatalIfErr(t, err)
+	start := time.Unix(1600000000, 0)
+	v.started = start
+	process := func(offset time.Duration, line string) {
+		v.clock = fakeClock(start.Add(offset))
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+	}
+	requests := func() int64 {
+		d, err := v.m[0].GetDatum()
+		testutil.FatalIfErr(t, err)
+		return datum.GetInt(d)
+	}
+
+	skippedCheck := testutil.ExpectMapExpvarDeltaWithDeadline(t, "vm_warmup_skipped_total", "warmup", 2)
+	process(0, "GET /")
+	process(29*time.Second, "GET /")
+	if got := requests(); got != 0 {
+		t.Errorf("requests during warmup is %d, want 0", got)
+	}
+	skippedCheck()
+
+	skippedCheck = testutil.ExpectMapExpvarDeltaWithDeadline(t, "vm_warmup_skipped_total", "warmup", 0)
+	process(30*time.Second, "GET /")
+	process(time.Minute, "GET /")
+	if got := requests(); got != 2 {
+		t.Errorf("requests after warmup is %d, want 2", got)
+	}
+	skippedCheck()
+}
+
+func TestHourOfDayDayOfWeek(t *testing.T) {
+	prog := `counter requests by hour, weekday
+/^(?P<date>\S+) GET/ {
+  strptime($date, "2006-01-02T15:04:05Z07:00")
+  requests[hour_of_day(timestamp()), day_of_week(timestamp())]++
+}
+`
+	loc, err := time.LoadLocation("America/New_York")
+	testutil.FatalIfErr(t, err)
+	v, err := Compile("hours", strings.NewReader(prog), false, false, false, loc)
+	testutil.FatalIfErr(t, err)
+	for _, tc := range []struct {
+		date    string
+		hour    string
+		weekday string
+	}{
+		// Saturday evening in New York is already Sunday in UTC.
+		{"2021-03-13T22:30:00-05:00", "22", "6"},
+		{"2021-03-14T04:30:00Z", "23", "6"},
+		{"2021-03-14T06:30:00Z", "1", "0"},
+		// Clocks went forward from 2am EST to 3am EDT at 07:00 UTC.
+		{"2021-03-14T07:30:00Z", "3", "0"},
+	} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", tc.date+" GET /"))
+		d, err := v.m[0].GetDatum(tc.hour, tc.weekday)
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != 1 {
+			t.Errorf("%s: requests[%s, %s] is %d, want 1", tc.date, tc.hour, tc.weekday, got)
+		}
+	}
+	if v.RuntimeErrorString() != "" {
+		t.Errorf("unexpected runtime error %q", v.RuntimeErrorString())
+	}
+}
+
+func TestSinceSeen(t *testing.T) {
+	prog := `counter checkouts by store
+gauge staleness by store
+/^checkout (?P<store>\S+) ok$/ {
+  checkouts[$store]++
+  mark_seen(checkouts[$store])
+}
+/^(checkout|tick) (?P<store>\S+)/ {
+  staleness[$store] = since_seen(checkouts[$store])
+}
+`
+	v, err := Compile("since_seen", strings.NewReader(prog), false, false, false, nil)
+	testutil.FatalIfErr(t, err)
+	start := time.Unix(1600000000, 0)
+	process := func(offset time.Duration, line string) {
+		v.clock = fakeClock(start.Add(offset))
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+	}
+	staleness := func(store string) float64 {
+		d, err := v.m[1].GetDatum(store)
+		testutil.FatalIfErr(t, err)
+		return datum.GetFloat(d)
+	}
+
+	process(0, "checkout a ok")
+	if got := staleness("a"); got != 0 {
+		t.Errorf("staleness after checkout is %g, want 0", got)
+	}
+	process(90*time.Second, "tick a")
+	if got := staleness("a"); got != 90 {
+		t.Errorf("staleness after 90s is %g, want 90", got)
+	}
+	// A store never seen is told apart from one just seen.
+	process(90*time.Second, "tick b")
+	if got := staleness("b"); got != -1 {
+		t.Errorf("staleness of unseen store is %g, want -1", got)
+	}
+	// A new checkout resets the staleness.
+	process(100*time.Second, "checkout a ok")
+	process(130*time.Second, "tick a")
+	if got := staleness("a"); got != 30 {
+		t.Errorf("staleness after another checkout is %g, want 30", got)
+	}
+}
+
+func TestBucketHash(t *testing.T) {
+	const n = 16
+	counts := make([]int, n)
+	for i := 0; i < 16000; i++ {
+		s := fmt.Sprintf("user%d", i)
+		b := bucketHash(s, n)
+		if b < 0 || b >= n {
+			t.Fatalf("bucketHash(%q, %d) = %d, out of range", s, n, b)
+		}
+		if again := bucketHash(s, n); again != b {
+			t.Fatalf("bucketHash(%q, %d) = %d, then %d", s, n, b, again)
+		}
+		counts[b]++
+	}
+	// Each bucket should get about 1000; allow for a generous 20% either way.
+	for b, c := range counts {
+		if c < 800 || c > 1200 {
+			t.Errorf("bucket %d has %d of 16000 values, want about 1000: %v", b, c, counts)
+		}
+	}
+}
+
+func TestSyslogPri(t *testing.T) {
+	for _, tc := range []struct {
+		line, facility, severity string
+	}{
+		{"<134>Oct 11 22:14:15 web1 app: started", "local0", "info"},
+		{"<0>panic", "kern", "emerg"},
+		{"<13>x", "user", "notice"},
+		{"<191>x", "local7", "debug"},
+		{"<192>out of range", "", ""},
+		{"Oct 11 22:14:15 web1 app: no priority", "", ""},
+		{"<>x", "", ""},
+		{"<+1>x", "", ""},
+		{"<1340>x", "", ""},
+		{"<13", "", ""},
+		{"", "", ""},
+	} {
+		facility, severity := syslogPri(tc.line)
+		if facility != tc.facility || severity != tc.severity {
+			t.Errorf("syslogPri(%q) = %q, %q, want %q, %q", tc.line, facility, severity, tc.facility, tc.severity)
+		}
+	}
+}
+
+func TestLineLen(t *testing.T) {
+	prog := `counter bytes_processed
+/^/ {
+  bytes_processed += linelen()
+}
+`
+	v, err := Compile("linelen", strings.NewReader(prog), false, false, false, nil)
+	testutil.FatalIfErr(t, err)
+	var before int64
+	if e, ok := bytesProcessed.Get("linelen").(*expvar.Int); ok {
+		before = e.Value()
+	}
+	for _, line := range []string{"", "a", "hello world", "caf\u00e9"} {
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", line))
+	}
+	if v.RuntimeErrorString() != "" {
+		t.Fatalf("unexpected runtime error %q", v.RuntimeErrorString())
+	}
+	// The é is two bytes.
+	const total = 0 + 1 + 11 + 5
+	d, err := v.m[0].GetDatum()
+	testutil.FatalIfErr(t, err)
+	testutil.ExpectNoDiff(t, int64(total), datum.GetInt(d))
+	var after int64
+	if e, ok := bytesProcessed.Get("linelen").(*expvar.Int); ok {
+		after = e.Value()
+	}
+	testutil.ExpectNoDiff(t, int64(total), after-before)
+}
+
+func TestExpBucket(t *testing.T) {
+	for _, tc := range []struct {
+		x, base  float64
+		expected int64
+	}{
+		{1, 2, 0},
+		{2, 2, 1},
+		{3, 2, 2},
+		{4, 2, 2},
+		{4.000001, 2, 3},
+		{8, 2, 3},
+		{0.5, 2, -1},
+		{0.3, 2, -1},
+		{1000, 10, 3},
+		{1001, 10, 4},
+		{0.001, 10, -3},
+		{1.1, math.Sqrt(2), 1},
+		{2, math.Sqrt(2), 2},
+	} {
+		if got := expBucket(tc.x, tc.base); got != tc.expected {
+			t.Errorf("expBucket(%g, %g) = %d, want %d", tc.x, tc.base, got, tc.expected)
+		}
+	}
+	for _, base := range []float64{1.09, math.Sqrt(2), 2, 10} {
+		last := expBucket(1e-6, base)
+		for x := 1e-6; x < 1e6; x *= 1.01 {
+			b := expBucket(x, base)
+			if b < last {
+				t.Fatalf("expBucket(%g, %g) = %d, less than %d for a smaller value", x, base, b, last)
+			}
+			if lo, hi := math.Pow(base, float64(b-1)), math.Pow(base, float64(b)); !(x > lo && x <= hi) {
+				t.Fatalf("expBucket(%g, %g) = %d, but the bucket holds (%g, %g]", x, base, b, lo, hi)
+			}
+			last = b
+		}
+	}
+
+	v := makeVM(code.Instr{code.Expbucket, 2, 0}, nil)
+	v.t.Push(int64(5))
+	v.t.Push(2.0)
+	v.execute(v.t, v.prog[0])
+	if v.terminate {
+		t.Fatalf("Execution failed, see info log.")
+	}
+	testutil.ExpectNoDiff(t, int64(3), v.t.Pop())
+
+	v = makeVM(code.Instr{code.Expbucket, 2, 0}, nil)
+	v.t.Push(0.0)
+	v.t.Push(2.0)
+	v.t.pc = 1 // as if the instruction had been fetched
+	v.execute(v.t, v.prog[0])
+	if !v.terminate {
+		t.Error("expecting exp_bucket of zero to be a runtime error")
+	}
+}
+
+func TestTumblingInc(t *testing.T) {
+	prog := `counter checkouts
+/checkout/ {
+  tumbling_inc(checkouts, 60)
+}
+`
+	v, err := Compile("tumbling_inc", strings.NewReader(prog), false, false, false, nil)
+	testutil.FatalIfErr(t, err)
+	// The start of a minute.
+	start := time.Unix(1600000020, 0)
+	for _, tc := range []struct {
+		offset   time.Duration
+		expected int64
+	}{
+		{0, 1},
+		{10 * time.Second, 2},
+		{59 * time.Second, 3},
+		// The next window begins.
+		{60 * time.Second, 1},
+		{90 * time.Second, 2},
+		// A window with no events is skipped.
+		{200 * time.Second, 1},
+	} {
+		v.clock = fakeClock(start.Add(tc.offset))
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "checkout"))
+		d, err := v.m[0].GetDatum()
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != tc.expected {
+			t.Errorf("at %s: got %d, want %d", tc.offset, got, tc.expected)
+		}
+	}
+}
+
+func TestFirstSeenTTL(t *testing.T) {
+	v := makeVM(code.Instr{code.Firstseen, 2, 0}, nil)
+	start := time.Unix(1600000000, 0)
+	for _, tc := range []struct {
+		offset   time.Duration
+		key      string
+		expected bool
+	}{
+		{0, "a", true},
+		{30 * time.Second, "a", false},
+		{60 * time.Second, "b", true},
+		// Last seen 60s ago, so forgotten.
+		{90 * time.Second, "a", true},
+		{100 * time.Second, "b", false},
+	} {
+		v.clock = fakeClock(start.Add(tc.offset))
+		v.t.Push(tc.key)
+		v.t.Push(int64(60))
+		v.execute(v.t, v.prog[0])
+		if v.terminate {
+			t.Fatalf("Execution failed, see info log.")
+		}
+		if got := v.t.Pop(); got != tc.expected {
+			t.Errorf("at %s first_seen(%q): got %v, want %v", tc.offset, tc.key, got, tc.expected)
+		}
+	}
+	// The sweep at 90s removed nothing still live, and the sweep after the
+	// TTL of both keys removes them.
+	v.clock = fakeClock(start.Add(200 * time.Second))
+	v.t.Push("c")
+	v.t.Push(int64(60))
+	v.execute(v.t, v.prog[0])
+	v.t.Pop()
+	if _, ok := v.firstSeen["a"]; ok {
+		t.Errorf("expired key not removed: %v", v.firstSeen)
+	}
+}
+
+func TestAfterGap(t *testing.T) {
+	prog := `counter resumed by service
+/^(?P<service>\S+) GET/ {
+  after_gap($service, 300) {
+    resumed[$service]++
+  }
+}
+`
+	v, err := Compile("after_gap", strings.NewReader(prog), false, false, false, nil)
+	testutil.FatalIfErr(t, err)
+	start := time.Unix(1600000000, 0)
+	for _, tc := range []struct {
+		offset   time.Duration
+		line     string
+		expected int64
+	}{
+		// The first match has no gap before it.
+		{0, "web GET /", 0},
+		{time.Minute, "web GET /", 0},
+		{5 * time.Minute, "web GET /", 0},
+		// Silent for more than five minutes since the last match.
+		{11 * time.Minute, "web GET /", 1},
+		{12 * time.Minute, "web GET /", 1},
+	} {
+		v.clock = fakeClock(start.Add(tc.offset))
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", tc.line))
+		d, err := v.m[0].GetDatum("web")
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetInt(d); got != tc.expected {
+			t.Errorf("at %s resumed is %d, want %d", tc.offset, got, tc.expected)
+		}
+	}
+}
+
+func TestProgramVersion(t *testing.T) {
+	prog := `gauge info by version
+/start/ {
+  info[program_version()] = 1
+}
+`
+	version := func(prog string) string {
+		t.Helper()
+		v, err := Compile("version", strings.NewReader(prog), false, false, false, nil)
+		testutil.FatalIfErr(t, err)
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "start"))
+		if v.RuntimeErrorString() != "" {
+			t.Fatalf("unexpected runtime error %q", v.RuntimeErrorString())
+		}
+		lv := v.m[0].LabelValues
+		if len(lv) != 1 {
+			t.Fatalf("expected one label set of info, got %v", lv)
+		}
+		return lv[0].Labels[0]
+	}
+	first := version(prog)
+	if first == "" {
+		t.Error("program_version() is empty")
+	}
+	if second := version(prog); second != first {
+		t.Errorf("program_version() of the same source changed from %q to %q", first, second)
+	}
+	if edited := version(prog + "# edited\n"); edited == first {
+		t.Errorf("program_version() of the edited source is unchanged, %q", edited)
+	}
+}
+
+func TestWindowMax(t *testing.T) {
+	prog := `gauge peak_concurrency by host
+/^(?P<host>\S+) active=(?P<active>\d+)/ {
+  window_max(peak_concurrency[$host], $active, 60)
+}
+`
+	v, err := Compile("window_max", strings.NewReader(prog), false, false, false, nil)
+	testutil.FatalIfErr(t, err)
+	// The start of a minute.
+	start := time.Unix(1600000020, 0)
+	for _, tc := range []struct {
+		offset   time.Duration
+		line     string
+		host     string
+		expected float64
+	}{
+		{0, "web1 active=5", "web1", 5},
+		{0, "web2 active=2", "web2", 2},
+		{10 * time.Second, "web1 active=9", "web1", 9},
+		{20 * time.Second, "web1 active=3", "web1", 9},
+		{59 * time.Second, "web2 active=7", "web2", 7},
+		// The next window begins.
+		{60 * time.Second, "web1 active=4", "web1", 4},
+		{70 * time.Second, "web1 active=6", "web1", 6},
+		{80 * time.Second, "web1 active=1", "web1", 6},
+		{90 * time.Second, "web2 active=1", "web2", 1},
+	} {
+		v.clock = fakeClock(start.Add(tc.offset))
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", tc.line))
+		d, err := v.m[0].GetDatum(tc.host)
+		testutil.FatalIfErr(t, err)
+		if got := datum.GetFloat(d); got != tc.expected {
+			t.Errorf("at %s after %q: got %g, want %g", tc.offset, tc.line, got, tc.expected)
+		}
+	}
+}
+
 // code.Instructions with datum retrieve
 func TestDatumFetchInstrs(t *testing.T) {
 	var m []*metrics.Metric
@@ -817,3 +2032,49 @@ func TestTimestampInstr(t *testing.T) {
 		t.Errorf("Expecting timestamp to be %s, was %s", newT, tos)
 	}
 }
+
+func TestRuntimeErrorLogLimit(t *testing.T) {
+	prog := `counter total
+/^(?P<n>\S+)$/ {
+  total += int($n)
+}
+`
+	v, err := Compile("errors", strings.NewReader(prog), false, false, false, nil)
+	testutil.FatalIfErr(t, err)
+	var logs []string
+	v.logRuntimeError = func(s string) { logs = append(logs, s) }
+	v.runtimeErrorLimit = newRuntimeErrorLimiter(time.Minute)
+	start := time.Unix(1600000000, 0)
+	errorsBefore := progRuntimeErrors.Get("errors")
+
+	// Ten errors a second for two and a half minutes.
+	for i := 0; i < 1500; i++ {
+		v.clock = fakeClock(start.Add(time.Duration(i) * 100 * time.Millisecond))
+		v.ProcessLogLine(context.Background(), logline.New(context.Background(), "test", "notanumber"))
+	}
+
+	var errorCount int64
+	if e, ok := progRuntimeErrors.Get("errors").(*expvar.Int); ok {
+		errorCount = e.Value()
+	}
+	if e, ok := errorsBefore.(*expvar.Int); ok {
+		errorCount -= e.Value()
+	}
+	if errorCount != 1500 {
+		t.Errorf("expecting 1500 runtime errors counted, got %d", errorCount)
+	}
+	// Logged at 0s, 60s, and 120s, with a summary before each of the last two.
+	if len(logs) != 5 {
+		t.Fatalf("expecting 5 log messages, got %d: %q", len(logs), logs)
+	}
+	for _, i := range []int{0, 2, 4} {
+		if !strings.Contains(logs[i], "Runtime error: ") {
+			t.Errorf("log %d is not the error: %q", i, logs[i])
+		}
+	}
+	for _, i := range []int{1, 3} {
+		if !strings.Contains(logs[i], "599 identical runtime errors not logged") {
+			t.Errorf("log %d is not the summary: %q", i, logs[i])
+		}
+	}
+}
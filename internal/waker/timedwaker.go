@@ -5,6 +5,7 @@ package waker
 
 import (
 	"context"
+	"math/rand"
 	"sync"
 	"time"
 )
@@ -41,6 +42,40 @@ func NewTimed(ctx context.Context, interval time.Duration) Waker {
 	return t
 }
 
+// NewJitteredTimed returns a new timedWaker that is shut down when the context
+// is cancelled.  Each interval between wakes is randomly lengthened or
+// shortened by up to the fraction jitter of interval, so that many mtails
+// started together don't poll in step.  jitter must be at least 0 and less
+// than 1.
+func NewJitteredTimed(ctx context.Context, interval time.Duration, jitter float64) Waker {
+	t := &timedWaker{
+		wake: make(chan struct{}),
+	}
+	go func() {
+		timer := time.NewTimer(jitteredInterval(interval, jitter, rand.Float64()))
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+				t.mu.Lock()
+				close(t.wake)
+				t.wake = make(chan struct{})
+				t.mu.Unlock()
+				timer.Reset(jitteredInterval(interval, jitter, rand.Float64()))
+			}
+		}
+	}()
+	return t
+}
+
+// jitteredInterval returns interval changed by the fraction jitter of it,
+// scaled by r in [0, 1) from the shortest to the longest interval.
+func jitteredInterval(interval time.Duration, jitter, r float64) time.Duration {
+	return time.Duration(float64(interval) * (1 + jitter*(2*r-1)))
+}
+
 // Wake implements the Waker interface.
 func (t *timedWaker) Wake() (w <-chan struct{}) {
 	t.mu.Lock()
@@ -0,0 +1,41 @@
+// Copyright 2021 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package waker
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestJitteredInterval(t *testing.T) {
+	interval := 100 * time.Millisecond
+	min, max := 80*time.Millisecond, 120*time.Millisecond
+	for _, tc := range []struct {
+		r    float64
+		want time.Duration
+	}{
+		{0, min},
+		{0.5, interval},
+		{0.75, 110 * time.Millisecond},
+	} {
+		if got := jitteredInterval(interval, 0.2, tc.r); got != tc.want {
+			t.Errorf("jitteredInterval(%s, 0.2, %g) = %s, want %s", interval, tc.r, got, tc.want)
+		}
+	}
+
+	// Over several cycles the intervals vary, but stay within the band.
+	r := rand.New(rand.NewSource(1))
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 10; i++ {
+		got := jitteredInterval(interval, 0.2, r.Float64())
+		if got < min || got >= max {
+			t.Errorf("interval %s out of band [%s, %s)", got, min, max)
+		}
+		seen[got] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("intervals don't vary: %v", seen)
+	}
+}
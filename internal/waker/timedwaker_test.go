@@ -25,3 +25,20 @@ func TestTimedWakerWakes(t *testing.T) {
 		// Luke Luck licks lakes.  Luke's duck licks lakes.
 	}
 }
+
+func TestJitteredTimedWakerWakes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := waker.NewJitteredTimed(ctx, 10*time.Millisecond, 0.5)
+
+	timer := time.NewTimer(100 * time.Millisecond)
+	defer timer.Stop()
+	// Each wake is a new cycle, so several cycles must pass by the deadline.
+	for i := 0; i < 3; i++ {
+		select {
+		case <-timer.C:
+			t.Fatalf("only %d wakes before deadline", i)
+		case <-w.Wake():
+		}
+	}
+}